@@ -0,0 +1,310 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"GoTcpServerWithOpaque/opaque"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// An account owns one or more credentials. Each credential is a separate
+// OPAQUE registration, so each has its own password, OPRF key and envelope.
+// AuthMsg1.CredentialID selects the credential a login uses; the empty ID
+// selects defaultCredential, which is the one written by the pwreg command.
+//
+// pwreg only creates accounts. Once an account exists its credentials can
+// only be changed by a login of the account, with the credential commands
+// below, so an unauthenticated client cannot take it over.
+
+// Kinds of credentials.
+const (
+	kindPassword = "password"
+	kindDevice   = "device"
+	// A recovery credential is removed after it has been used for a login.
+	kindRecovery = "recovery"
+)
+
+// defaultCredential is the ID of the credential created by the pwreg command.
+const defaultCredential = "default"
+
+var (
+	errNoSuchCredential = errors.New("no such credential")
+	errLastCredential   = errors.New("cannot remove the last non-recovery credential")
+	errCredentialKind   = errors.New("unknown credential kind")
+	errAccountExists    = errors.New("account exists")
+)
+
+// credential is one OPAQUE registration of an account.
+type credential struct {
+	ID      string
+	Kind    string
+	Created time.Time
+	// User holds the OPAQUE registration. User.Username is the account name.
+	User *opaque.User `json:"-"`
+	// VaultKey is the account's vault key wrapped under the credential's
+	// export key, see vault.go, or nil if the client has not shared it with
+	// the credential.
+	VaultKey []byte `json:"-"`
+}
+
+// accountStore stores accounts and their credentials. It is an interface so
+// that the in-memory store can be replaced by a persistent one.
+// Implementations must be safe for concurrent use.
+type accountStore interface {
+	// Get returns the credential id of username.
+	Get(username, id string) (*credential, bool)
+	// Create creates the account username with the credential c. It returns
+	// errAccountExists if the account exists.
+	Create(username string, c *credential) error
+	// Put adds c to username's account, creating the account if needed. A
+	// credential with the same ID is replaced, together with its vault key,
+	// and Put reports whether there was one.
+	Put(username string, c *credential) bool
+	// Remove removes the credential id of username. It returns
+	// errNoSuchCredential if there is no such credential and
+	// errLastCredential if it is the account's last non-recovery
+	// credential. Remove succeeds only once for each credential.
+	Remove(username, id string) error
+	// List returns the credentials of username ordered by ID.
+	List(username string) []*credential
+	// Len returns the number of accounts.
+	Len() int
+
+	// PutVaultKey sets the VaultKey of the credential id of username to
+	// key. It returns errNoSuchCredential if there is no such credential,
+	// and, if create is set, errVaultKeyExists if a credential of username
+	// has a VaultKey.
+	PutVaultKey(username, id string, key []byte, create bool) error
+	// GetBlob returns the vault blob name of username.
+	GetBlob(username, name string) (*blob, bool)
+	// PutBlob stores b for username if the blob's current version is
+	// b.Version, or it does not exist and b.Version is 0. It sets
+	// b.Version to the new version and b.Modified. PutBlob returns
+	// errVersionMismatch if the version differs and errVaultQuota if the
+	// blobs of username would exceed quota.
+	PutBlob(username string, b *blob, quota blobQuota) error
+	// DeleteBlob removes the blob name of username if its version is
+	// version. It returns errNoSuchBlob or errVersionMismatch otherwise.
+	DeleteBlob(username, name string, version uint64) error
+	// ListBlobs returns the blobs of username ordered by name.
+	ListBlobs(username string) []blobInfo
+}
+
+// accounts is the server's account store.
+var accounts accountStore = newMemoryAccountStore()
+
+// memoryAccountStore is an accountStore that keeps everything in memory.
+type memoryAccountStore struct {
+	mu       sync.RWMutex
+	accounts map[string]map[string]*credential
+	// blobs are the vault blobs of each account, see vault.go.
+	blobs map[string]map[string]*blob
+}
+
+func newMemoryAccountStore() *memoryAccountStore {
+	return &memoryAccountStore{
+		accounts: map[string]map[string]*credential{},
+		blobs:    map[string]map[string]*blob{},
+	}
+}
+
+func (s *memoryAccountStore) Get(username, id string) (*credential, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c, ok := s.accounts[username][id]
+	return c, ok
+}
+
+func (s *memoryAccountStore) Create(username string, c *credential) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.accounts[username]) > 0 {
+		return errAccountExists
+	}
+	s.accounts[username] = map[string]*credential{c.ID: c}
+	return nil
+}
+
+func (s *memoryAccountStore) Put(username string, c *credential) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.accounts[username] == nil {
+		s.accounts[username] = map[string]*credential{}
+	}
+	_, replaced := s.accounts[username][c.ID]
+	s.accounts[username][c.ID] = c
+	return replaced
+}
+
+func (s *memoryAccountStore) Remove(username, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	creds := s.accounts[username]
+	c, ok := creds[id]
+	if !ok {
+		return errNoSuchCredential
+	}
+	if c.Kind != kindRecovery {
+		n := 0
+		for _, other := range creds {
+			if other.Kind != kindRecovery {
+				n++
+			}
+		}
+		if n == 1 {
+			return errLastCredential
+		}
+	}
+	delete(creds, id)
+	return nil
+}
+
+func (s *memoryAccountStore) List(username string) []*credential {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	res := []*credential{}
+	for _, c := range s.accounts[username] {
+		res = append(res, c)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
+
+func (s *memoryAccountStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.accounts)
+}
+
+func (s *memoryAccountStore) PutVaultKey(username, id string, key []byte, create bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	creds := s.accounts[username]
+	c, ok := creds[id]
+	if !ok {
+		return errNoSuchCredential
+	}
+	if create {
+		for _, other := range creds {
+			if other.VaultKey != nil {
+				return errVaultKeyExists
+			}
+		}
+	}
+	// The credential may be in use by a login, so it is replaced rather
+	// than changed.
+	updated := *c
+	updated.VaultKey = key
+	creds[id] = &updated
+	return nil
+}
+
+// credentialIdentifierLabel separates credential identifiers from other
+// inputs derived from the same seed.
+const credentialIdentifierLabel = "GoTcpServerWithOpaque-CredentialIdentifier"
+
+// credentialIdentifier returns the credential_identifier of RFC 9807 for
+// the credential id of username, from which its OPRF key is derived if
+// oprfSeed is set. The username and the ID are both length-prefixed, so two
+// different credentials never share an identifier, whatever bytes the
+// username holds.
+func credentialIdentifier(username, id string) []byte {
+	b := []byte(credentialIdentifierLabel)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(username)))
+	b = append(b, username...)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(id)))
+	return append(b, id...)
+}
+
+// credentialID returns the ID of the credential selected by id from
+// AuthMsg1.
+func credentialID(id string) string {
+	if id == "" {
+		return defaultCredential
+	}
+	return id
+}
+
+// validKind reports whether kind is one of the credential kinds.
+func validKind(kind string) bool {
+	switch kind {
+	case kindPassword, kindDevice, kindRecovery:
+		return true
+	}
+	return false
+}
+
+// credentialRef is the argument of the credential channel commands that
+// name a credential.
+type credentialRef struct {
+	CredentialID string
+	Kind         string `json:",omitempty"`
+}
+
+// The channel commands below let a logged-in user manage the credentials of
+// their account. Adding a credential runs the password registration protocol
+// over the channel:
+//
+//	credential-add-start   credentialRef + PwRegMsg1  -> PwRegMsg2 + SessionID
+//	credential-add-finish  SessionID + PwRegMsg3      -> nothing
+//
+// The username in PwRegMsg1 is ignored; the credential is always added to
+// the account of the login. Adding a credential with the ID of an existing
+// one replaces it, which is how a password is changed, and revokes the
+// other logins of the account.
+
+func cmdCredentials(l *login, _ json.RawMessage) (interface{}, error) {
+	return accounts.List(l.username), nil
+}
+
+func cmdCredentialAddStart(l *login, args json.RawMessage) (interface{}, error) {
+	var ref credentialRef
+	if err := json.Unmarshal(args, &ref); err != nil {
+		return nil, err
+	}
+	if ref.CredentialID == "" {
+		return nil, errNoSuchCredential
+	}
+	if !validKind(ref.Kind) {
+		return nil, errCredentialKind
+	}
+	msg1, err := opaque.DecodePwRegMsg1(args)
+	if err != nil {
+		return nil, err
+	}
+	msg1.Username = l.username
+	id, msg2, err := pwRegStart(msg1, &credential{ID: ref.CredentialID, Kind: ref.Kind}, l)
+	if err != nil {
+		return nil, err
+	}
+	return pwRegMsg2{PwRegMsg2: msg2, SessionID: id}, nil
+}
+
+func cmdCredentialAddFinish(l *login, args json.RawMessage) (interface{}, error) {
+	var ref sessionRef
+	if err := json.Unmarshal(args, &ref); err != nil {
+		return nil, err
+	}
+	msg3, err := opaque.DecodePwRegMsg3(args)
+	if err != nil {
+		return nil, err
+	}
+	_, err = pwRegFinish(ref.SessionID, msg3)
+	return nil, err
+}
+
+func cmdCredentialRemove(l *login, args json.RawMessage) (interface{}, error) {
+	var ref credentialRef
+	if err := json.Unmarshal(args, &ref); err != nil {
+		return nil, err
+	}
+	return nil, accounts.Remove(l.username, ref.CredentialID)
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"GoTcpServerWithOpaque/client"
+	"GoTcpServerWithOpaque/opaque"
+	"testing"
+)
+
+func TestMemoryAccountStore(t *testing.T) {
+	s := newMemoryAccountStore()
+	s.Put("a", &credential{ID: "default", Kind: kindPassword})
+	s.Put("a", &credential{ID: "r1", Kind: kindRecovery})
+
+	if err := s.Remove("a", "default"); err != errLastCredential {
+		t.Errorf("removing the last password: got %v, want %v", err, errLastCredential)
+	}
+	if err := s.Remove("a", "r1"); err != nil {
+		t.Errorf("removing a recovery credential: %v", err)
+	}
+	if err := s.Remove("a", "r1"); err != errNoSuchCredential {
+		t.Errorf("second remove: got %v, want %v", err, errNoSuchCredential)
+	}
+
+	s.Put("a", &credential{ID: "laptop", Kind: kindDevice})
+	if err := s.Remove("a", "default"); err != nil {
+		t.Errorf("removing one of two passwords: %v", err)
+	}
+	if got := s.List("a"); len(got) != 1 || got[0].ID != "laptop" {
+		t.Errorf("List = %+v", got)
+	}
+	if n := s.Len(); n != 1 {
+		t.Errorf("Len = %d, want 1", n)
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	register(t, "multi", "password")
+	c, _ := loginChannel(t, "multi", "password")
+	if err := c.AddCredential("phone", client.KindDevice, "phone passphrase"); err != nil {
+		t.Fatalf("adding phone: %v", err)
+	}
+	if err := c.AddCredential("code-1", client.KindRecovery, "1234-5678"); err != nil {
+		t.Fatalf("adding recovery code: %v", err)
+	}
+	if err := c.AddCredential("bad", "fingerprint", "x"); err == nil {
+		t.Error("credential of unknown kind added")
+	}
+	var creds []credential
+	if err := c.Call("credentials", nil, &creds); err != nil {
+		t.Fatal(err)
+	}
+	if len(creds) != 3 || creds[0].ID != "code-1" || creds[1].ID != "default" || creds[2].Kind != kindDevice {
+		t.Errorf("credentials = %+v", creds)
+	}
+
+	login := func(credentialID, password string) error {
+		c := dial(t)
+		_, err := c.LoginCredential("multi", credentialID, password)
+		c.serverErr()
+		return err
+	}
+	if err := login("phone", "phone passphrase"); err != nil {
+		t.Errorf("login with phone: %v", err)
+	}
+	if err := login("phone", "password"); err == nil {
+		t.Error("phone credential accepted the account password")
+	}
+	if err := login("", "password"); err != nil {
+		t.Errorf("login with default credential: %v", err)
+	}
+
+	// Recovery codes work once.
+	if err := login("code-1", "1234-5678"); err != nil {
+		t.Errorf("login with recovery code: %v", err)
+	}
+	if err := login("code-1", "1234-5678"); err == nil {
+		t.Error("recovery code used twice")
+	}
+
+	if err := c.RemoveCredential("phone"); err != nil {
+		t.Fatal(err)
+	}
+	if err := login("phone", "phone passphrase"); err == nil {
+		t.Error("removed credential still works")
+	}
+	if err := c.RemoveCredential("default"); err == nil {
+		t.Error("last credential removed")
+	}
+	c.serverErr()
+}
+
+func TestRecoveryCodeConcurrentUse(t *testing.T) {
+	register(t, "recovery-race", "password")
+	c, _ := loginChannel(t, "recovery-race", "password")
+	if err := c.AddCredential("code", client.KindRecovery, "code"); err != nil {
+		t.Fatal(err)
+	}
+	c.serverErr()
+
+	// Two logins with the same code get past AuthMsg1; only one finishes.
+	type run struct {
+		sess *opaque.AuthClientSession
+		msg2 authMsg2
+	}
+	var runs []run
+	for i := 0; i < 2; i++ {
+		c := dial(t)
+		sess, msg2 := startAuthCredential(t, c, "recovery-race", "code", "code")
+		c.serverErr()
+		runs = append(runs, run{sess, msg2})
+	}
+	ok := 0
+	for _, r := range runs {
+		_, msg3, err := opaque.Auth2(r.sess, r.msg2.AuthMsg2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := authFinish(r.msg2.SessionID, msg3, "pipe"); err == nil {
+			ok++
+		}
+	}
+	if ok != 1 {
+		t.Errorf("%d logins with one recovery code, want 1", ok)
+	}
+}
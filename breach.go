@@ -0,0 +1,167 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"GoTcpServerWithOpaque/breach"
+	"GoTcpServerWithOpaque/opaque"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// The breach-check command tells a client whether a password is in the list
+// of breached passwords given with -breach-file, without the password leaving
+// the client, see package breach:
+//
+//	client: "breach-check"
+//	client: opaque.OprfRequest with one element
+//	server: breach.Evaluation
+//	client: breach.BucketRequest
+//	server: breach.Bucket
+//
+// Clients run it before registering, see client.Conn.BreachCheck. The list in
+// -breach-file holds the OPRF outputs of the passwords, not the passwords,
+// and is computed offline by cmd/breach-set with the key derived from the
+// seed in -breach-key-file. Evaluations are limited to -breach-rate per second
+// over all clients.
+
+var errNoBreachList = errors.New("No breach list")
+
+// breachList is nil unless enabled with -breach-file.
+var breachList *breachChecker
+
+type breachChecker struct {
+	k   *big.Int
+	set *breach.Set
+	now func() time.Time
+
+	mu      sync.Mutex
+	bucket  *tokenBucket
+	checked int64
+	limited int64
+}
+
+// newBreachChecker reads the list written by cmd/breach-set from r. The
+// list must have been computed with the key derived from seed.
+func newBreachChecker(seed []byte, r io.Reader, prefixBits int, rate float64, burst int) (*breachChecker, error) {
+	if rate <= 0 || burst < 1 {
+		return nil, errors.New("breach: rate must be positive and burst at least 1")
+	}
+	k, err := breach.DeriveKey(seed)
+	if err != nil {
+		return nil, err
+	}
+	set, err := breach.Read(r, prefixBits)
+	if err != nil {
+		return nil, err
+	}
+	return &breachChecker{
+		k:      k,
+		set:    set,
+		now:    time.Now,
+		bucket: newTokenBucket(rate, float64(burst)),
+	}, nil
+}
+
+// evaluate evaluates req on the crypto pool if the rate limit allows it.
+func (b *breachChecker) evaluate(req opaque.OprfRequest) (opaque.OprfResponse, error) {
+	b.mu.Lock()
+	ok := b.bucket.take(1, b.now())
+	if ok {
+		b.checked++
+	} else {
+		b.limited++
+	}
+	b.mu.Unlock()
+	if !ok {
+		return opaque.OprfResponse{}, errRateLimited
+	}
+	var res opaque.OprfResponse
+	var err error
+	if poolErr := pool.do(func() {
+		res, err = opaque.OprfEvaluate(b.k, req)
+	}); poolErr != nil {
+		b.mu.Lock()
+		b.bucket.give(1)
+		b.checked--
+		b.mu.Unlock()
+		return opaque.OprfResponse{}, poolErr
+	}
+	return res, err
+}
+
+// metrics returns the size of the list and the number of checked and
+// rejected passwords.
+func (b *breachChecker) metrics() map[string]int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return map[string]int64{"passwords": int64(b.set.Len()), "checked": b.checked, "rate_limited": b.limited}
+}
+
+func handleBreachCheck(r *bufio.Reader, w *bufio.Writer) error {
+	data, err := opaque.Read(r)
+	if err != nil {
+		return err
+	}
+	req, err := opaque.DecodeOprfRequest(data)
+	if err != nil {
+		return err
+	}
+	if len(req.Elements) != 1 || req.Info != nil {
+		return errors.New("want one element and no Info")
+	}
+
+	var res opaque.OprfResponse
+	if breachList == nil {
+		err = errNoBreachList
+	} else {
+		res, err = breachList.evaluate(req)
+	}
+	switch err {
+	case nil:
+	case errNoBreachList, errRateLimited:
+		if err := opaque.Write(w, []byte(err.Error())); err != nil {
+			return err
+		}
+		return err
+	case errBusy:
+		return writeBusy(w, err)
+	default:
+		return err
+	}
+	data, err = json.Marshal(breach.Evaluation{OprfResponse: res, PrefixBits: breachList.set.PrefixBits()})
+	if err != nil {
+		return err
+	}
+	if err := opaque.Write(w, data); err != nil {
+		return err
+	}
+
+	data, err = opaque.Read(r)
+	if err != nil {
+		return err
+	}
+	var breq breach.BucketRequest
+	if err := json.Unmarshal(data, &breq); err != nil {
+		return err
+	}
+	bucket, err := breachList.set.Bucket(breq.Prefix)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Breach check for prefix %d, %d entries\n", breq.Prefix, len(bucket.Entries))
+	data, err = json.Marshal(bucket)
+	if err != nil {
+		return err
+	}
+	return opaque.Write(w, data)
+}
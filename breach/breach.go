@@ -0,0 +1,237 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+// Package breach checks passwords against a list of breached passwords
+// without revealing them to the server that holds the list.
+//
+// The OPRF from package opaque is evaluated on every password in the list
+// with the server's key k, and the server keeps the outputs in a Set. The
+// outputs are computed offline, with Hash and Write, so the server loads the
+// Set with Read and never handles the passwords. A client that wants to
+// check a password has the server evaluate it blindly, so the server never
+// learns the password, and then asks for the bucket of outputs that share
+// the first PrefixBits bits with its own output. The client tests membership
+// locally. The server only learns the prefix, which many passwords share,
+// and without k the client cannot check passwords offline.
+package breach
+
+import (
+	"GoTcpServerWithOpaque/opaque"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// EntryLength is the number of bytes of each OPRF output that a Set keeps.
+// With 16 bytes, false positives need a list far larger than any breach.
+const EntryLength = 16
+
+// MaxPrefixBits is the largest supported bucket prefix length.
+const MaxPrefixBits = 24
+
+// Set is a set of OPRF outputs, grouped into buckets by prefix. It does not
+// change after it is created and is safe for concurrent use.
+type Set struct {
+	prefixBits int
+	// entries holds the truncated outputs, sorted, EntryLength bytes each.
+	entries []byte
+	// offsets[p] is the index in entries of the first entry with prefix p,
+	// and offsets[1<<prefixBits] is the number of entries.
+	offsets []uint32
+}
+
+// Prefix returns the first bits bits of output, which is the bucket output
+// belongs to in a Set with that prefix length.
+func Prefix(output []byte, bits int) uint32 {
+	var b [4]byte
+	copy(b[:], output)
+	return binary.BigEndian.Uint32(b[:]) >> (32 - bits)
+}
+
+// NewSet returns a Set holding outputs, with buckets of the given prefix
+// length. Duplicates are kept only once.
+func NewSet(outputs [][]byte, prefixBits int) (*Set, error) {
+	if prefixBits < 1 || prefixBits > MaxPrefixBits {
+		return nil, fmt.Errorf("breach: prefix length %d, must be 1 to %d", prefixBits, MaxPrefixBits)
+	}
+	entries := make([][]byte, 0, len(outputs))
+	for _, out := range outputs {
+		if len(out) < EntryLength {
+			return nil, errors.New("breach: output too short")
+		}
+		entries = append(entries, out[:EntryLength])
+	}
+	sort.Slice(entries, func(i, j int) bool { return bytes.Compare(entries[i], entries[j]) < 0 })
+
+	s := &Set{prefixBits: prefixBits, offsets: make([]uint32, 1<<prefixBits+1)}
+	for i, e := range entries {
+		if i > 0 && bytes.Equal(e, entries[i-1]) {
+			continue
+		}
+		s.entries = append(s.entries, e...)
+		s.offsets[Prefix(e, prefixBits)+1]++
+	}
+	for p := 1; p < len(s.offsets); p++ {
+		s.offsets[p] += s.offsets[p-1]
+	}
+	return s, nil
+}
+
+// DeriveKey derives the OPRF key of a breach list from seed, which must be at
+// least 32 bytes. The server and the tool that computes the Set from the
+// passwords, cmd/breach-set, derive it from the same seed.
+func DeriveKey(seed []byte) (*big.Int, error) {
+	k, _, err := opaque.DeriveOprfKey(seed, "breach")
+	return k, err
+}
+
+// Load reads passwords from r, one per line, and returns the Set of their
+// OPRF outputs under the key k. It is equivalent to Hash followed by NewSet.
+func Load(r io.Reader, k *big.Int, prefixBits int) (*Set, error) {
+	outputs, err := Hash(r, k)
+	if err != nil {
+		return nil, err
+	}
+	return NewSet(outputs, prefixBits)
+}
+
+// Hash reads passwords from r, one per line, and returns their OPRF outputs
+// under the key k. Empty lines are skipped. The outputs are computed on all
+// CPUs.
+func Hash(r io.Reader, k *big.Int) ([][]byte, error) {
+	var passwords [][]byte
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		if line := bytes.TrimRight(sc.Bytes(), "\r"); len(line) > 0 {
+			passwords = append(passwords, append([]byte(nil), line...))
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	outputs := make([][]byte, len(passwords))
+	workers := runtime.NumCPU()
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(passwords); i += workers {
+				out, err := opaque.OprfOutput(k, passwords[i])
+				if err != nil {
+					errs[w] = err
+					return
+				}
+				outputs[i] = out
+			}
+		}(w)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return outputs, nil
+}
+
+// WriteTo writes the entries of s to w, so that the Set can be read back with
+// Read without the passwords or the key. The entries are written one after
+// the other, EntryLength bytes each.
+func (s *Set) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(s.entries)
+	return int64(n), err
+}
+
+// Read reads the entries written by Set.WriteTo, or by Write, from r and
+// returns them as a Set with buckets of the given prefix length.
+func Read(r io.Reader, prefixBits int) (*Set, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data)%EntryLength != 0 {
+		return nil, fmt.Errorf("breach: %d bytes is not a whole number of entries", len(data))
+	}
+	outputs := make([][]byte, 0, len(data)/EntryLength)
+	for i := 0; i < len(data); i += EntryLength {
+		outputs = append(outputs, data[i:i+EntryLength])
+	}
+	return NewSet(outputs, prefixBits)
+}
+
+// Write writes the truncated outputs to w in the format read by Read.
+func Write(w io.Writer, outputs [][]byte) error {
+	for _, out := range outputs {
+		if len(out) < EntryLength {
+			return errors.New("breach: output too short")
+		}
+		if _, err := w.Write(out[:EntryLength]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PrefixBits returns the prefix length of the buckets of s.
+func (s *Set) PrefixBits() int {
+	return s.prefixBits
+}
+
+// Len returns the number of entries in s.
+func (s *Set) Len() int {
+	return len(s.entries) / EntryLength
+}
+
+// Bucket returns the entries of s with the given prefix.
+func (s *Set) Bucket(prefix uint32) (Bucket, error) {
+	if int(prefix) >= len(s.offsets)-1 {
+		return Bucket{}, fmt.Errorf("breach: prefix %d is longer than %d bits", prefix, s.prefixBits)
+	}
+	lo, hi := s.offsets[prefix], s.offsets[prefix+1]
+	b := Bucket{Entries: make([][]byte, 0, hi-lo)}
+	for i := lo; i < hi; i++ {
+		b.Entries = append(b.Entries, s.entries[i*EntryLength:(i+1)*EntryLength])
+	}
+	return b, nil
+}
+
+// Bucket is the answer to a BucketRequest.
+type Bucket struct {
+	// Entries are the truncated outputs in the bucket, in increasing order.
+	Entries [][]byte
+}
+
+// Contains reports whether the OPRF output is in b.
+func (b Bucket) Contains(output []byte) bool {
+	if len(output) < EntryLength {
+		return false
+	}
+	e := output[:EntryLength]
+	i := sort.Search(len(b.Entries), func(i int) bool { return bytes.Compare(b.Entries[i], e) >= 0 })
+	return i < len(b.Entries) && bytes.Equal(b.Entries[i], e)
+}
+
+// BucketRequest asks for the bucket with prefix Prefix. It is sent by the
+// client after it has computed its OPRF output.
+type BucketRequest struct {
+	Prefix uint32
+}
+
+// Evaluation is the server's answer to the blinded password: the evaluated
+// element and the prefix length of the buckets.
+type Evaluation struct {
+	opaque.OprfResponse
+	PrefixBits int
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package breach
+
+import (
+	"GoTcpServerWithOpaque/opaque"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSet(t *testing.T) {
+	var outputs [][]byte
+	for i := 0; i < 1000; i++ {
+		h := sha256.Sum256([]byte(fmt.Sprint(i)))
+		outputs = append(outputs, h[:])
+	}
+	// Duplicates are stored once.
+	s, err := NewSet(append(outputs, outputs[0]), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != 1000 {
+		t.Errorf("Len = %d, want 1000", s.Len())
+	}
+	total := 0
+	for p := uint32(0); p < 16; p++ {
+		b, err := s.Bucket(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, e := range b.Entries {
+			if Prefix(e, 4) != p || (i > 0 && bytes.Compare(b.Entries[i-1], e) >= 0) {
+				t.Fatalf("bucket %d: entry %d is %x", p, i, e)
+			}
+		}
+		total += len(b.Entries)
+	}
+	if total != 1000 {
+		t.Errorf("buckets hold %d entries, want 1000", total)
+	}
+	if _, err := s.Bucket(16); err == nil {
+		t.Error("Bucket accepted a 5 bit prefix")
+	}
+
+	for i, out := range outputs {
+		b, _ := s.Bucket(Prefix(out, 4))
+		if !b.Contains(out) {
+			t.Fatalf("output %d not found", i)
+		}
+	}
+	h := sha256.Sum256([]byte("not in the set"))
+	if b, _ := s.Bucket(Prefix(h[:], 4)); b.Contains(h[:]) {
+		t.Error("found an output that is not in the set")
+	}
+
+	for _, bits := range []int{0, MaxPrefixBits + 1} {
+		if _, err := NewSet(outputs, bits); err == nil {
+			t.Errorf("NewSet accepted prefix length %d", bits)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	k, err := DeriveKey(bytes.Repeat([]byte{3}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := Load(strings.NewReader("123456\r\npassword\n\nqwerty\npassword\n"), k, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != 3 {
+		t.Errorf("Len = %d, want 3", s.Len())
+	}
+	for _, pw := range []string{"123456", "password", "qwerty", "correct horse"} {
+		out, err := opaque.OprfOutput(k, []byte(pw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := s.Bucket(Prefix(out, 8))
+		if got, want := b.Contains(out), pw != "correct horse"; got != want {
+			t.Errorf("%q: Contains = %v, want %v", pw, got, want)
+		}
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	k, err := DeriveKey(bytes.Repeat([]byte{3}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputs, err := Hash(strings.NewReader("123456\npassword\nqwerty\npassword\n"), k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := Write(&buf, outputs); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 4*EntryLength {
+		t.Errorf("Write wrote %d bytes, want %d", buf.Len(), 4*EntryLength)
+	}
+	s, err := Read(&buf, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != 3 {
+		t.Errorf("Len = %d, want 3", s.Len())
+	}
+	for _, out := range outputs {
+		if b, _ := s.Bucket(Prefix(out, 8)); !b.Contains(out) {
+			t.Errorf("output %x not found", out)
+		}
+	}
+
+	// WriteTo writes what Read reads, with another prefix length if wanted.
+	buf.Reset()
+	if _, err := s.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	s2, err := Read(&buf, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s2.Len() != 3 || s2.PrefixBits() != 4 {
+		t.Errorf("read back %d entries with %d bit prefixes", s2.Len(), s2.PrefixBits())
+	}
+
+	if _, err := Read(bytes.NewReader(make([]byte, EntryLength+1)), 8); err == nil {
+		t.Error("Read accepted a partial entry")
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"GoTcpServerWithOpaque/breach"
+	"GoTcpServerWithOpaque/client"
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestBreachList returns a breach checker for passwords, computed as
+// cmd/breach-set does.
+func newTestBreachList(t *testing.T, rate float64, burst int, passwords ...string) *breachChecker {
+	t.Helper()
+	seed := bytes.Repeat([]byte{4}, 32)
+	k, err := breach.DeriveKey(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputs, err := breach.Hash(strings.NewReader(strings.Join(passwords, "\n")), k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := breach.Write(&buf, outputs); err != nil {
+		t.Fatal(err)
+	}
+	b, err := newBreachChecker(seed, &buf, 2, rate, burst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestBreachCheck(t *testing.T) {
+	c := dial(t)
+	if _, err := c.Breached("password"); err == nil {
+		t.Error("breach-check without a list succeeded")
+	}
+	c.serverErr()
+
+	breachList = newTestBreachList(t, 1, 3, "123456", "password", "letmein")
+	defer func() { breachList = nil }()
+	now := time.Unix(1e9, 0)
+	breachList.now = func() time.Time { return now }
+
+	for _, tc := range []struct {
+		password string
+		want     bool
+	}{
+		{"password", true},
+		{"letmein", true},
+		{"correct horse battery staple", false},
+	} {
+		c := dial(t)
+		got, err := c.Breached(tc.password)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.password, err)
+		}
+		if got != tc.want {
+			t.Errorf("%q: Breached = %v, want %v", tc.password, got, tc.want)
+		}
+		if err := c.serverErr(); err != nil {
+			t.Errorf("server: %v", err)
+		}
+	}
+
+	c = dial(t)
+	if _, err := c.Breached("123456"); err == nil {
+		t.Error("breach-check over the rate limit succeeded")
+	}
+	if err := c.serverErr(); err == nil || !strings.Contains(err.Error(), errRateLimited.Error()) {
+		t.Errorf("server: got %v, want %v", err, errRateLimited)
+	}
+	now = now.Add(time.Second)
+	c = dial(t)
+	if ok, err := c.Breached("123456"); err != nil || !ok {
+		t.Errorf("after a second: %v, %v", ok, err)
+	}
+	c.serverErr()
+	if m := breachList.metrics(); m["passwords"] != 3 || m["checked"] != 4 || m["rate_limited"] != 1 {
+		t.Errorf("metrics = %v", m)
+	}
+}
+
+func TestRegisterBreachCheck(t *testing.T) {
+	breachList = newTestBreachList(t, 100, 100, "123456", "password")
+	defer func() { breachList = nil }()
+	check := func(password string) (bool, error) {
+		c := dial(t)
+		defer c.serverErr()
+		return c.Breached(password)
+	}
+
+	c := dial(t)
+	c.BreachCheck = check
+	if err := c.Register("breached", "password"); err != client.PasswordBreached {
+		t.Errorf("breached password: got %v, want %v", err, client.PasswordBreached)
+	}
+	c.serverErr()
+	if _, ok := accounts.Get("breached", defaultCredential); ok {
+		t.Error("account registered with a breached password")
+	}
+
+	c = dial(t)
+	c.BreachCheck = check
+	if err := c.Register("breached", "correct horse battery staple"); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	if err := c.serverErr(); err != nil {
+		t.Errorf("server: %v", err)
+	}
+}
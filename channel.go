@@ -0,0 +1,132 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"GoTcpServerWithOpaque/opaque"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// After a successful login the connection stays open as an encrypted
+// channel. Every frame is a channelRequest or a channelResponse encrypted
+// with opaque.EncryptAndWrite under opaque.ChannelKey(SK). The client sends a
+// request and the server answers with a response, until the client closes
+// the connection or the login ends.
+
+// channelRequest is a command sent by the client.
+type channelRequest struct {
+	Cmd  string
+	Args json.RawMessage `json:",omitempty"`
+}
+
+// channelResponse is the server's answer to a channelRequest. Error is set if
+// the command failed.
+type channelResponse struct {
+	Result interface{} `json:",omitempty"`
+	Error  string      `json:",omitempty"`
+}
+
+// A channelCommand runs a command for the login l.
+type channelCommand func(l *login, args json.RawMessage) (interface{}, error)
+
+var channelCommands = map[string]channelCommand{
+	// ping does nothing. It keeps the login from timing out.
+	"ping": func(*login, json.RawMessage) (interface{}, error) {
+		return "pong", nil
+	},
+	// logins lists the user's logins.
+	"logins": func(l *login, _ json.RawMessage) (interface{}, error) {
+		return logins.list(l.username), nil
+	},
+	// revoke revokes one of the user's logins. Args is {"SessionID": ...}.
+	"revoke": func(l *login, args json.RawMessage) (interface{}, error) {
+		var ref sessionRef
+		if err := json.Unmarshal(args, &ref); err != nil {
+			return nil, err
+		}
+		return nil, logins.revoke(ref.SessionID, l.username)
+	},
+	// revoke-all revokes all of the user's logins, including this one.
+	"revoke-all": func(l *login, _ json.RawMessage) (interface{}, error) {
+		return logins.revokeUser(l.username), nil
+	},
+	// logout revokes this login.
+	"logout": func(l *login, _ json.RawMessage) (interface{}, error) {
+		return nil, logins.revoke(l.sessionID, "")
+	},
+
+	// Credential management, see accounts.go.
+	"credentials":           cmdCredentials,
+	"credential-add-start":  cmdCredentialAddStart,
+	"credential-add-finish": cmdCredentialAddFinish,
+	"credential-remove":     cmdCredentialRemove,
+
+	// OPRF evaluation for other services, see oprf.go.
+	"oprf": cmdOprf,
+
+	// Anonymous tokens, see privacypass.go.
+	"privacypass-issue": cmdPrivacyPassIssue,
+
+	// Encrypted blobs, see vault.go.
+	"vault-list":    cmdVaultList,
+	"vault-get":     cmdVaultGet,
+	"vault-put":     cmdVaultPut,
+	"vault-delete":  cmdVaultDelete,
+	"vault-key":     cmdVaultKey,
+	"vault-key-put": cmdVaultKeyPut,
+}
+
+// serveChannel runs the encrypted channel for l on conn. It returns nil when
+// the client closes the connection.
+func serveChannel(conn net.Conn, r *bufio.Reader, w *bufio.Writer, l *login) error {
+	key := opaque.ChannelKey(l.sk)
+	for {
+		conn.SetReadDeadline(time.Now().Add(logins.idle))
+		plaintext, err := opaque.ReadAndDecrypt(r, key)
+		if err == io.EOF {
+			return nil
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return errLoginIdle
+		}
+		if err != nil {
+			return err
+		}
+		// The login may have been revoked or timed out since the last
+		// request.
+		if err := logins.touch(l.sessionID); err != nil {
+			writeChannel(w, key, channelResponse{Error: err.Error()})
+			return err
+		}
+		var req channelRequest
+		var res channelResponse
+		if err := json.Unmarshal([]byte(plaintext), &req); err != nil {
+			res.Error = err.Error()
+		} else if cmd, ok := channelCommands[req.Cmd]; !ok {
+			res.Error = fmt.Sprintf("unknown command '%s'", req.Cmd)
+		} else if res.Result, err = cmd(l, req.Args); err != nil {
+			res.Error = err.Error()
+		}
+		if err := writeChannel(w, key, res); err != nil {
+			return err
+		}
+	}
+}
+
+func writeChannel(w *bufio.Writer, key []byte, res channelResponse) error {
+	data, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	return opaque.EncryptAndWrite(w, key, string(data))
+}
@@ -0,0 +1,459 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+// Package client implements the client side of the pwreg and auth commands
+// of the example server. It is used by the tests and by cmd/opaque-bench.
+package client
+
+import (
+	"GoTcpServerWithOpaque/breach"
+	"GoTcpServerWithOpaque/opaque"
+	"GoTcpServerWithOpaque/privacypass"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Phases reported to Conn.Observe. Each phase is one round trip to the
+// server.
+const (
+	PhasePwReg1 = "pwreg1" // PwRegMsg1 sent, PwRegMsg2 received
+	PhasePwReg2 = "pwreg2" // PwRegMsg3 sent, confirmation received
+	PhaseAuth1  = "auth1"  // AuthMsg1 sent, AuthMsg2 received
+	PhaseAuth2  = "auth2"  // AuthMsg3 sent, "ok" and token received
+	PhaseOprf   = "oprf"   // OprfRequest sent, OprfResponse received
+	PhaseBreach = "breach" // BucketRequest sent, Bucket received
+)
+
+// Conn is a client connection to the server. A Conn runs one command; the
+// server closes the connection after it, except after a successful Login,
+// when the connection becomes an encrypted channel used with Call.
+type Conn struct {
+	r *bufio.Reader
+	w *bufio.Writer
+	// key is the channel key and username the logged-in user after a
+	// successful Login.
+	key      []byte
+	username string
+
+	// OPRFKey is the server's OPRF public key for the account. Register sets
+	// it. If it is set, Login requires the server to prove that it evaluated
+	// the OPRF with this key, so a client that keeps the key across
+	// connections notices if the server uses another one.
+	OPRFKey *opaque.ECPoint
+
+	// Identities are the identities that logins are bound to. They must be
+	// the ones the server uses; the zero value is right for servers that use
+	// the public keys.
+	Identities opaque.Identities
+
+	// ExportKey is the export key of the credential registered by Register
+	// or used by the last Login, see Session.ExportKey. The vault key is
+	// wrapped under it.
+	ExportKey []byte
+	// vaultKey is the account's vault key once a vault method has fetched
+	// it, see vault.go.
+	vaultKey []byte
+
+	// Observe, if non-nil, is called after each phase with the time the
+	// phase took and the error it failed with, if any.
+	Observe func(phase string, elapsed time.Duration, err error)
+
+	// BreachCheck, if non-nil, is called by Register with the password
+	// before anything is sent, and Register fails with PasswordBreached if
+	// it reports the password as breached. It usually runs Breached on a new
+	// Conn to the same server, since a Conn runs one command.
+	BreachCheck func(password string) (bool, error)
+}
+
+// NewConn returns a Conn that talks to the server over rw.
+func NewConn(rw io.ReadWriter) *Conn {
+	return &Conn{r: bufio.NewReader(rw), w: bufio.NewWriter(rw)}
+}
+
+func (c *Conn) observe(phase string, start time.Time, err error) {
+	if c.Observe != nil {
+		c.Observe(phase, time.Since(start), err)
+	}
+}
+
+func (c *Conn) write(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return opaque.Write(c.w, data)
+}
+
+func (c *Conn) read(v interface{}) error {
+	data, err := opaque.Read(c.r)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("server replied %q", data)
+	}
+	return nil
+}
+
+var (
+	// AccountExists is returned by Register if the username is taken.
+	AccountExists = errors.New("client: account exists")
+	// PasswordBreached is returned by Register if BreachCheck reports the
+	// password as breached.
+	PasswordBreached = errors.New("client: password is in the breach list")
+)
+
+// Register runs the pwreg command, registering username with password.
+// Clients should check the password first by setting BreachCheck. Register
+// only creates accounts and returns AccountExists if username is registered;
+// the password of an account is changed with AddCredential.
+func (c *Conn) Register(username, password string) error {
+	if c.BreachCheck != nil {
+		breached, err := c.BreachCheck(password)
+		if err != nil {
+			return err
+		}
+		if breached {
+			return PasswordBreached
+		}
+	}
+	if err := opaque.Write(c.w, []byte("pwreg")); err != nil {
+		return err
+	}
+	sess, msg1, err := opaque.PwRegInit(username, password)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	var msg2 opaque.PwRegMsg2
+	var data []byte
+	err = c.write(msg1)
+	if err == nil {
+		data, err = opaque.Read(c.r)
+	}
+	if err == nil && string(data) == "Account exists" {
+		err = AccountExists
+	} else if err == nil && json.Unmarshal(data, &msg2) != nil {
+		err = fmt.Errorf("server replied %q", data)
+	}
+	c.observe(PhasePwReg1, start, err)
+	if err != nil {
+		return err
+	}
+
+	msg3, err := opaque.PwReg2(sess, msg2)
+	if err != nil {
+		return err
+	}
+	start = time.Now()
+	err = c.write(msg3)
+	if err == nil {
+		_, err = opaque.Read(c.r)
+	}
+	c.observe(PhasePwReg2, start, err)
+	if err != nil {
+		return err
+	}
+	c.OPRFKey = sess.OprfKey()
+	c.ExportKey = sess.ExportKey()
+	return nil
+}
+
+// Breached runs the breach-check command, which reports whether password is
+// in the server's list of breached passwords. The server learns neither the
+// password nor the result.
+func (c *Conn) Breached(password string) (bool, error) {
+	if err := opaque.Write(c.w, []byte("breach-check")); err != nil {
+		return false, err
+	}
+	sess, req, err := opaque.OprfBlind("", [][]byte{[]byte(password)}, nil)
+	if err != nil {
+		return false, err
+	}
+	start := time.Now()
+	var ev breach.Evaluation
+	err = c.write(req)
+	if err == nil {
+		err = c.read(&ev)
+	}
+	c.observe(PhaseOprf, start, err)
+	if err != nil {
+		return false, err
+	}
+	if ev.PrefixBits < 1 || ev.PrefixBits > breach.MaxPrefixBits {
+		return false, fmt.Errorf("server sent prefix length %d", ev.PrefixBits)
+	}
+	outputs, err := opaque.OprfFinalize(sess, ev.OprfResponse)
+	if err != nil {
+		return false, err
+	}
+
+	start = time.Now()
+	var bucket breach.Bucket
+	err = c.write(breach.BucketRequest{Prefix: breach.Prefix(outputs[0], ev.PrefixBits)})
+	if err == nil {
+		err = c.read(&bucket)
+	}
+	c.observe(PhaseBreach, start, err)
+	if err != nil {
+		return false, err
+	}
+	return bucket.Contains(outputs[0]), nil
+}
+
+// Oprf runs the oprf command, which evaluates the OPRF on inputs under the
+// server's key named key. It is run over the channel that follows Login, and
+// the server limits how many inputs each account can evaluate. pubK is the
+// public key of the key if the client knows it, in which case the server must
+// prove the evaluation against it.
+// Oprf returns the outputs and the verified public key, which can be passed
+// as pubK in later calls. opaque.InvalidProof is returned if the proof does
+// not verify.
+func (c *Conn) Oprf(key string, inputs [][]byte, pubK *opaque.ECPoint) ([][]byte, *opaque.ECPoint, error) {
+	sess, req, err := opaque.OprfBlind(key, inputs, pubK)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.oprf(sess, req)
+}
+
+// Poprf is like Oprf but evaluates under the key tweaked by the public
+// metadata info. pubK and the returned key are the untweaked public key,
+// which is the same for every info. The server has a separate key for
+// Poprf, so it is not the public key Oprf returns for the same key name.
+func (c *Conn) Poprf(key, info string, inputs [][]byte, pubK *opaque.ECPoint) ([][]byte, *opaque.ECPoint, error) {
+	sess, req, err := opaque.PoprfBlind(key, info, inputs, pubK)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.oprf(sess, req)
+}
+
+func (c *Conn) oprf(sess *opaque.OprfClientSession, req opaque.OprfRequest) ([][]byte, *opaque.ECPoint, error) {
+	start := time.Now()
+	var res opaque.OprfResponse
+	err := c.Call("oprf", req, &res)
+	c.observe(PhaseOprf, start, err)
+	if err != nil {
+		return nil, nil, err
+	}
+	outputs, err := opaque.OprfFinalize(sess, res)
+	if err != nil {
+		return nil, nil, err
+	}
+	return outputs, sess.OprfKey(), nil
+}
+
+// Session is the result of a successful login.
+type Session struct {
+	// Key is the session key shared with the server.
+	Key []byte
+	// Token is the bearer token issued by the server. It can be verified
+	// with package token.
+	Token string
+	// ExportKey is a key the server never learns, for encrypting data the
+	// client stores with the server. It is the same at every login with the
+	// credential until the credential is registered again, and each
+	// credential of an account has its own.
+	ExportKey []byte
+}
+
+// Login runs the auth command with the default credential of username.
+// opaque.AuthtagMismatch is returned if the password is wrong.
+func (c *Conn) Login(username, password string) (*Session, error) {
+	return c.LoginCredential(username, "", password)
+}
+
+// LoginCredential is like Login but uses the credential credentialID of
+// username.
+func (c *Conn) LoginCredential(username, credentialID, password string) (*Session, error) {
+	// "auth-token" asks for the token after "ok".
+	if err := opaque.Write(c.w, []byte("auth-token")); err != nil {
+		return nil, err
+	}
+	var sess *opaque.AuthClientSession
+	var msg1 opaque.AuthMsg1
+	var err error
+	if c.OPRFKey != nil {
+		sess, msg1, err = opaque.AuthInitVerifiable(username, password, c.OPRFKey)
+	} else {
+		sess, msg1, err = opaque.AuthInit(username, password)
+	}
+	if err != nil {
+		return nil, err
+	}
+	msg1.CredentialID = credentialID
+	sess.SetCredentialID(credentialID)
+	sess.SetIdentities(c.Identities)
+
+	start := time.Now()
+	var msg2 opaque.AuthMsg2
+	err = c.write(msg1)
+	if err == nil {
+		err = c.read(&msg2)
+	}
+	c.observe(PhaseAuth1, start, err)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, msg3, err := opaque.Auth2(sess, msg2)
+	if err != nil {
+		return nil, err
+	}
+	start = time.Now()
+	err = c.write(msg3)
+	var reply []byte
+	if err == nil {
+		reply, err = opaque.Read(c.r)
+	}
+	if err == nil && string(reply) != "ok" {
+		err = fmt.Errorf("server replied %q", reply)
+	}
+	var tok string
+	if err == nil {
+		tok, err = opaque.ReadAndDecrypt(c.r, opaque.ChannelKey(secret))
+	}
+	c.observe(PhaseAuth2, start, err)
+	if err != nil {
+		return nil, err
+	}
+	c.key = opaque.ChannelKey(secret)
+	c.username = username
+	c.ExportKey = sess.ExportKey()
+	c.vaultKey = nil
+	return &Session{Key: secret, Token: tok, ExportKey: sess.ExportKey()}, nil
+}
+
+// Credential kinds for AddCredential.
+const (
+	KindPassword = "password"
+	KindDevice   = "device"
+	// A recovery credential can be used for one login.
+	KindRecovery = "recovery"
+)
+
+// AddCredential registers password as the credential credentialID of the
+// logged-in user, replacing any credential with the same ID. Replacing a
+// credential, for example changing the password of the "default" one that
+// Register created, ends the user's other logins. The account's vault key is
+// shared with the new credential. It is run over the channel that follows
+// Login.
+func (c *Conn) AddCredential(credentialID, kind, password string) error {
+	// The vault key is fetched first, since replacing the credential of the
+	// login removes its copy. A login whose credential the key was not
+	// shared with cannot share it.
+	vaultKey, err := c.accountVaultKey()
+	if err != nil && err != NoVaultKey {
+		return err
+	}
+	sess, msg1, err := opaque.PwRegInit(c.username, password)
+	if err != nil {
+		return err
+	}
+	start := struct {
+		opaque.PwRegMsg1
+		CredentialID string
+		Kind         string
+	}{msg1, credentialID, kind}
+	var msg2 struct {
+		opaque.PwRegMsg2
+		SessionID string
+	}
+	if err := c.Call("credential-add-start", start, &msg2); err != nil {
+		return err
+	}
+	msg3, err := opaque.PwReg2(sess, msg2.PwRegMsg2)
+	if err != nil {
+		return err
+	}
+	finish := struct {
+		opaque.PwRegMsg3
+		SessionID string
+	}{msg3, msg2.SessionID}
+	if err := c.Call("credential-add-finish", finish, nil); err != nil {
+		return err
+	}
+	if vaultKey == nil {
+		return nil
+	}
+	return c.putVaultKey(credentialID, sess.ExportKey(), vaultKey, false)
+}
+
+// RemoveCredential removes the credential credentialID of the logged-in
+// user.
+func (c *Conn) RemoveCredential(credentialID string) error {
+	return c.Call("credential-remove", struct{ CredentialID string }{credentialID}, nil)
+}
+
+// Tokens obtains n anonymous tokens for challenge, an encoded
+// privacypass.Challenge, from the issuer with public key pubK. It is run over
+// the channel that follows Login, but the issuer cannot link the tokens to
+// the login.
+func (c *Conn) Tokens(pubK *opaque.ECPoint, challenge []byte, n int) ([]privacypass.Token, error) {
+	st, req, err := privacypass.NewTokenRequest(pubK, challenge, n)
+	if err != nil {
+		return nil, err
+	}
+	var res privacypass.TokenResponse
+	if err := c.Call("privacypass-issue", req, &res); err != nil {
+		return nil, err
+	}
+	return st.Finalize(res)
+}
+
+// Call runs the command cmd with the arguments args, which may be nil, over
+// the encrypted channel that follows a successful Login. The result is
+// decoded into result unless result is nil.
+func (c *Conn) Call(cmd string, args, result interface{}) error {
+	if c.key == nil {
+		return errors.New("client: Call before Login")
+	}
+	req := struct {
+		Cmd  string
+		Args interface{} `json:",omitempty"`
+	}{cmd, args}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	if err := opaque.EncryptAndWrite(c.w, c.key, string(data)); err != nil {
+		return err
+	}
+	reply, err := opaque.ReadAndDecrypt(c.r, c.key)
+	if err != nil {
+		return err
+	}
+	var res struct {
+		Result json.RawMessage
+		Error  string
+	}
+	if err := json.Unmarshal([]byte(reply), &res); err != nil {
+		return err
+	}
+	if res.Error != "" {
+		return &ServerError{Cmd: cmd, Msg: res.Error}
+	}
+	if result == nil || res.Result == nil {
+		return nil
+	}
+	return json.Unmarshal(res.Result, result)
+}
+
+// ServerError is returned by Call when the server reports that a command
+// failed.
+type ServerError struct {
+	Cmd string
+	Msg string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Cmd, e.Msg)
+}
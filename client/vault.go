@@ -0,0 +1,223 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package client
+
+import (
+	"GoTcpServerWithOpaque/opaque"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// The vault methods store blobs with the server over the channel that
+// follows Login. Each blob is encrypted with opaque.AuthEnc under a key
+// derived from the account's vault key, the blob's name and its version, so
+// the server sees only ciphertext and cannot move a blob to another name or
+// version without the client noticing.
+//
+// The vault key is random and made by the first client that uses the vault.
+// The server keeps it wrapped under the export key of each credential, which
+// the server never learns. AddCredential wraps it for the new credential, so
+// logins with any credential of the account, including one whose password
+// was changed, can read the vault.
+
+var (
+	// VersionMismatch is returned by VaultPut and VaultDelete if the blob
+	// has changed since the version the caller gave.
+	VersionMismatch = errors.New("client: version mismatch")
+	// NoVaultKey is returned by the vault methods if the account has a
+	// vault key but it was not shared with the credential of the login.
+	NoVaultKey = errors.New("client: the vault key is not shared with this credential")
+)
+
+// wrappedVaultKey is the argument of vault-key-put and the result of
+// vault-key.
+type wrappedVaultKey struct {
+	CredentialID string `json:",omitempty"`
+	Key          []byte
+	Create       bool `json:",omitempty"`
+}
+
+// VaultEntry describes a blob in the vault.
+type VaultEntry struct {
+	Name string
+	// Version is 1 when the blob is created and increases by one on every
+	// VaultPut.
+	Version  uint64
+	Size     int
+	Modified time.Time
+}
+
+type vaultBlob struct {
+	VaultEntry
+	Data []byte
+}
+
+// blobKey returns the key of version version of the blob name.
+func blobKey(vaultKey []byte, name string, version uint64) ([]byte, error) {
+	info := []byte("VaultKey")
+	info = binary.BigEndian.AppendUint16(info, uint16(len(name)))
+	info = append(info, name...)
+	info = binary.BigEndian.AppendUint64(info, version)
+	key := make([]byte, 16)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, vaultKey, info), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// wrapKey returns the key that the vault key is wrapped under for the
+// credential with export key exportKey.
+func wrapKey(exportKey []byte) ([]byte, error) {
+	key := make([]byte, 16)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, exportKey, []byte("VaultKeyWrap")), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// accountVaultKey returns the vault key of the logged-in user, and makes one
+// if the account has none.
+func (c *Conn) accountVaultKey() ([]byte, error) {
+	if c.vaultKey != nil {
+		return c.vaultKey, nil
+	}
+	if c.ExportKey == nil {
+		return nil, errors.New("client: no export key, Login first")
+	}
+	wk, err := wrapKey(c.ExportKey)
+	if err != nil {
+		return nil, err
+	}
+	var res wrappedVaultKey
+	err = c.Call("vault-key", nil, &res)
+	var se *ServerError
+	switch {
+	case err == nil:
+		if c.vaultKey, err = opaque.AuthDec(wk, res.Key); err != nil {
+			return nil, err
+		}
+		return c.vaultKey, nil
+	case errors.As(err, &se) && se.Msg == "vault key exists":
+		return nil, NoVaultKey
+	case !errors.As(err, &se) || se.Msg != "no vault key":
+		return nil, err
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := c.putVaultKey("", c.ExportKey, key, true); err != nil {
+		if errors.As(err, &se) && se.Msg == "vault key exists" {
+			// Another client made one first.
+			return nil, NoVaultKey
+		}
+		return nil, err
+	}
+	c.vaultKey = key
+	return key, nil
+}
+
+// putVaultKey stores key wrapped for the credential credentialID, or the one
+// of the login if it is empty, whose export key is exportKey.
+func (c *Conn) putVaultKey(credentialID string, exportKey, key []byte, create bool) error {
+	wk, err := wrapKey(exportKey)
+	if err != nil {
+		return err
+	}
+	wrapped, err := opaque.AuthEnc(rand.Reader, wk, key)
+	if err != nil {
+		return err
+	}
+	return c.Call("vault-key-put", wrappedVaultKey{CredentialID: credentialID, Key: wrapped, Create: create}, nil)
+}
+
+// vaultError returns VersionMismatch for the server's version mismatch
+// error and err otherwise.
+func vaultError(err error) error {
+	var se *ServerError
+	if errors.As(err, &se) && se.Msg == "version mismatch" {
+		return VersionMismatch
+	}
+	return err
+}
+
+// VaultList returns the blobs of the logged-in user ordered by name.
+func (c *Conn) VaultList() ([]VaultEntry, error) {
+	var entries []VaultEntry
+	if err := c.Call("vault-list", nil, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// VaultPut encrypts plaintext and stores it as the blob name, replacing
+// version version of it, or creating it if version is 0. It returns the new
+// version.
+func (c *Conn) VaultPut(name string, plaintext []byte, version uint64) (uint64, error) {
+	vk, err := c.accountVaultKey()
+	if err != nil {
+		return 0, err
+	}
+	key, err := blobKey(vk, name, version+1)
+	if err != nil {
+		return 0, err
+	}
+	data, err := opaque.AuthEnc(rand.Reader, key, plaintext)
+	if err != nil {
+		return 0, err
+	}
+	b := vaultBlob{VaultEntry: VaultEntry{Name: name, Version: version}, Data: data}
+	var res VaultEntry
+	if err := c.Call("vault-put", b, &res); err != nil {
+		return 0, vaultError(err)
+	}
+	if res.Version != version+1 {
+		return 0, errors.New("client: server returned the wrong version")
+	}
+	return res.Version, nil
+}
+
+// VaultGet fetches and decrypts the blob name. It returns the plaintext and
+// the version. opaque.AuthtagMismatch is returned if the server has tampered
+// with the blob.
+func (c *Conn) VaultGet(name string) ([]byte, uint64, error) {
+	vk, err := c.accountVaultKey()
+	if err != nil {
+		return nil, 0, err
+	}
+	var b vaultBlob
+	if err := c.Call("vault-get", struct{ Name string }{name}, &b); err != nil {
+		return nil, 0, err
+	}
+	if b.Name != name {
+		return nil, 0, errors.New("client: server returned the wrong blob")
+	}
+	key, err := blobKey(vk, name, b.Version)
+	if err != nil {
+		return nil, 0, err
+	}
+	plaintext, err := opaque.AuthDec(key, b.Data)
+	if err != nil {
+		return nil, 0, err
+	}
+	return plaintext, b.Version, nil
+}
+
+// VaultDelete deletes version version of the blob name.
+func (c *Conn) VaultDelete(name string, version uint64) error {
+	args := struct {
+		Name    string
+		Version uint64
+	}{name, version}
+	return vaultError(c.Call("vault-delete", args, nil))
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+// breach-set computes the breach list of the example server from a file of
+// breached passwords, one per line. It evaluates the OPRF on each password
+// with the key derived from the seed in -key-file and writes the truncated
+// outputs to -out, to be passed to the server with -breach-file together with
+// the same key file as -breach-key-file. The server never sees the passwords.
+package main
+
+import (
+	"GoTcpServerWithOpaque/breach"
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "%s computes a breach list from the passwords in the given file.\nUsage: %s [flags] passwords.txt\n", os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	keyFile := flag.String("key-file", "", "File with a hex-encoded seed of at least 32 bytes, the -breach-key-file of the server.")
+	out := flag.String("out", "breach.set", "File to write the breach list to.")
+	flag.Parse()
+
+	if err := compute(*keyFile, flag.Arg(0), *out); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func compute(keyFile, passwords, out string) error {
+	if keyFile == "" || passwords == "" {
+		return fmt.Errorf("need -key-file and a password file")
+	}
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return err
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("%s: %s", keyFile, err)
+	}
+	k, err := breach.DeriveKey(seed)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(passwords)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	outputs, err := breach.Hash(in, k)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = breach.Write(w, outputs)
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %d passwords to %s\n", len(outputs), out)
+	return nil
+}
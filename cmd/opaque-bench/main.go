@@ -0,0 +1,158 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+// opaque-bench is a load generator for the example server. It registers a set
+// of users and then runs logins from concurrent simulated clients, reporting
+// latency percentiles, the handshake rate and error counts for each protocol
+// phase.
+package main
+
+import (
+	"GoTcpServerWithOpaque/client"
+	"GoTcpServerWithOpaque/opaque"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// phases lists the phases in the order they are reported.
+var phases = []string{"connect", client.PhasePwReg1, client.PhasePwReg2, client.PhaseAuth1, client.PhaseAuth2, "login"}
+
+// stats collects latencies and errors per phase.
+type stats struct {
+	mu        sync.Mutex
+	latencies map[string][]time.Duration
+	errors    map[string]int
+}
+
+func newStats() *stats {
+	return &stats{latencies: map[string][]time.Duration{}, errors: map[string]int{}}
+}
+
+func (s *stats) observe(phase string, elapsed time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.errors[phase]++
+		return
+	}
+	s.latencies[phase] = append(s.latencies[phase], elapsed)
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p * float64(len(sorted)-1))
+	return sorted[i]
+}
+
+func (s *stats) report(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintf(w, "%-8s %8s %6s %10s %10s %10s %10s\n", "phase", "ok", "errors", "p50", "p90", "p99", "max")
+	for _, phase := range phases {
+		l := s.latencies[phase]
+		if len(l) == 0 && s.errors[phase] == 0 {
+			continue
+		}
+		sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+		fmt.Fprintf(w, "%-8s %8d %6d %10v %10v %10v %10v\n", phase, len(l), s.errors[phase],
+			percentile(l, 0.5).Round(time.Microsecond), percentile(l, 0.9).Round(time.Microsecond),
+			percentile(l, 0.99).Round(time.Microsecond), percentile(l, 1).Round(time.Microsecond))
+	}
+}
+
+// command dials addr and runs f on a new connection, recording the connect
+// phase in s.
+func command(addr string, s *stats, f func(c *client.Conn) error) error {
+	start := time.Now()
+	conn, err := net.Dial("tcp", addr)
+	s.observe("connect", time.Since(start), err)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	c := client.NewConn(conn)
+	c.Observe = s.observe
+	return f(c)
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "%s drives concurrent simulated clients against the example server.\nUsage:\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	addr := flag.String("addr", "localhost:9999", "Address of the server.")
+	concurrency := flag.Int("c", 16, "Number of concurrent clients.")
+	logins := flag.Int("n", 1000, "Total number of logins.")
+	duration := flag.Duration("d", 0, "Run logins for this long instead of -n logins.")
+	prefix := flag.String("prefix", fmt.Sprintf("bench-%d-", time.Now().Unix()), "Prefix of the usernames registered by the benchmark.")
+	flag.Parse()
+
+	opaque.Trace = io.Discard
+	s := newStats()
+
+	// Every client registers its own user before the logins start.
+	fmt.Printf("Registering %d users...\n", *concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			username := fmt.Sprintf("%s%d", *prefix, i)
+			command(*addr, s, func(c *client.Conn) error {
+				return c.Register(username, "password")
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	fmt.Printf("Running logins with %d clients...\n", *concurrency)
+	var remaining = int64(*logins)
+	var deadline time.Time
+	if *duration > 0 {
+		deadline = time.Now().Add(*duration)
+	}
+	var succeeded int64
+	start := time.Now()
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			username := fmt.Sprintf("%s%d", *prefix, i)
+			for {
+				if deadline.IsZero() {
+					if atomic.AddInt64(&remaining, -1) < 0 {
+						return
+					}
+				} else if time.Now().After(deadline) {
+					return
+				}
+				loginStart := time.Now()
+				err := command(*addr, s, func(c *client.Conn) error {
+					_, err := c.Login(username, "password")
+					return err
+				})
+				s.observe("login", time.Since(loginStart), err)
+				if err == nil {
+					atomic.AddInt64(&succeeded, 1)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	s.report(os.Stdout)
+	fmt.Printf("\n%d logins in %v: %.1f handshakes/s\n", succeeded, elapsed.Round(time.Millisecond),
+		float64(succeeded)/elapsed.Seconds())
+}
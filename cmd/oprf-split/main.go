@@ -0,0 +1,87 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+// oprf-split generates the seeds of the per-user OPRF keys for the threshold
+// mode of the example server and splits them among share holders. It writes
+// share-<i>.json for each share holder, to be passed with -oprf-share-file,
+// and threshold.json, with the addresses of the share holders, to be passed to
+// the coordinators with -threshold-config. Each share holder gets a random key
+// that authenticates the coordinators' requests; it is in both files, so keep
+// threshold.json as secret as the shares.
+package main
+
+import (
+	"GoTcpServerWithOpaque/opaque"
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type peer struct {
+	Index  int
+	Addr   string
+	MacKey []byte
+}
+
+type share struct {
+	opaque.KeyShare
+	MacKey []byte
+}
+
+type config struct {
+	T     int
+	Peers []peer
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "%s splits a new OPRF key among share holders.\nUsage:\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	t := flag.Int("t", 2, "Number of share holders needed to evaluate the OPRF.")
+	addrs := flag.String("addrs", "", "Comma separated -oprf-share-addr of the share holders, one per share.")
+	dir := flag.String("dir", ".", "Directory to write the files to.")
+	flag.Parse()
+
+	if err := split(*t, strings.Split(*addrs, ","), *dir); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func split(t int, addrs []string, dir string) error {
+	if len(addrs) == 0 || addrs[0] == "" {
+		return fmt.Errorf("no -addrs")
+	}
+	shares, err := opaque.SplitOprfKey(t, len(addrs))
+	if err != nil {
+		return err
+	}
+	cfg := config{T: t}
+	for i, s := range shares {
+		macKey := make([]byte, 32)
+		if _, err := rand.Read(macKey); err != nil {
+			return err
+		}
+		cfg.Peers = append(cfg.Peers, peer{Index: s.Index, Addr: addrs[i], MacKey: macKey})
+		if err := writeJSON(filepath.Join(dir, fmt.Sprintf("share-%d.json", s.Index)), share{s, macKey}, 0600); err != nil {
+			return err
+		}
+	}
+	return writeJSON(filepath.Join(dir, "threshold.json"), cfg, 0600)
+}
+
+func writeJSON(file string, v interface{}, perm os.FileMode) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println("Writing", file)
+	return os.WriteFile(file, append(data, '\n'), perm)
+}
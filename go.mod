@@ -1,10 +1,14 @@
 //module GoTcpServerWithOpaque
 module GoTcpServerWithOpaque
 
-
-go 1.14
+go 1.24.0
 
 require (
+	filippo.io/bigmod v0.1.0
+	filippo.io/nistec v0.0.4
 	github.com/go-test/deep v1.0.1
-	golang.org/x/crypto v0.0.0-20181112202954-3d3f9f413869
+	golang.org/x/crypto v0.42.0
+	golang.org/x/net v0.44.0
 )
+
+require golang.org/x/sys v0.36.0 // indirect
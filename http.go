@@ -0,0 +1,243 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+// This file contains the HTTP transport. It carries the same messages as the
+// TCP protocol as JSON request and response bodies:
+//
+//	POST /register/start   PwRegMsg1              -> PwRegMsg2 + SessionID
+//	POST /register/finish  PwRegMsg3 + SessionID  -> {"Username": ...}
+//	POST /login/start      AuthMsg1               -> AuthMsg2 + SessionID
+//	POST /login/finish     AuthMsg3 + SessionID   -> {"Username": ..., "Token": ...}
+//	GET  /.well-known/jwks.json                    -> keys that sign tokens
+//	POST /token/introspect {"Token": ...}           -> introspection
+//
+// With -privacypass-key-file, the issuer directory and /privacypass/redeem
+// from privacypass.go are served as well.
+//
+// Failures are reported with a non-2xx status and an httpError body. Note that
+// /register/start answers 409 account_exists for a taken username, so unlike
+// /login/start it reveals which usernames exist; see pwRegStart.
+
+import (
+	"GoTcpServerWithOpaque/opaque"
+	"GoTcpServerWithOpaque/privacypass"
+	"GoTcpServerWithOpaque/token"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// maxBodySize limits the size of request bodies. The largest message,
+// PwRegMsg3, is well below 4 KiB.
+const maxBodySize = 64 << 10
+
+// httpError is the body of an error response.
+type httpError struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// loginResult is the body of a successful /register/finish or /login/finish
+// response.
+type loginResult struct {
+	Username string
+	// Token is set by /login/finish. It is the token issued for the login,
+	// encrypted with the session key as by opaque.EncryptAndWrite.
+	Token string `json:",omitempty"`
+}
+
+func newHTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/register/start", httpPost(httpRegisterStart))
+	mux.HandleFunc("/register/finish", httpPost(httpRegisterFinish))
+	mux.HandleFunc("/login/start", httpPost(httpLoginStart))
+	mux.HandleFunc("/login/finish", httpPost(httpLoginFinish))
+	mux.Handle("/.well-known/jwks.json", token.KeySetHandler(signer.KeySet()))
+	mux.HandleFunc("/token/introspect", httpPost(httpIntrospect))
+	if tokenIssuer != nil {
+		mux.HandleFunc("/.well-known/private-token-issuer-directory", httpIssuerDirectory)
+		mux.HandleFunc("/privacypass/issue", httpPost(httpIssue))
+		mux.HandleFunc("/privacypass/redeem", httpPost(httpRedeem))
+	}
+	return mux
+}
+
+// httpPost adapts f to an http.HandlerFunc. The request body is read and
+// passed to f together with the request, and the value or error returned by f
+// is written as JSON.
+func httpPost(f func(r *http.Request, body []byte) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeHTTPError(w, http.StatusMethodNotAllowed, "method_not_allowed", "use POST")
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+		if err != nil {
+			writeHTTPError(w, http.StatusRequestEntityTooLarge, "bad_request", err.Error())
+			return
+		}
+		res, err := f(r, body)
+		if err != nil {
+			fmt.Printf("Error happened in %s: %s\n", r.URL.Path, err)
+			status, code := httpStatus(err)
+			writeHTTPError(w, status, code, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, res)
+	}
+}
+
+// badRequest marks errors caused by malformed request bodies.
+type badRequest struct {
+	err error
+}
+
+func (e badRequest) Error() string { return e.err.Error() }
+
+// httpStatus maps an error from the protocol functions to an HTTP status and
+// an error code for the response body.
+func httpStatus(err error) (int, string) {
+	var bad badRequest
+	switch {
+	case errors.As(err, &bad):
+		return http.StatusBadRequest, "bad_request"
+	case err == errBusy:
+		return http.StatusServiceUnavailable, "server_busy"
+	case err == errAccountExists:
+		return http.StatusConflict, "account_exists"
+	case err == errTooManySessions:
+		return http.StatusServiceUnavailable, "too_many_sessions"
+	case err == errUnknownSession, err == errSessionExpired:
+		return http.StatusNotFound, "unknown_session"
+	case err == errSessionReplayed:
+		return http.StatusConflict, "session_replayed"
+	case errors.Is(err, errOutOfOrder):
+		return http.StatusConflict, "out_of_order"
+	case err == opaque.MacMismatch:
+		return http.StatusUnauthorized, "authentication_failed"
+	case err == errNoBearer:
+		return http.StatusUnauthorized, "unauthorized"
+	case err == errRateLimited:
+		return http.StatusTooManyRequests, "rate_limited"
+	case err == privacypass.DoubleSpend:
+		return http.StatusConflict, "double_spend"
+	case err == privacypass.Malformed, err == privacypass.WrongTokenType, err == privacypass.UnknownKey,
+		err == privacypass.ChallengeMismatch, err == privacypass.InvalidToken:
+		return http.StatusUnauthorized, "invalid_token"
+	}
+	return http.StatusBadRequest, "protocol_error"
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeHTTPError(w http.ResponseWriter, status int, code, message string) {
+	var e httpError
+	e.Error.Code = code
+	e.Error.Message = message
+	writeJSON(w, status, e)
+}
+
+func httpRegisterStart(_ *http.Request, body []byte) (interface{}, error) {
+	msg1, err := opaque.DecodePwRegMsg1(body)
+	if err != nil {
+		return nil, badRequest{err}
+	}
+	id, msg2, err := pwRegStart(msg1, &credential{ID: defaultCredential, Kind: kindPassword}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return pwRegMsg2{PwRegMsg2: msg2, SessionID: id}, nil
+}
+
+func httpRegisterFinish(_ *http.Request, body []byte) (interface{}, error) {
+	var ref sessionRef
+	if err := json.Unmarshal(body, &ref); err != nil {
+		return nil, badRequest{err}
+	}
+	msg3, err := opaque.DecodePwRegMsg3(body)
+	if err != nil {
+		return nil, badRequest{err}
+	}
+	user, err := pwRegFinish(ref.SessionID, msg3)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("Added user: " + user.Username)
+	return loginResult{Username: user.Username}, nil
+}
+
+func httpLoginStart(_ *http.Request, body []byte) (interface{}, error) {
+	msg1, err := opaque.DecodeAuthMsg1(body)
+	if err != nil {
+		return nil, badRequest{err}
+	}
+	id, msg2, err := authStart(msg1)
+	if err != nil {
+		return nil, err
+	}
+	return authMsg2{AuthMsg2: msg2, SessionID: id}, nil
+}
+
+func httpLoginFinish(r *http.Request, body []byte) (interface{}, error) {
+	var msg3 struct {
+		sessionRef
+		opaque.AuthMsg3
+	}
+	if err := json.Unmarshal(body, &msg3); err != nil {
+		return nil, badRequest{err}
+	}
+	l, err := authFinish(msg3.SessionID, msg3.AuthMsg3, r.RemoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := opaque.AuthEnc(rand.Reader, opaque.ChannelKey(l.sk), []byte(l.token))
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("Authentication finished for " + l.username)
+	return loginResult{Username: l.username, Token: base64.StdEncoding.EncodeToString(ciphertext)}, nil
+}
+
+// introspection is the body of a /token/introspect response. Unlike a
+// Verifier built from the published key set, introspection also reports
+// whether the login the token was issued for is still active.
+type introspection struct {
+	Active bool
+	// Reason is set if Active is false.
+	Reason string        `json:",omitempty"`
+	Claims *token.Claims `json:",omitempty"`
+}
+
+func httpIntrospect(_ *http.Request, body []byte) (interface{}, error) {
+	var req struct {
+		Token string
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, badRequest{err}
+	}
+	v, err := token.NewVerifier(signer.KeySet())
+	if err != nil {
+		return nil, err
+	}
+	v.Check = logins.checkClaims
+	claims, err := v.Verify(req.Token)
+	if err != nil {
+		return introspection{Reason: err.Error()}, nil
+	}
+	return introspection{Active: true, Claims: claims}, nil
+}
@@ -0,0 +1,215 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"GoTcpServerWithOpaque/opaque"
+	"GoTcpServerWithOpaque/token"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// post sends v as JSON to path and decodes the response into res if the
+// status is 200 and into an httpError otherwise.
+func post(t *testing.T, srv *httptest.Server, path string, v, res interface{}) (int, httpError) {
+	t.Helper()
+	body, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(srv.URL+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var herr httpError
+	if resp.StatusCode != http.StatusOK {
+		res = &herr
+	}
+	if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+		t.Fatalf("%s: decoding response: %v", path, err)
+	}
+	return resp.StatusCode, herr
+}
+
+func registerHTTP(t *testing.T, srv *httptest.Server, username, password string) {
+	t.Helper()
+	sess, msg1, err := opaque.PwRegInit(username, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg2 pwRegMsg2
+	if status, herr := post(t, srv, "/register/start", msg1, &msg2); status != http.StatusOK {
+		t.Fatalf("/register/start: %d %+v", status, herr)
+	}
+	msg3, err := opaque.PwReg2(sess, msg2.PwRegMsg2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res loginResult
+	req := struct {
+		opaque.PwRegMsg3
+		sessionRef
+	}{msg3, sessionRef{msg2.SessionID}}
+	if status, herr := post(t, srv, "/register/finish", req, &res); status != http.StatusOK {
+		t.Fatalf("/register/finish: %d %+v", status, herr)
+	}
+	if res.Username != username {
+		t.Errorf("registered %q, want %q", res.Username, username)
+	}
+}
+
+// startLoginHTTP runs the first round of a login and returns the client
+// session and the server's reply.
+func startLoginHTTP(t *testing.T, srv *httptest.Server, username, password string) (*opaque.AuthClientSession, authMsg2) {
+	t.Helper()
+	sess, msg1, err := opaque.AuthInit(username, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg2 authMsg2
+	if status, herr := post(t, srv, "/login/start", msg1, &msg2); status != http.StatusOK {
+		t.Fatalf("/login/start: %d %+v", status, herr)
+	}
+	return sess, msg2
+}
+
+// checkHTTPToken decrypts the token from a /login/finish response and
+// verifies it with the key set served by srv.
+func checkHTTPToken(t *testing.T, srv *httptest.Server, encrypted string, sk []byte) {
+	t.Helper()
+	ciphertext, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := opaque.AuthDec(opaque.ChannelKey(sk), ciphertext)
+	if err != nil {
+		t.Fatalf("decrypting token: %v", err)
+	}
+	resp, err := http.Get(srv.URL + "/.well-known/jwks.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var ks token.KeySet
+	if err := json.NewDecoder(resp.Body).Decode(&ks); err != nil {
+		t.Fatal(err)
+	}
+	v, err := token.NewVerifier(ks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Verify(string(tok)); err != nil {
+		t.Errorf("token: %v", err)
+	}
+}
+
+type loginFinishReq struct {
+	opaque.AuthMsg3
+	sessionRef
+}
+
+func TestHTTPRegisterAndLogin(t *testing.T) {
+	srv := httptest.NewServer(newHTTPHandler())
+	defer srv.Close()
+	registerHTTP(t, srv, "http-user", "secret")
+
+	sess, msg2 := startLoginHTTP(t, srv, "http-user", "secret")
+	secret, msg3, err := opaque.Auth2(sess, msg2.AuthMsg2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res loginResult
+	req := loginFinishReq{msg3, sessionRef{msg2.SessionID}}
+	if status, herr := post(t, srv, "/login/finish", req, &res); status != http.StatusOK {
+		t.Fatalf("/login/finish: %d %+v", status, herr)
+	}
+	if res.Username != "http-user" {
+		t.Errorf("logged in as %q", res.Username)
+	}
+	checkHTTPToken(t, srv, res.Token, secret)
+
+	// The session can only be finished once.
+	status, herr := post(t, srv, "/login/finish", req, &res)
+	if status != http.StatusNotFound || herr.Error.Code != "unknown_session" {
+		t.Errorf("replayed /login/finish: %d %+v", status, herr)
+	}
+
+	// A user registered over HTTP can log in over TCP.
+	c := dial(t)
+	if _, err := c.Login("http-user", "secret"); err != nil {
+		t.Fatalf("TCP login: %v", err)
+	}
+	if err := c.serverErr(); err != nil {
+		t.Errorf("server: %v", err)
+	}
+}
+
+func TestHTTPErrors(t *testing.T) {
+	srv := httptest.NewServer(newHTTPHandler())
+	defer srv.Close()
+	registerHTTP(t, srv, "http-errors", "secret")
+
+	_, authMsg1, err := opaque.AuthInit("http-errors-unknown", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, regMsg2 := startLoginHTTP(t, srv, "http-errors", "secret")
+	_, pwRegMsg1, err := opaque.PwRegInit("http-errors-kind", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, takeover, err := opaque.PwRegInit("http-errors", "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pwReg pwRegMsg2
+	if status, herr := post(t, srv, "/register/start", pwRegMsg1, &pwReg); status != http.StatusOK {
+		t.Fatalf("/register/start: %d %+v", status, herr)
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		req    interface{}
+		status int
+		code   string
+	}{
+		{"malformed", "/login/start", map[string]string{"Username": "x"}, http.StatusBadRequest, "bad_request"},
+		{"existing account", "/register/start", takeover, http.StatusConflict, "account_exists"},
+		{"unknown session", "/login/finish", loginFinishReq{opaque.AuthMsg3{Mac2: "00"}, sessionRef{"nope"}}, http.StatusNotFound, "unknown_session"},
+		{"bad mac", "/login/finish", loginFinishReq{opaque.AuthMsg3{Mac2: "00"}, sessionRef{regMsg2.SessionID}}, http.StatusUnauthorized, "authentication_failed"},
+		{"wrong kind", "/login/finish", loginFinishReq{opaque.AuthMsg3{Mac2: "00"}, sessionRef{pwReg.SessionID}}, http.StatusConflict, "out_of_order"},
+	}
+	// An unknown user gets an answer, as a registered one does.
+	var unknown authMsg2
+	if status, herr := post(t, srv, "/login/start", authMsg1, &unknown); status != http.StatusOK {
+		t.Errorf("unknown user: got %d %+v, want %d", status, herr, http.StatusOK)
+	}
+	for _, tc := range tests {
+		var res interface{}
+		status, herr := post(t, srv, tc.path, tc.req, &res)
+		if status != tc.status || herr.Error.Code != tc.code {
+			t.Errorf("%s: got %d %q, want %d %q", tc.name, status, herr.Error.Code, tc.status, tc.code)
+		}
+		if herr.Error.Message == "" {
+			t.Errorf("%s: no error message", tc.name)
+		}
+	}
+
+	resp, err := http.Get(srv.URL + "/login/start")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET: status %d", resp.StatusCode)
+	}
+}
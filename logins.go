@@ -0,0 +1,251 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"GoTcpServerWithOpaque/token"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	errLoginRevoked  = errors.New("login revoked")
+	errLoginIdle     = errors.New("login timed out")
+	errLoginExpired  = errors.New("login expired")
+	errUnknownLogin  = errors.New("unknown login")
+	errTokenMismatch = errors.New("token was not issued for this login")
+)
+
+// login is a successful run of the authentication protocol.
+type login struct {
+	username string
+	// sessionID identifies the login. It is unrelated to the ID of the
+	// handshake that produced it.
+	sessionID string
+	sk        []byte
+	// token is the bearer token issued for the login and tokenID its ID.
+	token   string
+	tokenID string
+	// credID is the ID of the credential used for the login.
+	credID string
+	// vaultKey is the credential's VaultKey at the login, which a recovery
+	// login still needs after its credential is removed.
+	vaultKey []byte
+
+	// The fields below are set by loginRegistry and protected by its mutex.
+	remoteAddr string
+	created    time.Time
+	lastSeen   time.Time
+	revoked    bool
+}
+
+// loginInfo is the exported view of a login, used when listing logins.
+type loginInfo struct {
+	SessionID  string
+	Username   string
+	RemoteAddr string
+	TokenID    string
+	Credential string
+	Created    time.Time
+	LastSeen   time.Time
+	Revoked    bool
+}
+
+// loginRegistry records successful logins. A login ends when it is revoked,
+// when it has not been used for idle, or when it is older than maxAge.
+//
+// The registry is local to the server. With stateless logins (-session-key-file)
+// each server only knows the logins it finished.
+type loginRegistry struct {
+	mu        sync.Mutex
+	logins    map[string]*login
+	idle      time.Duration
+	maxAge    time.Duration
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func newLoginRegistry(idle, maxAge time.Duration) *loginRegistry {
+	return &loginRegistry{
+		logins: map[string]*login{},
+		idle:   idle,
+		maxAge: maxAge,
+		now:    time.Now,
+	}
+}
+
+// sweep removes logins that have ended by timing out. Revoked logins are
+// kept until then so that they are reported as revoked rather than unknown.
+// t.mu must be held.
+func (t *loginRegistry) sweep(now time.Time) {
+	for id, l := range t.logins {
+		if now.Sub(l.created) > t.maxAge || now.Sub(l.lastSeen) > t.idle {
+			delete(t.logins, id)
+		}
+	}
+	t.lastSweep = now
+}
+
+// add records l, which was finished from remoteAddr.
+func (t *loginRegistry) add(l *login, remoteAddr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	if now.Sub(t.lastSweep) > t.idle {
+		t.sweep(now)
+	}
+	l.remoteAddr = remoteAddr
+	l.created = now
+	l.lastSeen = now
+	t.logins[l.sessionID] = l
+}
+
+// check returns the login with the given session ID if it is still active.
+// t.mu must be held.
+func (t *loginRegistry) check(id string, now time.Time) (*login, error) {
+	l, ok := t.logins[id]
+	switch {
+	case !ok:
+		return nil, errUnknownLogin
+	case l.revoked:
+		return nil, errLoginRevoked
+	case now.Sub(l.created) > t.maxAge:
+		return nil, errLoginExpired
+	case now.Sub(l.lastSeen) > t.idle:
+		return nil, errLoginIdle
+	}
+	return l, nil
+}
+
+// touch checks that the login id is active and records that it was used.
+func (t *loginRegistry) touch(id string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	l, err := t.check(id, now)
+	if err != nil {
+		return err
+	}
+	l.lastSeen = now
+	return nil
+}
+
+// checkClaims is used as token.Verifier.Check. It rejects tokens for logins
+// that are no longer active and counts the use of a token as activity.
+func (t *loginRegistry) checkClaims(c *token.Claims) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	l, err := t.check(c.SessionID, now)
+	if err != nil {
+		return err
+	}
+	if l.tokenID != c.ID {
+		return errTokenMismatch
+	}
+	l.lastSeen = now
+	return nil
+}
+
+// list returns the logins of username, or all logins if username is empty,
+// oldest first.
+func (t *loginRegistry) list(username string) []loginInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	res := []loginInfo{}
+	for _, l := range t.logins {
+		if username != "" && l.username != username {
+			continue
+		}
+		res = append(res, loginInfo{
+			SessionID:  l.sessionID,
+			Username:   l.username,
+			RemoteAddr: l.remoteAddr,
+			TokenID:    l.tokenID,
+			Credential: l.credID,
+			Created:    l.created,
+			LastSeen:   l.lastSeen,
+			Revoked:    l.revoked,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if !res[i].Created.Equal(res[j].Created) {
+			return res[i].Created.Before(res[j].Created)
+		}
+		return res[i].SessionID < res[j].SessionID
+	})
+	return res
+}
+
+// revoke revokes the login id. If username is not empty the login must
+// belong to username.
+func (t *loginRegistry) revoke(id, username string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l, ok := t.logins[id]
+	if !ok || (username != "" && l.username != username) {
+		return errUnknownLogin
+	}
+	l.revoked = true
+	return nil
+}
+
+// revokeUser revokes all logins of username and returns how many were
+// revoked.
+func (t *loginRegistry) revokeUser(username string) int {
+	return t.revokeOthers(username, "")
+}
+
+// revokeOthers revokes the logins of username except the login keep and
+// returns how many were revoked.
+func (t *loginRegistry) revokeOthers(username, keep string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for id, l := range t.logins {
+		if l.username == username && id != keep && !l.revoked {
+			l.revoked = true
+			n++
+		}
+	}
+	return n
+}
+
+// handleLoginAdmin adds handlers for listing and revoking logins to mux. They
+// are served on the -debug address, which should not be reachable by users.
+//
+//	GET  /debug/logins?user=<username>     list logins, of all users if user is empty
+//	POST /debug/logins/revoke?id=<id>      revoke one login
+//	POST /debug/logins/revoke?user=<name>  revoke all logins of a user
+func handleLoginAdmin(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/logins", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(logins.list(r.FormValue("user")))
+	})
+	mux.HandleFunc("/debug/logins/revoke", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		switch id, user := r.FormValue("id"), r.FormValue("user"); {
+		case id != "":
+			if err := logins.revoke(id, ""); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			fmt.Fprintln(w, "revoked 1")
+		case user != "":
+			fmt.Fprintf(w, "revoked %d\n", logins.revokeUser(user))
+		default:
+			http.Error(w, "id or user required", http.StatusBadRequest)
+		}
+	})
+}
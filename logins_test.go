@@ -0,0 +1,151 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"GoTcpServerWithOpaque/client"
+	"GoTcpServerWithOpaque/token"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLoginRegistry(t *testing.T) {
+	reg := newLoginRegistry(time.Minute, time.Hour)
+	now := time.Unix(1e9, 0)
+	reg.now = func() time.Time { return now }
+
+	a1 := &login{username: "a", sessionID: "a1", tokenID: "t1"}
+	a2 := &login{username: "a", sessionID: "a2", tokenID: "t2"}
+	b1 := &login{username: "b", sessionID: "b1", tokenID: "t3"}
+	reg.add(a1, "addr-a1")
+	reg.add(a2, "addr-a2")
+	reg.add(b1, "addr-b1")
+
+	if got := reg.list("a"); len(got) != 2 || got[0].RemoteAddr != "addr-a1" {
+		t.Errorf("list(a) = %+v", got)
+	}
+	if got := reg.list(""); len(got) != 3 {
+		t.Errorf("list() has %d logins, want 3", len(got))
+	}
+
+	if err := reg.checkClaims(&token.Claims{SessionID: "a1", ID: "t2"}); err != errTokenMismatch {
+		t.Errorf("token of another login: got %v, want %v", err, errTokenMismatch)
+	}
+	if err := reg.revoke("a1", "b"); err != errUnknownLogin {
+		t.Errorf("revoking another user's login: got %v, want %v", err, errUnknownLogin)
+	}
+	if err := reg.revoke("a1", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.touch("a1"); err != errLoginRevoked {
+		t.Errorf("revoked: got %v, want %v", err, errLoginRevoked)
+	}
+	if err := reg.checkClaims(&token.Claims{SessionID: "a1", ID: "t1"}); err != errLoginRevoked {
+		t.Errorf("token of revoked login: got %v, want %v", err, errLoginRevoked)
+	}
+	if n := reg.revokeUser("a"); n != 1 {
+		t.Errorf("revokeUser revoked %d logins, want 1", n)
+	}
+
+	// b1 stays active as long as it is used.
+	for i := 0; i < 3; i++ {
+		now = now.Add(50 * time.Second)
+		if err := reg.touch("b1"); err != nil {
+			t.Fatalf("touch after %d: %v", i, err)
+		}
+	}
+	now = now.Add(2 * time.Minute)
+	if err := reg.touch("b1"); err != errLoginIdle {
+		t.Errorf("idle: got %v, want %v", err, errLoginIdle)
+	}
+
+	b2 := &login{username: "b", sessionID: "b2"}
+	reg.add(b2, "addr-b2")
+	for i := 0; i < 70; i++ {
+		now = now.Add(time.Minute - time.Second)
+		reg.touch("b2")
+	}
+	if err := reg.touch("b2"); err != errLoginExpired {
+		t.Errorf("max age: got %v, want %v", err, errLoginExpired)
+	}
+	if err := reg.touch("nope"); err != errUnknownLogin {
+		t.Errorf("unknown: got %v, want %v", err, errUnknownLogin)
+	}
+}
+
+// loginChannel logs in on a new connection and returns the connection,
+// which is then an encrypted channel.
+func loginChannel(t *testing.T, username, password string) (*testConn, *client.Session) {
+	t.Helper()
+	c := dial(t)
+	sess, err := c.Login(username, password)
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	return c, sess
+}
+
+func TestChannelRevocation(t *testing.T) {
+	register(t, "channel", "secret")
+	c1, sess1 := loginChannel(t, "channel", "secret")
+	c2, _ := loginChannel(t, "channel", "secret")
+
+	var pong string
+	if err := c1.Call("ping", nil, &pong); err != nil || pong != "pong" {
+		t.Fatalf("ping: %q, %v", pong, err)
+	}
+	var list []loginInfo
+	if err := c1.Call("logins", nil, &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("logins = %+v, want 2", list)
+	}
+	if err := c1.Call("no-such-command", nil, nil); err == nil {
+		t.Error("unknown command succeeded")
+	}
+
+	srv := httptest.NewServer(newHTTPHandler())
+	defer srv.Close()
+	var in introspection
+	if status, herr := post(t, srv, "/token/introspect", map[string]string{"Token": sess1.Token}, &in); status != http.StatusOK || !in.Active {
+		t.Fatalf("introspect: %d %+v %+v", status, herr, in)
+	}
+
+	// The second connection revokes the first login.
+	if err := c2.Call("revoke", sessionRef{SessionID: in.Claims.SessionID}, nil); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	if err := c1.Call("ping", nil, nil); err == nil {
+		t.Error("revoked login can still use the channel")
+	}
+	if err := c1.serverErr(); err != errLoginRevoked {
+		t.Errorf("server: got %v, want %v", err, errLoginRevoked)
+	}
+	in = introspection{}
+	post(t, srv, "/token/introspect", map[string]string{"Token": sess1.Token}, &in)
+	if in.Active || in.Reason != errLoginRevoked.Error() {
+		t.Errorf("introspect revoked: %+v", in)
+	}
+
+	if err := c2.Call("logout", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c2.Call("ping", nil, nil); err == nil {
+		t.Error("channel usable after logout")
+	}
+	c2.serverErr()
+}
+
+func TestChannelClosedByClient(t *testing.T) {
+	register(t, "channel-close", "secret")
+	c, _ := loginChannel(t, "channel-close", "secret")
+	if err := c.serverErr(); err != nil {
+		t.Errorf("server: %v", err)
+	}
+}
@@ -7,15 +7,26 @@ package main
 
 import (
 	"GoTcpServerWithOpaque/opaque"
+	"GoTcpServerWithOpaque/token"
 	"bufio"
+	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"expvar"
 	"flag"
 	"fmt"
 	"math/big"
 	"net"
+	"net/http"
 	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
 )
 
 
@@ -25,8 +36,103 @@ var privS opaque.ECPrivateKey
 var pubS opaque.ECPoint
 
 
-// Map usernames to users.
-var users = map[string]*opaque.User{}
+// pool runs PwReg and Auth1. It is created in main according to the flags.
+var pool *cryptoPool
+
+// sessions holds the handshakes that are waiting for their final message. It
+// is replaced in main according to the flags.
+var sessions = newSessionTable(time.Minute, 10000)
+
+// ephemerals holds pre-generated ephemeral keys for Auth1. It is nil unless
+// enabled with -ephemeral-pool.
+var ephemerals *opaque.EphemeralPool
+
+// sealer, if set, makes logins stateless: the server's half of an auth
+// handshake is sealed into the SessionID instead of being stored in sessions.
+// It is nil unless enabled with -session-key-file.
+var sealer *opaque.SessionSealer
+
+// logins records successful logins. It is replaced in main according to the
+// flags.
+var logins = newLoginRegistry(30*time.Minute, 12*time.Hour)
+
+// signer issues the tokens sent to clients after a successful login.
+var signer *token.Signer
+
+// oprfSeed, if set, is the seed the OPRF keys of new registrations are
+// derived from. It is nil unless enabled with -user-oprf-seed-file.
+var oprfSeed []byte
+
+// fakeUserSeed is the seed of the fake users that logins for unknown users
+// are answered with, see opaque.FakeUser. It is set in main.
+var fakeUserSeed []byte
+
+// serverIdentity and usernameIdentity select the identities that logins are
+// bound to, see opaque.Identities. serverIdentity is nil and usernameIdentity
+// false unless set with -server-identity and -client-identity, and the
+// public keys are used.
+var (
+	serverIdentity   []byte
+	usernameIdentity bool
+)
+
+// loginIdentities returns the identities of a login of username.
+func loginIdentities(username string) opaque.Identities {
+	ids := opaque.Identities{Server: serverIdentity}
+	if usernameIdentity {
+		ids.Client = []byte(username)
+	}
+	return ids
+}
+
+// initServerKey generates the server's EC key pair.
+func initServerKey() error {
+	sk, x, y, err := elliptic.GenerateKey(p256, rand.Reader)
+	if err != nil {
+		return err
+	}
+	privS = opaque.ECPrivateKey{PrivateKeyBytes: sk}
+	pubS = opaque.ECPoint{X: x, Y: y}
+	return nil
+}
+
+// readKeyFile returns the hex-encoded key in the file keyFile.
+func readKeyFile(keyFile string) ([]byte, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", keyFile, err)
+	}
+	return key, nil
+}
+
+// newTokenSigner returns a token signer using the EC private key in the PEM
+// file keyFile, or a newly generated key if keyFile is empty.
+func newTokenSigner(keyFile string, ttl time.Duration) (*token.Signer, error) {
+	if keyFile == "" {
+		key, err := ecdsa.GenerateKey(p256, rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return token.NewSigner(key, ttl)
+	}
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", keyFile)
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", keyFile, err)
+	}
+	return token.NewSigner(key, ttl)
+}
 
 func main() {
 	fmt.Println("Start server...")
@@ -35,18 +141,200 @@ func main() {
 		flag.PrintDefaults()
 	}
 	addr := flag.String("l", ":9999", "Address to listen on.")
+	workers := flag.Int("workers", runtime.NumCPU(), "Number of workers for OPRF and AKE computations.")
+	queueLen := flag.Int("queue", 4*runtime.NumCPU(), "Number of computations that may wait for a worker before clients are told the server is busy.")
+	debugAddr := flag.String("debug", "", "If set, serve metrics at http://<debug>/debug/vars and login administration at http://<debug>/debug/logins.")
+	sessionTTL := flag.Duration("session-ttl", time.Minute, "Time a client has to send the final message of a handshake.")
+	maxSessions := flag.Int("max-sessions", 10000, "Maximum number of handshakes in progress.")
+	ephemeralPool := flag.Int("ephemeral-pool", 0, "Number of ephemeral key pairs to generate ahead of time for logins. 0 disables the pool.")
+	sessionKeyFile := flag.String("session-key-file", "", "File with a hex-encoded key of at least 32 bytes. If set, logins are stateless: the server's handshake state is sealed with a key derived from this one and returned to the client as the SessionID. Servers sharing the key can finish each other's logins.")
+	replayDir := flag.String("replay-dir", "", "Directory that records the login states opened with -session-key-file, so that each can only be used once. Servers sharing the key must share the directory, for example over a network file system, or a login state can be replayed on another server. If not set, each server remembers them in memory.")
+	sessionKeyPeriod := flag.Duration("session-key-period", time.Hour, "How often the key used to seal login state rotates. Must be at least -session-ttl.")
+	tokenKeyFile := flag.String("token-key-file", "", "PEM file with the P-256 key that signs tokens. If not set a new key is generated at startup.")
+	tokenTTL := flag.Duration("token-ttl", 15*time.Minute, "Lifetime of the tokens issued after a login.")
+	loginIdle := flag.Duration("login-idle", 30*time.Minute, "A login ends if it is not used for this long.")
+	loginMaxAge := flag.Duration("login-max-age", 12*time.Hour, "A login ends this long after it started.")
+	httpAddr := flag.String("http", "", "If set, also serve the protocol as JSON over HTTP at this address.")
+	wsAddr := flag.String("ws", "", "If set, also serve the protocol over WebSocket at ws://<ws>/.")
+	oprfKeyFile := flag.String("oprf-key-file", "", "File with a hex-encoded seed of at least 32 bytes. If set, the oprf command evaluates the OPRF under keys derived from the seed.")
+	oprfKeySpec := flag.String("oprf-keys", "default", "Comma separated names of the keys of the oprf command. A name may be followed by :rate or :rate:burst to override -oprf-rate and -oprf-burst for that key.")
+	oprfRate := flag.Float64("oprf-rate", 10, "Number of elements per second that the oprf command evaluates for each account under each key.")
+	oprfBurst := flag.Int("oprf-burst", opaque.MaxOprfBatch, "Number of elements that the oprf command evaluates for an account under a key in a burst. Batches larger than this are always rejected.")
+	privacyPassKeyFile := flag.String("privacypass-key-file", "", "File with a hex-encoded seed of at least 32 bytes. If set, logged-in users can obtain anonymous tokens issued with a key derived from the seed, and the HTTP server redeems them.")
+	privacyPassIssuer := flag.String("privacypass-issuer", "localhost", "Issuer name of the anonymous tokens, the IssuerName of the challenges they are made for.")
+	privacyPassKeyPeriod := flag.Duration("privacypass-key-period", 30*24*time.Hour, "How often the key of the anonymous tokens changes. Tokens can be redeemed until the end of the period after the one they were issued in.")
+	privacyPassSpentDir := flag.String("privacypass-spent-dir", "", "Directory that records redeemed anonymous tokens, so that each can only be redeemed once. Servers redeeming tokens of the same issuer must share the directory. If not set, the server remembers them in memory, and forgets them when restarted.")
+	privacyPassRate := flag.Float64("privacypass-rate", 100, "Number of anonymous tokens per hour that each user can obtain.")
+	privacyPassBurst := flag.Int("privacypass-burst", 2*opaque.MaxOprfBatch, "Number of anonymous tokens that a user can obtain in a burst.")
+	breachFile := flag.String("breach-file", "", "Breach list computed by cmd/breach-set from a file of breached passwords. If set, clients can check passwords against it with the breach-check command without revealing them.")
+	breachKeyFile := flag.String("breach-key-file", "", "File with the hex-encoded seed that the -breach-file was computed with.")
+	breachPrefixBits := flag.Int("breach-prefix-bits", 16, "Number of bits of a password's OPRF output that a client reveals to get the bucket of breached passwords to check it against.")
+	breachRate := flag.Float64("breach-rate", 100, "Number of passwords per second that the breach-check command checks, over all clients.")
+	breachBurst := flag.Int("breach-burst", 100, "Number of passwords that the breach-check command checks in a burst.")
+	userOprfSeedFile := flag.String("user-oprf-seed-file", "", "File with a hex-encoded seed of at least 32 bytes. If set, the OPRF keys of new registrations are derived from the seed instead of being stored, and the answers to logins for unknown users stay the same across restarts. Servers sharing the seed can share the account store.")
+	oprfShareFile := flag.String("oprf-share-file", "", "JSON file with this server's share of a threshold OPRF key, as written by cmd/oprf-split. If set, partial evaluations are answered at -oprf-share-addr.")
+	oprfShareAddr := flag.String("oprf-share-addr", "127.0.0.1:9998", "Address to answer partial evaluations on. Only coordinators should be able to reach it.")
+	oprfShareRate := flag.Float64("oprf-share-rate", 10, "Number of partial evaluations per minute that the share holder answers for each credential.")
+	oprfShareBurst := flag.Int("oprf-share-burst", 10, "Number of partial evaluations that the share holder answers for each credential in a burst.")
+	thresholdConfigFile := flag.String("threshold-config", "", "JSON file listing the share holders of a threshold OPRF key, as written by cmd/oprf-split. If set, the OPRF keys of new registrations are shared among them.")
+	thresholdTimeout := flag.Duration("threshold-timeout", 2*time.Second, "Time to wait for the share holders.")
+	serverID := flag.String("server-identity", "", "Identity of the server that logins are bound to, for example its host name. Clients must use the same. If not set, the server's public key is used.")
+	clientID := flag.String("client-identity", "pubkey", "Identity of the client that logins are bound to: pubkey for the public key registered by the client or username for the username. Clients must use the same.")
+	vaultMaxBlobs := flag.Int("vault-max-blobs", vaultQuota.Blobs, "Number of blobs that each user can store in the vault.")
+	vaultMaxBytes := flag.Int("vault-max-bytes", vaultQuota.Bytes, "Total size in bytes of the blobs that each user can store in the vault.")
 	flag.Parse()
 
-	var err error
-	var sk []byte
-	var x, y *big.Int
-	sk, x, y, err = elliptic.GenerateKey(p256, rand.Reader)
-	privS = opaque.ECPrivateKey{PrivateKeyBytes: sk}
-	pubS = opaque.ECPoint{X: x, Y: y}
+	if *serverID != "" {
+		serverIdentity = []byte(*serverID)
+	}
+	switch *clientID {
+	case "pubkey":
+	case "username":
+		usernameIdentity = true
+	default:
+		fmt.Fprintf(os.Stderr, "-client-identity must be pubkey or username\n")
+		os.Exit(1)
+	}
+	vaultQuota = blobQuota{Blobs: *vaultMaxBlobs, Bytes: *vaultMaxBytes}
+	if *ephemeralPool > 0 {
+		ephemerals = opaque.NewEphemeralPool(*ephemeralPool)
+		defer ephemerals.Close()
+		expvar.Publish("ephemeral_pool", expvar.Func(func() interface{} {
+			hits, misses := ephemerals.Stats()
+			return map[string]int64{"hits": hits, "misses": misses}
+		}))
+	}
 
+	pool = newCryptoPool(*workers, *queueLen)
+	defer pool.close()
+	sessions = newSessionTable(*sessionTTL, *maxSessions)
+	logins = newLoginRegistry(*loginIdle, *loginMaxAge)
+	if *sessionKeyFile != "" {
+		var err error
+		sealer, err = newSealer(*sessionKeyFile, *replayDir, *sessionKeyPeriod, *sessionTTL)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *userOprfSeedFile != "" {
+		var err error
+		oprfSeed, err = readKeyFile(*userOprfSeedFile)
+		if err == nil && len(oprfSeed) < opaque.MinOprfSeedLength {
+			err = fmt.Errorf("%s: seed is %d bytes, need at least %d", *userOprfSeedFile, len(oprfSeed), opaque.MinOprfSeedLength)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	}
+	seed, err := newFakeUserSeed(oprfSeed)
 	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	fakeUserSeed = seed
+	if *oprfShareFile != "" {
+		share, err := readKeyShare(*oprfShareFile)
+		var holder *shareHolder
+		if err == nil {
+			holder, err = newShareHolder(share, *oprfShareRate, *oprfShareBurst)
+		}
+		var ln net.Listener
+		if err == nil {
+			ln, err = net.Listen("tcp", *oprfShareAddr)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		go func() {
+			fmt.Fprintf(os.Stderr, "share holder: %v\n", serveKeyShare(ln, holder))
+		}()
+	}
+	if *thresholdConfigFile != "" {
+		cfg, err := readThresholdConfig(*thresholdConfigFile)
+		if err == nil && oprfSeed != nil {
+			err = fmt.Errorf("-threshold-config and -user-oprf-seed-file cannot be used together")
+		}
+		if err == nil {
+			thresholdKey, err = newThresholdOprf(cfg, *thresholdTimeout)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *oprfKeyFile != "" {
+		seed, err := readKeyFile(*oprfKeyFile)
+		if err == nil {
+			oprfKeys, err = newOprfKeyring(seed, *oprfKeySpec, *oprfRate, *oprfBurst)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		expvar.Publish("oprf", expvar.Func(func() interface{} { return oprfKeys.metrics() }))
+	}
+	if *breachFile != "" {
+		if *breachKeyFile == "" {
+			fmt.Fprintf(os.Stderr, "-breach-file needs -breach-key-file\n")
+			os.Exit(1)
+		}
+		seed, err := readKeyFile(*breachKeyFile)
+		var f *os.File
+		if err == nil {
+			f, err = os.Open(*breachFile)
+		}
+		if err == nil {
+			breachList, err = newBreachChecker(seed, f, *breachPrefixBits, *breachRate, *breachBurst)
+			f.Close()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Loaded %d breached passwords\n", breachList.set.Len())
+		expvar.Publish("breach", expvar.Func(func() interface{} { return breachList.metrics() }))
+	}
+	if *privacyPassKeyFile != "" {
+		seed, err := readKeyFile(*privacyPassKeyFile)
+		if err == nil {
+			tokenIssuer, err = newTokenIssuance(*privacyPassIssuer, seed, *privacyPassKeyPeriod, *privacyPassSpentDir, *privacyPassRate, *privacyPassBurst)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		expvar.Publish("privacypass", expvar.Func(func() interface{} { return tokenIssuer.metrics() }))
+	}
+	publishPoolMetrics()
+	if *debugAddr != "" {
+		handleLoginAdmin(http.DefaultServeMux)
+		go func() {
+			fmt.Fprintf(os.Stderr, "debug server: %v\n", http.ListenAndServe(*debugAddr, nil))
+		}()
+	}
+
+	if err := initServerKey(); err != nil {
 		panic(err)
 	}
+	signer, err = newTokenSigner(*tokenKeyFile, *tokenTTL)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	if *httpAddr != "" {
+		go func() {
+			fmt.Fprintf(os.Stderr, "http server: %v\n", http.ListenAndServe(*httpAddr, newHTTPHandler()))
+		}()
+	}
+	if *wsAddr != "" {
+		go func() {
+			fmt.Fprintf(os.Stderr, "websocket server: %v\n", http.ListenAndServe(*wsAddr, newWSHandler()))
+		}()
+	}
 
 	ln, err := net.Listen("tcp", *addr)
 	if err != nil {
@@ -66,9 +354,9 @@ func main() {
 
 func handleConn(conn net.Conn) {
 	defer conn.Close()
-	fmt.Println("Got connection from %s", conn.RemoteAddr())
+	fmt.Printf("Got connection from %s\n", conn.RemoteAddr())
 	if err := doHandleConn(conn); err != nil {
-		fmt.Println("Error happened in handleConn: %s\n", err)
+		fmt.Printf("Error happened in handleConn: %s\n", err)
 	}
 }
 
@@ -86,16 +374,66 @@ func doHandleConn(conn net.Conn) error {
 		if err := handlePwReg(r, w); err != nil {
 			return fmt.Errorf("pwreg: %s", err)
 		}
-	case "auth":
-		if err := handleAuth(r, w); err != nil {
-			return fmt.Errorf("auth: %s", err)
+	case "auth", "auth-token":
+		l, err := handleAuth(r, w, conn.RemoteAddr().String(), string(cmd) == "auth-token")
+		if err != nil {
+			return fmt.Errorf("%s: %s", cmd, err)
+		}
+		return serveChannel(conn, r, w, l)
+	case "pwreg-finish":
+		if err := handlePwRegFinish(r, w); err != nil {
+			return fmt.Errorf("pwreg-finish: %s", err)
+		}
+	case "breach-check":
+		if err := handleBreachCheck(r, w); err != nil {
+			return fmt.Errorf("breach-check: %s", err)
+		}
+	case "auth-finish", "auth-finish-token":
+		l, err := handleAuthFinish(r, w, conn.RemoteAddr().String(), string(cmd) == "auth-finish-token")
+		if err != nil {
+			return fmt.Errorf("%s: %s", cmd, err)
 		}
+		return serveChannel(conn, r, w, l)
 	default:
 		return fmt.Errorf("Unknown command '%s'\n", string(cmd))
 	}
 	return nil
 }
 
+// auth1 runs opaque.Auth1, taking the ephemeral key from the pool if one is
+// configured.
+func auth1(user *opaque.User, msg1 opaque.AuthMsg1) (*opaque.AuthServerSession, opaque.AuthMsg2, error) {
+	if ephemerals == nil {
+		return opaque.Auth1(&privS, user, msg1)
+	}
+	eph, err := ephemerals.Get()
+	if err != nil {
+		return nil, opaque.AuthMsg2{}, err
+	}
+	return opaque.Auth1WithEphemeral(&privS, user, msg1, eph)
+}
+
+// auth1Evaluated is like auth1 for a user whose OPRF evaluation b was
+// computed by the share holders, with the proof proof if msg1 asks for one.
+func auth1Evaluated(user *opaque.User, msg1 opaque.AuthMsg1, b *opaque.ECPoint, proof string) (*opaque.AuthServerSession, opaque.AuthMsg2, error) {
+	var eph *opaque.ServerEphemeral
+	if ephemerals != nil {
+		var err error
+		if eph, err = ephemerals.Get(); err != nil {
+			return nil, opaque.AuthMsg2{}, err
+		}
+	}
+	return opaque.Auth1Evaluated(&privS, user, msg1, eph, b, proof)
+}
+
+// writeBusy tells the client that the server is busy and returns err.
+func writeBusy(w *bufio.Writer, err error) error {
+	if err := opaque.Write(w, []byte("Server busy")); err != nil {
+		return err
+	}
+	return err
+}
+
 type BigInt struct {
 	big.Int
 }
@@ -112,16 +450,40 @@ func (i *BigInt) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
-func handleAuth(r *bufio.Reader, w *bufio.Writer) error {
+// authMsg2 is an AuthMsg2 together with the ID of the handshake. The ID is
+// needed to send the AuthMsg3 on another connection with "auth-finish".
+type authMsg2 struct {
+	opaque.AuthMsg2
+	SessionID string
+}
+
+// pwRegMsg2 is a PwRegMsg2 together with the ID of the handshake. The ID is
+// needed to send the PwRegMsg3 on another connection with "pwreg-finish".
+type pwRegMsg2 struct {
+	opaque.PwRegMsg2
+	SessionID string
+}
+
+// sessionRef is the part of an "auth-finish" or "pwreg-finish" message that
+// selects the handshake. The rest of the message is an AuthMsg3 or a
+// PwRegMsg3.
+type sessionRef struct {
+	SessionID string
+}
+
+// handleAuth handles the "auth" and "auth-token" commands. With "auth-token"
+// the server sends the login's token after "ok"; "auth" is kept as it was for
+// clients that do not expect the token.
+func handleAuth(r *bufio.Reader, w *bufio.Writer, remoteAddr string, withToken bool) (*login, error) {
 	fmt.Println("Start client authentication...")
 	data1, err := opaque.Read(r)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	var msg1 opaque.AuthMsg1
-	if err := json.Unmarshal([]byte(opaque.RemoveQuotesFromJson(string(data1))), &msg1); err != nil {
-		return err
+	msg1, err := opaque.DecodeAuthMsg1(data1)
+	if err != nil {
+		return nil, err
 	}
 
 	fmt.Println("Got data from client #1:")
@@ -138,29 +500,22 @@ func handleAuth(r *bufio.Reader, w *bufio.Writer) error {
 	fmt.Println(msg1.NonceU)
 	fmt.Println("====================================")
 
-
-	user, ok := users[msg1.Username]
-	if !ok {
-		if err := opaque.Write(w, []byte("No such user")); err != nil {
-			return err
-		}
-		return fmt.Errorf("No such user")
-	}
-
-	fmt.Println("User with username " + msg1.Username + " is found." )
-
 	fmt.Println("Start calculating B for OPRF and common secret...")
 
-	session, msg2, err := opaque.Auth1(&privS, user, msg1)
-	if err != nil {
-		return err
+	id, msg2, err := authStart(msg1)
+	switch err {
+	case nil:
+	case errBusy:
+		return nil, writeBusy(w, err)
+	default:
+		return nil, err
 	}
 
 	fmt.Println("Finished calculating B for OPRF and common secret...")
 
-	data2, err := json.Marshal(msg2)
+	data2, err := json.Marshal(authMsg2{AuthMsg2: msg2, SessionID: id})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	fmt.Println("====================================")
@@ -181,7 +536,7 @@ func handleAuth(r *bufio.Reader, w *bufio.Writer) error {
 	fmt.Println("====================================")
 
 	if err := opaque.Write(w, data2); err != nil {
-		return err
+		return nil, err
 	}
 
 	fmt.Println("Sent data to Client")
@@ -189,11 +544,30 @@ func handleAuth(r *bufio.Reader, w *bufio.Writer) error {
 
 	data3, err := opaque.Read(r)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return finishAuth(w, id, data3, remoteAddr, withToken)
+}
+
+// handleAuthFinish handles the "auth-finish" and "auth-finish-token"
+// commands, which carry the AuthMsg3 of a handshake started on another
+// connection. They differ like "auth" and "auth-token".
+func handleAuthFinish(r *bufio.Reader, w *bufio.Writer, remoteAddr string, withToken bool) (*login, error) {
+	data3, err := opaque.Read(r)
+	if err != nil {
+		return nil, err
 	}
+	var ref sessionRef
+	if err := json.Unmarshal(data3, &ref); err != nil {
+		return nil, err
+	}
+	return finishAuth(w, ref.SessionID, data3, remoteAddr, withToken)
+}
+
+func finishAuth(w *bufio.Writer, id string, data3 []byte, remoteAddr string, withToken bool) (*login, error) {
 	var msg3 opaque.AuthMsg3
 	if err := json.Unmarshal(data3, &msg3); err != nil {
-		return err
+		return nil, err
 	}
 
 	fmt.Println("====================================")
@@ -203,22 +577,29 @@ func handleAuth(r *bufio.Reader, w *bufio.Writer) error {
 	fmt.Println(msg3.Mac2)
 	fmt.Println("====================================")
 
-	sharedSecret, err := opaque.Auth3(session, msg3)
+	l, err := authFinish(id, msg3, remoteAddr)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	fmt.Println("Verified Mac2 from Client succesfully!")
 
 	if err := opaque.Write(w, []byte("ok")); err != nil {
-		return err
+		return nil, err
+	}
+	// The token follows "ok" if the client asked for it, encrypted with
+	// the session key.
+	if withToken {
+		if err := opaque.EncryptAndWrite(w, opaque.ChannelKey(l.sk), l.token); err != nil {
+			return nil, err
+		}
 	}
 
 	fmt.Println("Authentication finished!")
 
 	fmt.Println("Session key:")
-	fmt.Println(string(sharedSecret))
-	return nil
+	fmt.Println(string(l.sk))
+	return l, nil
 }
 
 func handlePwReg(r *bufio.Reader, w *bufio.Writer) error {
@@ -227,9 +608,8 @@ func handlePwReg(r *bufio.Reader, w *bufio.Writer) error {
 	if err != nil {
 		return err
 	}
-	var msg1 opaque.PwRegMsg1
-
-	if err := json.Unmarshal([]byte(opaque.RemoveQuotesFromJson(string(data1))), &msg1); err != nil {
+	msg1, err := opaque.DecodePwRegMsg1(data1)
+	if err != nil {
 		return err
 	}
 
@@ -244,7 +624,19 @@ func handlePwReg(r *bufio.Reader, w *bufio.Writer) error {
 
 	fmt.Println("Start calculating B for OPRF...")
 
-	session, msg2, err := opaque.PwReg(&pubS, msg1)
+	id, msg2, err := pwRegStart(msg1, &credential{ID: defaultCredential, Kind: kindPassword}, nil)
+	if err == errBusy {
+		return writeBusy(w, err)
+	}
+	if err == errAccountExists {
+		if err := opaque.Write(w, []byte("Account exists")); err != nil {
+			return err
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
 
 	fmt.Println("Finished calculating B for OPRF...")
 
@@ -258,11 +650,7 @@ func handlePwReg(r *bufio.Reader, w *bufio.Writer) error {
 	fmt.Println("Y: "+ msg2.B.Y)
 	fmt.Println("====================================")
 
-	if err != nil {
-		return err
-	}
-
-	data2, err := json.Marshal(msg2)
+	data2, err := json.Marshal(pwRegMsg2{PwRegMsg2: msg2, SessionID: id})
 
 	if err != nil {
 		return err
@@ -277,10 +665,32 @@ func handlePwReg(r *bufio.Reader, w *bufio.Writer) error {
 	if err != nil {
 		return err
 	}
+	return finishPwReg(w, id, data3)
+}
 
+// handlePwRegFinish handles the "pwreg-finish" command, which carries the
+// PwRegMsg3 of a registration started on another connection.
+func handlePwRegFinish(r *bufio.Reader, w *bufio.Writer) error {
+	data3, err := opaque.Read(r)
+	if err != nil {
+		return err
+	}
+	var ref sessionRef
+	if err := json.Unmarshal(data3, &ref); err != nil {
+		return err
+	}
+	return finishPwReg(w, ref.SessionID, data3)
+}
+
+func finishPwReg(w *bufio.Writer, id string, data3 []byte) error {
 	fmt.Println(string(data3))
-	var msg3 opaque.PwRegMsg3
-	if err := json.Unmarshal([]byte(opaque.RemoveQuotesFromJson(string(data3))), &msg3); err != nil {
+	msg3, err := opaque.DecodePwRegMsg3(data3)
+	if err != nil {
+		return err
+	}
+
+	user, err := pwRegFinish(id, msg3)
+	if err != nil {
 		return err
 	}
 
@@ -293,17 +703,15 @@ func handlePwReg(r *bufio.Reader, w *bufio.Writer) error {
 	fmt.Println("X: " + msg3.EnvU)
 	fmt.Println("====================================")
 
-	user := opaque.PwReg3(session, msg3)
 	if err := opaque.Write(w, []byte("Msg from Server: Registration finished!")); err != nil {
 		return err
 	}
 	fmt.Println("Added user: " + user.Username)
-	users[user.Username] = user
 
-	fmt.Println("Number of users = " + string(len(users)))
+	fmt.Println("Number of users = " + strconv.Itoa(accounts.Len()))
 
 	fmt.Println("Registration finished!")
-	fmt.Println("======================================= \n")
+	fmt.Println("=======================================")
 
 	return nil
 }
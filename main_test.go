@@ -0,0 +1,530 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"GoTcpServerWithOpaque/client"
+	"GoTcpServerWithOpaque/opaque"
+	"GoTcpServerWithOpaque/token"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	if err := initServerKey(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	var err error
+	signer, err = newTokenSigner("", time.Minute)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if fakeUserSeed, err = newFakeUserSeed(nil); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	// Leave room for the concurrent tests below.
+	pool = newCryptoPool(runtime.NumCPU(), 64)
+	code := m.Run()
+	pool.close()
+	os.Exit(code)
+}
+
+// testConn is the client end of a connection to an in-process server. Tests
+// either use the embedded client.Conn or write raw frames with r, w, read and
+// write, but not both on the same connection.
+type testConn struct {
+	*client.Conn
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+	// done receives the error returned by doHandleConn.
+	done chan error
+}
+
+func dial(t *testing.T) *testConn {
+	t.Helper()
+	clientEnd, server := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := doHandleConn(server)
+		server.Close()
+		done <- err
+	}()
+	c := &testConn{
+		Conn: client.NewConn(clientEnd),
+		conn: clientEnd,
+		r:    bufio.NewReader(clientEnd),
+		w:    bufio.NewWriter(clientEnd),
+		done: done,
+	}
+	t.Cleanup(func() { clientEnd.Close() })
+	return c
+}
+
+func (c *testConn) write(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return opaque.Write(c.w, data)
+}
+
+func (c *testConn) read(v interface{}) error {
+	data, err := opaque.Read(c.r)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// serverErr closes the client end and returns the error from the server.
+func (c *testConn) serverErr() error {
+	c.conn.Close()
+	return <-c.done
+}
+
+func register(t *testing.T, username, password string) {
+	t.Helper()
+	c := dial(t)
+	if err := c.Register(username, password); err != nil {
+		t.Fatalf("register %s: %v", username, err)
+	}
+	if err := c.serverErr(); err != nil {
+		t.Fatalf("register %s: server: %v", username, err)
+	}
+}
+
+// changePassword logs in as username and replaces the default credential
+// with one for password.
+func changePassword(t *testing.T, username, old, password string) {
+	t.Helper()
+	c := dial(t)
+	if _, err := c.Login(username, old); err != nil {
+		t.Fatalf("login %s: %v", username, err)
+	}
+	if err := c.AddCredential("default", client.KindPassword, password); err != nil {
+		t.Fatalf("change password of %s: %v", username, err)
+	}
+	c.conn.Close()
+	c.serverErr()
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	register(t, "reg-login", "secret")
+
+	c := dial(t)
+	sess, err := c.Login("reg-login", "secret")
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if err := c.serverErr(); err != nil {
+		t.Errorf("server: %v", err)
+	}
+
+	v, err := token.NewVerifier(signer.KeySet())
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := v.Verify(sess.Token)
+	if err != nil {
+		t.Fatalf("token: %v", err)
+	}
+	if claims.Subject != "reg-login" || claims.Binding != token.Binding(sess.Key) || claims.SessionID == "" {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+}
+
+func TestVerifiableLogin(t *testing.T) {
+	c := dial(t)
+	if err := c.Register("verifiable", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	c.serverErr()
+	oprfKey := c.OPRFKey
+	if oprfKey == nil {
+		t.Fatal("Register did not set OPRFKey")
+	}
+
+	c = dial(t)
+	c.OPRFKey = oprfKey
+	if _, err := c.Login("verifiable", "secret"); err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	c.serverErr()
+
+	// Changing the password gives the account a new OPRF key, which a
+	// client that pinned the old one rejects.
+	changePassword(t, "verifiable", "secret", "secret")
+	c = dial(t)
+	c.OPRFKey = oprfKey
+	if _, err := c.Login("verifiable", "secret"); err != opaque.InvalidProof {
+		t.Errorf("login with new key: got %v, want %v", err, opaque.InvalidProof)
+	}
+	c.serverErr()
+}
+
+func TestLoginExportKey(t *testing.T) {
+	c := dial(t)
+	if err := c.Register("export-key", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	c.serverErr()
+	if len(c.ExportKey) != 32 {
+		t.Fatalf("Register set ExportKey %x", c.ExportKey)
+	}
+	for i := 0; i < 2; i++ {
+		lc := dial(t)
+		sess, err := lc.Login("export-key", "secret")
+		if err != nil {
+			t.Fatalf("login: %v", err)
+		}
+		lc.serverErr()
+		if !bytes.Equal(sess.ExportKey, c.ExportKey) || bytes.Equal(sess.ExportKey, sess.Key) {
+			t.Errorf("login %d: export key %x, registered %x, session key %x", i, sess.ExportKey, c.ExportKey, sess.Key)
+		}
+	}
+}
+
+func TestLoginIdentities(t *testing.T) {
+	defer func(id []byte, u bool) { serverIdentity, usernameIdentity = id, u }(serverIdentity, usernameIdentity)
+	serverIdentity, usernameIdentity = []byte("example.com"), true
+	register(t, "identities", "secret")
+
+	c := dial(t)
+	c.Identities = opaque.Identities{Server: []byte("example.com"), Client: []byte("identities")}
+	if _, err := c.Login("identities", "secret"); err != nil {
+		t.Errorf("login: %v", err)
+	}
+	c.serverErr()
+
+	c = dial(t)
+	if _, err := c.Login("identities", "secret"); err != opaque.MacMismatch {
+		t.Errorf("login with the public keys as identities: got %v, want %v", err, opaque.MacMismatch)
+	}
+	c.serverErr()
+}
+
+func TestLoginEphemeralPool(t *testing.T) {
+	register(t, "ephemeral-pool", "secret")
+	ephemerals = opaque.NewEphemeralPool(4)
+	defer func() {
+		ephemerals.Close()
+		ephemerals = nil
+	}()
+
+	for i := 0; i < 3; i++ {
+		c := dial(t)
+		if _, err := c.Login("ephemeral-pool", "secret"); err != nil {
+			t.Fatalf("login: %v", err)
+		}
+		if err := c.serverErr(); err != nil {
+			t.Errorf("server: %v", err)
+		}
+	}
+	if hits, misses := ephemerals.Stats(); hits+misses != 3 {
+		t.Errorf("pool used %d times, want 3", hits+misses)
+	}
+}
+
+func TestLoginWrongPassword(t *testing.T) {
+	register(t, "wrong-pw", "secret")
+
+	c := dial(t)
+	if _, err := c.Login("wrong-pw", "guess"); err != opaque.AuthtagMismatch {
+		t.Errorf("login: got %v, want %v", err, opaque.AuthtagMismatch)
+	}
+	if err := c.serverErr(); err == nil {
+		t.Error("server reported success for an aborted login")
+	}
+}
+
+func TestLoginUnknownUser(t *testing.T) {
+	// An unknown user looks like a wrong password.
+	c := dial(t)
+	if _, err := c.Login("no-such-user", "secret"); err != opaque.AuthtagMismatch {
+		t.Errorf("login: got %v, want %v", err, opaque.AuthtagMismatch)
+	}
+	if err := c.serverErr(); err == nil {
+		t.Error("server reported success for unknown user")
+	}
+}
+
+func TestLoginBadMac2(t *testing.T) {
+	register(t, "bad-mac2", "secret")
+
+	c := dial(t)
+	if err := opaque.Write(c.w, []byte("auth")); err != nil {
+		t.Fatal(err)
+	}
+	_, msg1, err := opaque.AuthInit("bad-mac2", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.write(msg1); err != nil {
+		t.Fatal(err)
+	}
+	var msg2 opaque.AuthMsg2
+	if err := c.read(&msg2); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.write(opaque.AuthMsg3{Mac2: msg2.Mac1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.serverErr(); err == nil {
+		t.Error("server accepted a forged Mac2")
+	}
+}
+
+func TestLoginWithoutToken(t *testing.T) {
+	register(t, "no-token", "secret")
+
+	// A client that sends "auth" gets "ok" and then the channel, without
+	// the token that "auth-token" asks for.
+	c := dial(t)
+	if err := opaque.Write(c.w, []byte("auth")); err != nil {
+		t.Fatal(err)
+	}
+	sess, msg1, err := opaque.AuthInit("no-token", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.write(msg1); err != nil {
+		t.Fatal(err)
+	}
+	var msg2 opaque.AuthMsg2
+	if err := c.read(&msg2); err != nil {
+		t.Fatal(err)
+	}
+	secret, msg3, err := opaque.Auth2(sess, msg2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.write(msg3); err != nil {
+		t.Fatal(err)
+	}
+	if reply, err := opaque.Read(c.r); err != nil || string(reply) != "ok" {
+		t.Fatalf("reply %q, %v", reply, err)
+	}
+	key := opaque.ChannelKey(secret)
+	if err := opaque.EncryptAndWrite(c.w, key, `{"Cmd":"ping"}`); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := opaque.ReadAndDecrypt(c.r, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != `{"Result":"pong"}` {
+		t.Errorf("first frame after ok is %q, want the answer to ping", reply)
+	}
+	c.conn.Close()
+	c.serverErr()
+}
+
+func TestReregistration(t *testing.T) {
+	register(t, "rereg", "old password")
+	live, _ := loginChannel(t, "rereg", "old password")
+
+	// pwreg cannot take over an existing account.
+	c := dial(t)
+	if err := c.Register("rereg", "attacker"); err != client.AccountExists {
+		t.Errorf("second pwreg: got %v, want %v", err, client.AccountExists)
+	}
+	c.serverErr()
+	c = dial(t)
+	if _, err := c.Login("rereg", "attacker"); err == nil {
+		t.Error("login with the attacker's password succeeded")
+	}
+	c.serverErr()
+
+	// The password is changed by a login of the account, which ends the
+	// other logins.
+	changePassword(t, "rereg", "old password", "new password")
+	if err := live.Call("ping", nil, nil); err == nil {
+		t.Error("login with the old password outlived the change")
+	}
+	live.serverErr()
+
+	c = dial(t)
+	if _, err := c.Login("rereg", "old password"); err == nil {
+		t.Error("login with old password succeeded after re-registration")
+	}
+	c.serverErr()
+
+	c = dial(t)
+	if _, err := c.Login("rereg", "new password"); err != nil {
+		t.Errorf("login with new password: %v", err)
+	}
+	if err := c.serverErr(); err != nil {
+		t.Errorf("server: %v", err)
+	}
+}
+
+func TestConcurrentLogins(t *testing.T) {
+	const n = 8
+	for i := 0; i < n; i++ {
+		register(t, fmt.Sprintf("concurrent-%d", i), "secret")
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*n)
+	for i := 0; i < n; i++ {
+		username := fmt.Sprintf("concurrent-%d", i)
+		c := dial(t)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.Login(username, "secret"); err != nil {
+				errs <- fmt.Errorf("login %s: %v", username, err)
+			}
+			if err := c.serverErr(); err != nil {
+				errs <- fmt.Errorf("server %s: %v", username, err)
+			}
+		}()
+	}
+	// Registrations racing with the logins above.
+	for i := 0; i < n; i++ {
+		username := fmt.Sprintf("concurrent-new-%d", i)
+		c := dial(t)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.Register(username, "secret"); err != nil {
+				errs <- fmt.Errorf("register %s: %v", username, err)
+			}
+			c.serverErr()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestRealClientEncoding(t *testing.T) {
+	// Clients in other languages send coordinates as JSON strings, which the
+	// server converts with RemoveQuotesFromJson.
+	c := dial(t)
+	if err := opaque.Write(c.w, []byte("pwreg")); err != nil {
+		t.Fatal(err)
+	}
+	sess, msg1, err := opaque.PwRegInit("string-coords", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := fmt.Sprintf(`{"username":"string-coords","a":{"x":"%s","y":"%s"}}`, msg1.A.X, msg1.A.Y)
+	if err := opaque.Write(c.w, []byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	var msg2 opaque.PwRegMsg2
+	if err := c.read(&msg2); err != nil {
+		t.Fatal(err)
+	}
+	msg3, err := opaque.PwReg2(sess, msg2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = fmt.Sprintf(`{"envU":"%s","pubU":{"x":"%s","y":"%s"}}`, msg3.EnvU, msg3.PubU.X, msg3.PubU.Y)
+	if err := opaque.Write(c.w, []byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := opaque.Read(c.r); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.serverErr(); err != nil {
+		t.Fatalf("server: %v", err)
+	}
+
+	c = dial(t)
+	if _, err := c.Login("string-coords", "secret"); err != nil {
+		t.Errorf("login: %v", err)
+	}
+	c.serverErr()
+}
+
+func TestMalformedMessages(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		frames []string
+	}{
+		{"unknown command", []string{"frobnicate"}},
+		{"pwreg invalid json", []string{"pwreg", "not json"}},
+		{"pwreg missing point", []string{"pwreg", `{"Username":"x"}`}},
+		{"pwreg point off curve", []string{"pwreg", `{"Username":"x","A":{"X":1,"Y":1}}`}},
+		{"auth invalid json", []string{"auth", "{"}},
+		{"auth missing points", []string{"auth", `{"Username":"x"}`}},
+		{"auth point off curve", []string{"auth", `{"Username":"x","A":{"X":1,"Y":2},"EphemeralPubU":{"X":1,"Y":2}}`}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := dial(t)
+			go func() {
+				for _, f := range tc.frames {
+					if err := opaque.Write(c.w, []byte(f)); err != nil {
+						return
+					}
+				}
+			}()
+			if err := <-c.done; err == nil {
+				t.Error("server accepted malformed message")
+			}
+		})
+	}
+}
+
+func TestTruncatedMessages(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data string
+	}{
+		{"empty", ""},
+		{"partial command", "pwr"},
+		{"partial pwreg msg1", "pwreg\n{\"Username\":\"x\",\"A\":{"},
+		{"partial auth msg1", "auth\n{\"Username\":"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := dial(t)
+			c.conn.Write([]byte(tc.data))
+			if err := c.serverErr(); err == nil {
+				t.Error("server accepted truncated message")
+			}
+		})
+	}
+}
+
+func TestTruncatedAfterMsg2(t *testing.T) {
+	register(t, "truncated", "secret")
+
+	c := dial(t)
+	if err := opaque.Write(c.w, []byte("auth")); err != nil {
+		t.Fatal(err)
+	}
+	_, msg1, err := opaque.AuthInit("truncated", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.write(msg1); err != nil {
+		t.Fatal(err)
+	}
+	var msg2 opaque.AuthMsg2
+	if err := c.read(&msg2); err != nil {
+		t.Fatal(err)
+	}
+	c.conn.Write([]byte(`{"Mac2":"ab`))
+	if err := c.serverErr(); err == nil {
+		t.Error("server accepted truncated AuthMsg3")
+	}
+}
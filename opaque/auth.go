@@ -15,7 +15,6 @@ import (
 	"fmt"
 	"golang.org/x/crypto/hkdf"
 	"io"
-	"math/big"
 )
 
 // AuthServerSession keeps track of state needed on the server-side during a
@@ -26,12 +25,22 @@ type AuthServerSession struct {
 	Km3 []byte
 	NonceU string
 	NonceS string
-	EphemeralPrivS *ECPrivateKey
 	EphemeralPubS *ECPoint
-	user *User
+	username string
+	credentialID string
 	XCrypt []byte
 }
 
+// Username returns the name of the user that is authenticating.
+func (s *AuthServerSession) Username() string {
+	return s.username
+}
+
+// CredentialID returns AuthMsg1.CredentialID of the run.
+func (s *AuthServerSession) CredentialID() string {
+	return s.credentialID
+}
+
 // AuthMsg1 is the first message in the authentication protocol. It is sent from
 // the client to the server.
 type AuthMsg1 struct {
@@ -39,6 +48,20 @@ type AuthMsg1 struct {
 	A *ECPoint
 	NonceU string //hex
 	EphemeralPubU *ECPoint
+
+	// CredentialID selects one of the user's credentials on servers that
+	// store several per user. It is empty for the default credential. The
+	// opaque package does not interpret it, but from protocol version 3 the
+	// keys are bound to it, see AuthClientSession.SetCredentialID.
+	CredentialID string `json:",omitempty"`
+
+	// Verifiable asks the server for a proof of the OPRF evaluation in
+	// AuthMsg2.Proof, see voprf.go.
+	Verifiable bool `json:",omitempty"`
+
+	// Version is the client's protocol version, see ProtocolVersion. It is
+	// missing in version 1.
+	Version int `json:",omitempty"`
 }
 
 // AuthMsg2 is the second message in the authentication protocol. It is sent
@@ -57,6 +80,14 @@ type AuthMsg2 struct {
 	NonceS string
 
 	Mac1 string
+
+	// Proof is the hex encoded proof that B=A^k for the user's OPRF key k.
+	// It is set if AuthMsg1.Verifiable is.
+	Proof string `json:",omitempty"`
+
+	// Version is the protocol version the server uses, the smaller of
+	// AuthMsg1.Version and ProtocolVersion. It is missing in version 1.
+	Version int `json:",omitempty"`
 }
 
 // After receiving AuthMsg2 client can compute RwdU as H(x, v, b*v^{-r}).
@@ -76,140 +107,484 @@ type AuthMsg3 struct {
 }
 
 
-// Auth1 is the processing done by the server when it receives an AuthMsg1
-// struct. On success a nil error is returned together with a AuthServerSession
-// and an AuthMsg2 struct. The AuthMsg2 struct should be sent to the client.
-func Auth1(privS *ECPrivateKey, user *User, msg1 AuthMsg1) (*AuthServerSession, AuthMsg2, error) {
-	var err error
-	var sk []byte
-	var x, y *big.Int
-	sk, x, y, err = elliptic.GenerateKey(dhGroup, rand.Reader)
+// AuthClientSession keeps track of state needed on the client-side during a
+// run of the authentication protocol.
+type AuthClientSession struct {
+	username       string
+	password       []byte
+	r              *Scalar
+	a              *ECPoint
+	nonceU         []byte
+	ephemeralPrivU *ECPrivateKey
+	ephemeralPubU  *ECPoint
+	// oprfKey is the server's OPRF public key if the client asked for a
+	// proof of the OPRF evaluation.
+	oprfKey *ECPoint
+	// exportKey is set by Auth2.
+	exportKey []byte
+	// identities is set with SetIdentities.
+	identities Identities
+	// credentialID is set with SetCredentialID.
+	credentialID string
+}
+
+// AuthInit initiates the authentication protocol. It is invoked by the client.
+// On success a nil error is returned together with a client session and an
+// AuthMsg1 struct. The AuthMsg1 struct should be sent to the server.
+//
+// See also Auth1, Auth2, and Auth3.
+func AuthInit(username, password string) (*AuthClientSession, AuthMsg1, error) {
+	a, r, err := dhOprf1([]byte(password))
 	if err != nil {
-		return nil, AuthMsg2{}, err
+		return nil, AuthMsg1{}, err
+	}
+	sk, x, y, err := elliptic.GenerateKey(dhGroup, rand.Reader)
+	if err != nil {
+		return nil, AuthMsg1{}, err
+	}
+	nonceU := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, nonceU); err != nil {
+		return nil, AuthMsg1{}, err
+	}
+	session := &AuthClientSession{
+		username:       username,
+		password:       []byte(password),
+		r:              r,
+		a:              a,
+		nonceU:         nonceU,
+		ephemeralPrivU: &ECPrivateKey{PrivateKeyBytes: sk},
+		ephemeralPubU:  &ECPoint{X: x, Y: y},
 	}
-	var EPrivateS = ECPrivateKey{PrivateKeyBytes: sk}
-	var EPubS = ECPoint{X: x, Y: y}
+	msg1 := AuthMsg1{
+		Username:      username,
+		A:             a,
+		NonceU:        hex.EncodeToString(nonceU),
+		EphemeralPubU: session.ephemeralPubU,
+		Version:       ProtocolVersion,
+	}
+	return session, msg1, nil
+}
 
-	var msg2 AuthMsg2
-	var B, err1 = dhOprf2(msg1.A, user.K)
-	if err1 != nil {
-		return nil, AuthMsg2{}, err
+// AuthInitVerifiable is like AuthInit but asks the server to prove that it
+// evaluated the OPRF with the key whose public key is oprfKey, which the
+// client got from PwRegClientSession.OprfKey at registration. Auth2 then
+// checks the proof before it uses the server's reply.
+func AuthInitVerifiable(username, password string, oprfKey *ECPoint) (*AuthClientSession, AuthMsg1, error) {
+	if err := checkPoint("oprfKey", oprfKey); err != nil {
+		return nil, AuthMsg1{}, err
 	}
-	msg2.B =  &Point{X: B.X.String(), Y: B.Y.String()}
-	msg2.EnvU = user.EnvU
-	msg2.EphemeralPubS =  &Point{X: EPubS.X.String(), Y: EPubS.Y.String()}
+	session, msg1, err := AuthInit(username, password)
+	if err != nil {
+		return nil, AuthMsg1{}, err
+	}
+	session.oprfKey = oprfKey
+	msg1.Verifiable = true
+	return session, msg1, nil
+}
+
+// Identities are the identities of the server and the client that a login
+// binds its keys to, server_identity and client_identity in RFC 9807. A nil
+// identity stands for the peer's public key, PubS or PubU. The client and the
+// server must use the same identities or Auth2 fails with MacMismatch.
+type Identities struct {
+	Server []byte
+	Client []byte
+}
 
-	NonceS := make([]byte, 32)
-	if _, err := io.ReadFull(rand.Reader, NonceS); err != nil {
-		panic(err.Error())
+// resolve returns the identities with nil ones replaced by the compressed
+// encodings of pubS and pubU.
+func (ids Identities) resolve(pubS, pubU *ECPoint) (idS, idU []byte, err error) {
+	idS, idU = ids.Server, ids.Client
+	if idS == nil {
+		if idS, err = compressedPoint(pubS); err != nil {
+			return nil, nil, fmt.Errorf("PubS: %s", err)
+		}
 	}
+	if idU == nil {
+		if idU, err = compressedPoint(pubU); err != nil {
+			return nil, nil, fmt.Errorf("PubU: %s", err)
+		}
+	}
+	return idS, idU, nil
+}
 
-	msg2.NonceS = hex.EncodeToString(NonceS[:])
+func compressedPoint(p *ECPoint) ([]byte, error) {
+	e, err := NewElement(p)
+	if err != nil {
+		return nil, err
+	}
+	return e.BytesCompressed(), nil
+}
 
-	var decodedNonceU,err2 = hex.DecodeString(msg1.NonceU)
+// bindings are the values besides the exchanged key material that XCrypt
+// binds a login to from protocol version 2: the identities of the peers and
+// the negotiated OPRF verification, and from version 3 the credential that
+// AuthMsg1.CredentialID selects.
+type bindings struct {
+	idS, idU     []byte
+	verifiable   bool
+	proof        string
+	credentialID string
+}
+
+// SetIdentities sets the identities the login binds its keys to. It must be
+// called before Auth2 if the server uses other identities than the public
+// keys.
+func (sess *AuthClientSession) SetIdentities(ids Identities) {
+	sess.identities = ids
+}
+
+// SetCredentialID sets the credential the login binds its keys to. It must be
+// called before Auth2 with the ID sent in AuthMsg1.CredentialID, so that a
+// login whose CredentialID was changed on the way fails key confirmation.
+func (sess *AuthClientSession) SetCredentialID(id string) {
+	sess.credentialID = id
+}
 
-	if err2 != nil {
-		panic(err)
+// transcript returns XCrypt, the encoding of the values exchanged in AuthMsg1
+// and AuthMsg2 in protocol version version, and from version 2 of bd. XCrypt
+// is authenticated by both Mac1 and Mac2, and from version 2 its hash is part
+// of the info the keys are derived with, see keyInfo.
+func transcript(version int, a *ECPoint, nonceU []byte, username string, ephemeralPubU *ECPoint,
+	b *ECPoint, envU []byte, nonceS []byte, ephemeralPubS *ECPoint, bd bindings) ([]byte, error) {
+	if version < 2 {
+		return transcriptV1(a, nonceU, username, ephemeralPubU, b, envU, nonceS, ephemeralPubS), nil
 	}
+	t := newTranscriptBuilder("OPAQUE-XCrypt", version).
+		Point(a).Bytes(nonceU).String(username).Point(ephemeralPubU).
+		Point(b).Bytes(envU).Bytes(nonceS).Point(ephemeralPubS).
+		Bytes(bd.idS).Bytes(bd.idU).Bool(bd.verifiable).String(bd.proof)
+	if version >= 3 {
+		t.String(bd.credentialID)
+	}
+	return t.Finish()
+}
 
-	var decodedEnvU,err3 = hex.DecodeString(msg2.EnvU)
+// transcriptV1 is transcript for protocol version 1, which binds neither the
+// identities nor the OPRF verification.
+func transcriptV1(a *ECPoint, nonceU []byte, username string, ephemeralPubU *ECPoint,
+	b *ECPoint, envU []byte, nonceS []byte, ephemeralPubS *ECPoint) []byte {
+	var XCrypt = append(a.X.Bytes(), a.Y.Bytes()...)
+	XCrypt = append(XCrypt, nonceU...)
+	XCrypt = append(XCrypt, []byte(username)...)
+	XCrypt = append(XCrypt, ephemeralPubU.X.Bytes()...)
+	XCrypt = append(XCrypt, ephemeralPubU.Y.Bytes()...)
+	XCrypt = append(XCrypt, b.X.Bytes()...)
+	XCrypt = append(XCrypt, b.Y.Bytes()...)
+	XCrypt = append(XCrypt, envU...)
+	XCrypt = append(XCrypt, nonceS...)
+	XCrypt = append(XCrypt, ephemeralPubS.X.Bytes()...)
+	XCrypt = append(XCrypt, ephemeralPubS.Y.Bytes()...)
+	return XCrypt
+}
 
-	if err3 != nil {
-		panic(err)
+// keyInfo returns the info that the HMQV exponents and the keys are derived
+// with in protocol version version: "HMQVKeys" followed by NonceU in version
+// 1, and by the hash of XCrypt from version 2.
+func keyInfo(version int, nonceU, XCrypt []byte) []byte {
+	if version < 2 {
+		return append([]byte("HMQVKeys"), nonceU...)
 	}
+	h := sha256.Sum256(XCrypt)
+	return append([]byte("HMQVKeys"), h[:]...)
+}
 
-	var XCrypt = append(msg1.A.X.Bytes(), msg1.A.Y.Bytes()...)
-	XCrypt = append(XCrypt, decodedNonceU...)
-	XCrypt = append(XCrypt, []byte(msg1.Username)...)
-	XCrypt = append(XCrypt, msg1.EphemeralPubU.X.Bytes()...)
-	XCrypt = append(XCrypt, msg1.EphemeralPubU.Y.Bytes()...)
-	XCrypt = append(XCrypt, B.X.Bytes()...)
-	XCrypt = append(XCrypt, B.Y.Bytes()...)
-	XCrypt = append(XCrypt, decodedEnvU...)
-	XCrypt = append(XCrypt, NonceS...)
-	XCrypt = append(XCrypt, EPubS.X.Bytes()...)
-	XCrypt = append(XCrypt, EPubS.Y.Bytes()...)
+// hmqvHash computes the HMQV exponent for the ephemeral key ephemeralPub in
+// protocol version version. role is "user" for the client's key and "srvr"
+// for the server's key.
+func hmqvHash(version int, ephemeralPub *ECPoint, role string, info []byte) ([32]byte, error) {
+	if version < 2 {
+		var input = append(ephemeralPub.X.Bytes(), ephemeralPub.Y.Bytes()...)
+		input = append(input, []byte(role)...)
+		input = append(input, info...)
+		return sha256.Sum256(input), nil
+	}
+	input, err := newTranscriptBuilder("OPAQUE-HMQV", version).
+		Point(ephemeralPub).String(role).Bytes(info).Finish()
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return sha256.Sum256(input), nil
+}
 
-	//Prepare common secret: session key, key for mac etc
+// hmqvExponentLength is the length of the HMQV exponents d and e from
+// protocol version 3, half the length of the group order as in the HMQV
+// paper.
+const hmqvExponentLength = scalarLength / 2
+
+// hmqvExponents returns the HMQV exponents d of the client's ephemeral key
+// ephemeralPubU and e of the server's, ephemeralPubS, in protocol version
+// version. From version 3 they are d = H(X, idS) and e = H(Y, idU) as in the
+// HMQV paper, where H is SHA-256 truncated to hmqvExponentLength bytes.
+// Before, they were full-length hashes of the ephemeral key, the role and
+// info.
+func hmqvExponents(version int, ephemeralPubU, ephemeralPubS *ECPoint, idS, idU, info []byte) (d, e []byte, err error) {
+	if version < 3 {
+		q1, err := hmqvHash(version, ephemeralPubU, "user", info)
+		if err != nil {
+			return nil, nil, err
+		}
+		q2, err := hmqvHash(version, ephemeralPubS, "srvr", info)
+		if err != nil {
+			return nil, nil, err
+		}
+		return q1[:], q2[:], nil
+	}
+	if d, err = hmqvHalfHash(version, ephemeralPubU, idS); err != nil {
+		return nil, nil, err
+	}
+	if e, err = hmqvHalfHash(version, ephemeralPubS, idU); err != nil {
+		return nil, nil, err
+	}
+	return d, e, nil
+}
 
-	var info = append([]byte("HMQVKeys"), decodedNonceU...)
-	//info = append(info, NonceS...)
-	//info = append(info, []byte(msg1.Username)...)
+func hmqvHalfHash(version int, ephemeralPub *ECPoint, id []byte) ([]byte, error) {
+	input, err := newTranscriptBuilder("OPAQUE-HMQV-Exponent", version).
+		Point(ephemeralPub).Bytes(id).Finish()
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256(input)
+	return h[:hmqvExponentLength], nil
+}
 
-	fmt.Println("NonceU = ")
-	fmt.Println(msg1.NonceU)
+// mac1Key returns the key of Mac1, with which the server confirms the keys.
+// From protocol version 3 it is Km2, so that the server's and the client's
+// confirmations are made with different keys; before, both used Km3.
+func mac1Key(version int, Km2, Km3 []byte) []byte {
+	if version >= 3 {
+		return Km2
+	}
+	return Km3
+}
 
-	fmt.Println("XCrypt = ")
-	fmt.Println( hex.EncodeToString(XCrypt))
+// hmqvSecret computes (ephemeralPubPeer + qPeer*pubPeer)^(ephemeralPriv + qOwn*priv),
+// which is the same value on both sides of a successful HMQV exchange, and
+// returns its encoding in protocol version version. The exponent is reduced
+// modulo N before it is used. P-256 has cofactor 1, so checking that the
+// peer's points are on the curve, which NewElement does, and that the result
+// is not the identity is all the cofactor handling HMQV needs.
+func hmqvSecret(version int, ephemeralPubPeer, pubPeer *ECPoint, qPeer []byte,
+	ephemeralPriv, priv *ECPrivateKey, qOwn []byte) ([]byte, error) {
+	ePeer, err := NewElement(ephemeralPubPeer)
+	if err != nil {
+		return nil, err
+	}
+	peer, err := NewElement(pubPeer)
+	if err != nil {
+		return nil, err
+	}
+	qPeerNum, err := NewScalar().SetBytes(qPeer)
+	if err != nil {
+		return nil, err
+	}
+	qOwnNum, err := NewScalar().SetBytes(qOwn)
+	if err != nil {
+		return nil, err
+	}
+	ePrivNum, err := NewScalar().SetBytes(ephemeralPriv.PrivateKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+	privNum, err := NewScalar().SetBytes(priv.PrivateKeyBytes)
+	if err != nil {
+		return nil, err
+	}
 
-	fmt.Println("info = ")
-	fmt.Println( hex.EncodeToString(info))
+	var exp = NewScalar().Add(ePrivNum, NewScalar().Mul(qOwnNum, privNum))
 
-	var Q1Input = append(msg1.EphemeralPubU.X.Bytes(), msg1.EphemeralPubU.Y.Bytes()...)
-	Q1Input = append(Q1Input, []byte("user")...)
-	Q1Input = append(Q1Input, info...)
+	var sum = NewIdentity().Add(ePeer, NewIdentity().ScalarMult(qPeerNum, peer))
+	var ikm = NewIdentity().ScalarMult(exp, sum)
+	if ikm.IsIdentity() {
+		return nil, errors.New("HMQV secret is the identity")
+	}
+	if version >= 3 {
+		return ikm.Bytes(), nil
+	}
+	// Versions 1 and 2 drop leading zeros of the coordinates.
+	var ikmPoint = ikm.ECPoint()
+	return append(ikmPoint.X.Bytes(), ikmPoint.Y.Bytes()...), nil
+}
 
-	var Q2Input = append(EPubS.X.Bytes(), EPubS.Y.Bytes()...)
-	Q2Input = append(Q2Input, []byte("srvr")...)
-	Q2Input = append(Q2Input, info...)
+// deriveKeys expands the HMQV secret into the session key SK and the MAC keys
+// Km2 and Km3.
+func deriveKeys(secret []byte, info []byte) (SK, Km2, Km3 []byte, err error) {
+	var kdf = hkdf.New(hasher, secret, make([]byte, 32)[:], info)
+	SK = make([]byte, 32)
+	Km2 = make([]byte, 32)
+	Km3 = make([]byte, 32)
+	for _, key := range [][]byte{SK, Km2, Km3} {
+		if _, err := io.ReadFull(kdf, key); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return SK, Km2, Km3, nil
+}
 
-	var Q1 = sha256.Sum256(Q1Input)
-	var Q2 = sha256.Sum256(Q2Input)
+// MacMismatch is returned by Auth2 if Mac1 does not verify and by Auth3 if
+// Mac2 does not verify.
+var MacMismatch = errors.New("MAC mismatch")
 
-	fmt.Println("Q1 = ")
-	fmt.Println(hex.EncodeToString(Q1[:]))
+// Auth1 is the processing done by the server when it receives an AuthMsg1
+// struct. On success a nil error is returned together with a AuthServerSession
+// and an AuthMsg2 struct. The AuthMsg2 struct should be sent to the client.
+//
+// Auth1 generates a new ephemeral key pair. Use Auth1WithEphemeral to take
+// one from an EphemeralPool instead.
+func Auth1(privS *ECPrivateKey, user *User, msg1 AuthMsg1) (*AuthServerSession, AuthMsg2, error) {
+	eph, err := NewServerEphemeral()
+	if err != nil {
+		return nil, AuthMsg2{}, err
+	}
+	return Auth1WithEphemeral(privS, user, msg1, eph)
+}
 
-	fmt.Println("Q2 = ")
-	fmt.Println(hex.EncodeToString(Q2[:]))
+// Auth1WithEphemeral is like Auth1 but uses eph as the server's ephemeral key
+// pair and nonce. eph is erased before Auth1WithEphemeral returns and must
+// not be used again.
+func Auth1WithEphemeral(privS *ECPrivateKey, user *User, msg1 AuthMsg1, eph *ServerEphemeral) (*AuthServerSession, AuthMsg2, error) {
+	defer eph.erase()
+	if user.K == nil {
+		return nil, AuthMsg2{}, errors.New("user has no OPRF key, see User.WithDerivedKey")
+	}
+	B, err := dhOprf2(msg1.A, user.K)
+	if err != nil {
+		return nil, AuthMsg2{}, err
+	}
+	var proof string
+	if msg1.Verifiable {
+		_, proof, err = oprfProof(NewScalar().SetBigInt(user.K), msg1.A, B)
+		if err != nil {
+			return nil, AuthMsg2{}, err
+		}
+	}
+	return auth1(privS, user, msg1, eph, B, proof)
+}
 
-	var Q2Num = new(big.Int).SetBytes(Q2[:])
-	var EPrivSNum = new(big.Int).SetBytes(EPrivateS.PrivateKeyBytes[:])
-	var PrivSNum = new(big.Int).SetBytes(privS.PrivateKeyBytes[:])
+// Auth1Evaluated is like Auth1WithEphemeral, or like Auth1 if eph is nil, but
+// B=A^k has been computed elsewhere, for example with CombineOprf, and user.K
+// is not used. proof is the proof that B=A^k, see
+// ThresholdEvaluation.Proof, and must be given if msg1.Verifiable is set.
+func Auth1Evaluated(privS *ECPrivateKey, user *User, msg1 AuthMsg1, eph *ServerEphemeral, b *ECPoint, proof string) (*AuthServerSession, AuthMsg2, error) {
+	if eph == nil {
+		var err error
+		if eph, err = NewServerEphemeral(); err != nil {
+			return nil, AuthMsg2{}, err
+		}
+	}
+	defer eph.erase()
+	if err := checkPoint("B", b); err != nil {
+		return nil, AuthMsg2{}, err
+	}
+	if msg1.Verifiable && proof == "" {
+		return nil, AuthMsg2{}, errors.New("no proof of the OPRF evaluation")
+	}
+	if !msg1.Verifiable {
+		proof = ""
+	}
+	return auth1(privS, user, msg1, eph, b, proof)
+}
 
-	var exp = big.NewInt(0).Add(EPrivSNum, big.NewInt(1).Mul(Q2Num, PrivSNum)).Bytes()
+// auth1 is the part of Auth1 after the OPRF evaluation B of msg1.A and its
+// proof, if any.
+func auth1(privS *ECPrivateKey, user *User, msg1 AuthMsg1, eph *ServerEphemeral, B *ECPoint, proof string) (*AuthServerSession, AuthMsg2, error) {
+	EPrivateS, EPubS, NonceS, err := eph.take()
+	if err != nil {
+		return nil, AuthMsg2{}, err
+	}
+	if err := checkPoint("EphemeralPubU", msg1.EphemeralPubU); err != nil {
+		return nil, AuthMsg2{}, err
+	}
+	decodedNonceU, err := hex.DecodeString(msg1.NonceU)
+	if err != nil {
+		return nil, AuthMsg2{}, fmt.Errorf("NonceU: %s", err)
+	}
 
-	var xPubUQ2, yPubUQ2 = dhGroup.ScalarMult(user.PubU.X, user.PubU.Y, Q1[:])
-	var xSum, ySum = dhGroup.Add(msg1.EphemeralPubU.X, msg1.EphemeralPubU.Y, xPubUQ2, yPubUQ2)
-	var xIkms, yIkms = dhGroup.ScalarMult(xSum, ySum, exp)
-	var secret = append(xIkms.Bytes(), yIkms.Bytes()...)
+	var msg2 AuthMsg2
+	msg2.B = toPoint(B)
+	msg2.Proof = proof
+	msg2.EnvU = user.EnvU
+	msg2.EphemeralPubS = toPoint(EPubS)
 
-	var kdf = hkdf.New(hasher, secret, make([]byte, 32)[:], info)
+	msg2.NonceS = hex.EncodeToString(NonceS[:])
 
-	var SK = make([]byte, 32)
-	if _, err := io.ReadFull(kdf, SK); err != nil {
-		panic(err)
+	var decodedEnvU, err3 = hex.DecodeString(msg2.EnvU)
+	if err3 != nil {
+		return nil, AuthMsg2{}, fmt.Errorf("EnvU: %s", err3)
 	}
 
-	fmt.Println("xIkms = ")
-	fmt.Println(xIkms)
+	var pubS *ECPoint
+	if user.Identities.Server == nil {
+		k, err := NewScalar().SetBytes(privS.PrivateKeyBytes)
+		if err != nil {
+			return nil, AuthMsg2{}, err
+		}
+		pubS = NewIdentity().ScalarBaseMult(k).ECPoint()
+	}
+	idS, idU, err := user.Identities.resolve(pubS, user.PubU)
+	if err != nil {
+		return nil, AuthMsg2{}, err
+	}
+	bd := bindings{idS: idS, idU: idU, verifiable: msg1.Verifiable, proof: proof, credentialID: msg1.CredentialID}
+	version := negotiateVersion(msg1.Version)
+	XCrypt, err := transcript(version, msg1.A, decodedNonceU, msg1.Username, msg1.EphemeralPubU,
+		B, decodedEnvU, NonceS, EPubS, bd)
+	if err != nil {
+		return nil, AuthMsg2{}, err
+	}
+	if version > 1 {
+		msg2.Version = version
+	}
+
+	//Prepare common secret: session key, key for mac etc
+
+	var info = keyInfo(version, decodedNonceU, XCrypt)
 
-	fmt.Println("yIkms = ")
-	fmt.Println(yIkms)
+	fmt.Fprintln(Trace, "NonceU = ")
+	fmt.Fprintln(Trace, msg1.NonceU)
 
-	fmt.Println("SK = ")
-	fmt.Println( hex.EncodeToString(SK))
+	fmt.Fprintln(Trace, "XCrypt = ")
+	fmt.Fprintln(Trace, hex.EncodeToString(XCrypt))
 
-	var Km2 = make([]byte, 32)
-	if _, err := io.ReadFull(kdf, Km2); err != nil {
-		panic(err)
+	fmt.Fprintln(Trace, "info = ")
+	fmt.Fprintln(Trace, hex.EncodeToString(info))
+
+	Q1, Q2, err := hmqvExponents(version, msg1.EphemeralPubU, EPubS, idS, idU, info)
+	if err != nil {
+		return nil, AuthMsg2{}, err
 	}
 
-	fmt.Println("Km2 = ")
-	fmt.Println( hex.EncodeToString(Km2))
+	fmt.Fprintln(Trace, "Q1 = ")
+	fmt.Fprintln(Trace, hex.EncodeToString(Q1))
+
+	fmt.Fprintln(Trace, "Q2 = ")
+	fmt.Fprintln(Trace, hex.EncodeToString(Q2))
+
+	secret, err := hmqvSecret(version, msg1.EphemeralPubU, user.PubU, Q1, EPrivateS, privS, Q2)
+	if err != nil {
+		return nil, AuthMsg2{}, err
+	}
 
-	var Km3 = make([]byte, 32)
-	if _, err := io.ReadFull(kdf, Km3); err != nil {
-		panic(err)
+	SK, Km2, Km3, err := deriveKeys(secret, info)
+	if err != nil {
+		return nil, AuthMsg2{}, err
 	}
 
-	fmt.Println("Km3 = ")
-	fmt.Println( hex.EncodeToString(Km3))
+	fmt.Fprintln(Trace, "SK = ")
+	fmt.Fprintln(Trace, hex.EncodeToString(SK))
+
+	fmt.Fprintln(Trace, "Km2 = ")
+	fmt.Fprintln(Trace, hex.EncodeToString(Km2))
 
-	var mac1 = computeHMac(Km3, XCrypt)
+	fmt.Fprintln(Trace, "Km3 = ")
+	fmt.Fprintln(Trace, hex.EncodeToString(Km3))
+
+	var mac1 = computeHMac(mac1Key(version, Km2, Km3), XCrypt)
 	msg2.Mac1 = hex.EncodeToString(mac1)
 
-	fmt.Println("mac1 = ")
-	fmt.Println( hex.EncodeToString(mac1))
+	fmt.Fprintln(Trace, "mac1 = ")
+	fmt.Fprintln(Trace, hex.EncodeToString(mac1))
 
 	session := &AuthServerSession{
 		SK: SK,
@@ -217,14 +592,105 @@ func Auth1(privS *ECPrivateKey, user *User, msg1 AuthMsg1) (*AuthServerSession,
 		Km3: Km3,
 		NonceU: msg1.NonceU,
 		NonceS: hex.EncodeToString(NonceS),
-		EphemeralPrivS: &EPrivateS,
-		EphemeralPubS: &EPubS,
-		user: user,
+		EphemeralPubS: EPubS,
+		username: user.Username,
+		credentialID: msg1.CredentialID,
 		XCrypt: XCrypt,
 	}
 	return session, msg2, nil
 }
 
+// Auth2 is the processing done by the client when it receives an AuthMsg2
+// struct. On success a nil error is returned together with a secret and an
+// AuthMsg3 struct. The AuthMsg3 struct should be sent to the server.
+//
+// AuthtagMismatch is returned if EnvU cannot be opened, which is the case if
+// the password is wrong. A non-nil error is also returned if Mac1 does not
+// verify, in which case the server has not proved that it knows the private
+// key stored in EnvU at registration.
+//
+// If sess was created by AuthInitVerifiable, InvalidProof is returned if the
+// server's proof of the OPRF evaluation is missing or does not verify.
+func Auth2(sess *AuthClientSession, msg2 AuthMsg2) (secret []byte, msg3 AuthMsg3, err error) {
+	if msg2.Version != ProtocolVersion {
+		return nil, AuthMsg3{}, fmt.Errorf("server answered version %d: %w", msg2.Version, UnsupportedVersion)
+	}
+	b, err := msg2.B.toECPoint()
+	if err != nil {
+		return nil, AuthMsg3{}, err
+	}
+	ephemeralPubS, err := msg2.EphemeralPubS.toECPoint()
+	if err != nil {
+		return nil, AuthMsg3{}, err
+	}
+	nonceS, err := hex.DecodeString(msg2.NonceS)
+	if err != nil {
+		return nil, AuthMsg3{}, fmt.Errorf("NonceS: %s", err)
+	}
+	envU, err := hex.DecodeString(msg2.EnvU)
+	if err != nil {
+		return nil, AuthMsg3{}, fmt.Errorf("EnvU: %s", err)
+	}
+	mac1, err := hex.DecodeString(msg2.Mac1)
+	if err != nil {
+		return nil, AuthMsg3{}, fmt.Errorf("Mac1: %s", err)
+	}
+
+	if sess.oprfKey != nil {
+		if err := checkOprfProof(sess.oprfKey, sess.a, b, msg2.Proof); err != nil {
+			return nil, AuthMsg3{}, err
+		}
+	}
+	rwd, err := dhOprf3(sess.password, b, sess.r)
+	if err != nil {
+		return nil, AuthMsg3{}, err
+	}
+	env, err := openEnvelope(rwd, msg2.EnvU)
+	if err != nil {
+		return nil, AuthMsg3{}, err
+	}
+
+	idS, idU, err := sess.identities.resolve(env.PubS, env.PubU)
+	if err != nil {
+		return nil, AuthMsg3{}, err
+	}
+	bd := bindings{idS: idS, idU: idU, verifiable: sess.oprfKey != nil, proof: msg2.Proof, credentialID: sess.credentialID}
+	XCrypt, err := transcript(ProtocolVersion, sess.a, sess.nonceU, sess.username, sess.ephemeralPubU,
+		b, envU, nonceS, ephemeralPubS, bd)
+	if err != nil {
+		return nil, AuthMsg3{}, err
+	}
+	info := keyInfo(ProtocolVersion, sess.nonceU, XCrypt)
+	Q1, Q2, err := hmqvExponents(ProtocolVersion, sess.ephemeralPubU, ephemeralPubS, idS, idU, info)
+	if err != nil {
+		return nil, AuthMsg3{}, err
+	}
+	ikm, err := hmqvSecret(ProtocolVersion, ephemeralPubS, env.PubS, Q2,
+		sess.ephemeralPrivU, &ECPrivateKey{PrivateKeyBytes: env.PrivU}, Q1)
+	if err != nil {
+		return nil, AuthMsg3{}, err
+	}
+	SK, Km2, Km3, err := deriveKeys(ikm, info)
+	if err != nil {
+		return nil, AuthMsg3{}, err
+	}
+	if !verifyHMac(mac1Key(ProtocolVersion, Km2, Km3), XCrypt, mac1) {
+		return nil, AuthMsg3{}, MacMismatch
+	}
+	if sess.exportKey, err = exportKey(rwd, env); err != nil {
+		return nil, AuthMsg3{}, err
+	}
+	mac2 := computeHMac(Km3, append([]byte("Finish"), XCrypt...))
+	return SK, AuthMsg3{Mac2: hex.EncodeToString(mac2)}, nil
+}
+
+// ExportKey returns the export key of the credential once Auth2 has
+// succeeded, see PwRegClientSession.ExportKey. It is unrelated to the session
+// key.
+func (sess *AuthClientSession) ExportKey() []byte {
+	return sess.exportKey
+}
+
 
 // Auth3 is the processing done by the server when it receives an AuthMsg3
 // struct. On success a nil error is returned together with a secret. On
@@ -243,11 +709,11 @@ func Auth3(sess *AuthServerSession, msg3 AuthMsg3) (secret []byte, err error) {
 	var data = append([]byte("Finish"), sess.XCrypt...)
 	var mac2,err1 = hex.DecodeString(msg3.Mac2)
 	if err1 != nil {
-		panic(err)
+		return nil, fmt.Errorf("Mac2: %s", err1)
 	}
 
 	if !verifyHMac(sess.Km3, data, mac2) {
-		return nil, errors.New("MAC mismatch")
+		return nil, MacMismatch
 	}
 	return sess.SK, nil
 }
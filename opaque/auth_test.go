@@ -0,0 +1,669 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"golang.org/x/crypto/hkdf"
+)
+
+func newServerKey(t testing.TB) (*ECPrivateKey, *ECPoint) {
+	sk, x, y, err := elliptic.GenerateKey(dhGroup, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ECPrivateKey{PrivateKeyBytes: sk}, &ECPoint{X: x, Y: y}
+}
+
+func register(t testing.TB, pubS *ECPoint, username, password string) *User {
+	csess, msg1, err := PwRegInit(username, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ssess, msg2, err := PwReg(pubS, msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg3, err := PwReg2(csess, msg2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := PwReg3(ssess, msg3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func TestAuth(t *testing.T) {
+	privS, pubS := newServerKey(t)
+	user := register(t, pubS, "alice", "correct horse")
+
+	csess, msg1, err := AuthInit("alice", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ssess, msg2, err := Auth1(privS, user, msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientSecret, msg3, err := Auth2(csess, msg2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverSecret, err := Auth3(ssess, msg3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(clientSecret, serverSecret); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestAuthIdentities(t *testing.T) {
+	privS, pubS := newServerKey(t)
+	user := register(t, pubS, "alice", "correct horse")
+	ids := Identities{Server: []byte("example.com"), Client: []byte("alice")}
+
+	run := func(serverIDs, clientIDs Identities) ([]byte, error) {
+		csess, msg1, err := AuthInit("alice", "correct horse")
+		if err != nil {
+			t.Fatal(err)
+		}
+		csess.SetIdentities(clientIDs)
+		ssess, msg2, err := Auth1(privS, user.WithIdentities(serverIDs), msg1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sk, msg3, err := Auth2(csess, msg2)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := Auth3(ssess, msg3); err != nil {
+			t.Fatal(err)
+		}
+		return sk, nil
+	}
+
+	defaultSK, err := run(Identities{}, Identities{})
+	if err != nil {
+		t.Fatalf("public keys as identities: %v", err)
+	}
+	sk, err := run(ids, ids)
+	if err != nil {
+		t.Fatalf("configured identities: %v", err)
+	}
+	if bytes.Equal(sk, defaultSK) {
+		t.Error("identities do not change SK")
+	}
+	for _, c := range []Identities{
+		{Client: ids.Client},
+		{Server: ids.Server},
+		{Server: []byte("example.org"), Client: ids.Client},
+	} {
+		if _, err := run(ids, c); err != MacMismatch {
+			t.Errorf("client identities %q: got %v, want %v", c, err, MacMismatch)
+		}
+	}
+}
+
+func TestAuthCredentialID(t *testing.T) {
+	privS, pubS := newServerKey(t)
+	user := register(t, pubS, "alice", "correct horse")
+
+	run := func(sent, received string) error {
+		csess, msg1, err := AuthInit("alice", "correct horse")
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg1.CredentialID = sent
+		csess.SetCredentialID(sent)
+		// The credential selector is changed on the way to the server.
+		msg1.CredentialID = received
+		ssess, msg2, err := Auth1(privS, user, msg1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, msg3, err := Auth2(csess, msg2)
+		if err != nil {
+			return err
+		}
+		if _, err := Auth3(ssess, msg3); err != nil {
+			t.Fatal(err)
+		}
+		return nil
+	}
+	if err := run("laptop", "laptop"); err != nil {
+		t.Fatalf("same credential: %v", err)
+	}
+	for _, c := range [][2]string{{"laptop", "phone"}, {"laptop", ""}, {"", "laptop"}} {
+		if err := run(c[0], c[1]); err != MacMismatch {
+			t.Errorf("credential %q changed to %q: got %v, want %v", c[0], c[1], err, MacMismatch)
+		}
+	}
+}
+
+func TestAuthWrongPassword(t *testing.T) {
+	privS, pubS := newServerKey(t)
+	user := register(t, pubS, "alice", "correct horse")
+
+	csess, msg1, err := AuthInit("alice", "battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, msg2, err := Auth1(privS, user, msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Auth2(csess, msg2); err != AuthtagMismatch {
+		t.Errorf("Auth2 with wrong password: got %v, want %v", err, AuthtagMismatch)
+	}
+}
+
+func TestAuthBadMac2(t *testing.T) {
+	privS, pubS := newServerKey(t)
+	user := register(t, pubS, "alice", "correct horse")
+
+	_, msg1, err := AuthInit("alice", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ssess, _, err := Auth1(privS, user, msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mac2 := range []string{"", "00", "not hex"} {
+		if _, err := Auth3(ssess, AuthMsg3{Mac2: mac2}); err == nil {
+			t.Errorf("Auth3 accepted Mac2 %q", mac2)
+		}
+	}
+}
+
+func TestAuth1InvalidPoints(t *testing.T) {
+	privS, pubS := newServerKey(t)
+	user := register(t, pubS, "alice", "correct horse")
+
+	_, msg1, err := AuthInit("alice", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	offCurve := &ECPoint{X: msg1.A.X, Y: msg1.A.X}
+	for name, m := range map[string]AuthMsg1{
+		"missing A":           {Username: "alice", NonceU: msg1.NonceU, EphemeralPubU: msg1.EphemeralPubU},
+		"A off curve":         {Username: "alice", A: offCurve, NonceU: msg1.NonceU, EphemeralPubU: msg1.EphemeralPubU},
+		"missing ephemeral":   {Username: "alice", A: msg1.A, NonceU: msg1.NonceU},
+		"ephemeral off curve": {Username: "alice", A: msg1.A, NonceU: msg1.NonceU, EphemeralPubU: offCurve},
+		"bad nonce":           {Username: "alice", A: msg1.A, NonceU: "xyz", EphemeralPubU: msg1.EphemeralPubU},
+	} {
+		if _, _, err := Auth1(privS, user, m); err == nil {
+			t.Errorf("%s: Auth1 succeeded", name)
+		}
+	}
+}
+
+func BenchmarkAuth1(b *testing.B) {
+	quiet(b)
+	privS, pubS := newServerKey(b)
+	user := register(b, pubS, "alice", "secret")
+	_, msg1, err := AuthInit("alice", "secret")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := Auth1(privS, user, msg1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAuth1EphemeralPool(b *testing.B) {
+	quiet(b)
+	privS, pubS := newServerKey(b)
+	user := register(b, pubS, "alice", "secret")
+	_, msg1, err := AuthInit("alice", "secret")
+	if err != nil {
+		b.Fatal(err)
+	}
+	pool := NewEphemeralPool(b.N)
+	defer pool.Close()
+	for len(pool.ready) < cap(pool.ready) {
+		time.Sleep(time.Millisecond)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		eph, err := pool.Get()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, _, err := Auth1WithEphemeral(privS, user, msg1, eph); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAuth2(b *testing.B) {
+	quiet(b)
+	privS, pubS := newServerKey(b)
+	user := register(b, pubS, "alice", "secret")
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		csess, msg1, err := AuthInit("alice", "secret")
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, msg2, err := Auth1(privS, user, msg1)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+		if _, _, err := Auth2(csess, msg2); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAuth3(b *testing.B) {
+	quiet(b)
+	privS, pubS := newServerKey(b)
+	user := register(b, pubS, "alice", "secret")
+	csess, msg1, err := AuthInit("alice", "secret")
+	if err != nil {
+		b.Fatal(err)
+	}
+	ssess, msg2, err := Auth1(privS, user, msg1)
+	if err != nil {
+		b.Fatal(err)
+	}
+	_, msg3, err := Auth2(csess, msg2)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Auth3(ssess, msg3); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// login runs a login of username and returns the client session.
+func login(t *testing.T, privS *ECPrivateKey, user *User, username, password string) (*AuthClientSession, []byte) {
+	t.Helper()
+	csess, msg1, err := AuthInit(username, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, msg2, err := Auth1(privS, user, msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sk, _, err := Auth2(csess, msg2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csess, sk
+}
+
+func TestExportKey(t *testing.T) {
+	quietT(t)
+	privS, pubS := newServerKey(t)
+	csess, msg1, err := PwRegInit("alice", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ssess, msg2, err := PwReg(pubS, msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg3, err := PwReg2(csess, msg2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := PwReg3(ssess, msg3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := csess.ExportKey()
+	if len(want) != 32 {
+		t.Fatalf("export key %x", want)
+	}
+
+	for i := 0; i < 2; i++ {
+		sess, sk := login(t, privS, user, "alice", "correct horse")
+		if !bytes.Equal(sess.ExportKey(), want) {
+			t.Errorf("login %d: export key %x, want %x", i, sess.ExportKey(), want)
+		}
+		if bytes.Equal(sess.ExportKey(), sk) {
+			t.Error("export key equals SK")
+		}
+	}
+
+	csessWrong, msg1Wrong, err := AuthInit("alice", "wrong")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, msg2Wrong, err := Auth1(privS, user, msg1Wrong)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Auth2(csessWrong, msg2Wrong); err == nil || csessWrong.ExportKey() != nil {
+		t.Errorf("wrong password: err %v, export key %x", err, csessWrong.ExportKey())
+	}
+
+	// Registering again, even with the same password, gives a new key.
+	again := register(t, pubS, "alice", "correct horse")
+	if sess, _ := login(t, privS, again, "alice", "correct horse"); bytes.Equal(sess.ExportKey(), want) {
+		t.Error("export key unchanged by a new registration")
+	}
+
+	// Envelopes sealed before export keys have no nonce but still yield a
+	// stable key.
+	rwd, err := dhOprf3([]byte("correct horse"), mustEval(t, msg1.A, user.K), csess.r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err := openEnvelope(rwd, user.EnvU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Nonce = nil
+	old := *user
+	if old.EnvU, err = sealEnvelope(rand.Reader, rwd, env); err != nil {
+		t.Fatal(err)
+	}
+	s1, _ := login(t, privS, &old, "alice", "correct horse")
+	s2, _ := login(t, privS, &old, "alice", "correct horse")
+	if len(s1.ExportKey()) != 32 || !bytes.Equal(s1.ExportKey(), s2.ExportKey()) || bytes.Equal(s1.ExportKey(), want) {
+		t.Errorf("export keys of an old envelope: %x and %x", s1.ExportKey(), s2.ExportKey())
+	}
+}
+
+func mustEval(t *testing.T, a *ECPoint, k *big.Int) *ECPoint {
+	t.Helper()
+	b, err := dhOprf2(a, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// TestHmqvVectors checks the key schedule of protocol version 3 against
+// fixed vectors, so that other implementations can check theirs. The private
+// keys are the SHA-256 hashes of "client static", "server static", "client
+// ephemeral" and "server ephemeral", idS is "example.com", idU is "alice" and
+// XCrypt is "transcript". TestAuthVectorV3 checks a whole login.
+func TestHmqvVectors(t *testing.T) {
+	const (
+		privU    = "aefec962fe71cb8592d7a16a533c8292eb6f01ac8513fb84f497caea54a66257"
+		privS    = "961dcc9360ea05800a0e76c414ba830e612661841ddce84c7e13c0f4aaa5e806"
+		ephPrivU = "9f105b2f779418ff0ed1770cbb37213edbf11e5b4f2a02db6fb05d8596f35cfd"
+		ephPrivS = "26d8cd779431405a837f31a4f140f127ebf4c0154f058c4840e55714a0ffde5a"
+		wantD    = "c64d0119171466027b0d88d6fa6cf277"
+		wantE    = "bd6bf9166ca519422b3800b6a297d5b3"
+		wantIKM  = "041106487d4dafcf61b06afc78d8638bee8450411809f6a8e3423b9359969fa4505be1a3354b8300f29f31c7e9b3efc8b81adcbe249b6001b1d8e205e676055374"
+		wantSK   = "4de2e6e3c512eccd3178a094d3f5f5d98ac1da5d4de36dec030f5bdabfa4407b"
+		wantKm2  = "e8068f268e4be4e7579831db784dcf40b56936a060ed5b9428658443079ce527"
+		wantKm3  = "31498dcac599856ca114e91cd44a328961ecf956aa87c04a63a78f32883f59be"
+		wantMac1 = "990d19914dd9cb6ffd38d95829386904b4b527edaaefc5abbace3a7e029e0978"
+		wantMac2 = "d95a302eef10d3993c9abc012a0ce4c041543041d618227f7a158833d1834d9e"
+	)
+	key := func(h string) (*ECPrivateKey, *ECPoint) {
+		b, err := hex.DecodeString(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := NewScalar().SetBytes(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &ECPrivateKey{PrivateKeyBytes: b}, NewIdentity().ScalarBaseMult(s).ECPoint()
+	}
+	a, A := key(privU)
+	b, B := key(privS)
+	x, X := key(ephPrivU)
+	y, Y := key(ephPrivS)
+	idS, idU := []byte("example.com"), []byte("alice")
+	XCrypt := []byte("transcript")
+	info := keyInfo(3, nil, XCrypt)
+	check := func(name string, got []byte, want string) {
+		t.Helper()
+		if h := hex.EncodeToString(got); h != want {
+			t.Errorf("%s = %s, want %s", name, h, want)
+		}
+	}
+
+	d, e, err := hmqvExponents(3, X, Y, idS, idU, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("d", d, wantD)
+	check("e", e, wantE)
+	// d is SHA-256 of the length-prefixed label, the version, X and idS,
+	// truncated to 16 bytes.
+	input := []byte("\x00\x14OPAQUE-HMQV-Exponent\x00\x03\x04")
+	input = append(input, X.X.FillBytes(make([]byte, 32))...)
+	input = append(input, X.Y.FillBytes(make([]byte, 32))...)
+	input = append(append(input, 0, byte(len(idS))), idS...)
+	if h := sha256.Sum256(input); !bytes.Equal(h[:16], d) {
+		t.Errorf("d is not the truncated hash of %x", input)
+	}
+
+	client, err := hmqvSecret(3, Y, B, e, x, a, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := hmqvSecret(3, X, A, d, y, b, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("client IKM", client, wantIKM)
+	check("server IKM", server, wantIKM)
+	// (Y + e*B)^(x + d*a mod N) with math/big and crypto/elliptic.
+	N := dhGroup.Params().N
+	exp := new(big.Int).Mul(new(big.Int).SetBytes(d), new(big.Int).SetBytes(a.PrivateKeyBytes))
+	exp.Add(exp, new(big.Int).SetBytes(x.PrivateKeyBytes)).Mod(exp, N)
+	px, py := dhGroup.ScalarMult(B.X, B.Y, e)
+	px, py = dhGroup.Add(Y.X, Y.Y, px, py)
+	px, py = dhGroup.ScalarMult(px, py, exp.Bytes())
+	if want := elliptic.Marshal(dhGroup, px, py); !bytes.Equal(client, want) {
+		t.Errorf("IKM = %x, math/big gives %x", client, want)
+	}
+
+	SK, Km2, Km3, err := deriveKeys(client, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("SK", SK, wantSK)
+	check("Km2", Km2, wantKm2)
+	check("Km3", Km3, wantKm3)
+	check("Mac1", computeHMac(mac1Key(3, Km2, Km3), XCrypt), wantMac1)
+	check("Mac2", computeHMac(Km3, append([]byte("Finish"), XCrypt...)), wantMac2)
+}
+
+// TestAuthVectorV3 is an end-to-end vector of protocol version 3: a login of
+// the credential "laptop" of "alice" with the password "correct horse" and no
+// identities set. The private keys are those of TestHmqvVectors, the OPRF key,
+// the blind, NonceU and NonceS are the SHA-256 hashes of "oprf key", "blind",
+// "nonceU" and "nonceS", and EnvU holds the hash of "envelope nonce" as nonce
+// and is sealed with the first 16 bytes of the hash of "envelope iv" as IV. The
+// keys and MACs are checked against a separate implementation of the key
+// schedule with crypto/elliptic, math/big, HKDF and HMAC that only reads
+// AuthMsg1 and AuthMsg2.
+func TestAuthVectorV3(t *testing.T) {
+	const (
+		wantSK   = "c7ad6808114335b40c88fd8d64b2882dc3568199ce0be8dd93de7e6463689d51"
+		wantMac1 = "92e19a5369430cd294670e3375d26ce96905236a8427e39a829c5722d258fe82"
+		wantMac2 = "9dc9d0bebd97bc92b9262a06041c0d5fc3889b70b0c5ee392599f1071b802fd1"
+	)
+	hash := func(s string) []byte {
+		h := sha256.Sum256([]byte(s))
+		return h[:]
+	}
+	key := func(b []byte) (*ECPrivateKey, *ECPoint) {
+		x, y := dhGroup.ScalarBaseMult(b)
+		return &ECPrivateKey{PrivateKeyBytes: b}, &ECPoint{X: x, Y: y}
+	}
+	mustDecode := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	privU, pubU := key(mustDecode("aefec962fe71cb8592d7a16a533c8292eb6f01ac8513fb84f497caea54a66257"))
+	privS, pubS := key(mustDecode("961dcc9360ea05800a0e76c414ba830e612661841ddce84c7e13c0f4aaa5e806"))
+	ephPrivU, ephPubU := key(mustDecode("9f105b2f779418ff0ed1770cbb37213edbf11e5b4f2a02db6fb05d8596f35cfd"))
+	ephPrivS, ephPubS := key(mustDecode("26d8cd779431405a837f31a4f140f127ebf4c0154f058c4840e55714a0ffde5a"))
+	password := []byte("correct horse")
+
+	// Registration and AuthInit with the fixed values.
+	k := new(big.Int).SetBytes(hash("oprf key"))
+	r, err := NewScalar().SetBytes(hash("blind"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := hashToCurve(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hElem, err := NewElement(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewIdentity().ScalarMult(r, hElem).ECPoint()
+	rwd, err := dhOprf3(password, mustEval(t, a, k), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := &envelope{PrivU: privU.PrivateKeyBytes, PubU: pubU, PubS: pubS, Nonce: hash("envelope nonce")}
+	envU, err := sealEnvelope(bytes.NewReader(hash("envelope iv")[:16]), rwd, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &User{Username: "alice", K: k, EnvU: envU, PubU: pubU}
+	csess := &AuthClientSession{
+		username:       "alice",
+		password:       password,
+		r:              r,
+		a:              a,
+		nonceU:         hash("nonceU"),
+		ephemeralPrivU: ephPrivU,
+		ephemeralPubU:  ephPubU,
+		credentialID:   "laptop",
+	}
+	msg1 := AuthMsg1{
+		Username:      "alice",
+		A:             a,
+		NonceU:        hex.EncodeToString(csess.nonceU),
+		EphemeralPubU: ephPubU,
+		CredentialID:  "laptop",
+		Version:       3,
+	}
+	// Auth1WithEphemeral erases eph, so it gets a copy of the key.
+	eph := &ServerEphemeral{
+		priv:   ECPrivateKey{PrivateKeyBytes: append([]byte(nil), ephPrivS.PrivateKeyBytes...)},
+		pub:    *ephPubS,
+		nonceS: hash("nonceS"),
+	}
+
+	ssess, msg2, err := Auth1WithEphemeral(privS, user, msg1, eph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SK, msg3, err := Auth2(csess, msg2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sk, err := Auth3(ssess, msg3); err != nil || !bytes.Equal(sk, SK) {
+		t.Fatalf("Auth3: %v", err)
+	}
+
+	// The separate implementation, from the server's side.
+	b, err := msg2.B.toECPoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	Y, err := msg2.EphemeralPubS.toECPoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	X := msg1.EphemeralPubU
+	point := func(p *ECPoint) []byte { return elliptic.Marshal(dhGroup, p.X, p.Y) }
+	compressed := func(p *ECPoint) []byte {
+		return append([]byte{2 + byte(p.Y.Bit(0))}, p.X.FillBytes(make([]byte, 32))...)
+	}
+	field := func(b []byte) []byte { return append([]byte{byte(len(b) >> 8), byte(len(b))}, b...) }
+	idS, idU := compressed(pubS), compressed(pubU)
+
+	// XCrypt: the length-prefixed label, the version as two bytes, then the
+	// fields, with points uncompressed and everything else length-prefixed.
+	XCrypt := append(field([]byte("OPAQUE-XCrypt")), 0, 3)
+	XCrypt = append(XCrypt, point(msg1.A)...)
+	XCrypt = append(XCrypt, field(mustDecode(msg1.NonceU))...)
+	XCrypt = append(XCrypt, field([]byte(msg1.Username))...)
+	XCrypt = append(XCrypt, point(X)...)
+	XCrypt = append(XCrypt, point(b)...)
+	XCrypt = append(XCrypt, field(mustDecode(msg2.EnvU))...)
+	XCrypt = append(XCrypt, field(mustDecode(msg2.NonceS))...)
+	XCrypt = append(XCrypt, point(Y)...)
+	XCrypt = append(XCrypt, field(idS)...)
+	XCrypt = append(XCrypt, field(idU)...)
+	XCrypt = append(XCrypt, 0)                    // not verifiable
+	XCrypt = append(XCrypt, field([]byte(""))...) // no proof
+	XCrypt = append(XCrypt, field([]byte(msg1.CredentialID))...)
+	digest := sha256.Sum256(XCrypt)
+	info := append([]byte("HMQVKeys"), digest[:]...)
+
+	exponent := func(p *ECPoint, id []byte) []byte {
+		input := append(field([]byte("OPAQUE-HMQV-Exponent")), 0, 3)
+		input = append(append(input, point(p)...), field(id)...)
+		h := sha256.Sum256(input)
+		return h[:16]
+	}
+	d, e := exponent(X, idS), exponent(Y, idU)
+	// (X + d*PubU)^(y + e*privS mod N).
+	N := dhGroup.Params().N
+	exp := new(big.Int).Mul(new(big.Int).SetBytes(e), new(big.Int).SetBytes(privS.PrivateKeyBytes))
+	exp.Add(exp, new(big.Int).SetBytes(ephPrivS.PrivateKeyBytes)).Mod(exp, N)
+	px, py := dhGroup.ScalarMult(pubU.X, pubU.Y, d)
+	px, py = dhGroup.Add(X.X, X.Y, px, py)
+	px, py = dhGroup.ScalarMult(px, py, exp.Bytes())
+	keys := make([]byte, 96)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, elliptic.Marshal(dhGroup, px, py), make([]byte, 32), info), keys); err != nil {
+		t.Fatal(err)
+	}
+	mac := func(key, data []byte) string {
+		h := hmac.New(sha256.New, key)
+		h.Write(data)
+		return hex.EncodeToString(h.Sum(nil))
+	}
+	wantSK2, mac1, mac2 := hex.EncodeToString(keys[:32]), mac(keys[32:64], XCrypt), mac(keys[64:], append([]byte("Finish"), XCrypt...))
+
+	for _, c := range []struct{ name, got, separate, want string }{
+		{"SK", hex.EncodeToString(SK), wantSK2, wantSK},
+		{"Mac1", msg2.Mac1, mac1, wantMac1},
+		{"Mac2", msg3.Mac2, mac2, wantMac2},
+	} {
+		if c.got != c.separate {
+			t.Errorf("%s = %s, the separate implementation gives %s", c.name, c.got, c.separate)
+		}
+		if c.got != c.want {
+			t.Errorf("%s = %s, want %s", c.name, c.got, c.want)
+		}
+	}
+}
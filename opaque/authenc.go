@@ -9,6 +9,7 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/hmac"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -142,8 +143,7 @@ func AuthDec(key []byte, input []byte) ([]byte, error) {
 	plaintext := make([]byte, len(ciphertext))
 	enc.CryptBlocks(plaintext, ciphertext)
 	fmt.Fprintf(debug, "AuthDec plaintext: %v\n", plaintext)
-	plaintext = removePadding(ciph.BlockSize(), plaintext)
-	return plaintext, nil
+	return removePadding(ciph.BlockSize(), plaintext)
 }
 
 // addPadding pads "input" using the padding algorithm from
@@ -159,17 +159,24 @@ func addPadding(blockSize int, input []byte) []byte {
 }
 
 // removePadding removes the padding from "input". See also addPadding.
-func removePadding(blockSize int, input []byte) []byte {
+//
+// A non-nil error is returned if the padding is invalid.
+func removePadding(blockSize int, input []byte) ([]byte, error) {
 	if len(input)%blockSize != 0 {
-		panic("removePadding: Input length is not a multiple of block size")
+		return nil, errors.New("removePadding: Input length is not a multiple of block size")
 	}
 	if len(input) == 0 {
-		panic("removePadding: Empty input")
+		return nil, errors.New("removePadding: Empty input")
 	}
 	b := input[len(input)-1]
-	if int(b) > blockSize {
-		panic("removePadding: Invalid padding")
+	if b == 0 || int(b) > blockSize {
+		return nil, errors.New("removePadding: Invalid padding")
+	}
+	for _, c := range input[len(input)-int(b):] {
+		if c != b {
+			return nil, errors.New("removePadding: Invalid padding")
+		}
 	}
 	input = input[:len(input)-int(b)]
-	return input
+	return input, nil
 }
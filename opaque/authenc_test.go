@@ -0,0 +1,121 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+)
+
+func TestAuthEncDec(t *testing.T) {
+	key := make([]byte, 16)
+	for n := 0; n < 40; n++ {
+		plaintext := bytes.Repeat([]byte{'a'}, n)
+		ciphertext, err := AuthEnc(rand.Reader, key, plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := AuthDec(key, ciphertext)
+		if err != nil {
+			t.Fatalf("AuthDec of %d bytes: %v", n, err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Errorf("AuthDec = %q, want %q", got, plaintext)
+		}
+		ciphertext[len(ciphertext)-1] ^= 1
+		if _, err := AuthDec(key, ciphertext); err != AuthtagMismatch {
+			t.Errorf("AuthDec of modified ciphertext: got %v, want %v", err, AuthtagMismatch)
+		}
+	}
+}
+
+func TestRemovePadding(t *testing.T) {
+	for _, tc := range []struct {
+		in  []byte
+		ok  bool
+		out []byte
+	}{
+		{bytes.Repeat([]byte{16}, 16), true, []byte{}},
+		{append([]byte("abc"), bytes.Repeat([]byte{13}, 13)...), true, []byte("abc")},
+		{nil, false, nil},
+		{make([]byte, 15), false, nil},
+		{make([]byte, 16), false, nil},
+		{bytes.Repeat([]byte{17}, 16), false, nil},
+		{append(bytes.Repeat([]byte{1}, 14), 2, 2), true, bytes.Repeat([]byte{1}, 14)},
+		{append(bytes.Repeat([]byte{1}, 14), 3, 2), false, nil},
+	} {
+		out, err := removePadding(16, tc.in)
+		if (err == nil) != tc.ok {
+			t.Errorf("removePadding(%v): err = %v", tc.in, err)
+			continue
+		}
+		if tc.ok && !bytes.Equal(out, tc.out) {
+			t.Errorf("removePadding(%v) = %v, want %v", tc.in, out, tc.out)
+		}
+	}
+}
+
+func FuzzAuthDec(f *testing.F) {
+	envU, err := hex.DecodeString(transcriptEnvU)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(make([]byte, 16), envU)
+	f.Add(make([]byte, 16), make([]byte, 48))
+	f.Add(make([]byte, 15), []byte{})
+	f.Fuzz(func(t *testing.T, key []byte, input []byte) {
+		AuthDec(key, input)
+	})
+}
+
+func FuzzRemovePadding(f *testing.F) {
+	f.Add([]byte{})
+	f.Add(bytes.Repeat([]byte{16}, 16))
+	f.Add(append([]byte("abc"), bytes.Repeat([]byte{13}, 13)...))
+	f.Fuzz(func(t *testing.T, input []byte) {
+		out, err := removePadding(16, input)
+		if err != nil {
+			return
+		}
+		if !bytes.Equal(addPadding(16, out), input) {
+			t.Errorf("removePadding accepted non-canonical padding %v", input)
+		}
+	})
+}
+
+func benchmarkAuthEnc(b *testing.B, size int) {
+	key := make([]byte, 16)
+	plaintext := make([]byte, size)
+	b.SetBytes(int64(size))
+	for i := 0; i < b.N; i++ {
+		if _, err := AuthEnc(rand.Reader, key, plaintext); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkAuthDec(b *testing.B, size int) {
+	key := make([]byte, 16)
+	ciphertext, err := AuthEnc(rand.Reader, key, make([]byte, size))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := AuthDec(key, ciphertext); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// 200 bytes is roughly the size of the envelope plaintext.
+func BenchmarkAuthEnc200(b *testing.B) { benchmarkAuthEnc(b, 200) }
+func BenchmarkAuthEnc4K(b *testing.B)  { benchmarkAuthEnc(b, 4096) }
+func BenchmarkAuthDec200(b *testing.B) { benchmarkAuthDec(b, 200) }
+func BenchmarkAuthDec4K(b *testing.B)  { benchmarkAuthDec(b, 4096) }
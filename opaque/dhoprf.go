@@ -12,7 +12,10 @@ package opaque
 import (
 	"crypto/rand"
 	"errors"
+	"fmt"
 	"math/big"
+
+	"filippo.io/nistec"
 )
 
 
@@ -21,6 +24,68 @@ func generateSalt() (k *big.Int, err error) {
 	return
 }
 
+// hashToCurve maps x to a point on dhGroup. This is the H' function from the
+// I-D. The mapping uses try-and-increment: H(ctr || x) is used as the
+// x-coordinate until a point on the curve is found.
+//
+// Of the two square roots of x^3 - 3x + b the mapping takes the one that is
+// itself a square, which is the root big.Int.ModSqrt returns for P-256, so
+// points are the same as when the mapping was computed with big.Int. The
+// square root is computed by nistec when it decompresses the point, and
+// deciding which root is a square only needs a Jacobi symbol, which is much
+// faster than the modular exponentiation ModSqrt does.
+func hashToCurve(x []byte) (*ECPoint, error) {
+	params := dhGroup.Params()
+	compressed := make([]byte, 1+coordinateLength)
+	compressed[0] = 2
+	for ctr := 0; ctr < 256; ctr++ {
+		h := hasher()
+		h.Write([]byte{byte(ctr)})
+		h.Write(x)
+		px := new(big.Int).SetBytes(h.Sum(nil))
+		if px.Cmp(params.P) >= 0 {
+			continue
+		}
+		px.FillBytes(compressed[1:])
+		// SetBytes fails if px is not the x-coordinate of a point, and
+		// otherwise returns the point with even y.
+		p, err := nistec.NewP256Point().SetBytes(compressed)
+		if err != nil {
+			continue
+		}
+		py := new(big.Int).SetBytes(p.Bytes()[1+coordinateLength:])
+		// p = 3 mod 4, so -1 is not a square and exactly one of y and
+		// p - y is.
+		if py.Sign() != 0 && big.Jacobi(py, params.P) != 1 {
+			py.Sub(params.P, py)
+		}
+		return &ECPoint{X: px, Y: py}, nil
+	}
+	return nil, errors.New("hashToCurve: no point found")
+}
+
+// dhOprf1 is the first step in computing DH-OPRF. dhOprf1 is executed on the
+// client.
+// From the I-D:
+//     U: choose random r in [0..q-1], send a=H'(x)*g^r to S
+// On an elliptic curve the blinding is done multiplicatively, a=H'(x)^r, so
+// that the client can unblind b with r^{-1}.
+func dhOprf1(x []byte) (a *ECPoint, r *Scalar, err error) {
+	p, err := hashToCurve(x)
+	if err != nil {
+		return nil, nil, err
+	}
+	h, err := NewElement(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err = RandomScalar(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return NewIdentity().ScalarMult(r, h).ECPoint(), r, nil
+}
+
 // dhOprf2 is the second step in computing DH-OPRF. dhOprf2 is executed on the
 // server.
 // From the I-D:
@@ -29,15 +94,39 @@ func generateSalt() (k *big.Int, err error) {
 func dhOprf2(a *ECPoint, k *big.Int) (b *ECPoint, err error) {
 	// From I-D: All received values (a, b) are checked to be non-unit
 	// elements in G.
-	// First check that a is in Z^*_p.
-	if !dhGroup.IsOnCurve(a.X, a.Y) {
-		return nil,  errors.New("a is not in elliptic curve")
+	// NewElement checks that a is on dhGroup. P-256 has cofactor 1, so there
+	// are no small subgroups to check for.
+	elemA, err := NewElement(a)
+	if err != nil {
+		return nil, fmt.Errorf("a: %s", err)
+	}
+	elemB := NewIdentity().ScalarMult(NewScalar().SetBigInt(k), elemA)
+	if elemB.IsIdentity() {
+		return nil, errors.New("b is the identity")
+	}
+	return elemB.ECPoint(), nil
+}
+
+// dhOprf3 is the third and final step in computing DH-OPRF. dhOprf3 is
+// executed on the client.
+// From the I-D:
+//     U: upon receiving b, output H(x, v, b*v^{-r})
+// With multiplicative blinding the unblinded value is b^{1/r}.
+func dhOprf3(x []byte, b *ECPoint, r *Scalar) ([]byte, error) {
+	elemB, err := NewElement(b)
+	if err != nil {
+		return nil, errors.New("b is not in elliptic curve")
 	}
-	// Also check that a is not in a two element subgroup of dhGroup.
-	/*if dhGroup.IsInSmallSubgroup(a) {
-		return nil, nil, errors.New("a is in a small subgroup")
-	}*/
-	var xB, yB = dhGroup.ScalarMult(a.X, a.Y, k.Bytes())
-	return &ECPoint{X: xB, Y: yB}, nil
+	u := NewIdentity().ScalarMult(NewScalar().Invert(r), elemB).ECPoint()
+	return oprfOutput(x, u), nil
 }
 
+// oprfOutput returns H(x, u), the output of DH-OPRF for the input x, where u
+// is H'(x)^k.
+func oprfOutput(x []byte, u *ECPoint) []byte {
+	h := hasher()
+	h.Write(x)
+	h.Write(u.X.Bytes())
+	h.Write(u.Y.Bytes())
+	return h.Sum(nil)
+}
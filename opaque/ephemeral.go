@@ -0,0 +1,169 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+import (
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ServerEphemeral is the server's ephemeral key pair and nonce for one run of
+// the authentication protocol. A ServerEphemeral is used at most once; Auth1
+// erases it after use.
+type ServerEphemeral struct {
+	mu     sync.Mutex
+	priv   ECPrivateKey
+	pub    ECPoint
+	nonceS []byte
+	used   bool
+}
+
+// NewServerEphemeral generates a fresh ephemeral key pair and NonceS.
+func NewServerEphemeral() (*ServerEphemeral, error) {
+	sk, x, y, err := elliptic.GenerateKey(dhGroup, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	nonceS := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, nonceS); err != nil {
+		return nil, err
+	}
+	return &ServerEphemeral{
+		priv:   ECPrivateKey{PrivateKeyBytes: sk},
+		pub:    ECPoint{X: x, Y: y},
+		nonceS: nonceS,
+	}, nil
+}
+
+// take marks e as used and returns its contents. A non-nil error is returned
+// if e has been used before.
+func (e *ServerEphemeral) take() (*ECPrivateKey, *ECPoint, []byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.used {
+		return nil, nil, nil, errors.New("ephemeral key already used")
+	}
+	e.used = true
+	return &e.priv, &e.pub, e.nonceS, nil
+}
+
+// erase overwrites the private key. NonceS and the public key are sent to the
+// client and need not be erased.
+func (e *ServerEphemeral) erase() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.used = true
+	for i := range e.priv.PrivateKeyBytes {
+		e.priv.PrivateKeyBytes[i] = 0
+	}
+}
+
+// EphemeralPool keeps a number of ServerEphemeral values ready so that Auth1
+// does not have to generate a key pair while the client waits. A background
+// goroutine refills the pool as values are taken.
+type EphemeralPool struct {
+	ready   chan *ServerEphemeral
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+
+	generate func() (*ServerEphemeral, error)
+
+	hits   int64
+	misses int64
+}
+
+// NewEphemeralPool starts a pool holding up to size ephemeral values. Call
+// Close to stop the background goroutine and erase the values left in the
+// pool.
+func NewEphemeralPool(size int) *EphemeralPool {
+	return newEphemeralPool(size, NewServerEphemeral)
+}
+
+// ephemeralRetryDelay is how long the background goroutine waits before it
+// tries again after failing to generate a value.
+const ephemeralRetryDelay = 100 * time.Millisecond
+
+func newEphemeralPool(size int, generate func() (*ServerEphemeral, error)) *EphemeralPool {
+	p := &EphemeralPool{
+		ready:    make(chan *ServerEphemeral, size),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		generate: generate,
+	}
+	go p.produce()
+	return p
+}
+
+func (p *EphemeralPool) produce() {
+	defer close(p.stopped)
+	for {
+		e, err := p.generate()
+		if err != nil {
+			// Get falls back to generating values itself. Wait before
+			// trying again, so a failing random source is not polled in
+			// a busy loop.
+			select {
+			case <-time.After(ephemeralRetryDelay):
+				continue
+			case <-p.done:
+				p.drain()
+				return
+			}
+		}
+		select {
+		case p.ready <- e:
+		case <-p.done:
+			e.erase()
+			p.drain()
+			return
+		}
+	}
+}
+
+// drain erases the values left in the pool.
+func (p *EphemeralPool) drain() {
+	for {
+		select {
+		case e := <-p.ready:
+			e.erase()
+		default:
+			return
+		}
+	}
+}
+
+// Get returns an unused ephemeral value. If the pool is empty a new value is
+// generated directly, so Get never waits for the background goroutine.
+func (p *EphemeralPool) Get() (*ServerEphemeral, error) {
+	select {
+	case e := <-p.ready:
+		atomic.AddInt64(&p.hits, 1)
+		return e, nil
+	default:
+		atomic.AddInt64(&p.misses, 1)
+		return NewServerEphemeral()
+	}
+}
+
+// Stats returns the number of Get calls served from the pool and the number
+// that had to generate a new value.
+func (p *EphemeralPool) Stats() (hits, misses int64) {
+	return atomic.LoadInt64(&p.hits), atomic.LoadInt64(&p.misses)
+}
+
+// Close stops the background goroutine and erases the values in the pool.
+func (p *EphemeralPool) Close() {
+	p.once.Do(func() {
+		close(p.done)
+		<-p.stopped
+	})
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestEphemeralPool(t *testing.T) {
+	p := NewEphemeralPool(4)
+	defer p.Close()
+	// Give the producer time to fill the pool.
+	for i := 0; i < 100 && len(p.ready) < cap(p.ready); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	seen := map[string]bool{}
+	for i := 0; i < 8; i++ {
+		e, err := p.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := string(e.priv.PrivateKeyBytes)
+		if seen[key] {
+			t.Fatal("Get returned the same key twice")
+		}
+		seen[key] = true
+	}
+	if hits, misses := p.Stats(); hits == 0 || hits+misses != 8 {
+		t.Errorf("Stats = %d hits, %d misses", hits, misses)
+	}
+}
+
+func TestAuth1ErasesEphemeral(t *testing.T) {
+	quietT(t)
+	privS, pubS := newServerKey(t)
+	user := register(t, pubS, "alice", "secret")
+	csess, msg1, err := AuthInit("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	eph, err := NewServerEphemeral()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ssess, msg2, err := Auth1WithEphemeral(privS, user, msg1, eph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(eph.priv.PrivateKeyBytes, make([]byte, len(eph.priv.PrivateKeyBytes))) {
+		t.Error("ephemeral private key not erased")
+	}
+	if _, _, err := Auth1WithEphemeral(privS, user, msg1, eph); err == nil {
+		t.Error("ephemeral key used twice")
+	}
+
+	// The login still completes.
+	_, msg3, err := Auth2(csess, msg2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Auth3(ssess, msg3); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEphemeralPoolClose(t *testing.T) {
+	p := NewEphemeralPool(2)
+	for i := 0; i < 100 && len(p.ready) < cap(p.ready); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	p.Close()
+	if n := len(p.ready); n != 0 {
+		t.Errorf("%d values left in a closed pool", n)
+	}
+	// Get still works on a closed pool.
+	if _, err := p.Get(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEphemeralPoolCloseWhileFailing(t *testing.T) {
+	p := newEphemeralPool(2, func() (*ServerEphemeral, error) {
+		return nil, errors.New("no randomness")
+	})
+	closed := make(chan struct{})
+	go func() {
+		p.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(10 * ephemeralRetryDelay):
+		t.Fatal("Close did not return while generation was failing")
+	}
+}
@@ -0,0 +1,290 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+// This file contains the group backend used by DH-OPRF and HMQV. Scalars are
+// integers modulo the order N of dhGroup and elements are points on dhGroup.
+// Both are backed by constant-time implementations, so secret values such as
+// OPRF keys and private keys do not leak through timing, and every scalar is
+// reduced modulo N.
+//
+// ECPoint and *big.Int remain the types used in messages and in User. Convert
+// at the boundary with NewElement/Element.ECPoint and NewScalar().SetBigInt.
+
+import (
+	"errors"
+	"io"
+	"math/big"
+
+	"filippo.io/bigmod"
+	"filippo.io/nistec"
+)
+
+// scalarLength is the length in bytes of an encoded scalar and of an encoded
+// coordinate.
+const scalarLength = 32
+
+var groupOrder *bigmod.Modulus
+
+// wideShift is 2^256 mod N. It is used to reduce 64 byte values.
+var wideShift *bigmod.Nat
+
+func init() {
+	var err error
+	groupOrder, err = bigmod.NewModulus(dhGroup.Params().N.Bytes())
+	if err != nil {
+		panic(err)
+	}
+	two256 := new(big.Int).Lsh(big.NewInt(1), 256)
+	two256.Mod(two256, dhGroup.Params().N)
+	wideShift, err = bigmod.NewNat().SetBytes(two256.Bytes(), groupOrder)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Scalar is an integer modulo the order of dhGroup. The zero value is not
+// usable; use NewScalar.
+type Scalar struct {
+	n *bigmod.Nat
+}
+
+// NewScalar returns a new Scalar set to zero.
+func NewScalar() *Scalar {
+	return &Scalar{n: bigmod.NewNat().ExpandFor(groupOrder)}
+}
+
+// RandomScalar returns a uniformly random non-zero scalar read from randr.
+func RandomScalar(randr io.Reader) (*Scalar, error) {
+	// Reducing 64 random bytes gives a negligible bias.
+	b := make([]byte, 2*scalarLength)
+	for {
+		if _, err := io.ReadFull(randr, b); err != nil {
+			return nil, err
+		}
+		s := NewScalar().SetUniformBytes(b)
+		if !s.IsZero() {
+			return s, nil
+		}
+	}
+}
+
+// Set sets s = x and returns s.
+func (s *Scalar) Set(x *Scalar) *Scalar {
+	s.n = bigmod.NewNat().ExpandFor(groupOrder).Add(x.n, groupOrder)
+	return s
+}
+
+// SetBytes sets s to the big-endian value b reduced modulo N. b may be at most
+// scalarLength bytes long.
+func (s *Scalar) SetBytes(b []byte) (*Scalar, error) {
+	if len(b) > scalarLength {
+		return nil, errors.New("scalar too long")
+	}
+	padded := make([]byte, scalarLength)
+	copy(padded[scalarLength-len(b):], b)
+	n, err := bigmod.NewNat().SetOverflowingBytes(padded, groupOrder)
+	if err != nil {
+		return nil, err
+	}
+	s.n = n
+	return s, nil
+}
+
+// SetUniformBytes sets s to the big-endian value b reduced modulo N. b must be
+// 2*scalarLength bytes long, which is enough for the result to be close to
+// uniform when b is.
+func (s *Scalar) SetUniformBytes(b []byte) *Scalar {
+	if len(b) != 2*scalarLength {
+		panic("SetUniformBytes: wrong input length")
+	}
+	hi, err := NewScalar().SetBytes(b[:scalarLength])
+	if err != nil {
+		panic(err)
+	}
+	lo, err := NewScalar().SetBytes(b[scalarLength:])
+	if err != nil {
+		panic(err)
+	}
+	s.n = hi.n.Mul(wideShift, groupOrder).Add(lo.n, groupOrder)
+	return s
+}
+
+// SetBigInt sets s = k mod N and returns s. The magnitude of k is reduced in
+// scalarLength byte chunks with the constant-time group order arithmetic, so
+// only the length and sign of k affect the running time.
+func (s *Scalar) SetBigInt(k *big.Int) *Scalar {
+	b := new(big.Int).Abs(k).Bytes()
+	padded := make([]byte, (len(b)+scalarLength-1)/scalarLength*scalarLength)
+	copy(padded[len(padded)-len(b):], b)
+	acc := bigmod.NewNat().ExpandFor(groupOrder)
+	for i := 0; i < len(padded); i += scalarLength {
+		chunk, err := bigmod.NewNat().SetOverflowingBytes(padded[i:i+scalarLength], groupOrder)
+		if err != nil {
+			panic(err)
+		}
+		acc.Mul(wideShift, groupOrder).Add(chunk, groupOrder)
+	}
+	if k.Sign() < 0 {
+		acc = bigmod.NewNat().ExpandFor(groupOrder).Sub(acc, groupOrder)
+	}
+	s.n = acc
+	return s
+}
+
+// Bytes returns the scalarLength byte big-endian encoding of s.
+func (s *Scalar) Bytes() []byte {
+	return s.n.Bytes(groupOrder)
+}
+
+// BigInt returns s as a *big.Int.
+func (s *Scalar) BigInt() *big.Int {
+	return new(big.Int).SetBytes(s.Bytes())
+}
+
+// IsZero reports whether s is zero.
+func (s *Scalar) IsZero() bool {
+	return s.n.IsZero() == 1
+}
+
+// Equal reports whether s and x are equal.
+func (s *Scalar) Equal(x *Scalar) bool {
+	return s.n.Equal(x.n) == 1
+}
+
+// Add sets s = a + b mod N and returns s.
+func (s *Scalar) Add(a, b *Scalar) *Scalar {
+	s.n = bigmod.NewNat().ExpandFor(groupOrder).Add(a.n, groupOrder).Add(b.n, groupOrder)
+	return s
+}
+
+// Sub sets s = a - b mod N and returns s.
+func (s *Scalar) Sub(a, b *Scalar) *Scalar {
+	s.n = bigmod.NewNat().ExpandFor(groupOrder).Add(a.n, groupOrder).Sub(b.n, groupOrder)
+	return s
+}
+
+// Mul sets s = a * b mod N and returns s.
+func (s *Scalar) Mul(a, b *Scalar) *Scalar {
+	s.n = bigmod.NewNat().ExpandFor(groupOrder).Add(a.n, groupOrder).Mul(b.n, groupOrder)
+	return s
+}
+
+// Invert sets s = 1/a mod N and returns s. The inverse is computed as
+// a^(N-2), which takes the same time for every a. If a is zero s is set to
+// zero.
+func (s *Scalar) Invert(a *Scalar) *Scalar {
+	nMinus2 := new(big.Int).Sub(dhGroup.Params().N, big.NewInt(2))
+	s.n = bigmod.NewNat().ExpandFor(groupOrder).Exp(a.n, nMinus2.Bytes(), groupOrder)
+	return s
+}
+
+// Element is a point on dhGroup. The zero value is not usable; use
+// NewElement or NewIdentity.
+type Element struct {
+	p *nistec.P256Point
+}
+
+// NewIdentity returns the identity element (the point at infinity).
+func NewIdentity() *Element {
+	return &Element{p: nistec.NewP256Point()}
+}
+
+// NewGenerator returns the generator of dhGroup.
+func NewGenerator() *Element {
+	return &Element{p: nistec.NewP256Point().SetGenerator()}
+}
+
+// NewElement converts p to an Element. A non-nil error is returned if p is
+// missing or not on dhGroup.
+func NewElement(p *ECPoint) (*Element, error) {
+	if p == nil || p.X == nil || p.Y == nil {
+		return nil, errors.New("point is missing")
+	}
+	if p.X.Sign() < 0 || p.Y.Sign() < 0 || p.X.BitLen() > 8*scalarLength || p.Y.BitLen() > 8*scalarLength {
+		return nil, errors.New("point is not in elliptic curve")
+	}
+	b := make([]byte, 1+2*scalarLength)
+	b[0] = 4
+	p.X.FillBytes(b[1 : 1+scalarLength])
+	p.Y.FillBytes(b[1+scalarLength:])
+	return NewIdentity().SetBytes(b)
+}
+
+// SetBytes sets e to the SEC 1 encoded point b, compressed or uncompressed.
+func (e *Element) SetBytes(b []byte) (*Element, error) {
+	p, err := nistec.NewP256Point().SetBytes(b)
+	if err != nil {
+		return nil, errors.New("point is not in elliptic curve")
+	}
+	e.p = p
+	return e, nil
+}
+
+// ECPoint converts e to an ECPoint. It panics if e is the identity, which has
+// no affine coordinates.
+func (e *Element) ECPoint() *ECPoint {
+	b := e.p.Bytes()
+	if len(b) != 1+2*scalarLength {
+		panic("ECPoint: identity element")
+	}
+	return &ECPoint{
+		X: new(big.Int).SetBytes(b[1 : 1+scalarLength]),
+		Y: new(big.Int).SetBytes(b[1+scalarLength:]),
+	}
+}
+
+// Bytes returns the uncompressed SEC 1 encoding of e.
+func (e *Element) Bytes() []byte {
+	return e.p.Bytes()
+}
+
+// BytesCompressed returns the compressed SEC 1 encoding of e.
+func (e *Element) BytesCompressed() []byte {
+	return e.p.BytesCompressed()
+}
+
+// IsIdentity reports whether e is the identity element.
+func (e *Element) IsIdentity() bool {
+	return len(e.p.Bytes()) == 1
+}
+
+// Equal reports whether e and x are the same point.
+func (e *Element) Equal(x *Element) bool {
+	return string(e.p.Bytes()) == string(x.p.Bytes())
+}
+
+// Set sets e = x and returns e.
+func (e *Element) Set(x *Element) *Element {
+	e.p = nistec.NewP256Point().Set(x.p)
+	return e
+}
+
+// Add sets e = a + b and returns e.
+func (e *Element) Add(a, b *Element) *Element {
+	e.p = nistec.NewP256Point().Add(a.p, b.p)
+	return e
+}
+
+// ScalarMult sets e = s * x and returns e.
+func (e *Element) ScalarMult(s *Scalar, x *Element) *Element {
+	p, err := nistec.NewP256Point().ScalarMult(x.p, s.Bytes())
+	if err != nil {
+		panic(err)
+	}
+	e.p = p
+	return e
+}
+
+// ScalarBaseMult sets e = s * G, where G is the generator, and returns e.
+func (e *Element) ScalarBaseMult(s *Scalar) *Element {
+	p, err := nistec.NewP256Point().ScalarBaseMult(s.Bytes())
+	if err != nil {
+		panic(err)
+	}
+	e.p = p
+	return e
+}
@@ -0,0 +1,284 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+)
+
+// hmqvSecretBigInt is the HMQV computation as it was done with *big.Int and
+// dhGroup.ScalarMult before the constant-time backend. It is kept as a
+// reference for tests and benchmarks.
+func hmqvSecretBigInt(ephemeralPubPeer, pubPeer *ECPoint, qPeer []byte,
+	ephemeralPriv, priv *ECPrivateKey, qOwn []byte) []byte {
+	var qOwnNum = new(big.Int).SetBytes(qOwn)
+	var ePrivNum = new(big.Int).SetBytes(ephemeralPriv.PrivateKeyBytes)
+	var privNum = new(big.Int).SetBytes(priv.PrivateKeyBytes)
+
+	var exp = big.NewInt(0).Add(ePrivNum, big.NewInt(1).Mul(qOwnNum, privNum)).Bytes()
+
+	var xPubQ, yPubQ = dhGroup.ScalarMult(pubPeer.X, pubPeer.Y, qPeer)
+	var xSum, ySum = dhGroup.Add(ephemeralPubPeer.X, ephemeralPubPeer.Y, xPubQ, yPubQ)
+	var xIkms, yIkms = dhGroup.ScalarMult(xSum, ySum, exp)
+	return append(xIkms.Bytes(), yIkms.Bytes()...)
+}
+
+// hashToCurveBigInt is hashToCurve as it was computed with big.Int.ModSqrt.
+// It is kept as a reference for tests and benchmarks.
+func hashToCurveBigInt(x []byte) (*ECPoint, error) {
+	params := dhGroup.Params()
+	three := big.NewInt(3)
+	for ctr := 0; ctr < 256; ctr++ {
+		h := hasher()
+		h.Write([]byte{byte(ctr)})
+		h.Write(x)
+		px := new(big.Int).SetBytes(h.Sum(nil))
+		if px.Cmp(params.P) >= 0 {
+			continue
+		}
+		// y^2 = x^3 - 3x + b
+		y2 := new(big.Int).Exp(px, three, params.P)
+		y2.Sub(y2, new(big.Int).Mul(px, three))
+		y2.Add(y2, params.B)
+		y2.Mod(y2, params.P)
+		py := new(big.Int).ModSqrt(y2, params.P)
+		if py == nil {
+			continue
+		}
+		return &ECPoint{X: px, Y: py}, nil
+	}
+	return nil, errors.New("hashToCurve: no point found")
+}
+
+func randomScalar(t testing.TB) *Scalar {
+	s, err := RandomScalar(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestScalarArithmetic(t *testing.T) {
+	N := dhGroup.Params().N
+	for i := 0; i < 50; i++ {
+		a, b := randomScalar(t), randomScalar(t)
+		aInt, bInt := a.BigInt(), b.BigInt()
+
+		sum := new(big.Int).Add(aInt, bInt)
+		if got := NewScalar().Add(a, b).BigInt(); got.Cmp(sum.Mod(sum, N)) != 0 {
+			t.Errorf("Add = %v, want %v", got, sum)
+		}
+		diff := new(big.Int).Sub(aInt, bInt)
+		if got := NewScalar().Sub(a, b).BigInt(); got.Cmp(diff.Mod(diff, N)) != 0 {
+			t.Errorf("Sub = %v, want %v", got, diff)
+		}
+		prod := new(big.Int).Mul(aInt, bInt)
+		if got := NewScalar().Mul(a, b).BigInt(); got.Cmp(prod.Mod(prod, N)) != 0 {
+			t.Errorf("Mul = %v, want %v", got, prod)
+		}
+		inv := new(big.Int).ModInverse(aInt, N)
+		if got := NewScalar().Invert(a).BigInt(); got.Cmp(inv) != 0 {
+			t.Errorf("Invert = %v, want %v", got, inv)
+		}
+
+		wide := make([]byte, 64)
+		rand.Read(wide)
+		want := new(big.Int).SetBytes(wide)
+		if got := NewScalar().SetUniformBytes(wide).BigInt(); got.Cmp(want.Mod(want, N)) != 0 {
+			t.Errorf("SetUniformBytes = %v, want %v", got, want)
+		}
+	}
+	// N itself and values above it are reduced.
+	if !NewScalar().SetBigInt(N).IsZero() {
+		t.Error("N is not reduced to zero")
+	}
+	nPlus1 := new(big.Int).Add(N, big.NewInt(1))
+	if got := NewScalar().SetBigInt(nPlus1).BigInt(); got.Cmp(big.NewInt(1)) != 0 {
+		t.Errorf("N+1 reduced to %v", got)
+	}
+	// Values wider than a scalar and negative values are reduced as well.
+	for _, k := range []*big.Int{
+		new(big.Int).Lsh(N, 300),
+		new(big.Int).Add(new(big.Int).Lsh(big.NewInt(1), 600), big.NewInt(7)),
+		big.NewInt(-3),
+		new(big.Int).Neg(new(big.Int).Lsh(N, 40)),
+	} {
+		want := new(big.Int).Mod(k, N)
+		if got := NewScalar().SetBigInt(k).BigInt(); got.Cmp(want) != 0 {
+			t.Errorf("SetBigInt(%v) = %v, want %v", k, got, want)
+		}
+	}
+}
+
+func TestElementScalarMult(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		k := randomScalar(t)
+		x, y := dhGroup.ScalarBaseMult(k.Bytes())
+		got := NewIdentity().ScalarBaseMult(k).ECPoint()
+		if got.X.Cmp(x) != 0 || got.Y.Cmp(y) != 0 {
+			t.Fatalf("ScalarBaseMult mismatch for %v", k.BigInt())
+		}
+		p, err := NewElement(got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := randomScalar(t)
+		x, y = dhGroup.ScalarMult(x, y, l.Bytes())
+		got = NewIdentity().ScalarMult(l, p).ECPoint()
+		if got.X.Cmp(x) != 0 || got.Y.Cmp(y) != 0 {
+			t.Fatalf("ScalarMult mismatch")
+		}
+	}
+	if _, err := NewElement(&ECPoint{X: big.NewInt(1), Y: big.NewInt(1)}); err == nil {
+		t.Error("NewElement accepted a point off the curve")
+	}
+	if _, err := NewElement(&ECPoint{X: big.NewInt(-1), Y: big.NewInt(1)}); err == nil {
+		t.Error("NewElement accepted a negative coordinate")
+	}
+}
+
+func hmqvInputs(t testing.TB) (ePub, pub *ECPoint, q1, q2 []byte, ePriv, priv *ECPrivateKey) {
+	ePriv, ePub = newServerKey(t)
+	priv, pub = newServerKey(t)
+	h1 := sha256.Sum256([]byte("q1"))
+	h2 := sha256.Sum256([]byte("q2"))
+	return ePub, pub, h1[:], h2[:], ePriv, priv
+}
+
+func TestHmqvSecretMatchesBigInt(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		ePub, pub, q1, q2, ePriv, priv := hmqvInputs(t)
+		got, err := hmqvSecret(1, ePub, pub, q1, ePriv, priv, q2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := hmqvSecretBigInt(ePub, pub, q1, ePriv, priv, q2); !bytes.Equal(got, want) {
+			t.Errorf("hmqvSecret = %x, want %x", got, want)
+		}
+	}
+}
+
+func BenchmarkScalarMultBigInt(b *testing.B) {
+	_, p := newServerKey(b)
+	k := randomScalar(b).Bytes()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dhGroup.ScalarMult(p.X, p.Y, k)
+	}
+}
+
+func BenchmarkScalarMult(b *testing.B) {
+	_, p := newServerKey(b)
+	k := randomScalar(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		e, err := NewElement(p)
+		if err != nil {
+			b.Fatal(err)
+		}
+		NewIdentity().ScalarMult(k, e).ECPoint()
+	}
+}
+
+func BenchmarkDhOprf2BigInt(b *testing.B) {
+	_, a := newServerKey(b)
+	k := randomScalar(b).BigInt()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !dhGroup.IsOnCurve(a.X, a.Y) {
+			b.Fatal("not on curve")
+		}
+		dhGroup.ScalarMult(a.X, a.Y, k.Bytes())
+	}
+}
+
+func BenchmarkDhOprf2(b *testing.B) {
+	_, a := newServerKey(b)
+	k := randomScalar(b).BigInt()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := dhOprf2(a, k); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkHmqvSecretBigInt(b *testing.B) {
+	ePub, pub, q1, q2, ePriv, priv := hmqvInputs(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		hmqvSecretBigInt(ePub, pub, q1, ePriv, priv, q2)
+	}
+}
+
+func BenchmarkHmqvSecret(b *testing.B) {
+	ePub, pub, q1, q2, ePriv, priv := hmqvInputs(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := hmqvSecret(1, ePub, pub, q1, ePriv, priv, q2); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestHashToCurveMatchesBigInt(t *testing.T) {
+	// Points must not change, or registered users could no longer log in.
+	for i := 0; i < 1000; i++ {
+		x := []byte(fmt.Sprintf("password %d", i))
+		want, err := hashToCurveBigInt(x)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := hashToCurve(x)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.X.Cmp(want.X) != 0 || got.Y.Cmp(want.Y) != 0 {
+			t.Fatalf("hashToCurve(%q) = (%x, %x), want (%x, %x)", x, got.X, got.Y, want.X, want.Y)
+		}
+	}
+}
+
+func BenchmarkHashToCurveBigInt(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		if _, err := hashToCurveBigInt([]byte(fmt.Sprint(i))); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkHashToCurve(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		if _, err := hashToCurve([]byte(fmt.Sprint(i))); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDhOprf1BigInt(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		p, err := hashToCurveBigInt([]byte(fmt.Sprint(i)))
+		if err != nil {
+			b.Fatal(err)
+		}
+		r := randomScalar(b).Bytes()
+		dhGroup.ScalarMult(p.X, p.Y, r)
+	}
+}
+
+func BenchmarkDhOprf1(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		if _, _, err := dhOprf1([]byte(fmt.Sprint(i))); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
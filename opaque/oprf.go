@@ -0,0 +1,296 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+// This file exposes the DH-OPRF from dhoprf.go on its own, for uses other
+// than password registration and authentication: hardening secrets with a
+// server-held key, rate-limited hashing and private set membership. A
+// client blinds a batch of inputs with OprfBlind, the server evaluates the
+// batch under one of its keys with OprfEvaluate, and the client unblinds the
+// result with OprfFinalize. The output for an input is
+// H(input, H'(input)^k), the same function as RwdU in OPAQUE.
+//
+// If the client asks for it, the server proves with a single DLEQ proof that
+// it evaluated the whole batch with the key whose public key it sends, see
+// voprf.go. Requests with Info use the partially oblivious variant from
+// poprf.go instead.
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// MaxOprfBatch is the largest number of elements in one OprfRequest.
+const MaxOprfBatch = 64
+
+// OprfRequest is a batch of blinded inputs to be evaluated under the
+// server's key named KeyName. It is sent from the client to the server.
+//
+// The field is not called Key because RemoveQuotesFromJson would take its
+// value for a coordinate.
+type OprfRequest struct {
+	KeyName  string
+	Elements []*ECPoint
+	// Verifiable asks the server to include its public key and a proof of
+	// the evaluation in the OprfResponse.
+	Verifiable bool `json:",omitempty"`
+	// Info, if not nil, is public metadata that tweaks the key, see
+	// poprf.go.
+	Info *string `json:",omitempty"`
+}
+
+// OprfResponse is the server's answer to an OprfRequest. Elements[i] is
+// OprfRequest.Elements[i]^k, or OprfRequest.Elements[i]^(1/t) for the
+// tweaked key t if OprfRequest.Info is set. PubK=g^k and Proof are set if
+// OprfRequest.Verifiable is.
+type OprfResponse struct {
+	Elements []*Point
+	PubK     *Point `json:",omitempty"`
+	Proof    string `json:",omitempty"`
+}
+
+// OprfClientSession keeps track of the state needed on the client between
+// OprfBlind and OprfFinalize.
+type OprfClientSession struct {
+	inputs  [][]byte
+	blinded []*ECPoint
+	r       []*Scalar
+	info    *string
+	// pinned is the public key the server must prove its evaluation
+	// against, if the client knows it.
+	pinned *ECPoint
+	// pubK is the verified public key of the server, set by OprfFinalize.
+	pubK *ECPoint
+}
+
+// OprfBlind blinds inputs for evaluation under the server's key named key.
+// The returned OprfRequest should be sent to the server. The request asks
+// for a proof of the evaluation; if pubK is not nil, OprfFinalize checks the
+// proof against pubK and otherwise against the public key in the response.
+func OprfBlind(key string, inputs [][]byte, pubK *ECPoint) (*OprfClientSession, OprfRequest, error) {
+	return oprfBlind(key, nil, inputs, pubK)
+}
+
+func oprfBlind(key string, info *string, inputs [][]byte, pubK *ECPoint) (*OprfClientSession, OprfRequest, error) {
+	if len(inputs) == 0 || len(inputs) > MaxOprfBatch {
+		return nil, OprfRequest{}, fmt.Errorf("batch of %d inputs, must be 1 to %d", len(inputs), MaxOprfBatch)
+	}
+	if pubK != nil {
+		if err := checkPoint("pubK", pubK); err != nil {
+			return nil, OprfRequest{}, err
+		}
+	}
+	if info != nil && len(*info) > maxInfoLength {
+		return nil, OprfRequest{}, errInfoLength
+	}
+	sess := &OprfClientSession{pinned: pubK, info: info}
+	for _, x := range inputs {
+		a, r, err := dhOprf1(x)
+		if err != nil {
+			return nil, OprfRequest{}, err
+		}
+		sess.inputs = append(sess.inputs, append([]byte(nil), x...))
+		sess.blinded = append(sess.blinded, a)
+		sess.r = append(sess.r, r)
+	}
+	req := OprfRequest{KeyName: key, Elements: sess.blinded, Verifiable: true, Info: info}
+	return sess, req, nil
+}
+
+// DecodeOprfRequest parses an OprfRequest sent by a client and checks the
+// size of the batch and that all points in it are valid.
+func DecodeOprfRequest(data []byte) (OprfRequest, error) {
+	var req OprfRequest
+	if err := json.Unmarshal([]byte(RemoveQuotesFromJson(string(data))), &req); err != nil {
+		return OprfRequest{}, err
+	}
+	if len(req.Elements) == 0 || len(req.Elements) > MaxOprfBatch {
+		return OprfRequest{}, fmt.Errorf("batch of %d elements, must be 1 to %d", len(req.Elements), MaxOprfBatch)
+	}
+	for i, a := range req.Elements {
+		if err := checkPoint(fmt.Sprintf("Elements[%d]", i), a); err != nil {
+			return OprfRequest{}, err
+		}
+	}
+	if req.Info != nil && len(*req.Info) > maxInfoLength {
+		return OprfRequest{}, errInfoLength
+	}
+	return req, nil
+}
+
+// OprfEvaluate is invoked on the server. It evaluates the elements of req
+// under the key k. k must be a key for requests of the kind of req, from
+// DeriveOprfKey if req has no Info and from DerivePoprfKey if it has.
+func OprfEvaluate(k *big.Int, req OprfRequest) (OprfResponse, error) {
+	if len(req.Elements) == 0 || len(req.Elements) > MaxOprfBatch {
+		return OprfResponse{}, fmt.Errorf("batch of %d elements, must be 1 to %d", len(req.Elements), MaxOprfBatch)
+	}
+	key := NewScalar().SetBigInt(k)
+	// The elements are raised to evalKey and the proof is for proofKey.
+	mode, proofKey, evalKey := byte(modeVOPRF), key, k
+	if req.Info != nil {
+		if len(*req.Info) > maxInfoLength {
+			return OprfResponse{}, errInfoLength
+		}
+		t, err := poprfTweakKey(key, []byte(*req.Info))
+		if err != nil {
+			return OprfResponse{}, err
+		}
+		mode, proofKey, evalKey = modePOPRF, t, NewScalar().Invert(t).BigInt()
+	}
+	var res OprfResponse
+	var blinded, evaluated []*Element
+	for i, a := range req.Elements {
+		b, err := dhOprf2(a, evalKey)
+		if err != nil {
+			return OprfResponse{}, fmt.Errorf("Elements[%d]: %s", i, err)
+		}
+		res.Elements = append(res.Elements, toPoint(b))
+		if req.Verifiable {
+			// dhOprf2 has checked both points.
+			c, _ := NewElement(a)
+			d, _ := NewElement(b)
+			blinded, evaluated = append(blinded, c), append(evaluated, d)
+		}
+	}
+	if req.Verifiable {
+		cs, ds := blinded, evaluated
+		if mode == modePOPRF {
+			// blinded = evaluated^t.
+			cs, ds = evaluated, blinded
+		}
+		pk := NewIdentity().ScalarBaseMult(proofKey)
+		proof, err := generateProof(mode, proofKey, NewGenerator(), pk, cs, ds)
+		if err != nil {
+			return OprfResponse{}, err
+		}
+		res.PubK = toPoint(NewIdentity().ScalarBaseMult(key).ECPoint())
+		res.Proof = hex.EncodeToString(proof)
+	}
+	return res, nil
+}
+
+// OprfFinalize is invoked on the client when it has received the
+// OprfResponse. It returns the OPRF outputs in the order of the inputs given
+// to OprfBlind.
+//
+// InvalidProof is returned if the response has no valid proof for the whole
+// batch, or if the proof is for another key than the one given to OprfBlind.
+func OprfFinalize(sess *OprfClientSession, res OprfResponse) ([][]byte, error) {
+	if len(res.Elements) != len(sess.blinded) {
+		return nil, fmt.Errorf("got %d elements, want %d", len(res.Elements), len(sess.blinded))
+	}
+	evaluated := make([]*ECPoint, len(res.Elements))
+	for i, p := range res.Elements {
+		b, err := p.toECPoint()
+		if err != nil {
+			return nil, fmt.Errorf("Elements[%d]: %s", i, err)
+		}
+		evaluated[i] = b
+	}
+
+	pubK := sess.pinned
+	if pubK == nil {
+		if res.PubK == nil {
+			return nil, InvalidProof
+		}
+		p, err := res.PubK.toECPoint()
+		if err != nil {
+			return nil, InvalidProof
+		}
+		pubK = p
+	}
+	pk, err := NewElement(pubK)
+	if err != nil {
+		return nil, InvalidProof
+	}
+	if sess.info == nil {
+		err = checkBatchProof(modeVOPRF, pk, sess.blinded, evaluated, res.Proof)
+	} else {
+		var tweaked *Element
+		tweaked, err = poprfTweakPublicKey(pk, []byte(*sess.info))
+		if err != nil {
+			return nil, err
+		}
+		err = checkBatchProof(modePOPRF, tweaked, evaluated, sess.blinded, res.Proof)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sess.pubK = pubK
+
+	outputs := make([][]byte, len(evaluated))
+	for i, b := range evaluated {
+		var out []byte
+		if sess.info == nil {
+			out, err = dhOprf3(sess.inputs[i], b, sess.r[i])
+		} else {
+			out, err = poprfFinalize(sess.inputs[i], []byte(*sess.info), b, sess.r[i])
+		}
+		if err != nil {
+			return nil, err
+		}
+		outputs[i] = out
+	}
+	return outputs, nil
+}
+
+// OprfKey returns the server's public key once OprfFinalize has verified the
+// evaluation. A client can keep it and pass it to OprfBlind later.
+func (sess *OprfClientSession) OprfKey() *ECPoint {
+	return sess.pubK
+}
+
+// OprfOutput returns the output of the OPRF for input under the key k, as
+// OprfFinalize would for a request evaluated under k without Info. It is used
+// by a server that knows k to check an output presented to it.
+func OprfOutput(k *big.Int, input []byte) ([]byte, error) {
+	p, err := hashToCurve(input)
+	if err != nil {
+		return nil, err
+	}
+	h, err := NewElement(p)
+	if err != nil {
+		return nil, err
+	}
+	u := NewIdentity().ScalarMult(NewScalar().SetBigInt(k), h)
+	if u.IsIdentity() {
+		return nil, errors.New("k is zero")
+	}
+	return oprfOutput(input, u.ECPoint()), nil
+}
+
+// DeriveOprfKey derives the key named name from seed, which must be at least
+// 32 bytes, with DeriveKeyPair from RFC 9497. It returns the key and its
+// public key. The key is for requests without Info; see DerivePoprfKey.
+func DeriveOprfKey(seed []byte, name string) (*big.Int, *ECPoint, error) {
+	return deriveNamedKey(modeVOPRF, seed, name)
+}
+
+// DerivePoprfKey is like DeriveOprfKey but derives the key for requests with
+// Info. RFC 9497 derives the keys of each mode with their own context
+// string, so the POPRF key is unrelated to the OPRF key of the same name and
+// the server never answers both a^k and a^(1/(k+m)) for one k.
+func DerivePoprfKey(seed []byte, name string) (*big.Int, *ECPoint, error) {
+	return deriveNamedKey(modePOPRF, seed, name)
+}
+
+func deriveNamedKey(mode byte, seed []byte, name string) (*big.Int, *ECPoint, error) {
+	if len(seed) < 32 {
+		return nil, nil, fmt.Errorf("seed is %d bytes, need at least 32", len(seed))
+	}
+	if name == "" {
+		return nil, nil, errors.New("empty key name")
+	}
+	k, pubK, err := deriveKeyPair(mode, seed, []byte(name))
+	if err != nil {
+		return nil, nil, err
+	}
+	return k.BigInt(), pubK.ECPoint(), nil
+}
@@ -0,0 +1,147 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func oprf(t *testing.T, k []byte, inputs [][]byte) [][]byte {
+	t.Helper()
+	key, _, err := DeriveOprfKey(k, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, req, err := OprfBlind("test", inputs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := OprfEvaluate(key, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := OprfFinalize(sess, res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestOprf(t *testing.T) {
+	seed1 := bytes.Repeat([]byte{1}, 32)
+	seed2 := bytes.Repeat([]byte{2}, 32)
+	inputs := [][]byte{[]byte("a"), []byte("b"), []byte("a")}
+
+	out := oprf(t, seed1, inputs)
+	if len(out) != 3 || !bytes.Equal(out[0], out[2]) || bytes.Equal(out[0], out[1]) {
+		t.Errorf("outputs %x", out)
+	}
+	// The output does not depend on the blinding.
+	if again := oprf(t, seed1, inputs[:1]); !bytes.Equal(again[0], out[0]) {
+		t.Error("output changed between evaluations")
+	}
+	if other := oprf(t, seed2, inputs[:1]); bytes.Equal(other[0], out[0]) {
+		t.Error("same output under different keys")
+	}
+}
+
+func TestOprfOutput(t *testing.T) {
+	seed := bytes.Repeat([]byte{1}, 32)
+	k, _, err := DeriveOprfKey(seed, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := oprf(t, seed, [][]byte{[]byte("x")})
+	direct, err := OprfOutput(k, []byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out[0], direct) {
+		t.Errorf("OprfOutput = %x, want %x", direct, out[0])
+	}
+}
+
+func TestOprfProof(t *testing.T) {
+	seed := bytes.Repeat([]byte{1}, 32)
+	k, pubK, err := DeriveOprfKey(seed, "pinned")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := DeriveOprfKey(seed, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs := [][]byte{[]byte("x"), []byte("y")}
+
+	sess, req, err := OprfBlind("pinned", inputs, pubK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := OprfEvaluate(k, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OprfFinalize(sess, res); err != nil {
+		t.Fatal(err)
+	}
+	if got := sess.OprfKey(); got.X.Cmp(pubK.X) != 0 || got.Y.Cmp(pubK.Y) != 0 {
+		t.Error("OprfKey is not the pinned key")
+	}
+
+	// A server that uses another key for the batch, or for part of it, is
+	// caught.
+	wrong, err := OprfEvaluate(other, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OprfFinalize(sess, wrong); err != InvalidProof {
+		t.Errorf("other key: got %v, want %v", err, InvalidProof)
+	}
+	mixed := res
+	mixed.Elements = []*Point{res.Elements[0], wrong.Elements[1]}
+	if _, err := OprfFinalize(sess, mixed); err != InvalidProof {
+		t.Errorf("mixed keys: got %v, want %v", err, InvalidProof)
+	}
+	req.Verifiable = false
+	noProof, err := OprfEvaluate(k, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if noProof.Proof != "" || noProof.PubK != nil {
+		t.Error("proof sent although not asked for")
+	}
+	if _, err := OprfFinalize(sess, noProof); err != InvalidProof {
+		t.Errorf("no proof: got %v, want %v", err, InvalidProof)
+	}
+}
+
+func TestDecodeOprfRequest(t *testing.T) {
+	_, req, err := OprfBlind("k", [][]byte{[]byte("x")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecodeOprfRequest(data); err != nil {
+		t.Errorf("valid request: %v", err)
+	}
+	for _, bad := range []string{
+		`{"KeyName":"k","Elements":[]}`,
+		`{"KeyName":"k","Elements":[{"X":1,"Y":2}]}`,
+		`{"KeyName":"k","Elements":[null]}`,
+	} {
+		if _, err := DecodeOprfRequest([]byte(bad)); err == nil {
+			t.Errorf("%s: no error", bad)
+		}
+	}
+	if _, _, err := DeriveOprfKey(make([]byte, 16), "k"); err == nil {
+		t.Error("short seed accepted")
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+// This file derives the OPRF key of every user from a single server-wide
+// seed, as in RFC 9807 section 4.1.2:
+//
+//	seed = HKDF-Expand(oprf_seed, credential_identifier || "OprfKey", 32)
+//	k    = DeriveKeyPair(seed, "OPAQUE-DeriveKeyPair")
+//
+// The server then does not store K in User, servers that share the seed
+// compute the same keys, and a server can answer a login for an unknown
+// credential identifier with FakeUser, so that the answer looks like one for
+// a registered user with a wrong password.
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// MinOprfSeedLength is the smallest OPRF seed accepted.
+const MinOprfSeedLength = 32
+
+// DeriveUserOprfKey returns the OPRF key for credentialIdentifier derived
+// from oprfSeed.
+func DeriveUserOprfKey(oprfSeed, credentialIdentifier []byte) (*big.Int, error) {
+	if len(oprfSeed) < MinOprfSeedLength {
+		return nil, fmt.Errorf("OPRF seed is %d bytes, need at least %d", len(oprfSeed), MinOprfSeedLength)
+	}
+	info := append(append([]byte(nil), credentialIdentifier...), "OprfKey"...)
+	seed := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, oprfSeed, info), seed); err != nil {
+		return nil, err
+	}
+	k, _, err := deriveKeyPair(modeOPRF, seed, []byte("OPAQUE-DeriveKeyPair"))
+	if err != nil {
+		return nil, err
+	}
+	return k.BigInt(), nil
+}
+
+// PwRegDerived is like PwReg but uses the OPRF key derived from oprfSeed for
+// credentialIdentifier. The User returned by PwReg3 has no K; pass it through
+// WithDerivedKey before Auth1.
+func PwRegDerived(pubS *ECPoint, oprfSeed, credentialIdentifier []byte, msg1 PwRegMsg1) (*PwRegServerSession, PwRegMsg2, error) {
+	k, err := DeriveUserOprfKey(oprfSeed, credentialIdentifier)
+	if err != nil {
+		return nil, PwRegMsg2{}, err
+	}
+	sess, msg2, err := pwReg(pubS, k, msg1)
+	if err != nil {
+		return nil, PwRegMsg2{}, err
+	}
+	sess.derived = true
+	return sess, msg2, nil
+}
+
+// WithDerivedKey returns u if it has its own OPRF key, as users registered
+// with PwReg do, and otherwise a copy of u with K derived from oprfSeed for
+// credentialIdentifier.
+func (u *User) WithDerivedKey(oprfSeed, credentialIdentifier []byte) (*User, error) {
+	if u.K != nil {
+		return u, nil
+	}
+	if oprfSeed == nil {
+		return nil, errors.New("user has a derived OPRF key but there is no OPRF seed")
+	}
+	k, err := DeriveUserOprfKey(oprfSeed, credentialIdentifier)
+	if err != nil {
+		return nil, err
+	}
+	v := *u
+	v.K = k
+	return &v, nil
+}
+
+// FakeUser returns a User for an unregistered credentialIdentifier, for Auth1
+// to answer a login with. K is the key a registration would get, and EnvU and
+// PubU are derived from oprfSeed, so the answer is the same every time and,
+// without the password, cannot be told apart from one for a registered user.
+// The client fails to open EnvU, as with a wrong password.
+func FakeUser(oprfSeed, credentialIdentifier []byte, username string, pubS *ECPoint) (*User, error) {
+	k, err := DeriveUserOprfKey(oprfSeed, credentialIdentifier)
+	if err != nil {
+		return nil, err
+	}
+	info := append(append([]byte(nil), credentialIdentifier...), "FakeUser"...)
+	r := hkdf.Expand(sha256.New, oprfSeed, info)
+	seed := make([]byte, 32)
+	rwd := make([]byte, 32)
+	if _, err := io.ReadFull(r, seed); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, rwd); err != nil {
+		return nil, err
+	}
+	privU, pubU, err := deriveKeyPair(modeOPRF, seed, []byte("OPAQUE-FakeUser"))
+	if err != nil {
+		return nil, err
+	}
+	env := &envelope{PrivU: privU.Bytes(), PubU: pubU.ECPoint(), PubS: pubS, Nonce: make([]byte, envelopeNonceLength)}
+	if _, err := io.ReadFull(r, env.Nonce); err != nil {
+		return nil, err
+	}
+	envU, err := sealEnvelope(r, rwd, env)
+	if err != nil {
+		return nil, err
+	}
+	return &User{Username: username, K: k, EnvU: envU, PubU: env.PubU}, nil
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDeriveUserOprfKey(t *testing.T) {
+	seed := bytes.Repeat([]byte{4}, 32)
+	k1, err := DeriveUserOprfKey(seed, []byte("alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := DeriveUserOprfKey(seed, []byte("alice"))
+	k2, _ := DeriveUserOprfKey(seed, []byte("bob"))
+	k3, _ := DeriveUserOprfKey(bytes.Repeat([]byte{5}, 32), []byte("alice"))
+	if k1.Cmp(again) != 0 {
+		t.Error("the key is not deterministic")
+	}
+	if k1.Cmp(k2) == 0 || k1.Cmp(k3) == 0 {
+		t.Error("the key does not depend on the identifier and the seed")
+	}
+	if _, err := DeriveUserOprfKey(seed[:31], []byte("alice")); err == nil {
+		t.Error("accepted a 31 byte seed")
+	}
+}
+
+func TestPwRegDerived(t *testing.T) {
+	quietT(t)
+	seed := bytes.Repeat([]byte{4}, 32)
+	privS, pubS := newServerKey(t)
+	csess, msg1, err := PwRegInit("alice", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ssess, msg2, err := PwRegDerived(pubS, seed, []byte("alice"), msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg3, err := PwReg2(csess, msg2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := PwReg3(ssess, msg3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.K != nil {
+		t.Fatal("PwReg3 returned the derived key")
+	}
+
+	_, msg1a, err := AuthInit("alice", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Auth1(privS, user, msg1a); err == nil {
+		t.Error("Auth1 accepted a user without K")
+	}
+	if _, err := user.WithDerivedKey(nil, []byte("alice")); err == nil {
+		t.Error("WithDerivedKey without a seed succeeded")
+	}
+	withK, err := user.WithDerivedKey(seed, []byte("alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	csess2, msg1b, err := AuthInitVerifiable("alice", "correct horse", csess.OprfKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ssess2, msg2b, err := Auth1(privS, withK, msg1b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, msg3b, err := Auth2(csess2, msg2b)
+	if err != nil {
+		t.Fatalf("Auth2: %v", err)
+	}
+	if _, err := Auth3(ssess2, msg3b); err != nil {
+		t.Errorf("Auth3: %v", err)
+	}
+
+	// A user with its own key keeps it.
+	random := register(t, pubS, "bob", "secret")
+	if u, _ := random.WithDerivedKey(seed, []byte("bob")); u.K.Cmp(random.K) != 0 {
+		t.Error("WithDerivedKey replaced a random key")
+	}
+}
+
+func TestFakeUser(t *testing.T) {
+	quietT(t)
+	seed := bytes.Repeat([]byte{4}, 32)
+	privS, pubS := newServerKey(t)
+	fake, err := FakeUser(seed, []byte("mallory"), "mallory", pubS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := FakeUser(seed, []byte("mallory"), "mallory", pubS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fake.EnvU != again.EnvU || fake.PubU.X.Cmp(again.PubU.X) != 0 {
+		t.Error("the fake user is not deterministic")
+	}
+	if k, _ := DeriveUserOprfKey(seed, []byte("mallory")); fake.K.Cmp(k) != 0 {
+		t.Error("the fake user has another key than a registration would")
+	}
+	real := register(t, pubS, "mallory", "secret")
+	if d := len(fake.EnvU) - len(real.EnvU); d < -8 || d > 8 {
+		t.Errorf("fake EnvU is %d bytes, a real one %d", len(fake.EnvU), len(real.EnvU))
+	}
+
+	csess, msg1, err := AuthInit("mallory", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, msg2, err := Auth1(privS, fake, msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Auth2(csess, msg2); err != AuthtagMismatch {
+		t.Errorf("Auth2: got %v, want %v", err, AuthtagMismatch)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+// This file contains the partially oblivious PRF (POPRF) from RFC 9497
+// section 3.3.3. The client sends public metadata, info, in the clear along
+// with its blinded inputs, and the server evaluates under the key
+//
+//	t = k + HashToScalar("Info" || len(info) || info)
+//
+// so one key k serves any number of contexts, such as tenants, purposes or
+// epochs. Outputs for different info are unrelated, so rotating the info
+// (for example to a new epoch) rotates the effective key without a new k.
+// The server sends b = a^(1/t) and proves it against g^t, which the client
+// computes from info and the server's public key g^k. A client that has
+// pinned g^k therefore needs nothing new when the info changes.
+//
+// As in voprf.go, the proofs and the tweak are as in the RFC, but inputs are
+// mapped to the curve with hashToCurve, so outputs differ from the RFC's.
+
+import (
+	"crypto/sha256"
+	"errors"
+)
+
+// maxInfoLength is the largest info that can be framed with a two byte
+// length.
+const maxInfoLength = 65535
+
+var errInfoLength = errors.New("info is longer than 65535 bytes")
+
+// poprfTweak returns m = HashToScalar(framedInfo), the value added to the
+// key for info.
+func poprfTweak(info []byte) (*Scalar, error) {
+	if len(info) > maxInfoLength {
+		return nil, errInfoLength
+	}
+	framed := appendLengthPrefixed([]byte("Info"), info)
+	return hashToScalar(framed, append([]byte("HashToScalar-"), contextString(modePOPRF)...))
+}
+
+// poprfTweakKey returns the tweaked key t = k + m for info. It is used by the
+// server.
+func poprfTweakKey(k *Scalar, info []byte) (*Scalar, error) {
+	m, err := poprfTweak(info)
+	if err != nil {
+		return nil, err
+	}
+	t := NewScalar().Add(k, m)
+	if t.IsZero() {
+		return nil, errors.New("tweaked key is zero")
+	}
+	return t, nil
+}
+
+// poprfTweakPublicKey returns the tweaked public key g^t = g^m * pk for info.
+// It is used by the client.
+func poprfTweakPublicKey(pk *Element, info []byte) (*Element, error) {
+	m, err := poprfTweak(info)
+	if err != nil {
+		return nil, err
+	}
+	tweaked := NewIdentity().Add(NewIdentity().ScalarBaseMult(m), pk)
+	if tweaked.IsIdentity() {
+		return nil, InvalidProof
+	}
+	return tweaked, nil
+}
+
+// poprfFinalize unblinds b and returns the output for input and info. The
+// output is Finalize from RFC 9497 section 3.3.3.
+func poprfFinalize(input, info []byte, b *ECPoint, r *Scalar) ([]byte, error) {
+	elemB, err := NewElement(b)
+	if err != nil {
+		return nil, err
+	}
+	n := NewIdentity().ScalarMult(NewScalar().Invert(r), elemB)
+	t := appendLengthPrefixed(nil, input)
+	t = appendLengthPrefixed(t, info)
+	t = appendLengthPrefixed(t, n.BytesCompressed())
+	t = append(t, "Finalize"...)
+	h := sha256.Sum256(t)
+	return h[:], nil
+}
+
+// PoprfBlind is like OprfBlind, but the inputs are evaluated under the
+// server's key tweaked by info, which is sent to the server in the clear.
+// pubK is the server's untweaked public key, as returned by
+// OprfClientSession.OprfKey for any info.
+func PoprfBlind(key, info string, inputs [][]byte, pubK *ECPoint) (*OprfClientSession, OprfRequest, error) {
+	return oprfBlind(key, &info, inputs, pubK)
+}
@@ -0,0 +1,164 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// TestPoprfVectors uses the test vectors from RFC 9497, appendix A.3.3
+// (P256-SHA256, POPRF mode). The blinded elements are taken from the
+// vectors since inputs are mapped to the curve differently here.
+func TestPoprfVectors(t *testing.T) {
+	k := unhexScalar(t, "6ad2173efa689ef2c27772566ad7ff6e2d59b3b196f00219451fb2c89ee4dae2")
+	pk := unhexElements(t, "030d7ff077fddeec965db14b794f0cc1ba9019b04a2f4fcc1fa525dedf72e2a3e3")[0]
+	info := []byte("test info")
+	for i, tc := range []struct {
+		inputs, blinds, blinded, evaluated, outputs string
+		r, proof                                    string
+	}{
+		{
+			"00",
+			"3338fa65ec36e0290022b48eb562889d89dbfa691d1cde91517fa222ed7ad364",
+			"031563e127099a8f61ed51eeede05d747a8da2be329b40ba1f0db0b2bd9dd4e2c0",
+			"02c5e5300c2d9e6ba7f3f4ad60500ad93a0157e6288eb04b67e125db024a2c74d2",
+			"193a92520bd8fd1f37accb918040a57108daa110dc4f659abe212636d245c592",
+			"f9db001266677f62c095021db018cd8cbb55941d4073698ce45c405d1348b7b1",
+			"f8a33690b87736c854eadfcaab58a59b8d9c03b569110b6f31f8bf7577f3fbb85a8a0c38468ccde1ba942be501654adb106167c8eb178703ccb42bccffb9231a",
+		},
+		{
+			"5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a",
+			"3338fa65ec36e0290022b48eb562889d89dbfa691d1cde91517fa222ed7ad364",
+			"021a440ace8ca667f261c10ac7686adc66a12be31e3520fca317643a1eee9dcd4d",
+			"0208ca109cbae44f4774fc0bdd2783efdcb868cb4523d52196f700210e777c5de3",
+			"1e6d164cfd835d88a31401623549bf6b9b306628ef03a7962921d62bc5ffce8c",
+			"f9db001266677f62c095021db018cd8cbb55941d4073698ce45c405d1348b7b1",
+			"043a8fb7fc7fd31e35770cabda4753c5bf0ecc1e88c68d7d35a62bf2631e875af4613641be2d1875c31d1319d191c4bbc0d04875f4fd03c31d3d17dd8e069b69",
+		},
+		{
+			"00,5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a",
+			"3338fa65ec36e0290022b48eb562889d89dbfa691d1cde91517fa222ed7ad364,f9db001266677f62c095021db018cd8cbb55941d4073698ce45c405d1348b7b1",
+			"031563e127099a8f61ed51eeede05d747a8da2be329b40ba1f0db0b2bd9dd4e2c0,03ca4ff41c12fadd7a0bc92cf856732b21df652e01a3abdf0fa8847da053db213c",
+			"02c5e5300c2d9e6ba7f3f4ad60500ad93a0157e6288eb04b67e125db024a2c74d2,02f0b6bcd467343a8d8555a99dc2eed0215c71898c5edb77a3d97ddd0dbad478e8",
+			"193a92520bd8fd1f37accb918040a57108daa110dc4f659abe212636d245c592,1e6d164cfd835d88a31401623549bf6b9b306628ef03a7962921d62bc5ffce8c",
+			"350e8040f828bf6ceca27405420cdf3d63cb3aef005f40ba51943c8026877963",
+			"8fbd85a32c13aba79db4b42e762c00687d6dbf9c8cb97b2a225645ccb00d9d7580b383c885cdfd07df448d55e06f50f6173405eee5506c0ed0851ff718d13e68",
+		},
+	} {
+		tweak, err := poprfTweakKey(k, info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blinded := unhexElements(t, strings.Split(tc.blinded, ",")...)
+		evaluated := unhexElements(t, strings.Split(tc.evaluated, ",")...)
+		inv := NewScalar().Invert(tweak)
+		for j := range blinded {
+			if !NewIdentity().ScalarMult(inv, blinded[j]).Equal(evaluated[j]) {
+				t.Errorf("%d: evaluation %d differs", i, j)
+			}
+		}
+
+		tweaked := NewIdentity().ScalarBaseMult(tweak)
+		proof, err := generateProofWithNonce(modePOPRF, tweak, NewGenerator(), tweaked, evaluated, blinded, unhexScalar(t, tc.r))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(proof); got != tc.proof {
+			t.Errorf("%d: proof = %s, want %s", i, got, tc.proof)
+		}
+		clientTweaked, err := poprfTweakPublicKey(pk, info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !clientTweaked.Equal(tweaked) {
+			t.Errorf("%d: client's tweaked key differs", i)
+		}
+
+		inputs := strings.Split(tc.inputs, ",")
+		blinds := strings.Split(tc.blinds, ",")
+		outputs := strings.Split(tc.outputs, ",")
+		for j := range inputs {
+			out, err := poprfFinalize(unhex(t, inputs[j]), info, evaluated[j].ECPoint(), unhexScalar(t, blinds[j]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := hex.EncodeToString(out); got != outputs[j] {
+				t.Errorf("%d: output %d = %s, want %s", i, j, got, outputs[j])
+			}
+		}
+	}
+}
+
+func TestPoprf(t *testing.T) {
+	seed := bytes.Repeat([]byte{3}, 32)
+	k, pubK, err := DeriveOprfKey(seed, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs := [][]byte{[]byte("a"), []byte("b")}
+	eval := func(info string, pinned *ECPoint) ([][]byte, error) {
+		sess, req, err := PoprfBlind("master", info, inputs, pinned)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := OprfEvaluate(k, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return OprfFinalize(sess, res)
+	}
+	epoch1, err := eval("tenant=acme epoch=1", pubK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := eval("tenant=acme epoch=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	epoch2, err := eval("tenant=acme epoch=2", pubK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty, err := eval("", pubK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Empty info is not the same as no info.
+	sess, req, err := OprfBlind("master", inputs, pubK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := OprfEvaluate(k, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := OprfFinalize(sess, res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(epoch1[0], again[0]) || bytes.Equal(epoch1[0], epoch2[0]) ||
+		bytes.Equal(epoch1[0], epoch1[1]) || bytes.Equal(empty[0], plain[0]) {
+		t.Errorf("outputs: epoch 1 %x, again %x, epoch 2 %x, empty info %x", epoch1, again, epoch2, empty)
+	}
+
+	// The proof is for the info the client asked for.
+	sess, req, err = PoprfBlind("master", "tenant=acme", inputs, pubK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := "tenant=evil"
+	req.Info = &other
+	res, err = OprfEvaluate(k, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OprfFinalize(sess, res); err != InvalidProof {
+		t.Errorf("other info: got %v, want %v", err, InvalidProof)
+	}
+}
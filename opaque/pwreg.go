@@ -11,7 +11,15 @@ package opaque
 // http://webee.technion.ac.il/~hugo/sigma-pdf.pdf
 
 import (
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
 	"math/big"
+
+	"golang.org/x/crypto/hkdf"
 )
 
 // The User struct is the state that the server needs to store for each
@@ -20,13 +28,30 @@ type User struct {
 	// Name of this user.
 	Username string
 
-	// OPRF key for this user. This is the salt.
+	// OPRF key for this user. This is the salt. It is nil if the key is
+	// derived from the server's OPRF seed, see oprfseed.go.
 	K *big.Int
 
 	// EnvU and PubU are generated by the client during password
 	// registration and stored at the server.
 	EnvU string //hex
 	PubU *ECPoint
+
+	// PubK is g^k for users whose OPRF key is shared among share holders,
+	// see threshold.go, and nil otherwise. The combined evaluation must be
+	// under this key.
+	PubK *ECPoint `json:",omitempty"`
+
+	// Identities are the identities logins of the user are bound to. They
+	// are not stored but set with WithIdentities.
+	Identities Identities `json:"-"`
+}
+
+// WithIdentities returns a copy of u whose logins are bound to ids.
+func (u *User) WithIdentities(ids Identities) *User {
+	v := *u
+	v.Identities = ids
+	return &v
 }
 
 // PwRegServerSession keeps track of state needed on the server-side during a
@@ -34,6 +59,24 @@ type User struct {
 type PwRegServerSession struct {
 	Username string
 	K        *big.Int
+	// derived is set if K is derived from an OPRF seed or shared, and not
+	// stored.
+	derived bool
+	// pubK is g^k if K is shared, see PwRegEvaluated.
+	pubK *ECPoint
+}
+
+// PwRegClientSession keeps track of state needed on the client-side during a
+// run of the password registration protocol.
+type PwRegClientSession struct {
+	username string
+	password []byte
+	r        *Scalar
+	a        *ECPoint
+	// pubK is the server's verified OPRF public key, set by PwReg2.
+	pubK *ECPoint
+	// exportKey is set by PwReg2.
+	exportKey []byte
 }
 
 // PwRegMsg1 is the first message during password registration. It is sent from
@@ -41,6 +84,9 @@ type PwRegServerSession struct {
 type PwRegMsg1 struct {
 	Username string
 	A        *ECPoint
+	// Verifiable asks the server to include its OPRF public key and a proof
+	// of the evaluation in PwRegMsg2, see voprf.go.
+	Verifiable bool `json:",omitempty"`
 }
 
 // PwRegMsg2 is the second message in password registration. Sent from server to
@@ -48,6 +94,10 @@ type PwRegMsg1 struct {
 type PwRegMsg2 struct {
 	B     *Point
 	PubS  *Point
+	// PubK=g^k is the OPRF public key for the user and Proof the hex encoded
+	// proof that B=A^k. They are set if PwRegMsg1.Verifiable is.
+	PubK  *Point `json:",omitempty"`
+	Proof string `json:",omitempty"`
 }
 
 // PwRegMsg3 is the third and final message in password registration. Sent from
@@ -57,12 +107,94 @@ type PwRegMsg3 struct {
 	PubU *ECPoint
 }
 
+// envelope is the plaintext of EnvU. It is encrypted with a key derived from
+// RwdU, so only a client that knows the password can open it.
+type envelope struct {
+	PrivU []byte
+	PubU  *ECPoint
+	PubS  *ECPoint
+	// Nonce is the envelope nonce the export key is derived with. It is
+	// missing from envelopes sealed before export keys were added.
+	Nonce []byte `json:",omitempty"`
+}
+
+// envelopeNonceLength is the length of envelope.Nonce.
+const envelopeNonceLength = 32
+
+// exportKey returns the export key for rwd and the envelope env, as in RFC
+// 9807 section 4.1.3: HKDF-Expand(rwd, nonce || "ExportKey", 32). It is
+// known only to the client and is the same for every login with the
+// credential, but changes when the credential is registered again.
+func exportKey(rwd []byte, env *envelope) ([]byte, error) {
+	info := append(append([]byte(nil), env.Nonce...), "ExportKey"...)
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.Expand(hasher, rwd, info), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// sealEnvelope encrypts env under rwd, with randomness from randr, and
+// returns the hex encoded EnvU.
+func sealEnvelope(randr io.Reader, rwd []byte, env *envelope) (string, error) {
+	plaintext, err := json.Marshal(env)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := AuthEnc(randr, rwd[:16], plaintext)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(ciphertext), nil
+}
+
+// openEnvelope decrypts the hex encoded envU using rwd. AuthtagMismatch is
+// returned if the password used to derive rwd is wrong.
+func openEnvelope(rwd []byte, envU string) (*envelope, error) {
+	ciphertext, err := hex.DecodeString(envU)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := AuthDec(rwd[:16], ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	var env envelope
+	if err := json.Unmarshal(plaintext, &env); err != nil {
+		return nil, err
+	}
+	return &env, nil
+}
+
+// PwRegInit initiates the password registration protocol. It is invoked by the
+// client. On success a nil error is returned together with a client session
+// and a PwRegMsg1 struct. The PwRegMsg1 struct should be sent to the server.
+//
+// See also PwReg, PwReg2, and PwReg3.
+func PwRegInit(username, password string) (*PwRegClientSession, PwRegMsg1, error) {
+	a, r, err := dhOprf1([]byte(password))
+	if err != nil {
+		return nil, PwRegMsg1{}, err
+	}
+	session := &PwRegClientSession{
+		username: username,
+		password: []byte(password),
+		r:        r,
+		a:        a,
+	}
+	return session, PwRegMsg1{Username: username, A: a, Verifiable: true}, nil
+}
+
 // PwReg PwReg1 is the processing done by the server when it has received a PwRegMsg1 struct from a client.
 func PwReg(pubS *ECPoint, msg1 PwRegMsg1) (*PwRegServerSession, PwRegMsg2, error) {
 	k, err := generateSalt()
 	if err != nil {
 		return nil, PwRegMsg2{}, err
 	}
+	return pwReg(pubS, k, msg1)
+}
+
+func pwReg(pubS *ECPoint, k *big.Int, msg1 PwRegMsg1) (*PwRegServerSession, PwRegMsg2, error) {
 	b, err := dhOprf2(msg1.A, k)
 	if err != nil {
 		return nil, PwRegMsg2{}, err
@@ -71,25 +203,112 @@ func PwReg(pubS *ECPoint, msg1 PwRegMsg1) (*PwRegServerSession, PwRegMsg2, error
 		Username: msg1.Username,
 		K:        k,
 	}
-	msg2 := PwRegMsg2{B: &Point{X: b.X.String(), Y: b.Y.String()}, PubS: &Point{X: pubS.X.String(), Y: pubS.Y.String()}}
+	msg2 := PwRegMsg2{B: toPoint(b), PubS: toPoint(pubS)}
+	if msg1.Verifiable {
+		pubK, proof, err := oprfProof(NewScalar().SetBigInt(k), msg1.A, b)
+		if err != nil {
+			return nil, PwRegMsg2{}, err
+		}
+		msg2.PubK, msg2.Proof = toPoint(pubK), proof
+	}
 	return session, msg2, nil
 }
 
+// PwReg2 is invoked on the client when it has received a PwRegMsg2 struct from
+// the server. It generates the user's key pair and seals it, together with the
+// server's public key, in EnvU. The returned PwRegMsg3 should be sent to the
+// server.
+//
+// If the server sent its OPRF public key, InvalidProof is returned unless
+// the proof of the OPRF evaluation verifies, and the key is then available
+// from sess.OprfKey.
+func PwReg2(sess *PwRegClientSession, msg2 PwRegMsg2) (PwRegMsg3, error) {
+	b, err := msg2.B.toECPoint()
+	if err != nil {
+		return PwRegMsg3{}, err
+	}
+	if msg2.PubK != nil {
+		pubK, err := msg2.PubK.toECPoint()
+		if err != nil {
+			return PwRegMsg3{}, InvalidProof
+		}
+		if err := checkOprfProof(pubK, sess.a, b, msg2.Proof); err != nil {
+			return PwRegMsg3{}, err
+		}
+		sess.pubK = pubK
+	}
+	pubS, err := msg2.PubS.toECPoint()
+	if err != nil {
+		return PwRegMsg3{}, err
+	}
+	rwd, err := dhOprf3(sess.password, b, sess.r)
+	if err != nil {
+		return PwRegMsg3{}, err
+	}
+	privU, x, y, err := elliptic.GenerateKey(dhGroup, rand.Reader)
+	if err != nil {
+		return PwRegMsg3{}, err
+	}
+	pubU := &ECPoint{X: x, Y: y}
+	env := &envelope{PrivU: privU, PubU: pubU, PubS: pubS, Nonce: make([]byte, envelopeNonceLength)}
+	if _, err := rand.Read(env.Nonce); err != nil {
+		return PwRegMsg3{}, err
+	}
+	if sess.exportKey, err = exportKey(rwd, env); err != nil {
+		return PwRegMsg3{}, err
+	}
+	envU, err := sealEnvelope(rand.Reader, rwd, env)
+	if err != nil {
+		return PwRegMsg3{}, err
+	}
+	return PwRegMsg3{EnvU: envU, PubU: pubU}, nil
+}
+
+// ExportKey returns the export key of the new credential once PwReg2 has
+// succeeded. The server never learns it, so the client can use it to encrypt
+// data that it stores with the server. AuthClientSession.ExportKey returns
+// the same key at every login with the credential.
+func (sess *PwRegClientSession) ExportKey() []byte {
+	return sess.exportKey
+}
+
+// OprfKey returns the server's OPRF public key for the user once PwReg2 has
+// verified it, or nil if the server did not send it. A client that keeps the
+// key can pass it to AuthInitVerifiable to check that later logins use the
+// same OPRF key.
+func (sess *PwRegClientSession) OprfKey() *ECPoint {
+	return sess.pubK
+}
+
 // PwReg3 is invoked on the server after it has received a PwRegMsg3 struct from
 // the client.
 // The returned User struct should be stored by the server and associated with
 // the username.
-func PwReg3(sess *PwRegServerSession, msg3 PwRegMsg3) *User {
+//
+// A non-nil error is returned if PubU is not a valid point or EnvU is not hex
+// encoded.
+func PwReg3(sess *PwRegServerSession, msg3 PwRegMsg3) (*User, error) {
+	if err := checkPoint("PubU", msg3.PubU); err != nil {
+		return nil, err
+	}
+	if _, err := hex.DecodeString(msg3.EnvU); err != nil {
+		return nil, fmt.Errorf("EnvU: %s", err)
+	}
 	// From the I-D:
 	//
 	//       U sends EnvU and PubU to S and erases PwdU, RwdU and all keys.
 	//       S stores (EnvU, PubKeyPoint, PrivateKeyBytes, PubU, kU, vU) in a user-specific
 	//       record.  If PrivateKeyBytes and PubKeyPoint are used for different users, they can
 	//       be stored separately and omitted from the record.
-	return &User{
+	user := &User{
 		Username: sess.Username,
 		K:        sess.K,
 		EnvU:     msg3.EnvU,
 		PubU:     msg3.PubU,
+		PubK:     sess.pubK,
+	}
+	if sess.derived {
+		user.K = nil
 	}
+	return user, nil
 }
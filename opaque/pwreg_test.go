@@ -0,0 +1,83 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+import (
+	"io"
+	"testing"
+)
+
+// quiet silences Trace for the duration of b.
+func quiet(b *testing.B) {
+	quietT(b)
+}
+
+// quietT silences Trace for the duration of t.
+func quietT(t testing.TB) {
+	old := Trace
+	Trace = io.Discard
+	t.Cleanup(func() { Trace = old })
+}
+
+func TestPwRegInvalidMsg3(t *testing.T) {
+	_, pubS := newServerKey(t)
+	csess, msg1, err := PwRegInit("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ssess, msg2, err := PwReg(pubS, msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg3, err := PwReg2(csess, msg2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, m := range map[string]PwRegMsg3{
+		"missing PubU":   {EnvU: msg3.EnvU},
+		"PubU off curve": {EnvU: msg3.EnvU, PubU: &ECPoint{X: msg3.PubU.X, Y: msg3.PubU.X}},
+		"EnvU not hex":   {EnvU: "zz", PubU: msg3.PubU},
+	} {
+		if _, err := PwReg3(ssess, m); err == nil {
+			t.Errorf("%s: PwReg3 succeeded", name)
+		}
+	}
+}
+
+func BenchmarkPwReg(b *testing.B) {
+	quiet(b)
+	_, pubS := newServerKey(b)
+	_, msg1, err := PwRegInit("alice", "secret")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := PwReg(pubS, msg1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPwRegClient(b *testing.B) {
+	quiet(b)
+	_, pubS := newServerKey(b)
+	for i := 0; i < b.N; i++ {
+		csess, msg1, err := PwRegInit("alice", "secret")
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StopTimer()
+		_, msg2, err := PwReg(pubS, msg1)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+		if _, err := PwReg2(csess, msg2); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DirReplayCache is a ReplayCache that records IDs as files in a directory.
+// Servers that share the directory, for example over a network file system,
+// share the cache, and the IDs survive restarts.
+//
+// Each ID is a file named after its SHA-256 hash whose modification time is
+// the ID's expiry. The file is written under a temporary name and then
+// hard-linked to its final name, which fails if the name exists, so of two
+// servers adding the same ID only one succeeds.
+type DirReplayCache struct {
+	dir string
+	now func() time.Time
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+// NewDirReplayCache returns a DirReplayCache that keeps its files in dir,
+// which is created if it does not exist.
+func NewDirReplayCache(dir string) (*DirReplayCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &DirReplayCache{dir: dir, now: time.Now}, nil
+}
+
+// Add implements ReplayCache. It returns false if the ID cannot be recorded,
+// so a failing directory rejects blobs rather than letting them be replayed.
+// Expired IDs are removed about once a minute in the background.
+func (c *DirReplayCache) Add(id string, expires time.Time) bool {
+	now := c.now()
+	c.mu.Lock()
+	if now.Sub(c.lastSweep) > time.Minute {
+		c.lastSweep = now
+		go c.sweep(now)
+	}
+	c.mu.Unlock()
+
+	h := sha256.Sum256([]byte(id))
+	name := filepath.Join(c.dir, hex.EncodeToString(h[:]))
+	tmp, err := os.CreateTemp(c.dir, ".tmp-")
+	if err != nil {
+		return false
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Close(); err != nil {
+		return false
+	}
+	if err := os.Chtimes(tmp.Name(), expires, expires); err != nil {
+		return false
+	}
+	return os.Link(tmp.Name(), name) == nil
+}
+
+// sweep removes the IDs that expired before now.
+func (c *DirReplayCache) sweep(now time.Time) {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		// Temporary files left behind by a crash have the expiry as
+		// well, and are removed like the IDs.
+		if now.After(info.ModTime()) {
+			os.Remove(filepath.Join(c.dir, e.Name()))
+		}
+	}
+}
+
+// Len returns the number of IDs in the cache, including expired ones that
+// have not been swept yet.
+func (c *DirReplayCache) Len() int {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, e := range entries {
+		if e.Name()[0] != '.' {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDirReplayCache(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Unix(1000, 0)
+	open := func() *DirReplayCache {
+		c, err := NewDirReplayCache(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Sweep only when the test asks for it.
+		c.now = func() time.Time { return now }
+		c.lastSweep = now
+		return c
+	}
+	a, b := open(), open()
+
+	if !a.Add("id1", now.Add(time.Minute)) {
+		t.Fatal("first Add returned false")
+	}
+	if a.Add("id1", now.Add(time.Minute)) {
+		t.Error("second Add returned true")
+	}
+	// Another server sharing the directory sees the ID, as does a restarted
+	// one.
+	if b.Add("id1", now.Add(time.Minute)) {
+		t.Error("Add on another cache returned true")
+	}
+	if open().Add("id1", now.Add(time.Minute)) {
+		t.Error("Add after a restart returned true")
+	}
+	if !b.Add("id2", now.Add(time.Hour)) {
+		t.Error("Add of another ID returned false")
+	}
+
+	a.sweep(now.Add(2 * time.Minute))
+	if n := a.Len(); n != 1 {
+		t.Errorf("Len = %d after sweep, want 1", n)
+	}
+	if b.Add("id2", now.Add(time.Hour)) {
+		t.Error("unexpired ID swept")
+	}
+}
+
+func TestSessionSealerDirReplayCache(t *testing.T) {
+	quietT(t)
+	dir := t.TempDir()
+	replay := func() ReplayCache {
+		c, err := NewDirReplayCache(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.lastSweep = time.Now()
+		return c
+	}
+	s1 := newSealer(t, 1, replay())
+	s2 := newSealer(t, 1, replay())
+	_, ss, _ := startAuth(t, "secret")
+	blob, err := s1.Seal(ss)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s1.Open(blob); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s2.Open(blob); err != SessionReplayed {
+		t.Errorf("Open on another server: got %v, want %v", err, SessionReplayed)
+	}
+}
@@ -0,0 +1,274 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"sync"
+	"time"
+)
+
+// A SessionSealer turns an AuthServerSession into an opaque blob that the
+// server can hand to the client together with AuthMsg2 instead of keeping
+// the session in memory. Any server that shares the master key can open the
+// blob when the client sends it back with AuthMsg3.
+//
+// Blobs are encrypted with AES-256-GCM. The key is derived from the master
+// key and the current period, so it rotates every period. Blobs sealed in the
+// previous period can still be opened. Each blob can be opened once; opening
+// it again returns SessionReplayed.
+type SessionSealer struct {
+	master []byte
+	period time.Duration
+	ttl    time.Duration
+	replay ReplayCache
+	now    func() time.Time
+
+	mu   sync.Mutex
+	keys map[uint64]cipher.AEAD
+}
+
+var (
+	// SessionExpired is returned by SessionSealer.Open for blobs older than
+	// the sealer's TTL.
+	SessionExpired = errors.New("sealed session expired")
+	// SessionReplayed is returned by SessionSealer.Open for blobs that have
+	// been opened before.
+	SessionReplayed = errors.New("sealed session replayed")
+	// InvalidSession is returned by SessionSealer.Open for blobs that were not
+	// sealed with the sealer's master key in the current or previous period.
+	InvalidSession = errors.New("invalid sealed session")
+)
+
+// sealedVersion is the first byte of every blob.
+const sealedVersion = 1
+
+// sealedHeaderLen is the length of the version byte and the period number,
+// which are authenticated but not encrypted.
+const sealedHeaderLen = 1 + 8
+
+// sealedSession is the plaintext of a blob.
+type sealedSession struct {
+	ID            []byte
+	Expires       int64
+	Username      string
+	CredentialID  string `json:",omitempty"`
+	SK            []byte
+	Km2           []byte
+	Km3           []byte
+	NonceU        string
+	NonceS        string
+	EphemeralPubS *Point
+	XCrypt        []byte
+}
+
+// NewSessionSealer returns a SessionSealer using master, which must be at
+// least 32 bytes, to derive its keys. Keys rotate every period and blobs
+// expire after ttl, which must not be longer than period. replay records
+// opened blobs; servers that share master must share replay for replays to be
+// detected across servers.
+func NewSessionSealer(master []byte, period, ttl time.Duration, replay ReplayCache) (*SessionSealer, error) {
+	if len(master) < 32 {
+		return nil, fmt.Errorf("master key is %d bytes, need at least 32", len(master))
+	}
+	if ttl <= 0 || ttl > period {
+		return nil, fmt.Errorf("ttl %s must be positive and at most the period %s", ttl, period)
+	}
+	return &SessionSealer{
+		master: append([]byte(nil), master...),
+		period: period,
+		ttl:    ttl,
+		replay: replay,
+		now:    time.Now,
+		keys:   map[uint64]cipher.AEAD{},
+	}, nil
+}
+
+// aead returns the cipher for the given period, deriving it if needed. Keys
+// for periods other than the current and the previous one are forgotten.
+func (s *SessionSealer) aead(period, current uint64) (cipher.AEAD, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if a, ok := s.keys[period]; ok {
+		return a, nil
+	}
+	for p := range s.keys {
+		if p+1 < current {
+			delete(s.keys, p)
+		}
+	}
+	var info [len("opaque sealed session") + 8]byte
+	copy(info[:], "opaque sealed session")
+	binary.BigEndian.PutUint64(info[len("opaque sealed session"):], period)
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(hasher, s.master, nil, info[:]), key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	a, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	s.keys[period] = a
+	return a, nil
+}
+
+func (s *SessionSealer) currentPeriod(now time.Time) uint64 {
+	return uint64(now.UnixNano() / int64(s.period))
+}
+
+// Seal returns a blob containing sess. The blob is URL-safe base64 and can be
+// sent to the client as is.
+func (s *SessionSealer) Seal(sess *AuthServerSession) (string, error) {
+	now := s.now()
+	id := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return "", err
+	}
+	plaintext, err := json.Marshal(sealedSession{
+		ID:            id,
+		Expires:       now.Add(s.ttl).UnixNano(),
+		Username:      sess.username,
+		CredentialID:  sess.credentialID,
+		SK:            sess.SK,
+		Km2:           sess.Km2,
+		Km3:           sess.Km3,
+		NonceU:        sess.NonceU,
+		NonceS:        sess.NonceS,
+		EphemeralPubS: toPoint(sess.EphemeralPubS),
+		XCrypt:        sess.XCrypt,
+	})
+	if err != nil {
+		return "", err
+	}
+	period := s.currentPeriod(now)
+	a, err := s.aead(period, period)
+	if err != nil {
+		return "", err
+	}
+	blob := make([]byte, sealedHeaderLen+a.NonceSize(), sealedHeaderLen+a.NonceSize()+len(plaintext)+a.Overhead())
+	blob[0] = sealedVersion
+	binary.BigEndian.PutUint64(blob[1:sealedHeaderLen], period)
+	nonce := blob[sealedHeaderLen:]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	blob = a.Seal(blob, nonce, plaintext, blob[:sealedHeaderLen])
+	return base64.RawURLEncoding.EncodeToString(blob), nil
+}
+
+// Open returns the AuthServerSession sealed in blob. The returned session can
+// be passed to Auth3.
+func (s *SessionSealer) Open(blob string) (*AuthServerSession, error) {
+	data, err := base64.RawURLEncoding.DecodeString(blob)
+	if err != nil || len(data) < sealedHeaderLen || data[0] != sealedVersion {
+		return nil, InvalidSession
+	}
+	now := s.now()
+	current := s.currentPeriod(now)
+	period := binary.BigEndian.Uint64(data[1:sealedHeaderLen])
+	if period != current && period+1 != current {
+		return nil, InvalidSession
+	}
+	a, err := s.aead(period, current)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < sealedHeaderLen+a.NonceSize() {
+		return nil, InvalidSession
+	}
+	nonce := data[sealedHeaderLen : sealedHeaderLen+a.NonceSize()]
+	plaintext, err := a.Open(nil, nonce, data[sealedHeaderLen+a.NonceSize():], data[:sealedHeaderLen])
+	if err != nil {
+		return nil, InvalidSession
+	}
+	var ss sealedSession
+	if err := json.Unmarshal(plaintext, &ss); err != nil {
+		return nil, InvalidSession
+	}
+	expires := time.Unix(0, ss.Expires)
+	if now.After(expires) {
+		return nil, SessionExpired
+	}
+	if !s.replay.Add(hex.EncodeToString(ss.ID), expires) {
+		return nil, SessionReplayed
+	}
+	ephemeralPubS, err := ss.EphemeralPubS.toECPoint()
+	if err != nil {
+		return nil, InvalidSession
+	}
+	return &AuthServerSession{
+		SK:            ss.SK,
+		Km2:           ss.Km2,
+		Km3:           ss.Km3,
+		NonceU:        ss.NonceU,
+		NonceS:        ss.NonceS,
+		EphemeralPubS: ephemeralPubS,
+		username:      ss.Username,
+		credentialID:  ss.CredentialID,
+		XCrypt:        ss.XCrypt,
+	}, nil
+}
+
+// A ReplayCache remembers the IDs of opened blobs until they expire.
+type ReplayCache interface {
+	// Add records id, which is remembered at least until expires. Add
+	// returns false if id has been recorded before.
+	Add(id string, expires time.Time) bool
+}
+
+// MemoryReplayCache is a ReplayCache for a single server.
+type MemoryReplayCache struct {
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewMemoryReplayCache returns an empty MemoryReplayCache.
+func NewMemoryReplayCache() *MemoryReplayCache {
+	return &MemoryReplayCache{seen: map[string]time.Time{}, now: time.Now}
+}
+
+// Add implements ReplayCache. Expired IDs are removed about once a minute.
+func (c *MemoryReplayCache) Add(id string, expires time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if now.Sub(c.lastSweep) > time.Minute {
+		for k, exp := range c.seen {
+			if now.After(exp) {
+				delete(c.seen, k)
+			}
+		}
+		c.lastSweep = now
+	}
+	if _, ok := c.seen[id]; ok {
+		return false
+	}
+	c.seen[id] = expires
+	return true
+}
+
+// Len returns the number of IDs in the cache.
+func (c *MemoryReplayCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.seen)
+}
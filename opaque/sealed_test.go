@@ -0,0 +1,150 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newSealer(t *testing.T, master byte, replay ReplayCache) *SessionSealer {
+	t.Helper()
+	s, err := NewSessionSealer(bytes.Repeat([]byte{master}, 32), time.Hour, time.Minute, replay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// startAuth runs AuthInit and Auth1 for a newly registered user.
+func startAuth(t *testing.T, password string) (*AuthClientSession, *AuthServerSession, AuthMsg2) {
+	t.Helper()
+	privS, pubS := newServerKey(t)
+	user := register(t, pubS, "alice", "secret")
+	csess, msg1, err := AuthInit("alice", password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ssess, msg2, err := Auth1(privS, user, msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csess, ssess, msg2
+}
+
+func TestSessionSealer(t *testing.T) {
+	quietT(t)
+	csess, ssess, msg2 := startAuth(t, "secret")
+	replay := NewMemoryReplayCache()
+	blob, err := newSealer(t, 1, replay).Seal(ssess)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another server with the same master key finishes the login.
+	other := newSealer(t, 1, replay)
+	opened, err := other.Open(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened.Username() != "alice" {
+		t.Errorf("Username() = %q", opened.Username())
+	}
+	secret, msg3, err := Auth2(csess, msg2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret2, err := Auth3(opened, msg3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(secret, secret2) {
+		t.Error("secrets differ")
+	}
+
+	if _, err := other.Open(blob); err != SessionReplayed {
+		t.Errorf("second Open: got %v, want %v", err, SessionReplayed)
+	}
+}
+
+func TestSessionSealerRejects(t *testing.T) {
+	quietT(t)
+	_, ssess, _ := startAuth(t, "secret")
+	s := newSealer(t, 1, NewMemoryReplayCache())
+	now := time.Unix(1e9, 0)
+	s.now = func() time.Time { return now }
+	blob, err := s.Seal(ssess)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrongKey := newSealer(t, 2, NewMemoryReplayCache())
+	wrongKey.now = s.now
+	if _, err := wrongKey.Open(blob); err != InvalidSession {
+		t.Errorf("wrong key: got %v, want %v", err, InvalidSession)
+	}
+
+	tampered := []byte(blob)
+	tampered[len(tampered)/2] ^= 1
+	if tampered[len(tampered)/2] == '-' || tampered[len(tampered)/2] == '_' {
+		tampered[len(tampered)/2] = 'A'
+	}
+	if _, err := s.Open(string(tampered)); err != InvalidSession {
+		t.Errorf("tampered: got %v, want %v", err, InvalidSession)
+	}
+	for _, bad := range []string{"", "!", strings.Repeat("A", 12)} {
+		if _, err := s.Open(bad); err != InvalidSession {
+			t.Errorf("Open(%q): got %v, want %v", bad, err, InvalidSession)
+		}
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, err := s.Open(blob); err != SessionExpired {
+		t.Errorf("expired: got %v, want %v", err, SessionExpired)
+	}
+
+	// Keys from two periods ago are no longer accepted, even for a sealer
+	// with a longer TTL.
+	now = now.Add(2 * time.Hour)
+	if _, err := s.Open(blob); err != InvalidSession {
+		t.Errorf("old period: got %v, want %v", err, InvalidSession)
+	}
+}
+
+func TestSessionSealerRotation(t *testing.T) {
+	quietT(t)
+	_, ssess, _ := startAuth(t, "secret")
+	s := newSealer(t, 1, NewMemoryReplayCache())
+	// Seal just before the end of a period and open just after it.
+	now := time.Unix(0, 0).Add(1000*time.Hour - time.Second)
+	s.now = func() time.Time { return now }
+	blob, err := s.Seal(ssess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(2 * time.Second)
+	if _, err := s.Open(blob); err != nil {
+		t.Fatalf("Open after rotation: %v", err)
+	}
+	blob2, err := s.Seal(ssess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blob[:12] == blob2[:12] {
+		t.Error("period not rotated")
+	}
+}
+
+func TestNewSessionSealerArgs(t *testing.T) {
+	if _, err := NewSessionSealer(make([]byte, 16), time.Hour, time.Minute, NewMemoryReplayCache()); err == nil {
+		t.Error("short master key accepted")
+	}
+	if _, err := NewSessionSealer(make([]byte, 32), time.Minute, time.Hour, NewMemoryReplayCache()); err == nil {
+		t.Error("ttl longer than period accepted")
+	}
+}
@@ -0,0 +1,438 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+// This file contains a threshold variant of the OPRF. The OPRF key of each
+// user is shared among n share holders so that any t of them can evaluate
+// the OPRF under it and fewer learn nothing about it. Each holder is a
+// different server, so a single compromised server does not allow offline
+// dictionary attacks.
+//
+// The per-user keys are not stored anywhere. They are pseudorandom secret
+// sharings (Cramer, Damgård and Ishai, TCC 2005): for every set S of n-t+1
+// share holders there is a random seed r_S known to the holders in S, and
+// the key for the credential identifier id is
+//
+//	k = sum over all S of PRF(r_S, id)
+//
+// Any t-1 holders miss the seed of the set of the other holders, so k looks
+// random to them, and the keys of different users are unrelated. Holder i
+// computes its Shamir share of k on its own,
+//
+//	k_i = sum over S containing i of PRF(r_S, id) f_S(i)
+//
+// where f_S is the polynomial of degree t-1 with f_S(0) = 1 that is zero at
+// the holders outside S.
+//
+// A holder evaluates a blinded element A under k_i with PartialEvaluate and
+// proves the evaluation against g^k_i. A coordinating server checks t of the
+// proofs and interpolates in the exponent with CombineOprf:
+//
+//	A^k = prod (A^k_i)^lambda_i,  g^k = prod (g^k_i)^lambda_i
+//
+// where lambda_i are the Lagrange coefficients for x=0. Neither the
+// coordinator nor any t-1 share holders learn k.
+//
+// The holders also commit to nonces r_i with g^r_i and A^r_i, from which
+// the coordinator computes the challenge c of a proof that B = A^k under
+// the public key g^k, see voprf.go. The holders answer with
+// r_i - c k_i, see PartialProver.Respond, and the answers combine into a
+// proof that is the same as one made by a server that knows k.
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// MaxShareHolders is the largest supported number of share holders. Each
+// holder keeps one seed for each of the sets of n-t+1 holders it is in.
+const MaxShareHolders = 16
+
+// KeyShare is one share holder's part of the per-user OPRF keys, created by
+// SplitOprfKey.
+type KeyShare struct {
+	// Index is the x-coordinate of the holder's shares, from 1 to N.
+	Index int
+	// T of the N share holders are needed to evaluate the OPRF.
+	T, N int
+	// Seeds are the seeds of the sets of share holders that include Index.
+	Seeds []SetSeed
+}
+
+// SetSeed is the seed of a set of share holders.
+type SetSeed struct {
+	// Holders are the indices of the share holders in the set, in
+	// increasing order.
+	Holders []int
+	Seed    []byte
+}
+
+// SplitOprfKey returns the key shares of n share holders, any t of which are
+// needed to evaluate the OPRF under the per-user keys.
+func SplitOprfKey(t, n int) ([]KeyShare, error) {
+	if t < 1 || t > n || n > MaxShareHolders {
+		return nil, fmt.Errorf("threshold %d of %d, need 1 <= t <= n <= %d", t, n, MaxShareHolders)
+	}
+	shares := make([]KeyShare, n)
+	for i := range shares {
+		shares[i] = KeyShare{Index: i + 1, T: t, N: n}
+	}
+	for _, set := range subsets(n, n-t+1) {
+		seed := make([]byte, 32)
+		if _, err := rand.Read(seed); err != nil {
+			return nil, err
+		}
+		for _, i := range set {
+			shares[i-1].Seeds = append(shares[i-1].Seeds, SetSeed{Holders: set, Seed: seed})
+		}
+	}
+	return shares, nil
+}
+
+// subsets returns the subsets of {1, ..., n} with k elements, each in
+// increasing order.
+func subsets(n, k int) [][]int {
+	var res [][]int
+	var rec func(start int, cur []int)
+	rec = func(start int, cur []int) {
+		if len(cur) == k {
+			res = append(res, append([]int(nil), cur...))
+			return
+		}
+		for i := start; i <= n-(k-len(cur))+1; i++ {
+			rec(i+1, append(cur, i))
+		}
+	}
+	rec(1, nil)
+	return res
+}
+
+// binomial returns the number of subsets of n elements with k elements.
+func binomial(n, k int) int {
+	r := 1
+	for i := 1; i <= k; i++ {
+		r = r * (n - k + i) / i
+	}
+	return r
+}
+
+// userKey returns the holder's share k_i of the OPRF key for
+// credentialIdentifier.
+func (s KeyShare) userKey(credentialIdentifier []byte) (*Scalar, error) {
+	if s.T < 1 || s.T > s.N || s.N > MaxShareHolders || s.Index < 1 || s.Index > s.N {
+		return nil, fmt.Errorf("key share %d of %d, threshold %d", s.Index, s.N, s.T)
+	}
+	// The holder is in C(n-1, t-1) sets.
+	if want := binomial(s.N-1, s.T-1); len(s.Seeds) != want {
+		return nil, fmt.Errorf("key share %d has %d seeds, want %d", s.Index, len(s.Seeds), want)
+	}
+	dst := []byte("HashToScalar-OPAQUE-ThresholdKey")
+	k := NewScalar()
+	for _, ss := range s.Seeds {
+		if len(ss.Holders) != s.N-s.T+1 || !contains(ss.Holders, s.Index) || len(ss.Seed) < 32 {
+			return nil, fmt.Errorf("key share %d: invalid seed for holders %v", s.Index, ss.Holders)
+		}
+		r, err := hashToScalar(append(appendLengthPrefixed(nil, ss.Seed), credentialIdentifier...), dst)
+		if err != nil {
+			return nil, err
+		}
+		k.Add(k, r.Mul(r, setPolynomial(ss.Holders, s.N, s.Index)))
+	}
+	return k, nil
+}
+
+// setPolynomial returns f(x) for the polynomial f of degree n-len(holders)
+// with f(0) = 1 that is zero at 1, ..., n except at holders.
+func setPolynomial(holders []int, n, x int) *Scalar {
+	num := NewScalar().SetBigInt(big.NewInt(1))
+	den := NewScalar().SetBigInt(big.NewInt(1))
+	for j := 1; j <= n; j++ {
+		if contains(holders, j) {
+			continue
+		}
+		num.Mul(num, NewScalar().SetBigInt(big.NewInt(int64(j-x))))
+		den.Mul(den, NewScalar().SetBigInt(big.NewInt(int64(j))))
+	}
+	return num.Mul(num, NewScalar().Invert(den))
+}
+
+// PartialEvaluation is the answer of the share holder with index Index to a
+// blinded element A. B = A^k_i for the holder's share k_i of the user's key,
+// PubK = g^k_i, and Proof is the hex encoded proof of that. T2 = g^r and
+// T3 = A^r commit to the nonce r of the holder's part of the joint proof.
+type PartialEvaluation struct {
+	Index  int
+	B      *Point
+	PubK   *Point
+	Proof  string
+	T2, T3 *Point
+}
+
+// PartialProver is the state of a share holder between PartialEvaluate and
+// Respond.
+type PartialProver struct {
+	k, r *Scalar
+}
+
+// PartialEvaluate is invoked on a share holder. It evaluates a under the
+// holder's share of the key for credentialIdentifier. The returned
+// PartialProver answers the coordinator's challenge if it asks for a proof.
+func PartialEvaluate(share KeyShare, credentialIdentifier []byte, a *ECPoint) (*PartialProver, PartialEvaluation, error) {
+	elemA, err := NewElement(a)
+	if err != nil {
+		return nil, PartialEvaluation{}, fmt.Errorf("A: %s", err)
+	}
+	k, err := share.userKey(credentialIdentifier)
+	if err != nil {
+		return nil, PartialEvaluation{}, err
+	}
+	b := NewIdentity().ScalarMult(k, elemA).ECPoint()
+	pubK, proof, err := oprfProof(k, a, b)
+	if err != nil {
+		return nil, PartialEvaluation{}, err
+	}
+	r, err := RandomScalar(rand.Reader)
+	if err != nil {
+		return nil, PartialEvaluation{}, err
+	}
+	return &PartialProver{k: k, r: r}, PartialEvaluation{
+		Index: share.Index,
+		B:     toPoint(b),
+		PubK:  toPoint(pubK),
+		Proof: proof,
+		T2:    toPoint(NewIdentity().ScalarBaseMult(r).ECPoint()),
+		T3:    toPoint(NewIdentity().ScalarMult(r, elemA).ECPoint()),
+	}, nil
+}
+
+// Respond returns the hex encoded answer r - c k_i to the hex encoded
+// challenge c. It can only be called once, since two answers with the same
+// nonce reveal the share.
+func (p *PartialProver) Respond(challenge string) (string, error) {
+	if p.r == nil {
+		return "", errors.New("challenge already answered")
+	}
+	data, err := hex.DecodeString(challenge)
+	if err != nil {
+		return "", fmt.Errorf("challenge: %s", err)
+	}
+	c, err := NewScalar().SetBytes(data)
+	if err != nil {
+		return "", fmt.Errorf("challenge: %s", err)
+	}
+	s := NewScalar().Sub(p.r, NewScalar().Mul(c, p.k))
+	p.r = nil
+	return hex.EncodeToString(s.Bytes()), nil
+}
+
+// partial is a PartialEvaluation whose proof has been checked.
+type partial struct {
+	index           int
+	b, pubK, t2, t3 *Element
+}
+
+func parsePartial(a *ECPoint, p PartialEvaluation) (*partial, error) {
+	var pts [4]*ECPoint
+	for i, pt := range []*Point{p.B, p.PubK, p.T2, p.T3} {
+		var err error
+		if pts[i], err = pt.toECPoint(); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkOprfProof(pts[1], a, pts[0], p.Proof); err != nil {
+		return nil, err
+	}
+	var elems [4]*Element
+	for i, pt := range pts {
+		var err error
+		if elems[i], err = NewElement(pt); err != nil {
+			return nil, err
+		}
+	}
+	return &partial{index: p.Index, b: elems[0], pubK: elems[1], t2: elems[2], t3: elems[3]}, nil
+}
+
+// ThresholdEvaluation is the evaluation of a blinded element under a user's
+// key, combined by CombineOprf from the partial evaluations of t share
+// holders.
+type ThresholdEvaluation struct {
+	// B = A^k and PubK = g^k for the user's key k.
+	B, PubK *ECPoint
+	// Indices are the share holders whose partial evaluations were
+	// combined. Only they can answer the Challenge.
+	Indices []int
+
+	a        *Element
+	partials []*partial
+	lambdas  []*Scalar
+	// c is the challenge, computed by Challenge.
+	c *Scalar
+}
+
+// CombineOprf is invoked on the coordinator. It checks the proofs of the
+// partial evaluations of a and combines t of those that verify into the
+// evaluation under the user's key. If pubK, the user's public key from
+// registration, is non-nil, the combined evaluation must be under that key,
+// so that a share holder that evaluates with another share is left out.
+// InvalidProof is returned if there are no such t partial evaluations.
+func CombineOprf(a *ECPoint, partials []PartialEvaluation, t int, pubK *ECPoint) (*ThresholdEvaluation, error) {
+	elemA, err := NewElement(a)
+	if err != nil {
+		return nil, fmt.Errorf("A: %s", err)
+	}
+	var indices []int
+	var valid []*partial
+	for _, p := range partials {
+		if contains(indices, p.Index) {
+			continue
+		}
+		pp, err := parsePartial(a, p)
+		if err != nil {
+			continue
+		}
+		indices = append(indices, p.Index)
+		valid = append(valid, pp)
+	}
+	if len(valid) < t {
+		return nil, fmt.Errorf("%d valid partial evaluations, need %d: %w", len(valid), t, InvalidProof)
+	}
+	for _, set := range subsets(len(valid), t) {
+		e := &ThresholdEvaluation{a: elemA}
+		for _, j := range set {
+			e.partials = append(e.partials, valid[j-1])
+			e.Indices = append(e.Indices, valid[j-1].index)
+		}
+		e.lambdas = lagrangeAtZero(e.Indices)
+		b, pk := NewIdentity(), NewIdentity()
+		for j, p := range e.partials {
+			b.Add(b, NewIdentity().ScalarMult(e.lambdas[j], p.b))
+			pk.Add(pk, NewIdentity().ScalarMult(e.lambdas[j], p.pubK))
+		}
+		if b.IsIdentity() || pk.IsIdentity() {
+			continue
+		}
+		e.B, e.PubK = b.ECPoint(), pk.ECPoint()
+		if pubK == nil || (e.PubK.X.Cmp(pubK.X) == 0 && e.PubK.Y.Cmp(pubK.Y) == 0) {
+			return e, nil
+		}
+	}
+	return nil, fmt.Errorf("no %d partial evaluations under the user's key: %w", t, InvalidProof)
+}
+
+func contains(xs []int, x int) bool {
+	for _, y := range xs {
+		if x == y {
+			return true
+		}
+	}
+	return false
+}
+
+// lagrangeAtZero returns the Lagrange coefficients for interpolating at x=0
+// from the points with the given distinct x-coordinates.
+func lagrangeAtZero(xs []int) []*Scalar {
+	lambdas := make([]*Scalar, len(xs))
+	for i, xi := range xs {
+		num := NewScalar().SetBigInt(big.NewInt(1))
+		den := NewScalar().SetBigInt(big.NewInt(1))
+		for j, xj := range xs {
+			if i == j {
+				continue
+			}
+			num.Mul(num, NewScalar().SetBigInt(big.NewInt(int64(xj))))
+			den.Mul(den, NewScalar().SetBigInt(big.NewInt(int64(xj-xi))))
+		}
+		lambdas[i] = num.Mul(num, NewScalar().Invert(den))
+	}
+	return lambdas
+}
+
+// Challenge returns the hex encoded challenge of the proof that B = A^k,
+// which the share holders in Indices answer with PartialProver.Respond.
+func (e *ThresholdEvaluation) Challenge() (string, error) {
+	pk, err := NewElement(e.PubK)
+	if err != nil {
+		return "", err
+	}
+	b, err := NewElement(e.B)
+	if err != nil {
+		return "", err
+	}
+	weights, err := compositeWeights(modeVOPRF, pk, []*Element{e.a}, []*Element{b})
+	if err != nil {
+		return "", err
+	}
+	// With one element m = d A and z = d B. The holders committed to
+	// A^r_i, so t3 = (prod (A^r_i)^lambda_i)^d.
+	d := weights[0]
+	m := NewIdentity().ScalarMult(d, e.a)
+	z := NewIdentity().ScalarMult(d, b)
+	t2, t3 := NewIdentity(), NewIdentity()
+	for j, p := range e.partials {
+		t2.Add(t2, NewIdentity().ScalarMult(e.lambdas[j], p.t2))
+		t3.Add(t3, NewIdentity().ScalarMult(e.lambdas[j], p.t3))
+	}
+	t3.ScalarMult(d, t3)
+	if e.c, err = challenge(modeVOPRF, pk, m, z, t2, t3); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(e.c.Bytes()), nil
+}
+
+// Proof combines the answers to the Challenge, responses[i] from the share
+// holder with index i, into the hex encoded proof that B = A^k under PubK,
+// as sent in AuthMsg2.Proof and PwRegMsg2.Proof. Each answer is checked
+// against the holder's commitments, and InvalidProof is returned if one is
+// wrong.
+func (e *ThresholdEvaluation) Proof(responses map[int]string) (string, error) {
+	if e.c == nil {
+		return "", errors.New("Proof called before Challenge")
+	}
+	s := NewScalar()
+	for j, p := range e.partials {
+		data, err := hex.DecodeString(responses[p.index])
+		if err != nil {
+			return "", fmt.Errorf("share holder %d: %w", p.index, InvalidProof)
+		}
+		si, err := NewScalar().SetBytes(data)
+		if err != nil {
+			return "", fmt.Errorf("share holder %d: %w", p.index, InvalidProof)
+		}
+		// g^s_i (g^k_i)^c = g^r_i and A^s_i (A^k_i)^c = A^r_i.
+		t2 := NewIdentity().Add(NewIdentity().ScalarBaseMult(si), NewIdentity().ScalarMult(e.c, p.pubK))
+		t3 := NewIdentity().Add(NewIdentity().ScalarMult(si, e.a), NewIdentity().ScalarMult(e.c, p.b))
+		if !t2.Equal(p.t2) || !t3.Equal(p.t3) {
+			return "", fmt.Errorf("share holder %d: %w", p.index, InvalidProof)
+		}
+		s.Add(s, si.Mul(si, e.lambdas[j]))
+	}
+	return hex.EncodeToString(append(e.c.Bytes(), s.Bytes()...)), nil
+}
+
+// PwRegEvaluated is like PwReg but B=A^k has been computed elsewhere, for
+// example with CombineOprf. pubK is g^k and proof the proof that B=A^k, which
+// must be given if msg1.Verifiable is set. The User returned by PwReg3 has
+// no K but has PubK.
+func PwRegEvaluated(pubS *ECPoint, msg1 PwRegMsg1, b, pubK *ECPoint, proof string) (*PwRegServerSession, PwRegMsg2, error) {
+	if err := checkPoint("B", b); err != nil {
+		return nil, PwRegMsg2{}, err
+	}
+	if err := checkPoint("PubK", pubK); err != nil {
+		return nil, PwRegMsg2{}, err
+	}
+	sess := &PwRegServerSession{Username: msg1.Username, derived: true, pubK: pubK}
+	msg2 := PwRegMsg2{B: toPoint(b), PubS: toPoint(pubS)}
+	if msg1.Verifiable {
+		if proof == "" {
+			return nil, PwRegMsg2{}, errors.New("no proof of the OPRF evaluation")
+		}
+		msg2.PubK, msg2.Proof = toPoint(pubK), proof
+	}
+	return sess, msg2, nil
+}
@@ -0,0 +1,192 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+import (
+	"errors"
+	"testing"
+)
+
+// combinedKey interpolates the key for credentialIdentifier from the first t
+// shares.
+func combinedKey(t *testing.T, shares []KeyShare, credentialIdentifier []byte) *Scalar {
+	t.Helper()
+	var indices []int
+	for _, s := range shares[:shares[0].T] {
+		indices = append(indices, s.Index)
+	}
+	lambdas := lagrangeAtZero(indices)
+	k := NewScalar()
+	for j, s := range shares[:len(indices)] {
+		ki, err := s.userKey(credentialIdentifier)
+		if err != nil {
+			t.Fatal(err)
+		}
+		k.Add(k, ki.Mul(ki, lambdas[j]))
+	}
+	return k
+}
+
+func TestThresholdKeys(t *testing.T) {
+	for _, tn := range [][2]int{{1, 1}, {1, 3}, {2, 3}, {3, 5}, {5, 5}} {
+		shares, err := SplitOprfKey(tn[0], tn[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Every t shares give the same key, which is the sum of the
+		// seeds' values.
+		want := NewScalar()
+		seen := map[string]bool{}
+		for _, s := range shares {
+			for _, ss := range s.Seeds {
+				if seen[string(ss.Seed)] {
+					continue
+				}
+				seen[string(ss.Seed)] = true
+				r, err := hashToScalar(append(appendLengthPrefixed(nil, ss.Seed), "alice"...), []byte("HashToScalar-OPAQUE-ThresholdKey"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				want.Add(want, r)
+			}
+		}
+		for _, first := range []int{0, tn[1] - tn[0]} {
+			if got := combinedKey(t, shares[first:], []byte("alice")); !got.Equal(want) {
+				t.Errorf("%d of %d: shares from %d give another key", tn[0], tn[1], first+1)
+			}
+		}
+		if combinedKey(t, shares, []byte("bob")).Equal(want) {
+			t.Errorf("%d of %d: alice and bob have the same key", tn[0], tn[1])
+		}
+	}
+
+	for _, tn := range [][2]int{{0, 3}, {4, 3}, {2, MaxShareHolders + 1}} {
+		if _, err := SplitOprfKey(tn[0], tn[1]); err == nil {
+			t.Errorf("SplitOprfKey accepted %d of %d", tn[0], tn[1])
+		}
+	}
+	shares, err := SplitOprfKey(2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := shares[0]
+	missing.Seeds = missing.Seeds[1:]
+	if _, err := missing.userKey([]byte("alice")); err == nil {
+		t.Error("userKey accepted a share with a missing seed")
+	}
+}
+
+func TestThresholdOprf(t *testing.T) {
+	shares, err := SplitOprfKey(3, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := []byte("alice")
+	k := combinedKey(t, shares, id)
+	pubK := NewIdentity().ScalarBaseMult(k).ECPoint()
+	a, _, err := dhOprf1([]byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := dhOprf2(a, k.BigInt())
+	if err != nil {
+		t.Fatal(err)
+	}
+	provers := map[int]*PartialProver{}
+	partial := func(s KeyShare) PartialEvaluation {
+		p, res, err := PartialEvaluate(s, id, a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		provers[s.Index] = p
+		return res
+	}
+
+	for _, subset := range [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4}} {
+		var partials []PartialEvaluation
+		for _, i := range subset {
+			partials = append(partials, partial(shares[i]))
+		}
+		e, err := CombineOprf(a, partials, 3, pubK)
+		if err != nil {
+			t.Fatalf("shares %v: %v", subset, err)
+		}
+		if e.B.X.Cmp(want.X) != 0 || e.B.Y.Cmp(want.Y) != 0 {
+			t.Errorf("shares %v: B differs from the evaluation under k", subset)
+		}
+		c, err := e.Challenge()
+		if err != nil {
+			t.Fatal(err)
+		}
+		responses := map[int]string{}
+		for _, i := range e.Indices {
+			if responses[i], err = provers[i].Respond(c); err != nil {
+				t.Fatal(err)
+			}
+		}
+		proof, err := e.Proof(responses)
+		if err != nil {
+			t.Fatalf("shares %v: Proof: %v", subset, err)
+		}
+		// The client checks the proof as if the server knew k.
+		if err := checkOprfProof(pubK, a, e.B, proof); err != nil {
+			t.Errorf("shares %v: combined proof: %v", subset, err)
+		}
+		if _, err := provers[e.Indices[0]].Respond(c); err == nil {
+			t.Error("a share holder answered twice with the same nonce")
+		}
+	}
+
+	// A share holder that evaluates with another share is left out, even
+	// if its proof verifies, when the user's key is known.
+	other, err := SplitOprfKey(3, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := partial(other[1])
+	partials := []PartialEvaluation{bad, partial(shares[0]), partial(shares[2]), partial(shares[3])}
+	e, err := CombineOprf(a, partials, 3, pubK)
+	if err != nil {
+		t.Fatalf("with one bad share: %v", err)
+	}
+	if contains(e.Indices, 2) {
+		t.Errorf("combined the bad share: %v", e.Indices)
+	}
+	if _, err := CombineOprf(a, partials[:3], 3, pubK); !errors.Is(err, InvalidProof) {
+		t.Errorf("with two good shares: got %v, want %v", err, InvalidProof)
+	}
+	// A wrong proof is not counted.
+	forged := partial(shares[4])
+	forged.Proof = partial(shares[1]).Proof
+	if _, err := CombineOprf(a, []PartialEvaluation{forged, partial(shares[0]), partial(shares[2])}, 3, nil); !errors.Is(err, InvalidProof) {
+		t.Errorf("with a forged proof: got %v, want %v", err, InvalidProof)
+	}
+	// The same share twice counts once.
+	dup := []PartialEvaluation{partial(shares[0]), partial(shares[0]), partial(shares[1])}
+	if _, err := CombineOprf(a, dup, 3, nil); !errors.Is(err, InvalidProof) {
+		t.Errorf("with a duplicate share: got %v, want %v", err, InvalidProof)
+	}
+
+	// A wrong answer to the challenge is detected.
+	e, err = CombineOprf(a, []PartialEvaluation{partial(shares[0]), partial(shares[1]), partial(shares[2])}, 3, pubK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := e.Challenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	responses := map[int]string{}
+	for _, i := range e.Indices {
+		if responses[i], err = provers[i].Respond(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	responses[e.Indices[1]] = responses[e.Indices[0]]
+	if _, err := e.Proof(responses); !errors.Is(err, InvalidProof) {
+		t.Errorf("with a wrong answer: got %v, want %v", err, InvalidProof)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ProtocolVersion is the version of the authentication protocol that
+// AuthInit and Auth2 speak.
+//
+// Version 1 is the protocol of the first release, spoken by clients that
+// send an AuthMsg1 without Version. XCrypt and the inputs of the HMQV
+// exponents concatenate the coordinates of points with leading zeros dropped
+// and variable-length fields without their lengths, so different transcripts
+// may have the same encoding, and the keys are derived with "HMQVKeys" and
+// NonceU only. Version 2 encodes them with transcriptBuilder, binds the
+// identities and the OPRF verification to XCrypt, see bindings, and derives
+// the keys with the hash of XCrypt. Version 3 follows the HMQV paper, see
+// hmqvExponents, binds AuthMsg1.CredentialID to XCrypt and confirms the keys
+// with Km2 for the server and Km3 for the client.
+//
+// Auth1 answers all versions up to ProtocolVersion; Auth2 only accepts
+// ProtocolVersion.
+const ProtocolVersion = 3
+
+// UnsupportedVersion is returned by Auth2 if the server does not answer with
+// ProtocolVersion.
+var UnsupportedVersion = errors.New("unsupported protocol version")
+
+// negotiateVersion returns the protocol version Auth1 uses for a client that
+// sent version in AuthMsg1.
+func negotiateVersion(version int) int {
+	if version < 1 {
+		return 1
+	}
+	if version > ProtocolVersion {
+		return ProtocolVersion
+	}
+	return version
+}
+
+// coordinateLength is the length of a coordinate of a point on dhGroup.
+const coordinateLength = 32
+
+// transcriptBuilder builds the encoding of version 2 transcripts. Points are
+// written as uncompressed SEC 1 encodings of fixed length and everything
+// else with a two byte big-endian length prefix, so the encoding of a
+// sequence of fields determines the fields.
+type transcriptBuilder struct {
+	buf []byte
+	err error
+}
+
+// newTranscriptBuilder returns a builder whose encoding starts with label
+// and version, so transcripts of different uses and versions differ.
+func newTranscriptBuilder(label string, version int) *transcriptBuilder {
+	t := &transcriptBuilder{}
+	t.String(label)
+	t.buf = binary.BigEndian.AppendUint16(t.buf, uint16(version))
+	return t
+}
+
+// Point appends p.
+func (t *transcriptBuilder) Point(p *ECPoint) *transcriptBuilder {
+	if t.err != nil {
+		return t
+	}
+	if p == nil || p.X == nil || p.Y == nil || p.X.Sign() < 0 || p.Y.Sign() < 0 ||
+		p.X.BitLen() > 8*coordinateLength || p.Y.BitLen() > 8*coordinateLength {
+		t.err = errors.New("transcript: invalid point")
+		return t
+	}
+	t.buf = append(t.buf, 4)
+	t.buf = append(t.buf, p.X.FillBytes(make([]byte, coordinateLength))...)
+	t.buf = append(t.buf, p.Y.FillBytes(make([]byte, coordinateLength))...)
+	return t
+}
+
+// Bytes appends b with its length.
+func (t *transcriptBuilder) Bytes(b []byte) *transcriptBuilder {
+	if t.err != nil {
+		return t
+	}
+	if len(b) > 0xffff {
+		t.err = fmt.Errorf("transcript: field of %d bytes", len(b))
+		return t
+	}
+	t.buf = appendLengthPrefixed(t.buf, b)
+	return t
+}
+
+// String appends s with its length.
+func (t *transcriptBuilder) String(s string) *transcriptBuilder {
+	return t.Bytes([]byte(s))
+}
+
+// Bool appends b as one byte.
+func (t *transcriptBuilder) Bool(b bool) *transcriptBuilder {
+	if b {
+		t.buf = append(t.buf, 1)
+	} else {
+		t.buf = append(t.buf, 0)
+	}
+	return t
+}
+
+// Finish returns the encoding, or the first error.
+func (t *transcriptBuilder) Finish() ([]byte, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	return t.buf, nil
+}
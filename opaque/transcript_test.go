@@ -0,0 +1,186 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/big"
+	"testing"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+func TestTranscriptBuilder(t *testing.T) {
+	// Coordinates with leading zero bytes keep their length.
+	p := &ECPoint{X: big.NewInt(1), Y: big.NewInt(2)}
+	enc, err := newTranscriptBuilder("", 2).Point(p).Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(enc) != 4+65 || enc[4] != 4 || enc[4+32] != 1 || enc[4+64] != 2 {
+		t.Errorf("point encoded as %x", enc)
+	}
+
+	split := func(a, b string) []byte {
+		enc, err := newTranscriptBuilder("test", 2).String(a).String(b).Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return enc
+	}
+	if bytes.Equal(split("ab", "c"), split("a", "bc")) {
+		t.Error("fields split differently have the same encoding")
+	}
+	v2, _ := newTranscriptBuilder("test", 2).Finish()
+	v3, _ := newTranscriptBuilder("test", 3).Finish()
+	if bytes.Equal(v2, v3) {
+		t.Error("versions have the same encoding")
+	}
+
+	if _, err := newTranscriptBuilder("test", 2).Bytes(make([]byte, 1<<16)).Finish(); err == nil {
+		t.Error("field longer than 65535 bytes encoded")
+	}
+	if _, err := newTranscriptBuilder("test", 2).Point(&ECPoint{X: big.NewInt(-1), Y: big.NewInt(1)}).Finish(); err == nil {
+		t.Error("negative coordinate encoded")
+	}
+}
+
+func TestAuthVersion(t *testing.T) {
+	quietT(t)
+	privS, pubS := newServerKey(t)
+	user := register(t, pubS, "alice", "correct horse")
+	for _, tc := range []struct {
+		client, server int
+	}{
+		{0, 0},
+		{1, 0},
+		{2, 2},
+		{ProtocolVersion, ProtocolVersion},
+		{ProtocolVersion + 1, ProtocolVersion},
+	} {
+		csess, msg1, err := AuthInit("alice", "correct horse")
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg1.Version = tc.client
+		_, msg2, err := Auth1(privS, user, msg1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg2.Version != tc.server {
+			t.Errorf("client version %d: server answered %d, want %d", tc.client, msg2.Version, tc.server)
+		}
+		// The client does not fall back to version 1, so a man in the
+		// middle cannot make it.
+		_, _, err = Auth2(csess, msg2)
+		if ok := tc.server == ProtocolVersion; ok != (err == nil) || !ok && !errors.Is(err, UnsupportedVersion) {
+			t.Errorf("client version %d: Auth2: %v", tc.client, err)
+		}
+	}
+
+	// Claiming version 2 in a version 1 answer does not help either.
+	csess, msg1, err := AuthInit("alice", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg1.Version = 0
+	_, msg2, err := Auth1(privS, user, msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg2.Version = ProtocolVersion
+	if _, _, err := Auth2(csess, msg2); err != MacMismatch {
+		t.Errorf("downgraded run: got %v, want %v", err, MacMismatch)
+	}
+}
+
+// TestAuthVersion1 runs the client side of the first release against Auth1,
+// so that clients that send no Version keep working: XCrypt is the plain
+// concatenation of the values, the keys are derived with "HMQVKeys" and
+// NonceU, and both MACs are made with Km3.
+func TestAuthVersion1(t *testing.T) {
+	quietT(t)
+	privS, pubS := newServerKey(t)
+	user := register(t, pubS, "alice", "correct horse")
+	csess, msg1, err := AuthInit("alice", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg1.Version = 0
+	ssess, msg2, err := Auth1(privS, user, msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg2.Version != 0 {
+		t.Fatalf("server answered version %d", msg2.Version)
+	}
+
+	b, err := msg2.B.toECPoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ephS, err := msg2.EphemeralPubS.toECPoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rwd, err := dhOprf3(csess.password, b, csess.r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err := openEnvelope(rwd, msg2.EnvU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonceS, _ := hex.DecodeString(msg2.NonceS)
+	envU, _ := hex.DecodeString(msg2.EnvU)
+	ephU := csess.ephemeralPubU
+
+	var XCrypt []byte
+	for _, f := range [][]byte{
+		csess.a.X.Bytes(), csess.a.Y.Bytes(), csess.nonceU, []byte("alice"),
+		ephU.X.Bytes(), ephU.Y.Bytes(), b.X.Bytes(), b.Y.Bytes(),
+		envU, nonceS, ephS.X.Bytes(), ephS.Y.Bytes(),
+	} {
+		XCrypt = append(XCrypt, f...)
+	}
+	info := append([]byte("HMQVKeys"), csess.nonceU...)
+	q1 := sha256.Sum256(append(append(append(ephU.X.Bytes(), ephU.Y.Bytes()...), "user"...), info...))
+	q2 := sha256.Sum256(append(append(append(ephS.X.Bytes(), ephS.Y.Bytes()...), "srvr"...), info...))
+
+	// (EphemeralPubS + q2*PubS)^(ephemeralPrivU + q1*PrivU)
+	exp := new(big.Int).Mul(new(big.Int).SetBytes(q1[:]), new(big.Int).SetBytes(env.PrivU))
+	exp.Add(exp, new(big.Int).SetBytes(csess.ephemeralPrivU.PrivateKeyBytes))
+	px, py := dhGroup.ScalarMult(env.PubS.X, env.PubS.Y, q2[:])
+	px, py = dhGroup.Add(ephS.X, ephS.Y, px, py)
+	px, py = dhGroup.ScalarMult(px, py, exp.Bytes())
+	kdf := hkdf.New(sha256.New, append(px.Bytes(), py.Bytes()...), make([]byte, 32), info)
+	keys := make([]byte, 96)
+	if _, err := io.ReadFull(kdf, keys); err != nil {
+		t.Fatal(err)
+	}
+	SK, Km3 := keys[:32], keys[64:]
+
+	mac := func(data []byte) []byte {
+		h := hmac.New(sha256.New, Km3)
+		h.Write(data)
+		return h.Sum(nil)
+	}
+	if hex.EncodeToString(mac(XCrypt)) != msg2.Mac1 {
+		t.Fatal("Mac1 differs from the first release")
+	}
+	sk, err := Auth3(ssess, AuthMsg3{Mac2: hex.EncodeToString(mac(append([]byte("Finish"), XCrypt...)))})
+	if err != nil {
+		t.Fatalf("Auth3: %v", err)
+	}
+	if !bytes.Equal(sk, SK) {
+		t.Error("server's SK differs from the client's")
+	}
+}
@@ -11,15 +11,50 @@ import (
 	"bufio"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math/big"
+	"os"
 	"strings"
 )
 
+// Trace receives the frames sent and received by Read and Write and the
+// intermediate values computed by Auth1. Set it to io.Discard to silence
+// them, e.g. in load tests.
+var Trace io.Writer = os.Stdout
+
 type Point struct {
 	X string
 	Y string
 }
 
+// toPoint converts p to the decimal string form used in messages sent from
+// the server.
+func toPoint(p *ECPoint) *Point {
+	return &Point{X: p.X.String(), Y: p.Y.String()}
+}
+
+// toECPoint parses p and checks that the result is on dhGroup.
+func (p *Point) toECPoint() (*ECPoint, error) {
+	if p == nil {
+		return nil, errors.New("point is missing")
+	}
+	x, ok := new(big.Int).SetString(p.X, 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid x-coordinate %q", p.X)
+	}
+	y, ok := new(big.Int).SetString(p.Y, 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid y-coordinate %q", p.Y)
+	}
+	if !dhGroup.IsOnCurve(x, y) {
+		return nil, errors.New("point is not in elliptic curve")
+	}
+	return &ECPoint{X: x, Y: y}, nil
+}
+
 func RemoveQuotesFromJson(json string) string {
 	var flag = true
 	var jsonTransformed = json
@@ -44,13 +79,73 @@ func RemoveQuotesFromJson(json string) string {
 	return jsonTransformed
 }
 
+// checkPoint returns an error if p is missing or not on dhGroup. name is used
+// in the error message.
+func checkPoint(name string, p *ECPoint) error {
+	if p == nil || p.X == nil || p.Y == nil {
+		return fmt.Errorf("%s is missing", name)
+	}
+	if !dhGroup.IsOnCurve(p.X, p.Y) {
+		return fmt.Errorf("%s is not in elliptic curve", name)
+	}
+	return nil
+}
+
+// DecodePwRegMsg1 parses a PwRegMsg1 sent by a client and checks that all
+// points in it are valid.
+func DecodePwRegMsg1(data []byte) (PwRegMsg1, error) {
+	var msg1 PwRegMsg1
+	if err := json.Unmarshal([]byte(RemoveQuotesFromJson(string(data))), &msg1); err != nil {
+		return PwRegMsg1{}, err
+	}
+	if err := checkPoint("A", msg1.A); err != nil {
+		return PwRegMsg1{}, err
+	}
+	return msg1, nil
+}
+
+// DecodePwRegMsg3 parses a PwRegMsg3 sent by a client and checks that all
+// points in it are valid.
+func DecodePwRegMsg3(data []byte) (PwRegMsg3, error) {
+	var msg3 PwRegMsg3
+	if err := json.Unmarshal([]byte(RemoveQuotesFromJson(string(data))), &msg3); err != nil {
+		return PwRegMsg3{}, err
+	}
+	if err := checkPoint("PubU", msg3.PubU); err != nil {
+		return PwRegMsg3{}, err
+	}
+	return msg3, nil
+}
+
+// DecodeAuthMsg1 parses an AuthMsg1 sent by a client and checks that all
+// points in it are valid.
+func DecodeAuthMsg1(data []byte) (AuthMsg1, error) {
+	var msg1 AuthMsg1
+	if err := json.Unmarshal([]byte(RemoveQuotesFromJson(string(data))), &msg1); err != nil {
+		return AuthMsg1{}, err
+	}
+	if err := checkPoint("A", msg1.A); err != nil {
+		return AuthMsg1{}, err
+	}
+	if err := checkPoint("EphemeralPubU", msg1.EphemeralPubU); err != nil {
+		return AuthMsg1{}, err
+	}
+	return msg1, nil
+}
+
+// removeQuote removes the closing quote of the string value that starts at
+// json[startInd+4]. If there is no closing quote, as in truncated input, json
+// is returned unchanged and the opening quote is removed by the caller.
 func removeQuote(json string, startInd int) string{
 	var indOfQuote = strings.Index(json[startInd+4: len(json)], "\"")
+	if indOfQuote == -1 {
+		return json
+	}
 	return json[0: startInd + 4 + indOfQuote] +  json[startInd + 4 + indOfQuote + 1: len(json)]
 }
 
 func Write(w *bufio.Writer, data []byte) error {
-	fmt.Printf("> %s\n", string(data))
+	fmt.Fprintf(Trace, "> %s\n", string(data))
 	w.Write(data)
 	w.Write([]byte("\n"))
 	if err := w.Flush(); err != nil {
@@ -60,15 +155,21 @@ func Write(w *bufio.Writer, data []byte) error {
 }
 
 func Read(r *bufio.Reader) ([]byte, error) {
-	fmt.Print("< ")
+	fmt.Fprint(Trace, "< ")
 	data, err := r.ReadBytes('\n')
 	if err != nil {
 		return nil, err
 	}
-	fmt.Print(string(data))
+	fmt.Fprint(Trace, string(data))
 	return data[:len(data)-1], nil
 }
 
+// ChannelKey returns the key used with EncryptAndWrite and ReadAndDecrypt for
+// messages sent after a login with the session key SK.
+func ChannelKey(SK []byte) []byte {
+	return SK[:16]
+}
+
 func EncryptAndWrite(w *bufio.Writer, key []byte, plaintext string) error {
 	ciphertext, err := AuthEnc(rand.Reader, key, []byte(plaintext))
 	if err != nil {
@@ -0,0 +1,113 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+import (
+	"math/big"
+	"testing"
+)
+
+var testSalt = big.NewInt(0x5eed)
+
+// Messages captured from a registration and a login by a client that encodes
+// coordinates as JSON strings. They are used as seeds for the fuzz targets.
+const (
+	transcriptEnvU      = "7cddfa273b9763743a86d601f2fe15ea733b53d2facf5b178886477874424860a7b8d55bfccc37aad890e338414df2bc3eb4b2ecb6077842811712aa17149e24156038d35a2121f7315362b0feb6177dc782780195ab9fd22e87dfb4509f61785c69e44f42a5f178f4df23bd83efc93c5edafbb3ca5221f330dbc2ddc4b0d6764939074d1dc1d7597ad23e214c8095d0bc5ff4b688c045ead8385ad1c00b26b7d6b8ba2095e8dd1c85275534357e76c17546425f9c1ac4dca3907f2fd255bf47700a71378312c79fb5ed4b6f84d3b6b35df0aa7645b0ee2686af82c7428ef3e3bcb431d0ddd66cbf8e84ef8e0280dcb50ad2f05757e5a60116e2929435a39649af71eb38e91053e1f853e01a461e46cfb3f7520b15fc9f74c3e4bef34dc3d276c01c4af4050daa45785c169cbcf6bfc7d53bfd9a7e0c5d17b1b89487a7ebace538b96d25bed246e033a422559fc9e1442de4c136923233748586ac589f0b87743521162096309075bf27057e690e1b72f5996bee75be5913d719ccba1f44d77c6f5deaf36b7523d0964cfc08ffe95bc5625e1750b8670d374dd0ce57aff3279f9b12091fdf5da94878366bd3900f0fe67e97c8eb2ad133ee66332316f3e1dd8bc55dd9ccdfcb9069a655a6ae1a08db3f"
+	transcriptPwRegMsg1 = `{"username":"alice","a":{"x":"33111174408224633173917277094587307946499652540595691378157708617552448881930","y":"114023929515884866899635935213853611490454957244186856897978607404300287692833"}}`
+	transcriptPwRegMsg3 = `{"envU":"` + transcriptEnvU + `","pubU":{"x":"9882725008930080803984179829445049898893703927225458166977212199377818322804","y":"5301338517495820621279466951452813533340882790436769704075086876499783170316"}}`
+	transcriptAuthMsg1  = `{"username":"alice","a":{"x":"83370332600868084798644495610585418266589665403355425538996128487577839427095","y":"92523580371266914918213484414037945950957519672685396433433825592728244348852"},"nonceU":"1fee609f845ccb51250c898134c04eb9a3c780eba22efa8bcb07598d781d058e","ephemeralPubU":{"x":"52371409404663194558654749648440141519188729875126129466894034161145199332728","y":"7294254676077934903412422066547745129274463945293344647238536200422073168214"}}`
+)
+
+var transcriptSeeds = []string{
+	transcriptPwRegMsg1,
+	transcriptPwRegMsg3,
+	transcriptAuthMsg1,
+	`{"Mac2":"00"}`,
+	`{"username":"alice","a":{"x":"1`,
+	`{"x":"`,
+	`y":"`,
+	``,
+}
+
+func TestRemoveQuotesFromJson(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{`{"a":{"x":"1","y":"2"}}`, `{"a":{"x":1,"y":2}}`},
+		{`{"a":{"x":1,"y":2}}`, `{"a":{"x":1,"y":2}}`},
+		{`{"username":"bob"}`, `{"username":"bob"}`},
+		// No closing quote.
+		{`{"a":{"x":"1`, `{"a":{"x":1`},
+	} {
+		if got := RemoveQuotesFromJson(tc.in); got != tc.want {
+			t.Errorf("RemoveQuotesFromJson(%s) = %s, want %s", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestDecodeTranscript(t *testing.T) {
+	if _, err := DecodePwRegMsg1([]byte(transcriptPwRegMsg1)); err != nil {
+		t.Errorf("DecodePwRegMsg1: %v", err)
+	}
+	if _, err := DecodePwRegMsg3([]byte(transcriptPwRegMsg3)); err != nil {
+		t.Errorf("DecodePwRegMsg3: %v", err)
+	}
+	if _, err := DecodeAuthMsg1([]byte(transcriptAuthMsg1)); err != nil {
+		t.Errorf("DecodeAuthMsg1: %v", err)
+	}
+}
+
+func FuzzRemoveQuotesFromJson(f *testing.F) {
+	for _, s := range transcriptSeeds {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		RemoveQuotesFromJson(s)
+	})
+}
+
+func FuzzDecodePwRegMsg1(f *testing.F) {
+	for _, s := range transcriptSeeds {
+		f.Add([]byte(s))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg1, err := DecodePwRegMsg1(data)
+		if err != nil {
+			return
+		}
+		if _, err := dhOprf2(msg1.A, testSalt); err != nil {
+			t.Errorf("dhOprf2 rejected decoded point: %v", err)
+		}
+	})
+}
+
+func FuzzDecodePwRegMsg3(f *testing.F) {
+	for _, s := range transcriptSeeds {
+		f.Add([]byte(s))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg3, err := DecodePwRegMsg3(data)
+		if err != nil {
+			return
+		}
+		PwReg3(&PwRegServerSession{Username: "alice", K: testSalt}, msg3)
+	})
+}
+
+func FuzzDecodeAuthMsg1(f *testing.F) {
+	privS, pubS := newServerKey(f)
+	user := register(f, pubS, "alice", "secret")
+	for _, s := range transcriptSeeds {
+		f.Add([]byte(s))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg1, err := DecodeAuthMsg1(data)
+		if err != nil {
+			return
+		}
+		Auth1(privS, user, msg1)
+	})
+}
@@ -0,0 +1,290 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+// This file contains the verifiable mode of the OPRF, following RFC 9497
+// (Oblivious Pseudorandom Functions Using Prime-Order Groups) with the
+// P256-SHA256 ciphersuite. The server's OPRF key k has the public key
+// pk = g^k, and with every evaluation b = a^k the server sends a DLEQ proof
+// that log_g(pk) = log_a(b). A client that knows pk checks the proof before
+// unblinding, so a server cannot evaluate with a different key for some
+// requests, for example to tell users apart.
+//
+// The proofs, HashToScalar and the key derivation are as in the RFC and are
+// tested with its test vectors. The input is still mapped to the curve with
+// hashToCurve from dhoprf.go and not with the RFC's hash_to_curve, so OPRF
+// outputs differ from the RFC's.
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+)
+
+// OPRF modes from RFC 9497.
+const (
+	modeOPRF  = 0x00
+	modeVOPRF = 0x01
+	modePOPRF = 0x02
+)
+
+// InvalidProof is returned if the server's proof that it evaluated the OPRF
+// with the expected key does not verify.
+var InvalidProof = errors.New("invalid OPRF proof")
+
+// proofLength is the length of an encoded proof, the scalars c and s.
+const proofLength = 2 * scalarLength
+
+// contextString returns the context string of the P256-SHA256 ciphersuite in
+// the given mode.
+func contextString(mode byte) []byte {
+	return append(append([]byte("OPRFV1-"), mode), "-P256-SHA256"...)
+}
+
+// expandMessageXMD is expand_message_xmd from RFC 9380 section 5.3.1 with
+// SHA-256.
+func expandMessageXMD(msg, dst []byte, n int) ([]byte, error) {
+	const bInBytes, sInBytes = sha256.Size, sha256.BlockSize
+	ell := (n + bInBytes - 1) / bInBytes
+	if ell > 255 || n > 65535 || len(dst) > 255 {
+		return nil, errors.New("expandMessageXMD: invalid lengths")
+	}
+	dstPrime := append(append([]byte(nil), dst...), byte(len(dst)))
+
+	h := sha256.New()
+	h.Write(make([]byte, sInBytes))
+	h.Write(msg)
+	h.Write([]byte{byte(n >> 8), byte(n), 0})
+	h.Write(dstPrime)
+	b0 := h.Sum(nil)
+
+	out := make([]byte, 0, ell*bInBytes)
+	bi := make([]byte, bInBytes)
+	for i := 1; i <= ell; i++ {
+		for j := range bi {
+			bi[j] ^= b0[j]
+		}
+		h.Reset()
+		h.Write(bi)
+		h.Write([]byte{byte(i)})
+		h.Write(dstPrime)
+		bi = h.Sum(nil)
+		out = append(out, bi...)
+	}
+	return out[:n], nil
+}
+
+// hashToScalar is HashToScalar of the P256-SHA256 ciphersuite: hash_to_field
+// from RFC 9380 with L = 48 bytes, reduced modulo the group order.
+func hashToScalar(msg, dst []byte) (*Scalar, error) {
+	const l = 48
+	uniform, err := expandMessageXMD(msg, dst, l)
+	if err != nil {
+		return nil, err
+	}
+	wide := make([]byte, 2*scalarLength)
+	copy(wide[2*scalarLength-l:], uniform)
+	return NewScalar().SetUniformBytes(wide), nil
+}
+
+// appendLengthPrefixed appends I2OSP(len(b), 2) || b to dst.
+func appendLengthPrefixed(dst, b []byte) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(b)))
+	return append(dst, b...)
+}
+
+// deriveKeyPair is DeriveKeyPair from RFC 9497 section 3.2.1. It derives
+// the key pair (k, g^k) from seed and info.
+func deriveKeyPair(mode byte, seed, info []byte) (*Scalar, *Element, error) {
+	input := appendLengthPrefixed(append([]byte(nil), seed...), info)
+	dst := append([]byte("DeriveKeyPair"), contextString(mode)...)
+	for counter := 0; counter < 256; counter++ {
+		k, err := hashToScalar(append(input, byte(counter)), dst)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !k.IsZero() {
+			return k, NewIdentity().ScalarBaseMult(k), nil
+		}
+	}
+	return nil, nil, errors.New("deriveKeyPair: no key found")
+}
+
+// computeComposites is ComputeComposites from RFC 9497 section 2.2.1 for
+// the prover, which knows k, if k is non-nil, and for the verifier
+// otherwise. It combines the pairs (cs[i], ds[i]) into the single pair
+// (m, z) so that one proof covers a whole batch.
+func computeComposites(mode byte, k *Scalar, b *Element, cs, ds []*Element) (m, z *Element, err error) {
+	weights, err := compositeWeights(mode, b, cs, ds)
+	if err != nil {
+		return nil, nil, err
+	}
+	m, z = NewIdentity(), NewIdentity()
+	for i, di := range weights {
+		m.Add(m, NewIdentity().ScalarMult(di, cs[i]))
+		if k == nil {
+			z.Add(z, NewIdentity().ScalarMult(di, ds[i]))
+		}
+	}
+	if k != nil {
+		z.ScalarMult(k, m)
+	}
+	return m, z, nil
+}
+
+// compositeWeights returns the scalars d_i of computeComposites, so that
+// m = sum d_i cs[i].
+func compositeWeights(mode byte, b *Element, cs, ds []*Element) ([]*Scalar, error) {
+	seedDST := append([]byte("Seed-"), contextString(mode)...)
+	seedTranscript := appendLengthPrefixed(nil, b.BytesCompressed())
+	seedTranscript = appendLengthPrefixed(seedTranscript, seedDST)
+	seed := sha256.Sum256(seedTranscript)
+
+	dst := append([]byte("HashToScalar-"), contextString(mode)...)
+	weights := make([]*Scalar, len(cs))
+	for i := range cs {
+		t := appendLengthPrefixed(nil, seed[:])
+		t = binary.BigEndian.AppendUint16(t, uint16(i))
+		t = appendLengthPrefixed(t, cs[i].BytesCompressed())
+		t = appendLengthPrefixed(t, ds[i].BytesCompressed())
+		t = append(t, "Composite"...)
+		di, err := hashToScalar(t, dst)
+		if err != nil {
+			return nil, err
+		}
+		weights[i] = di
+	}
+	return weights, nil
+}
+
+// challenge returns the challenge scalar c of a proof.
+func challenge(mode byte, b, m, z, t2, t3 *Element) (*Scalar, error) {
+	var t []byte
+	for _, e := range []*Element{b, m, z, t2, t3} {
+		t = appendLengthPrefixed(t, e.BytesCompressed())
+	}
+	t = append(t, "Challenge"...)
+	return hashToScalar(t, append([]byte("HashToScalar-"), contextString(mode)...))
+}
+
+// generateProof is GenerateProof from RFC 9497 section 2.2.1. It returns a
+// proof that ds[i] = cs[i]^k for all i, where b = a^k.
+func generateProof(mode byte, k *Scalar, a, b *Element, cs, ds []*Element) ([]byte, error) {
+	r, err := RandomScalar(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return generateProofWithNonce(mode, k, a, b, cs, ds, r)
+}
+
+// generateProofWithNonce is generateProof with the random scalar r given by
+// the caller. It exists for the test vectors.
+func generateProofWithNonce(mode byte, k *Scalar, a, b *Element, cs, ds []*Element, r *Scalar) ([]byte, error) {
+	m, z, err := computeComposites(mode, k, b, cs, ds)
+	if err != nil {
+		return nil, err
+	}
+	t2 := NewIdentity().ScalarMult(r, a)
+	t3 := NewIdentity().ScalarMult(r, m)
+	c, err := challenge(mode, b, m, z, t2, t3)
+	if err != nil {
+		return nil, err
+	}
+	s := NewScalar().Sub(r, NewScalar().Mul(c, k))
+	return append(c.Bytes(), s.Bytes()...), nil
+}
+
+// verifyProof is VerifyProof from RFC 9497 section 2.2.2. It reports
+// whether proof shows that ds[i] = cs[i]^k for all i, where b = a^k.
+func verifyProof(mode byte, a, b *Element, cs, ds []*Element, proof []byte) bool {
+	if len(proof) != proofLength || len(cs) != len(ds) || len(cs) == 0 {
+		return false
+	}
+	c, err := NewScalar().SetBytes(proof[:scalarLength])
+	if err != nil {
+		return false
+	}
+	s, err := NewScalar().SetBytes(proof[scalarLength:])
+	if err != nil {
+		return false
+	}
+	m, z, err := computeComposites(mode, nil, b, cs, ds)
+	if err != nil {
+		return false
+	}
+	t2 := NewIdentity().Add(NewIdentity().ScalarMult(s, a), NewIdentity().ScalarMult(c, b))
+	t3 := NewIdentity().Add(NewIdentity().ScalarMult(s, m), NewIdentity().ScalarMult(c, z))
+	expected, err := challenge(mode, b, m, z, t2, t3)
+	if err != nil {
+		return false
+	}
+	return expected.Equal(c)
+}
+
+// oprfProof returns pk = g^k and the hex encoded proof that b = a^k. It is
+// used by the server in PwReg and Auth1.
+func oprfProof(k *Scalar, a, b *ECPoint) (*ECPoint, string, error) {
+	elemA, err := NewElement(a)
+	if err != nil {
+		return nil, "", err
+	}
+	elemB, err := NewElement(b)
+	if err != nil {
+		return nil, "", err
+	}
+	pk := NewIdentity().ScalarBaseMult(k)
+	proof, err := generateProof(modeVOPRF, k, NewGenerator(), pk, []*Element{elemA}, []*Element{elemB})
+	if err != nil {
+		return nil, "", err
+	}
+	return pk.ECPoint(), hex.EncodeToString(proof), nil
+}
+
+// checkOprfProof returns InvalidProof unless proof is a valid hex encoded
+// proof that b = a^k, where pk = g^k. It is used by the client before b is
+// unblinded.
+func checkOprfProof(pk, a, b *ECPoint, proof string) error {
+	elemPK, err := NewElement(pk)
+	if err != nil {
+		return InvalidProof
+	}
+	return checkBatchProof(modeVOPRF, elemPK, []*ECPoint{a}, []*ECPoint{b}, proof)
+}
+
+// checkBatchProof is like checkOprfProof for a batch in the given mode: it
+// checks that bs[i] = as[i]^k for all i.
+func checkBatchProof(mode byte, pk *Element, as, bs []*ECPoint, proof string) error {
+	p, err := hex.DecodeString(proof)
+	if err != nil {
+		return InvalidProof
+	}
+	cs, err := toElements(as)
+	if err != nil {
+		return InvalidProof
+	}
+	ds, err := toElements(bs)
+	if err != nil {
+		return InvalidProof
+	}
+	if !verifyProof(mode, NewGenerator(), pk, cs, ds, p) {
+		return InvalidProof
+	}
+	return nil
+}
+
+func toElements(ps []*ECPoint) ([]*Element, error) {
+	res := make([]*Element, len(ps))
+	for i, p := range ps {
+		e, err := NewElement(p)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = e
+	}
+	return res, nil
+}
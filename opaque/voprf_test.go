@@ -0,0 +1,210 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package opaque
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func unhexElements(t *testing.T, ss ...string) []*Element {
+	t.Helper()
+	var res []*Element
+	for _, s := range ss {
+		e, err := NewIdentity().SetBytes(unhex(t, s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res = append(res, e)
+	}
+	return res
+}
+
+func unhexScalar(t *testing.T, s string) *Scalar {
+	t.Helper()
+	k, err := NewScalar().SetBytes(unhex(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestExpandMessageXMD(t *testing.T) {
+	// RFC 9380, appendix K.1.
+	got, err := expandMessageXMD(nil, []byte("QUUX-V01-CS02-with-expander-SHA256-128"), 0x20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "68a985b87eb6b46952128911f2a4412bbc302a9d759667f87f7a21d803f07235"
+	if hex.EncodeToString(got) != want {
+		t.Errorf("got %x, want %s", got, want)
+	}
+}
+
+// The test vectors below are from RFC 9497, appendix A.3 (P256-SHA256).
+
+func TestDeriveKeyPair(t *testing.T) {
+	seed := bytes.Repeat([]byte{0xa3}, 32)
+	for _, tc := range []struct {
+		mode byte
+		sk   string
+	}{
+		{modeOPRF, "159749d750713afe245d2d39ccfaae8381c53ce92d098a9375ee70739c7ac0bf"},
+		{modeVOPRF, "ca5d94c8807817669a51b196c34c1b7f8442fde4334a7121ae4736364312fca6"},
+		{0x02, "6ad2173efa689ef2c27772566ad7ff6e2d59b3b196f00219451fb2c89ee4dae2"},
+	} {
+		sk, _, err := deriveKeyPair(tc.mode, seed, []byte("test key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(sk.Bytes()); got != tc.sk {
+			t.Errorf("mode %d: sk = %s, want %s", tc.mode, got, tc.sk)
+		}
+	}
+}
+
+func TestProofVectors(t *testing.T) {
+	k := unhexScalar(t, "ca5d94c8807817669a51b196c34c1b7f8442fde4334a7121ae4736364312fca6")
+	pk := unhexElements(t, "03e17e70604bcabe198882c0a1f27a92441e774224ed9c702e51dd17038b102462")[0]
+	if !NewIdentity().ScalarBaseMult(k).Equal(pk) {
+		t.Fatal("pkSm != g^skSm")
+	}
+	for i, tc := range []struct {
+		blinded, evaluated []string
+		r, proof           string
+	}{
+		{
+			[]string{"02dd05901038bb31a6fae01828fd8d0e49e35a486b5c5d4b4994013648c01277da"},
+			[]string{"0209f33cab60cf8fe69239b0afbcfcd261af4c1c5632624f2e9ba29b90ae83e4a2"},
+			"f9db001266677f62c095021db018cd8cbb55941d4073698ce45c405d1348b7b1",
+			"e7c2b3c5c954c035949f1f74e6bce2ed539a3be267d1481e9ddb178533df4c2664f69d065c604a4fd953e100b856ad83804eb3845189babfa5a702090d6fc5fa",
+		},
+		{
+			[]string{"03cd0f033e791c4d79dfa9c6ed750f2ac009ec46cd4195ca6fd3800d1e9b887dbd"},
+			[]string{"030d2985865c693bf7af47ba4d3a3813176576383d19aff003ef7b0784a0d83cf1"},
+			"f9db001266677f62c095021db018cd8cbb55941d4073698ce45c405d1348b7b1",
+			"2787d729c57e3d9512d3aa9e8708ad226bc48e0f1750b0767aaff73482c44b8d2873d74ec88aebd3504961acea16790a05c542d9fbff4fe269a77510db00abab",
+		},
+		{
+			[]string{
+				"02dd05901038bb31a6fae01828fd8d0e49e35a486b5c5d4b4994013648c01277da",
+				"03462e9ae64cae5b83ba98a6b360d942266389ac369b923eb3d557213b1922f8ab",
+			},
+			[]string{
+				"0209f33cab60cf8fe69239b0afbcfcd261af4c1c5632624f2e9ba29b90ae83e4a2",
+				"02bb24f4d838414aef052a8f044a6771230ca69c0a5677540fff738dd31bb69771",
+			},
+			"350e8040f828bf6ceca27405420cdf3d63cb3aef005f40ba51943c8026877963",
+			"bdcc351707d02a72ce49511c7db990566d29d6153ad6f8982fad2b435d6ce4d60da1e6b3fa740811bde34dd4fe0aa1b5fe6600d0440c9ddee95ea7fad7a60cf2",
+		},
+	} {
+		cs := unhexElements(t, tc.blinded...)
+		ds := unhexElements(t, tc.evaluated...)
+		for j := range cs {
+			if !NewIdentity().ScalarMult(k, cs[j]).Equal(ds[j]) {
+				t.Fatalf("%d: evaluation %d != blinded^k", i, j)
+			}
+		}
+		proof, err := generateProofWithNonce(modeVOPRF, k, NewGenerator(), pk, cs, ds, unhexScalar(t, tc.r))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(proof); got != tc.proof {
+			t.Errorf("%d: proof = %s, want %s", i, got, tc.proof)
+		}
+		if !verifyProof(modeVOPRF, NewGenerator(), pk, cs, ds, unhex(t, tc.proof)) {
+			t.Errorf("%d: proof does not verify", i)
+		}
+		// The proof is bound to the key and to every element of the batch.
+		if verifyProof(modeVOPRF, NewGenerator(), ds[0], cs, ds, proof) {
+			t.Errorf("%d: proof verifies with another key", i)
+		}
+		if verifyProof(modeVOPRF, NewGenerator(), pk, cs, append([]*Element{cs[0]}, ds[1:]...), proof) {
+			t.Errorf("%d: proof verifies with another evaluation", i)
+		}
+	}
+}
+
+func TestVerifiableAuth(t *testing.T) {
+	privS, pubS := newServerKey(t)
+	csess, msg1, err := PwRegInit("alice", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ssess, msg2, err := PwReg(pubS, msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg3, err := PwReg2(csess, msg2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := PwReg3(ssess, msg3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oprfKey := csess.OprfKey()
+	if oprfKey == nil {
+		t.Fatal("no OPRF key after registration")
+	}
+
+	login := func(user *User, tamper func(*AuthMsg2)) error {
+		csess, msg1, err := AuthInitVerifiable("alice", "correct horse", oprfKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, msg2, err := Auth1(privS, user, msg1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tamper != nil {
+			tamper(&msg2)
+		}
+		_, _, err = Auth2(csess, msg2)
+		return err
+	}
+	if err := login(user, nil); err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if err := login(user, func(m *AuthMsg2) { m.Proof = "" }); err != InvalidProof {
+		t.Errorf("missing proof: got %v, want %v", err, InvalidProof)
+	}
+
+	// A server that evaluates with another key is caught before the client
+	// tries to open EnvU.
+	other := *user
+	other.K, err = generateSalt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := login(&other, nil); err != InvalidProof {
+		t.Errorf("other key: got %v, want %v", err, InvalidProof)
+	}
+
+	// The proof in PwRegMsg2 is checked too.
+	csess, msg1, err = PwRegInit("alice", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, msg2, err = PwReg(pubS, msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg2.PubK = toPoint(oprfKey)
+	if _, err := PwReg2(csess, msg2); err != InvalidProof {
+		t.Errorf("registration with wrong key: got %v, want %v", err, InvalidProof)
+	}
+}
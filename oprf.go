@@ -0,0 +1,276 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"GoTcpServerWithOpaque/opaque"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The oprf channel command evaluates the OPRF from package opaque under one
+// of the server's named keys, so that other services can harden secrets
+// without running OPAQUE themselves. The services log in with an account of
+// their own and then send
+//
+//	oprf  opaque.OprfRequest  -> opaque.OprfResponse
+//
+// A request with Info is evaluated under the POPRF key of the name tweaked by
+// Info, so one key can serve many tenants, purposes or epochs; see
+// opaque/poprf.go. The POPRF key is derived separately from the OPRF key of
+// the same name, and has another public key. The rate limit is shared.
+//
+// The keys are derived from the seed in -oprf-key-file and only the names
+// given with -oprf-keys exist. Each key limits the number of elements each
+// account can evaluate under it, so that someone who has stolen values
+// hashed with a key still has to ask the server for every guess, and one
+// caller using up its limit does not affect the others.
+
+var (
+	errNoSuchKey   = errors.New("No such key")
+	errRateLimited = errors.New("Rate limited")
+)
+
+// oprfKeys holds the keys of the oprf command. It is nil unless enabled with
+// -oprf-key-file.
+var oprfKeys *oprfKeyring
+
+// tokenBucket is a rate limiter that holds up to burst tokens and gains rate
+// tokens per second. It starts full. The caller synchronizes access.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst}
+}
+
+// take takes n tokens from the bucket. It returns false, and takes nothing,
+// if there are not enough.
+func (b *tokenBucket) take(n int, now time.Time) bool {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// give returns n tokens taken with take, for work that was not done.
+func (b *tokenBucket) give(n int) {
+	b.tokens += float64(n)
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// full reports whether the bucket would be full at now, in which case it
+// can be dropped and created again when needed.
+func (b *tokenBucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// bucketMap is a tokenBucket for each of many callers. The caller
+// synchronizes access.
+type bucketMap struct {
+	rate, burst float64
+	buckets     map[string]*tokenBucket
+	lastSweep   time.Time
+}
+
+func newBucketMap(rate, burst float64) *bucketMap {
+	return &bucketMap{rate: rate, burst: burst, buckets: map[string]*tokenBucket{}}
+}
+
+// take takes n tokens from the bucket of name.
+func (m *bucketMap) take(name string, n int, now time.Time) bool {
+	// Full buckets are the same as new ones, so they are dropped to keep
+	// the map small.
+	if now.Sub(m.lastSweep) > time.Minute {
+		for name, b := range m.buckets {
+			if b.full(now) {
+				delete(m.buckets, name)
+			}
+		}
+		m.lastSweep = now
+	}
+	b, ok := m.buckets[name]
+	if !ok {
+		b = newTokenBucket(m.rate, m.burst)
+		b.last = now
+		m.buckets[name] = b
+	}
+	return b.take(n, now)
+}
+
+// give returns n tokens taken by name for work that was not done.
+func (m *bucketMap) give(name string, n int) {
+	if b, ok := m.buckets[name]; ok {
+		b.give(n)
+	}
+}
+
+// oprfKey is one named key together with the rate limits of its callers.
+// Evaluating a batch takes one token per element from the caller's bucket.
+type oprfKey struct {
+	// k is the key of requests without Info and poprfK the key of
+	// requests with Info.
+	k      *big.Int
+	poprfK *big.Int
+
+	mu        sync.Mutex
+	buckets   *bucketMap
+	evaluated int64
+	limited   int64
+}
+
+// take takes n tokens from the bucket of username and counts the outcome.
+func (k *oprfKey) take(username string, n int, now time.Time) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if !k.buckets.take(username, n, now) {
+		k.limited++
+		return false
+	}
+	k.evaluated += int64(n)
+	return true
+}
+
+// give returns n tokens taken by username for a batch that was not
+// evaluated.
+func (k *oprfKey) give(username string, n int) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.buckets.give(username, n)
+	k.evaluated -= int64(n)
+}
+
+// oprfKeyring is the set of keys of the oprf command. The set does not
+// change after newOprfKeyring.
+type oprfKeyring struct {
+	keys map[string]*oprfKey
+	now  func() time.Time
+}
+
+// newOprfKeyring derives the keys listed in spec from seed. spec is a comma
+// separated list of key names, each optionally followed by ":rate" or
+// ":rate:burst" to override the default rate (elements per second) and
+// burst.
+func newOprfKeyring(seed []byte, spec string, rate float64, burst int) (*oprfKeyring, error) {
+	r := &oprfKeyring{keys: map[string]*oprfKey{}, now: time.Now}
+	for _, s := range strings.Split(spec, ",") {
+		parts := strings.Split(strings.TrimSpace(s), ":")
+		name, keyRate, keyBurst := parts[0], rate, float64(burst)
+		if len(parts) > 3 {
+			return nil, fmt.Errorf("oprf key %q: want name[:rate[:burst]]", s)
+		}
+		var err error
+		if len(parts) > 1 {
+			if keyRate, err = strconv.ParseFloat(parts[1], 64); err != nil {
+				return nil, fmt.Errorf("oprf key %q: %s", s, err)
+			}
+		}
+		if len(parts) > 2 {
+			if keyBurst, err = strconv.ParseFloat(parts[2], 64); err != nil {
+				return nil, fmt.Errorf("oprf key %q: %s", s, err)
+			}
+		}
+		if keyRate <= 0 || keyBurst < 1 {
+			return nil, fmt.Errorf("oprf key %q: rate must be positive and burst at least 1", s)
+		}
+		if _, ok := r.keys[name]; ok {
+			return nil, fmt.Errorf("oprf key %q listed twice", name)
+		}
+		k, _, err := opaque.DeriveOprfKey(seed, name)
+		if err != nil {
+			return nil, fmt.Errorf("oprf key %q: %s", s, err)
+		}
+		poprfK, _, err := opaque.DerivePoprfKey(seed, name)
+		if err != nil {
+			return nil, fmt.Errorf("oprf key %q: %s", s, err)
+		}
+		r.keys[name] = &oprfKey{k: k, poprfK: poprfK, buckets: newBucketMap(keyRate, keyBurst)}
+	}
+	return r, nil
+}
+
+// evaluate evaluates req for username on the crypto pool if the rate limit
+// of username for the key allows it.
+func (r *oprfKeyring) evaluate(username string, req opaque.OprfRequest) (opaque.OprfResponse, error) {
+	key, ok := r.keys[req.KeyName]
+	if !ok {
+		return opaque.OprfResponse{}, errNoSuchKey
+	}
+	n := len(req.Elements)
+	if !key.take(username, n, r.now()) {
+		return opaque.OprfResponse{}, errRateLimited
+	}
+	k := key.k
+	if req.Info != nil {
+		k = key.poprfK
+	}
+	var res opaque.OprfResponse
+	var err error
+	if poolErr := pool.do(func() {
+		res, err = opaque.OprfEvaluate(k, req)
+	}); poolErr != nil {
+		// Nothing was evaluated, so a busy server does not use up the
+		// caller's limit.
+		key.give(username, n)
+		return opaque.OprfResponse{}, poolErr
+	}
+	return res, err
+}
+
+// metrics returns the number of evaluated elements and of rejected requests
+// for each key.
+func (r *oprfKeyring) metrics() map[string]interface{} {
+	names := make([]string, 0, len(r.keys))
+	for name := range r.keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	m := map[string]interface{}{}
+	for _, name := range names {
+		k := r.keys[name]
+		k.mu.Lock()
+		m[name] = map[string]int64{"evaluated": k.evaluated, "rate_limited": k.limited}
+		k.mu.Unlock()
+	}
+	return m
+}
+
+func cmdOprf(l *login, args json.RawMessage) (interface{}, error) {
+	req, err := opaque.DecodeOprfRequest(args)
+	if err != nil {
+		return nil, err
+	}
+	if req.Info != nil {
+		fmt.Printf("POPRF request from %q for key %q, info %q, with %d elements\n", l.username, req.KeyName, *req.Info, len(req.Elements))
+	} else {
+		fmt.Printf("OPRF request from %q for key %q with %d elements\n", l.username, req.KeyName, len(req.Elements))
+	}
+	if oprfKeys == nil {
+		return nil, errNoSuchKey
+	}
+	return oprfKeys.evaluate(l.username, req)
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"GoTcpServerWithOpaque/client"
+	"GoTcpServerWithOpaque/opaque"
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestOprfKeyringSpec(t *testing.T) {
+	seed := bytes.Repeat([]byte{7}, 32)
+	r, err := newOprfKeyring(seed, "a, b:5, c:0.5:3", 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string][2]float64{"a": {10, 64}, "b": {5, 64}, "c": {0.5, 3}} {
+		k := r.keys[name]
+		if k == nil || k.buckets.rate != want[0] || k.buckets.burst != want[1] {
+			t.Errorf("key %s = %+v, want rate and burst %v", name, k, want)
+		}
+	}
+	for _, bad := range []string{"", "a,a", "a:x", "a:1:2:3", "a:0", "a:1:0"} {
+		if _, err := newOprfKeyring(seed, bad, 10, 64); err == nil {
+			t.Errorf("%q: no error", bad)
+		}
+	}
+	if _, err := newOprfKeyring(seed[:16], "a", 10, 64); err == nil {
+		t.Error("short seed accepted")
+	}
+}
+
+func TestOprfKeyBuckets(t *testing.T) {
+	k := &oprfKey{buckets: newBucketMap(1, 2)}
+	now := time.Unix(1e9, 0)
+	if !k.take("a", 2, now) || k.take("a", 1, now) {
+		t.Fatal("burst of a not enforced")
+	}
+	if !k.take("b", 2, now) {
+		t.Error("b limited by a")
+	}
+	k.give("b", 1)
+	if !k.take("b", 1, now) {
+		t.Error("tokens given back not usable")
+	}
+	// Buckets that have refilled are dropped.
+	now = now.Add(2 * time.Minute)
+	k.take("c", 1, now)
+	if len(k.buckets.buckets) != 1 {
+		t.Errorf("%d buckets after sweep, want 1", len(k.buckets.buckets))
+	}
+}
+
+func TestOprfCommand(t *testing.T) {
+	var err error
+	oprfKeys, err = newOprfKeyring(bytes.Repeat([]byte{7}, 32), "svc,slow:1:2", 100, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { oprfKeys = nil }()
+	now := time.Unix(1e9, 0)
+	oprfKeys.now = func() time.Time { return now }
+	register(t, "oprf-svc", "secret")
+	register(t, "oprf-other", "secret")
+	c, _ := loginChannel(t, "oprf-svc", "secret")
+
+	inputs := [][]byte{[]byte("secret 1"), []byte("secret 2")}
+	out, pubK, err := c.Oprf("svc", inputs, nil)
+	if err != nil {
+		t.Fatalf("oprf: %v", err)
+	}
+	// With the key pinned, the same inputs give the same outputs.
+	again, _, err := c.Oprf("svc", inputs, pubK)
+	if err != nil {
+		t.Fatalf("oprf with pinned key: %v", err)
+	}
+	if len(out) != 2 || !bytes.Equal(out[0], again[0]) || !bytes.Equal(out[1], again[1]) {
+		t.Errorf("outputs differ: %x and %x", out, again)
+	}
+
+	// One key serves several epochs. The pinned key does not change, and
+	// is not the OPRF key of the same name.
+	e1, poprfK, err := c.Poprf("svc", "epoch=1", inputs, nil)
+	if err != nil {
+		t.Fatalf("poprf: %v", err)
+	}
+	if poprfK.X.Cmp(pubK.X) == 0 {
+		t.Error("POPRF and OPRF share a key")
+	}
+	if _, _, err := c.Poprf("svc", "epoch=1", inputs, pubK); err != opaque.InvalidProof {
+		t.Errorf("poprf pinned to the OPRF key: got %v, want %v", err, opaque.InvalidProof)
+	}
+	e2, k2, err := c.Poprf("svc", "epoch=2", inputs, poprfK)
+	if err != nil {
+		t.Fatalf("poprf: %v", err)
+	}
+	if bytes.Equal(e1[0], e2[0]) || bytes.Equal(e1[0], out[0]) {
+		t.Error("outputs do not depend on the info")
+	}
+	if k2.X.Cmp(poprfK.X) != 0 {
+		t.Error("public key changed with the info")
+	}
+
+	// oprf returns the message of the error reported by the server.
+	oprf := func(c *testConn, key string, n int) error {
+		_, _, err := c.Oprf(key, inputs[:n], nil)
+		var se *client.ServerError
+		if errors.As(err, &se) {
+			return errors.New(se.Msg)
+		}
+		return err
+	}
+	if err := oprf(c, "nope", 1); err == nil || err.Error() != errNoSuchKey.Error() {
+		t.Errorf("unknown key: got %v, want %v", err, errNoSuchKey)
+	}
+	if err := oprf(c, "slow", 2); err != nil {
+		t.Fatalf("slow: %v", err)
+	}
+	if err := oprf(c, "slow", 1); err == nil || err.Error() != errRateLimited.Error() {
+		t.Errorf("over the limit: got %v, want %v", err, errRateLimited)
+	}
+	// The other key has its own limit, and so has another account.
+	if err := oprf(c, "svc", 2); err != nil {
+		t.Errorf("svc: %v", err)
+	}
+	other, _ := loginChannel(t, "oprf-other", "secret")
+	if err := oprf(other, "slow", 2); err != nil {
+		t.Errorf("other account: %v", err)
+	}
+	now = now.Add(time.Second)
+	if err := oprf(c, "slow", 1); err != nil {
+		t.Errorf("after a second: %v", err)
+	}
+	if m := oprfKeys.metrics()["slow"].(map[string]int64); m["evaluated"] != 5 || m["rate_limited"] != 1 {
+		t.Errorf("metrics = %v", m)
+	}
+
+	// A request the busy server turns away does not use up the limit.
+	now = now.Add(time.Second)
+	old := pool
+	pool = newCryptoPool(1, 1)
+	release := blockPool(t, pool, 1)
+	if err := oprf(c, "slow", 1); err == nil || err.Error() != errBusy.Error() {
+		t.Errorf("busy: got %v, want %v", err, errBusy)
+	}
+	close(release)
+	pool.close()
+	pool = old
+	if err := oprf(c, "slow", 1); err != nil {
+		t.Errorf("after busy: %v", err)
+	}
+	c.conn.Close()
+	other.conn.Close()
+	c.serverErr()
+	other.serverErr()
+
+	// Callers must log in.
+	anon := dial(t)
+	if err := opaque.Write(anon.w, []byte("oprf")); err != nil {
+		t.Fatal(err)
+	}
+	if err := anon.serverErr(); err == nil {
+		t.Error("anonymous oprf command accepted")
+	}
+}
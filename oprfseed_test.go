@@ -0,0 +1,80 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"GoTcpServerWithOpaque/opaque"
+	"bytes"
+	"testing"
+)
+
+func TestDerivedOprfKeys(t *testing.T) {
+	// Registered before the seed is set, with a random K.
+	register(t, "random-k", "secret")
+
+	oprfSeed = bytes.Repeat([]byte{8}, 32)
+	defer func() { oprfSeed = nil }()
+
+	register(t, "derived-k", "secret")
+	cred, ok := accounts.Get("derived-k", defaultCredential)
+	if !ok || cred.User.K != nil {
+		t.Fatalf("stored credential %+v, want one without K", cred)
+	}
+	for _, username := range []string{"derived-k", "random-k"} {
+		c := dial(t)
+		if _, err := c.Login(username, "secret"); err != nil {
+			t.Errorf("login %s: %v", username, err)
+		}
+		c.serverErr()
+	}
+
+	// An unknown user looks like a wrong password.
+	for _, username := range []string{"derived-k", "no-such-user-derived"} {
+		c := dial(t)
+		if _, err := c.Login(username, "guess"); err != opaque.AuthtagMismatch {
+			t.Errorf("login %s: got %v, want %v", username, err, opaque.AuthtagMismatch)
+		}
+		c.serverErr()
+	}
+
+	// The key depends only on the seed: a server with another seed rejects
+	// the password and one with the same seed accepts it.
+	other := oprfSeed
+	oprfSeed = bytes.Repeat([]byte{9}, 32)
+	c := dial(t)
+	if _, err := c.Login("derived-k", "secret"); err != opaque.AuthtagMismatch {
+		t.Errorf("login with another seed: got %v, want %v", err, opaque.AuthtagMismatch)
+	}
+	c.serverErr()
+	oprfSeed = other
+	c = dial(t)
+	if _, err := c.Login("derived-k", "secret"); err != nil {
+		t.Errorf("login with the seed restored: %v", err)
+	}
+	c.serverErr()
+}
+
+func TestCredentialIdentifierInjective(t *testing.T) {
+	// With a bare username for the default credential and a length prefix
+	// only for the others, these two would share an identifier.
+	seed := bytes.Repeat([]byte{8}, 32)
+	a := credentialIdentifier("alice", "device")
+	b := credentialIdentifier("\x00\x05alice"+"device", defaultCredential)
+	if bytes.Equal(a, b) {
+		t.Fatalf("identifiers collide: %x", a)
+	}
+	ka, err := opaque.DeriveUserOprfKey(seed, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, err := opaque.DeriveUserOprfKey(seed, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ka.Cmp(kb) == 0 {
+		t.Error("different credentials got the same OPRF key")
+	}
+}
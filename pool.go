@@ -0,0 +1,113 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"expvar"
+	"sync/atomic"
+	"time"
+)
+
+// errBusy is returned by cryptoPool.do when the queue is full. The client is
+// told "Server busy" and should retry later.
+var errBusy = errors.New("server busy")
+
+// cryptoPool runs the expensive OPRF and AKE computations (PwReg and Auth1) on
+// a fixed number of workers, so that a burst of commands cannot use more than
+// that many cores. Jobs wait in a bounded queue; when it is full new jobs are
+// rejected immediately instead of adding to the latency of everyone else.
+type cryptoPool struct {
+	jobs chan *poolJob
+
+	// Metrics, updated atomically.
+	completed int64
+	rejected  int64
+	waitNanos int64 // total time jobs spent in the queue
+	maxWait   int64
+}
+
+type poolJob struct {
+	f        func()
+	queued   time.Time
+	finished chan struct{}
+}
+
+// newCryptoPool starts workers goroutines that serve a queue with room for
+// queueLen waiting jobs.
+func newCryptoPool(workers, queueLen int) *cryptoPool {
+	p := &cryptoPool{jobs: make(chan *poolJob, queueLen)}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *cryptoPool) work() {
+	for job := range p.jobs {
+		wait := int64(time.Since(job.queued))
+		atomic.AddInt64(&p.waitNanos, wait)
+		for {
+			max := atomic.LoadInt64(&p.maxWait)
+			if wait <= max || atomic.CompareAndSwapInt64(&p.maxWait, max, wait) {
+				break
+			}
+		}
+		job.f()
+		atomic.AddInt64(&p.completed, 1)
+		close(job.finished)
+	}
+}
+
+// do runs f on one of the workers and waits for it to finish. errBusy is
+// returned without running f if the queue is full.
+func (p *cryptoPool) do(f func()) error {
+	job := &poolJob{f: f, queued: time.Now(), finished: make(chan struct{})}
+	select {
+	case p.jobs <- job:
+	default:
+		atomic.AddInt64(&p.rejected, 1)
+		return errBusy
+	}
+	<-job.finished
+	return nil
+}
+
+// close stops the workers once the queued jobs have run. do must not be
+// called after close.
+func (p *cryptoPool) close() {
+	close(p.jobs)
+}
+
+// queueDepth returns the number of jobs waiting for a worker.
+func (p *cryptoPool) queueDepth() int {
+	return len(p.jobs)
+}
+
+// metrics returns a snapshot of the pool's metrics.
+func (p *cryptoPool) metrics() map[string]interface{} {
+	completed := atomic.LoadInt64(&p.completed)
+	var meanWait time.Duration
+	if completed > 0 {
+		meanWait = time.Duration(atomic.LoadInt64(&p.waitNanos) / completed)
+	}
+	return map[string]interface{}{
+		"queue_depth":  p.queueDepth(),
+		"queue_cap":    cap(p.jobs),
+		"completed":    completed,
+		"rejected":     atomic.LoadInt64(&p.rejected),
+		"mean_wait_us": meanWait.Microseconds(),
+		"max_wait_us":  time.Duration(atomic.LoadInt64(&p.maxWait)).Microseconds(),
+	}
+}
+
+// publishPoolMetrics makes the metrics of the current pool available as the
+// expvar "crypto_pool".
+func publishPoolMetrics() {
+	expvar.Publish("crypto_pool", expvar.Func(func() interface{} {
+		return pool.metrics()
+	}))
+}
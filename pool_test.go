@@ -0,0 +1,95 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"GoTcpServerWithOpaque/opaque"
+	"testing"
+	"time"
+)
+
+// blockPool occupies p's workers and fills its queue with jobs that wait for
+// the returned channel to be closed.
+func blockPool(t *testing.T, p *cryptoPool, workers int) chan struct{} {
+	t.Helper()
+	release := make(chan struct{})
+	started := make(chan struct{})
+	for i := 0; i < workers; i++ {
+		go p.do(func() {
+			started <- struct{}{}
+			<-release
+		})
+		<-started
+	}
+	for len(p.jobs) < cap(p.jobs) {
+		p.jobs <- &poolJob{f: func() { <-release }, queued: time.Now(), finished: make(chan struct{})}
+	}
+	return release
+}
+
+func TestCryptoPoolRejectsWhenFull(t *testing.T) {
+	p := newCryptoPool(2, 3)
+	defer p.close()
+	release := blockPool(t, p, 2)
+	if err := p.do(func() {}); err != errBusy {
+		t.Errorf("do on a full pool: got %v, want %v", err, errBusy)
+	}
+	if depth := p.queueDepth(); depth != 3 {
+		t.Errorf("queueDepth = %d, want 3", depth)
+	}
+	close(release)
+	for p.queueDepth() == cap(p.jobs) {
+		time.Sleep(time.Millisecond)
+	}
+	if err := p.do(func() {}); err != nil {
+		t.Errorf("do after release: %v", err)
+	}
+	m := p.metrics()
+	if m["rejected"].(int64) != 1 {
+		t.Errorf("rejected = %v, want 1", m["rejected"])
+	}
+}
+
+func TestServerBusy(t *testing.T) {
+	register(t, "busy", "secret")
+	old := pool
+	pool = newCryptoPool(1, 1)
+	defer func() {
+		pool.close()
+		pool = old
+	}()
+	release := blockPool(t, pool, 1)
+	defer close(release)
+
+	c := dial(t)
+	_, err := c.Login("busy", "secret")
+	if err == nil {
+		t.Fatal("login succeeded while the pool was full")
+	}
+	if err := c.serverErr(); err == nil {
+		t.Error("server reported success while the pool was full")
+	}
+
+	c = dial(t)
+	if err := opaque.Write(c.w, []byte("pwreg")); err != nil {
+		t.Fatal(err)
+	}
+	_, msg1, err := opaque.PwRegInit("busy-new", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.write(msg1); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := opaque.Read(c.r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "Server busy" {
+		t.Errorf("reply = %q, want %q", reply, "Server busy")
+	}
+	c.serverErr()
+}
@@ -0,0 +1,336 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"GoTcpServerWithOpaque/opaque"
+	"GoTcpServerWithOpaque/privacypass"
+	"GoTcpServerWithOpaque/token"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The server can issue anonymous tokens, see package privacypass, to
+// logged-in users and redeem them for other services. Users obtain tokens
+// over the encrypted channel, or over HTTP with the bearer token of a login in
+// the Authorization header, and each user is limited to -privacypass-rate
+// tokens per hour:
+//
+//	privacypass-issue  privacypass.TokenRequest -> privacypass.TokenResponse
+//
+// Redemption is anonymous. It runs over HTTP next to issuance and the issuer
+// directory, from which clients learn the issuer's key:
+//
+//	GET  /.well-known/private-token-issuer-directory
+//	POST /privacypass/issue  privacypass.TokenRequest -> privacypass.TokenResponse
+//	POST /privacypass/redeem {"Token": ..., "Challenge": ...} -> {"Redeemed": true}
+//
+// Token and Challenge are base64url encoded without padding. The keys are
+// derived from the seed in -privacypass-key-file, and a new one is used every
+// -privacypass-key-period. Tokens can be redeemed until the end of the period
+// after the one they were issued in. Redeemed tokens are recorded in
+// -privacypass-spent-dir, which servers that redeem the same issuer's tokens
+// must share.
+
+var (
+	errNoTokenIssuer = errors.New("Token issuance is not enabled")
+	errNoBearer      = errors.New("No bearer token")
+)
+
+// tokenIssuer issues and redeems tokens. It is nil unless enabled with
+// -privacypass-key-file.
+var tokenIssuer *tokenIssuance
+
+// tokenIssuance is the server's issuer together with the per-user limits on
+// issuance and the record of spent tokens that detects double spending.
+//
+// The issuer's key rotates every period. Tokens are issued under the key of
+// the current period, or of the previous one for clients that have not seen
+// the new key yet, and are redeemed until the end of the period after their
+// key's. Spent tokens are remembered until then, so spent holds a bounded
+// number of them.
+type tokenIssuance struct {
+	name   string
+	seed   []byte
+	period time.Duration
+	spent  opaque.ReplayCache
+	// rate is in tokens per second.
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu      sync.Mutex
+	keys    map[uint64]*issuerKey
+	budgets map[string]*tokenBucket
+	issued  int64
+	limited int64
+	// retired holds the verifier metrics of forgotten keys.
+	retired map[string]int64
+}
+
+// issuerKey is the issuer's key of one period.
+type issuerKey struct {
+	issuer   *privacypass.Issuer
+	verifier *privacypass.Verifier
+	keyID    [32]byte
+}
+
+// newTokenIssuance returns an issuer named name with keys derived from seed
+// that rotate every period. Spent tokens are recorded in spentDir, see
+// newReplayCache, so servers that redeem the issuer's tokens must share it.
+// Each user may obtain perHour tokens per hour and up to burst at once.
+func newTokenIssuance(name string, seed []byte, period time.Duration, spentDir string, perHour float64, burst int) (*tokenIssuance, error) {
+	if perHour <= 0 || burst < 1 {
+		return nil, errors.New("privacypass: rate must be positive and burst at least 1")
+	}
+	// Clients cache the issuer directory for a day, see
+	// privacypass.Issuer.DirectoryHandler, and may ask for tokens under the
+	// previous key that long.
+	if period < 24*time.Hour {
+		return nil, fmt.Errorf("privacypass: key period %s is shorter than a day", period)
+	}
+	spent, err := newReplayCache(spentDir)
+	if err != nil {
+		return nil, err
+	}
+	ti := &tokenIssuance{
+		name:    name,
+		seed:    seed,
+		period:  period,
+		spent:   spent,
+		rate:    perHour / 3600,
+		burst:   float64(burst),
+		now:     time.Now,
+		keys:    map[uint64]*issuerKey{},
+		budgets: map[string]*tokenBucket{},
+		retired: map[string]int64{},
+	}
+	// Check the name and seed now rather than on the first request.
+	if _, _, err := ti.current(); err != nil {
+		return nil, err
+	}
+	return ti, nil
+}
+
+// current returns the keys of the current and the previous period, deriving
+// them if needed. Older keys are forgotten, and their tokens can no longer be
+// redeemed.
+func (ti *tokenIssuance) current() (cur, prev *issuerKey, err error) {
+	period := uint64(ti.now().UnixNano() / int64(ti.period))
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	for p := range ti.keys {
+		if p != period && p+1 != period {
+			for name, n := range ti.keys[p].verifier.Metrics() {
+				ti.retired[name] += n
+			}
+			delete(ti.keys, p)
+		}
+	}
+	if cur, err = ti.key(period); err != nil {
+		return nil, nil, err
+	}
+	if period > 0 {
+		if prev, err = ti.key(period - 1); err != nil {
+			return nil, nil, err
+		}
+	}
+	return cur, prev, nil
+}
+
+// key returns the key of period. ti.mu must be held.
+func (ti *tokenIssuance) key(period uint64) (*issuerKey, error) {
+	if k, ok := ti.keys[period]; ok {
+		return k, nil
+	}
+	issuer, err := privacypass.NewPeriodIssuer(ti.name, ti.seed, period)
+	if err != nil {
+		return nil, err
+	}
+	// The tokens of the key are redeemed until the end of the next period.
+	expires := time.Unix(0, int64(period+2)*int64(ti.period))
+	k := &issuerKey{
+		issuer:   issuer,
+		verifier: privacypass.NewVerifier(issuer, ti.spent, expires),
+		keyID:    issuer.TokenKeyID(),
+	}
+	ti.keys[period] = k
+	return k, nil
+}
+
+// issuer returns the issuer of the current period, whose key clients should
+// use.
+func (ti *tokenIssuance) issuer() (*privacypass.Issuer, error) {
+	cur, _, err := ti.current()
+	if err != nil {
+		return nil, err
+	}
+	return cur.issuer, nil
+}
+
+// take takes n tokens from username's budget.
+func (ti *tokenIssuance) take(username string, n int) bool {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	b, ok := ti.budgets[username]
+	if !ok {
+		b = newTokenBucket(ti.rate, ti.burst)
+		ti.budgets[username] = b
+	}
+	if !b.take(n, ti.now()) {
+		ti.limited++
+		return false
+	}
+	ti.issued += int64(n)
+	return true
+}
+
+// give returns n tokens taken by username for a request that was not
+// evaluated.
+func (ti *tokenIssuance) give(username string, n int) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	if b, ok := ti.budgets[username]; ok {
+		b.give(n)
+	}
+	ti.issued -= int64(n)
+}
+
+// issue evaluates req for username on the crypto pool if the user's budget
+// allows it.
+func (ti *tokenIssuance) issue(username string, req privacypass.TokenRequest) (privacypass.TokenResponse, error) {
+	n := len(req.BlindedElements)
+	if n == 0 || n > opaque.MaxOprfBatch {
+		return privacypass.TokenResponse{}, fmt.Errorf("batch of %d tokens, must be 1 to %d", n, opaque.MaxOprfBatch)
+	}
+	cur, prev, err := ti.current()
+	if err != nil {
+		return privacypass.TokenResponse{}, err
+	}
+	k := cur
+	if prev != nil && req.TruncatedTokenKeyID != cur.keyID[len(cur.keyID)-1] &&
+		req.TruncatedTokenKeyID == prev.keyID[len(prev.keyID)-1] {
+		k = prev
+	}
+	if !ti.take(username, n) {
+		return privacypass.TokenResponse{}, errRateLimited
+	}
+	var res privacypass.TokenResponse
+	if poolErr := pool.do(func() {
+		res, err = k.issuer.Issue(req)
+	}); poolErr != nil {
+		// Nothing was issued, so a busy server does not use up the
+		// user's budget.
+		ti.give(username, n)
+		return privacypass.TokenResponse{}, poolErr
+	}
+	return res, err
+}
+
+// redeem redeems token, an encoded privacypass.Token, for challenge with the
+// verifier of the token's key.
+func (ti *tokenIssuance) redeem(token, challenge []byte) error {
+	cur, prev, err := ti.current()
+	if err != nil {
+		return err
+	}
+	k := cur
+	if t, err := privacypass.ParseToken(token); err == nil && prev != nil && t.TokenKeyID == prev.keyID {
+		k = prev
+	}
+	return k.verifier.Redeem(token, challenge)
+}
+
+// metrics returns the number of issued tokens and rejected requests, and the
+// verifiers' counts of redeemed and rejected tokens.
+func (ti *tokenIssuance) metrics() map[string]int64 {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	m := map[string]int64{"issued": ti.issued, "rate_limited": ti.limited,
+		"redeemed": ti.retired["redeemed"], "rejected": ti.retired["rejected"]}
+	for _, k := range ti.keys {
+		for name, n := range k.verifier.Metrics() {
+			m[name] += n
+		}
+	}
+	return m
+}
+
+func cmdPrivacyPassIssue(l *login, args json.RawMessage) (interface{}, error) {
+	if tokenIssuer == nil {
+		return nil, errNoTokenIssuer
+	}
+	req, err := privacypass.DecodeTokenRequest(args)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Issuing %d tokens to %s\n", len(req.BlindedElements), l.username)
+	return tokenIssuer.issue(l.username, req)
+}
+
+func httpIssue(r *http.Request, body []byte) (interface{}, error) {
+	bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil, errNoBearer
+	}
+	v, err := token.NewVerifier(signer.KeySet())
+	if err != nil {
+		return nil, err
+	}
+	v.Check = logins.checkClaims
+	claims, err := v.Verify(bearer)
+	if err != nil {
+		return nil, errNoBearer
+	}
+	req, err := privacypass.DecodeTokenRequest(body)
+	if err != nil {
+		return nil, badRequest{err}
+	}
+	fmt.Printf("Issuing %d tokens to %s\n", len(req.BlindedElements), claims.Subject)
+	return tokenIssuer.issue(claims.Subject, req)
+}
+
+// httpIssuerDirectory serves the issuer directory with the key of the current
+// period.
+func httpIssuerDirectory(w http.ResponseWriter, r *http.Request) {
+	issuer, err := tokenIssuer.issuer()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	issuer.DirectoryHandler("/privacypass/issue").ServeHTTP(w, r)
+}
+
+// redeemRequest is the body of a /privacypass/redeem request.
+type redeemRequest struct {
+	Token     string
+	Challenge string
+}
+
+func httpRedeem(_ *http.Request, body []byte) (interface{}, error) {
+	var req redeemRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, badRequest{err}
+	}
+	tok, err := base64.RawURLEncoding.DecodeString(req.Token)
+	if err != nil {
+		return nil, badRequest{fmt.Errorf("Token: %s", err)}
+	}
+	challenge, err := base64.RawURLEncoding.DecodeString(req.Challenge)
+	if err != nil {
+		return nil, badRequest{fmt.Errorf("Challenge: %s", err)}
+	}
+	if err := tokenIssuer.redeem(tok, challenge); err != nil {
+		return nil, err
+	}
+	return struct{ Redeemed bool }{true}, nil
+}
@@ -0,0 +1,446 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+// Package privacypass issues and redeems anonymous tokens in the style of
+// Privacy Pass, with the privately verifiable issuance protocol of RFC 9578
+// built on the VOPRF from package opaque.
+//
+// A logged-in client obtains a batch of tokens from the Issuer with
+// NewTokenRequest and Finalize. The issuer sees only blinded elements, so it
+// cannot link a token it later redeems to the session that obtained it. A
+// client spends a token by presenting it, together with the TokenChallenge
+// it was made for, to a service that calls Verifier.Redeem. Each token can be
+// redeemed once.
+//
+// The messages and the token follow RFC 9577 and RFC 9578, but the VOPRF is
+// P-256 with SHA-256 and maps inputs to the curve as package opaque does, so
+// the tokens carry TokenType, a private token type, instead of type 0x0001.
+package privacypass
+
+import (
+	"GoTcpServerWithOpaque/opaque"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenType is the token type of the tokens of this package. It is not
+// assigned by IANA.
+const TokenType uint16 = 0xF001
+
+const (
+	nonceLength  = 32
+	digestLength = 32
+	keyIDLength  = 32
+	// authenticatorLength is the output length of the OPRF.
+	authenticatorLength = 32
+	// tokenLength is the length of a marshaled Token.
+	tokenLength = 2 + nonceLength + digestLength + keyIDLength + authenticatorLength
+)
+
+var (
+	// Malformed is returned for tokens and challenges that cannot be parsed.
+	Malformed = errors.New("privacypass: malformed token or challenge")
+	// WrongTokenType is returned for tokens and requests of another type.
+	WrongTokenType = errors.New("privacypass: wrong token type")
+	// UnknownKey is returned for tokens and requests for another issuer key.
+	UnknownKey = errors.New("privacypass: unknown issuer key")
+	// ChallengeMismatch is returned if a token was made for another
+	// challenge than the one it is redeemed with.
+	ChallengeMismatch = errors.New("privacypass: token is for another challenge")
+	// InvalidToken is returned if the authenticator of a token is wrong.
+	InvalidToken = errors.New("privacypass: invalid token")
+	// DoubleSpend is returned if a token has been redeemed before.
+	DoubleSpend = errors.New("privacypass: token already redeemed")
+)
+
+// Challenge is a TokenChallenge from RFC 9577 section 2.1. A service that
+// wants a token sends one to the client, and the token is bound to its
+// digest.
+type Challenge struct {
+	TokenType uint16
+	// IssuerName is the name of the issuer the service accepts tokens from.
+	IssuerName string
+	// RedemptionContext is empty or 32 bytes. A service that sets it to a
+	// fresh value per challenge only accepts tokens made for that challenge.
+	RedemptionContext []byte
+	// OriginInfo is the list of origins the token may be redeemed at, or nil
+	// for any origin.
+	OriginInfo []string
+}
+
+// Marshal returns the encoding of c from RFC 9577.
+func (c *Challenge) Marshal() ([]byte, error) {
+	if c.IssuerName == "" || len(c.IssuerName) > 65535 {
+		return nil, errors.New("privacypass: issuer name must be 1 to 65535 bytes")
+	}
+	if len(c.RedemptionContext) != 0 && len(c.RedemptionContext) != 32 {
+		return nil, errors.New("privacypass: redemption context must be empty or 32 bytes")
+	}
+	origins := strings.Join(c.OriginInfo, ",")
+	if len(origins) > 65535 {
+		return nil, errors.New("privacypass: origin info is longer than 65535 bytes")
+	}
+	b := binary.BigEndian.AppendUint16(nil, c.TokenType)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(c.IssuerName)))
+	b = append(b, c.IssuerName...)
+	b = append(b, byte(len(c.RedemptionContext)))
+	b = append(b, c.RedemptionContext...)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(origins)))
+	b = append(b, origins...)
+	return b, nil
+}
+
+// ParseChallenge parses a Challenge encoded as by Challenge.Marshal.
+func ParseChallenge(b []byte) (*Challenge, error) {
+	var c Challenge
+	var ok bool
+	if c.TokenType, b, ok = readUint16(b); !ok {
+		return nil, Malformed
+	}
+	var name, origins []byte
+	if name, b, ok = readOpaque16(b); !ok || len(name) == 0 {
+		return nil, Malformed
+	}
+	c.IssuerName = string(name)
+	if len(b) < 1 || len(b) < 1+int(b[0]) || (b[0] != 0 && b[0] != 32) {
+		return nil, Malformed
+	}
+	if b[0] != 0 {
+		c.RedemptionContext = append([]byte(nil), b[1:1+int(b[0])]...)
+	}
+	b = b[1+int(b[0]):]
+	if origins, b, ok = readOpaque16(b); !ok || len(b) != 0 {
+		return nil, Malformed
+	}
+	if len(origins) > 0 {
+		c.OriginInfo = strings.Split(string(origins), ",")
+	}
+	return &c, nil
+}
+
+func readUint16(b []byte) (uint16, []byte, bool) {
+	if len(b) < 2 {
+		return 0, nil, false
+	}
+	return binary.BigEndian.Uint16(b), b[2:], true
+}
+
+func readOpaque16(b []byte) ([]byte, []byte, bool) {
+	n, b, ok := readUint16(b)
+	if !ok || len(b) < int(n) {
+		return nil, nil, false
+	}
+	return b[:n], b[n:], true
+}
+
+// Token is a token from RFC 9577 section 2.2.
+type Token struct {
+	TokenType       uint16
+	Nonce           [nonceLength]byte
+	ChallengeDigest [digestLength]byte
+	TokenKeyID      [keyIDLength]byte
+	// Authenticator is the OPRF output for the fields above.
+	Authenticator [authenticatorLength]byte
+}
+
+// input returns token_input, the fields of t that are authenticated.
+func (t *Token) input() []byte {
+	b := binary.BigEndian.AppendUint16(nil, t.TokenType)
+	b = append(b, t.Nonce[:]...)
+	b = append(b, t.ChallengeDigest[:]...)
+	return append(b, t.TokenKeyID[:]...)
+}
+
+// Marshal returns the encoding of t.
+func (t *Token) Marshal() []byte {
+	return append(t.input(), t.Authenticator[:]...)
+}
+
+// ParseToken parses a Token encoded as by Token.Marshal.
+func ParseToken(b []byte) (*Token, error) {
+	if len(b) != tokenLength {
+		return nil, Malformed
+	}
+	var t Token
+	t.TokenType = binary.BigEndian.Uint16(b)
+	b = b[2:]
+	b = b[copy(t.Nonce[:], b):]
+	b = b[copy(t.ChallengeDigest[:], b):]
+	b = b[copy(t.TokenKeyID[:], b):]
+	copy(t.Authenticator[:], b)
+	return &t, nil
+}
+
+// KeyID returns token_key_id, the SHA-256 hash of the compressed encoding of
+// the issuer's public key pubK.
+func KeyID(pubK *opaque.ECPoint) ([keyIDLength]byte, error) {
+	e, err := opaque.NewElement(pubK)
+	if err != nil {
+		return [keyIDLength]byte{}, err
+	}
+	return sha256.Sum256(e.BytesCompressed()), nil
+}
+
+// TokenRequest is a batch of blinded tokens. It is sent from the client to
+// the issuer.
+type TokenRequest struct {
+	TokenType uint16
+	// TruncatedTokenKeyID is the last byte of the issuer's token_key_id.
+	TruncatedTokenKeyID uint8
+	BlindedElements     []*opaque.ECPoint
+}
+
+// TokenResponse is the issuer's answer to a TokenRequest: the evaluated
+// elements and a proof that all of them were evaluated with the issuer's
+// key.
+type TokenResponse = opaque.OprfResponse
+
+// DecodeTokenRequest parses a TokenRequest sent by a client. Coordinates may
+// be sent as JSON strings, see opaque.RemoveQuotesFromJson.
+func DecodeTokenRequest(data []byte) (TokenRequest, error) {
+	var req TokenRequest
+	if err := json.Unmarshal([]byte(opaque.RemoveQuotesFromJson(string(data))), &req); err != nil {
+		return TokenRequest{}, err
+	}
+	return req, nil
+}
+
+// Issuer issues tokens under one OPRF key. It is safe for concurrent use.
+type Issuer struct {
+	name  string
+	k     *big.Int
+	pubK  *opaque.ECPoint
+	keyID [keyIDLength]byte
+}
+
+// NewIssuer returns an issuer named name whose key is derived from seed,
+// which must be at least 32 bytes.
+func NewIssuer(name string, seed []byte) (*Issuer, error) {
+	return newIssuer(name, seed, "privacypass")
+}
+
+// NewPeriodIssuer is like NewIssuer but derives the key of the given
+// period, so that an issuer can rotate its key by counting periods. Each
+// period has another key, and none of them is the key of NewIssuer.
+func NewPeriodIssuer(name string, seed []byte, period uint64) (*Issuer, error) {
+	return newIssuer(name, seed, "privacypass period "+strconv.FormatUint(period, 10))
+}
+
+func newIssuer(name string, seed []byte, keyName string) (*Issuer, error) {
+	if name == "" {
+		return nil, errors.New("privacypass: empty issuer name")
+	}
+	k, pubK, err := opaque.DeriveOprfKey(seed, keyName)
+	if err != nil {
+		return nil, err
+	}
+	keyID, err := KeyID(pubK)
+	if err != nil {
+		return nil, err
+	}
+	return &Issuer{name: name, k: k, pubK: pubK, keyID: keyID}, nil
+}
+
+// Name returns the issuer name, the IssuerName of the challenges it serves.
+func (i *Issuer) Name() string {
+	return i.name
+}
+
+// PublicKey returns the issuer's public key, which clients pin when they
+// request tokens.
+func (i *Issuer) PublicKey() *opaque.ECPoint {
+	return i.pubK
+}
+
+// TokenKeyID returns the token_key_id of the issuer's tokens.
+func (i *Issuer) TokenKeyID() [keyIDLength]byte {
+	return i.keyID
+}
+
+// Issue evaluates the blinded tokens in req. It is invoked on the server for
+// an authenticated client, which is responsible for limiting how many tokens
+// each client may obtain.
+func (i *Issuer) Issue(req TokenRequest) (TokenResponse, error) {
+	if req.TokenType != TokenType {
+		return TokenResponse{}, WrongTokenType
+	}
+	if req.TruncatedTokenKeyID != i.keyID[keyIDLength-1] {
+		return TokenResponse{}, UnknownKey
+	}
+	return opaque.OprfEvaluate(i.k, opaque.OprfRequest{Elements: req.BlindedElements, Verifiable: true})
+}
+
+// directory is the issuer directory from RFC 9578 section 4.
+type directory struct {
+	IssuerRequestURI string     `json:"issuer-request-uri"`
+	TokenKeys        []tokenKey `json:"token-keys"`
+}
+
+type tokenKey struct {
+	TokenType uint16 `json:"token-type"`
+	TokenKey  string `json:"token-key"`
+}
+
+// DirectoryHandler returns an http.Handler that serves the issuer directory,
+// which clients fetch from /.well-known/private-token-issuer-directory to
+// learn the issuer's key. requestURI is where token requests are sent.
+func (i *Issuer) DirectoryHandler(requestURI string) http.Handler {
+	e, _ := opaque.NewElement(i.pubK)
+	data, _ := json.Marshal(directory{
+		IssuerRequestURI: requestURI,
+		TokenKeys: []tokenKey{{
+			TokenType: TokenType,
+			TokenKey:  base64.URLEncoding.EncodeToString(e.BytesCompressed()),
+		}},
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/private-token-issuer-directory")
+		w.Header().Set("Cache-Control", "max-age=86400")
+		w.Write(data)
+	})
+}
+
+// ClientState keeps track of the state needed on the client between
+// NewTokenRequest and Finalize.
+type ClientState struct {
+	sess   *opaque.OprfClientSession
+	tokens []Token
+}
+
+// NewTokenRequest prepares n tokens for challenge, an encoded Challenge, from
+// the issuer with public key pubK. The returned TokenRequest should be sent
+// to the issuer.
+func NewTokenRequest(pubK *opaque.ECPoint, challenge []byte, n int) (*ClientState, TokenRequest, error) {
+	keyID, err := KeyID(pubK)
+	if err != nil {
+		return nil, TokenRequest{}, err
+	}
+	digest := sha256.Sum256(challenge)
+	st := &ClientState{tokens: make([]Token, n)}
+	inputs := make([][]byte, n)
+	for j := range st.tokens {
+		t := &st.tokens[j]
+		t.TokenType = TokenType
+		if _, err := rand.Read(t.Nonce[:]); err != nil {
+			return nil, TokenRequest{}, err
+		}
+		t.ChallengeDigest = digest
+		t.TokenKeyID = keyID
+		inputs[j] = t.input()
+	}
+	sess, oreq, err := opaque.OprfBlind("", inputs, pubK)
+	if err != nil {
+		return nil, TokenRequest{}, err
+	}
+	st.sess = sess
+	req := TokenRequest{
+		TokenType:           TokenType,
+		TruncatedTokenKeyID: keyID[keyIDLength-1],
+		BlindedElements:     oreq.Elements,
+	}
+	return st, req, nil
+}
+
+// Finalize is invoked on the client when it has received the TokenResponse.
+// It checks the issuer's proof and returns the tokens.
+func (st *ClientState) Finalize(res TokenResponse) ([]Token, error) {
+	outputs, err := opaque.OprfFinalize(st.sess, res)
+	if err != nil {
+		return nil, err
+	}
+	tokens := make([]Token, len(st.tokens))
+	for j, out := range outputs {
+		tokens[j] = st.tokens[j]
+		copy(tokens[j].Authenticator[:], out)
+	}
+	return tokens, nil
+}
+
+// Verifier redeems the tokens of an issuer. It is safe for concurrent use.
+type Verifier struct {
+	issuer *Issuer
+	spent  opaque.ReplayCache
+	// expires is when the spent nonces may be forgotten.
+	expires time.Time
+
+	mu       sync.Mutex
+	redeemed int64
+	rejected int64
+}
+
+// NewVerifier returns a Verifier for the tokens of issuer that records spent
+// tokens in spent. Spent tokens are remembered until expires, after which
+// the issuer's key must no longer be used; the zero time means forever.
+func NewVerifier(issuer *Issuer, spent opaque.ReplayCache, expires time.Time) *Verifier {
+	if expires.IsZero() {
+		expires = time.Unix(1<<62, 0)
+	}
+	return &Verifier{issuer: issuer, spent: spent, expires: expires}
+}
+
+// Redeem checks that token, an encoded Token, is valid for challenge, an
+// encoded Challenge, and has not been redeemed before, and records it as
+// redeemed.
+func (v *Verifier) Redeem(token, challenge []byte) error {
+	err := v.redeem(token, challenge)
+	v.mu.Lock()
+	if err == nil {
+		v.redeemed++
+	} else {
+		v.rejected++
+	}
+	v.mu.Unlock()
+	return err
+}
+
+func (v *Verifier) redeem(token, challenge []byte) error {
+	t, err := ParseToken(token)
+	if err != nil {
+		return err
+	}
+	c, err := ParseChallenge(challenge)
+	if err != nil {
+		return err
+	}
+	if t.TokenType != TokenType || c.TokenType != TokenType {
+		return WrongTokenType
+	}
+	if c.IssuerName != v.issuer.name || t.TokenKeyID != v.issuer.keyID {
+		return UnknownKey
+	}
+	if t.ChallengeDigest != sha256.Sum256(challenge) {
+		return ChallengeMismatch
+	}
+	want, err := opaque.OprfOutput(v.issuer.k, t.input())
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(want, t.Authenticator[:]) != 1 {
+		return InvalidToken
+	}
+	if !v.spent.Add(hex.EncodeToString(t.Nonce[:]), v.expires) {
+		return DoubleSpend
+	}
+	return nil
+}
+
+// Metrics returns the number of redeemed and of rejected tokens.
+func (v *Verifier) Metrics() map[string]int64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return map[string]int64{"redeemed": v.redeemed, "rejected": v.rejected}
+}
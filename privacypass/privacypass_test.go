@@ -0,0 +1,170 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package privacypass
+
+import (
+	"GoTcpServerWithOpaque/opaque"
+	"bytes"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+func TestChallenge(t *testing.T) {
+	c := &Challenge{
+		TokenType:         TokenType,
+		IssuerName:        "issuer.example",
+		RedemptionContext: bytes.Repeat([]byte{9}, 32),
+		OriginInfo:        []string{"a.example", "b.example"},
+	}
+	b, err := c.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "f001" + "000e" + hex.EncodeToString([]byte("issuer.example")) +
+		"20" + hex.EncodeToString(c.RedemptionContext) +
+		"0013" + hex.EncodeToString([]byte("a.example,b.example"))
+	if got := hex.EncodeToString(b); got != want {
+		t.Errorf("Marshal = %s, want %s", got, want)
+	}
+	parsed, err := ParseChallenge(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(parsed, c); diff != nil {
+		t.Error(diff)
+	}
+
+	for _, bad := range []string{"", "f001", "f0010000000000", "f0010001610100", "f00100016100000001", "f001000161000000ff"} {
+		b, _ := hex.DecodeString(bad)
+		if _, err := ParseChallenge(b); err != Malformed {
+			t.Errorf("ParseChallenge(%s): got %v, want %v", bad, err, Malformed)
+		}
+	}
+	if _, err := (&Challenge{TokenType: TokenType, IssuerName: "x", RedemptionContext: []byte{1}}).Marshal(); err == nil {
+		t.Error("Marshal accepted a 1 byte redemption context")
+	}
+}
+
+// issue obtains n tokens for challenge from issuer.
+func issue(t *testing.T, issuer *Issuer, challenge []byte, n int) []Token {
+	t.Helper()
+	st, req, err := NewTokenRequest(issuer.PublicKey(), challenge, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := issuer.Issue(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := st.Finalize(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokens
+}
+
+func TestIssueAndRedeem(t *testing.T) {
+	issuer, err := NewIssuer("issuer.example", bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge, err := (&Challenge{TokenType: TokenType, IssuerName: "issuer.example"}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := issue(t, issuer, challenge, 3)
+	if len(tokens) != 3 || tokens[0].Nonce == tokens[1].Nonce {
+		t.Fatalf("got %d tokens with nonces %x and %x", len(tokens), tokens[0].Nonce, tokens[1].Nonce)
+	}
+
+	v := NewVerifier(issuer, opaque.NewMemoryReplayCache(), time.Time{})
+	for _, tok := range tokens {
+		if err := v.Redeem(tok.Marshal(), challenge); err != nil {
+			t.Errorf("Redeem: %v", err)
+		}
+	}
+	if err := v.Redeem(tokens[0].Marshal(), challenge); err != DoubleSpend {
+		t.Errorf("second Redeem: got %v, want %v", err, DoubleSpend)
+	}
+
+	other, err := (&Challenge{TokenType: TokenType, IssuerName: "issuer.example", OriginInfo: []string{"a.example"}}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherName, err := (&Challenge{TokenType: TokenType, IssuerName: "other.example"}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherIssuer, err := NewIssuer("issuer.example", bytes.Repeat([]byte{2}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh := issue(t, issuer, challenge, 1)[0]
+	tampered := fresh
+	tampered.Nonce[0] ^= 1
+	for _, tc := range []struct {
+		name      string
+		token     []byte
+		challenge []byte
+		want      error
+	}{
+		{"truncated", fresh.Marshal()[1:], challenge, Malformed},
+		{"other challenge", fresh.Marshal(), other, ChallengeMismatch},
+		{"other issuer name", fresh.Marshal(), otherName, UnknownKey},
+		{"other issuer key", issue(t, otherIssuer, challenge, 1)[0].Marshal(), challenge, UnknownKey},
+		{"tampered", tampered.Marshal(), challenge, InvalidToken},
+	} {
+		if err := v.Redeem(tc.token, tc.challenge); err != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+	// The rejected redemptions did not spend the token.
+	if err := v.Redeem(fresh.Marshal(), challenge); err != nil {
+		t.Errorf("Redeem: %v", err)
+	}
+	if m := v.Metrics(); m["redeemed"] != 4 || m["rejected"] != 6 {
+		t.Errorf("Metrics = %v", m)
+	}
+}
+
+func TestIssueRejects(t *testing.T) {
+	issuer, err := NewIssuer("issuer.example", bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewIssuer("issuer.example", bytes.Repeat([]byte{2}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, req, err := NewTokenRequest(issuer.PublicKey(), []byte("challenge"), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := req
+	bad.TokenType = 1
+	if _, err := issuer.Issue(bad); err != WrongTokenType {
+		t.Errorf("token type 1: got %v, want %v", err, WrongTokenType)
+	}
+	bad = req
+	bad.TruncatedTokenKeyID++
+	if _, err := issuer.Issue(bad); err != UnknownKey {
+		t.Errorf("other key ID: got %v, want %v", err, UnknownKey)
+	}
+
+	// A response under another key fails the client's check of the proof.
+	// The truncated key ID is changed so that other evaluates the request.
+	req.TruncatedTokenKeyID = other.keyID[keyIDLength-1]
+	res, err := other.Issue(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Finalize(res); err != opaque.InvalidProof {
+		t.Errorf("Finalize: got %v, want %v", err, opaque.InvalidProof)
+	}
+}
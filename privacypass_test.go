@@ -0,0 +1,294 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"GoTcpServerWithOpaque/client"
+	"GoTcpServerWithOpaque/privacypass"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPrivacyPass(t *testing.T) {
+	var err error
+	tokenIssuer, err = newTokenIssuance("issuer.example", bytes.Repeat([]byte{5}, 32), 30*24*time.Hour, "", 3600, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { tokenIssuer = nil }()
+	now := time.Unix(1e9, 0)
+	tokenIssuer.now = func() time.Time { return now }
+	srv := httptest.NewServer(newHTTPHandler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/.well-known/private-token-issuer-directory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dir struct {
+		IssuerRequestURI string `json:"issuer-request-uri"`
+		TokenKeys        []struct {
+			TokenType uint16 `json:"token-type"`
+		} `json:"token-keys"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&dir)
+	resp.Body.Close()
+	if err != nil || dir.IssuerRequestURI != "/privacypass/issue" || len(dir.TokenKeys) != 1 || dir.TokenKeys[0].TokenType != privacypass.TokenType {
+		t.Errorf("directory = %+v, %v", dir, err)
+	}
+
+	register(t, "anon", "secret")
+	c, _ := loginChannel(t, "anon", "secret")
+	challenge, err := (&privacypass.Challenge{TokenType: privacypass.TokenType, IssuerName: "issuer.example"}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer, err := tokenIssuer.issuer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubK := issuer.PublicKey()
+	tokens, err := c.Tokens(pubK, challenge, 3)
+	if err != nil {
+		t.Fatalf("Tokens: %v", err)
+	}
+	// The user's budget is 4 tokens.
+	if _, err := c.Tokens(pubK, challenge, 2); err == nil || err.(*client.ServerError).Msg != errRateLimited.Error() {
+		t.Errorf("over the budget: got %v, want %v", err, errRateLimited)
+	}
+	now = now.Add(time.Second)
+	if _, err := c.Tokens(pubK, challenge, 2); err != nil {
+		t.Errorf("after a second: %v", err)
+	}
+
+	redeem := func(tok privacypass.Token, challenge []byte) (int, string) {
+		var res struct{ Redeemed bool }
+		status, herr := post(t, srv, "/privacypass/redeem", redeemRequest{
+			Token:     base64.RawURLEncoding.EncodeToString(tok.Marshal()),
+			Challenge: base64.RawURLEncoding.EncodeToString(challenge),
+		}, &res)
+		if status == http.StatusOK && !res.Redeemed {
+			t.Error("200 without Redeemed")
+		}
+		return status, herr.Error.Code
+	}
+	if status, code := redeem(tokens[0], challenge); status != http.StatusOK {
+		t.Errorf("redeem: %d %s", status, code)
+	}
+	if status, code := redeem(tokens[0], challenge); status != http.StatusConflict || code != "double_spend" {
+		t.Errorf("double spend: %d %s", status, code)
+	}
+	other, err := (&privacypass.Challenge{TokenType: privacypass.TokenType, IssuerName: "issuer.example", OriginInfo: []string{"a.example"}}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, code := redeem(tokens[1], other); status != http.StatusUnauthorized || code != "invalid_token" {
+		t.Errorf("other challenge: %d %s", status, code)
+	}
+	if m := tokenIssuer.metrics(); m["issued"] != 5 || m["rate_limited"] != 1 || m["redeemed"] != 1 || m["rejected"] != 2 {
+		t.Errorf("metrics = %v", m)
+	}
+}
+
+func TestPrivacyPassHTTPIssue(t *testing.T) {
+	var err error
+	tokenIssuer, err = newTokenIssuance("issuer.example", bytes.Repeat([]byte{5}, 32), 30*24*time.Hour, "", 3600, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { tokenIssuer = nil }()
+	srv := httptest.NewServer(newHTTPHandler())
+	defer srv.Close()
+
+	register(t, "anon-http", "secret")
+	c, sess := loginChannel(t, "anon-http", "secret")
+	defer c.serverErr()
+	issuer, err := tokenIssuer.issuer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, req, err := privacypass.NewTokenRequest(issuer.PublicKey(), []byte("challenge"), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issue := func(bearer string) (*http.Response, error) {
+		body, err := json.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := http.NewRequest(http.MethodPost, srv.URL+"/privacypass/issue", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bearer != "" {
+			r.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		return http.DefaultClient.Do(r)
+	}
+
+	for _, bearer := range []string{"", "not a token"} {
+		resp, err := issue(bearer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("bearer %q: status %d, want %d", bearer, resp.StatusCode, http.StatusUnauthorized)
+		}
+	}
+
+	resp, err := issue(sess.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var res privacypass.TokenResponse
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Finalize(res); err != nil {
+		t.Errorf("Finalize: %v", err)
+	}
+}
+
+// issueTokens obtains n tokens for challenge from ti under the key of issuer.
+func issueTokens(t *testing.T, ti *tokenIssuance, issuer *privacypass.Issuer, challenge []byte, n int) []privacypass.Token {
+	t.Helper()
+	st, req, err := privacypass.NewTokenRequest(issuer.PublicKey(), challenge, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := ti.issue("rotation", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := st.Finalize(res)
+	if err != nil {
+		t.Fatalf("Finalize: %v", err)
+	}
+	return tokens
+}
+
+func TestPrivacyPassKeyRotation(t *testing.T) {
+	const period = 24 * time.Hour
+	ti, err := newTokenIssuance("issuer.example", bytes.Repeat([]byte{5}, 32), period, "", 3600, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1e9, 0)
+	ti.now = func() time.Time { return now }
+	challenge, err := (&privacypass.Challenge{TokenType: privacypass.TokenType, IssuerName: "issuer.example"}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := ti.issuer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := issueTokens(t, ti, first, challenge, 3)
+
+	now = now.Add(period)
+	second, err := ti.issuer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.TokenKeyID() == first.TokenKeyID() {
+		t.Fatal("the key did not change")
+	}
+	// Clients that have not seen the new key can still obtain tokens, and
+	// tokens of the previous period can still be redeemed.
+	tokens = append(tokens, issueTokens(t, ti, first, challenge, 1)...)
+	if err := ti.redeem(tokens[0].Marshal(), challenge); err != nil {
+		t.Errorf("token of the previous period: %v", err)
+	}
+	if err := ti.redeem(tokens[0].Marshal(), challenge); err != privacypass.DoubleSpend {
+		t.Errorf("double spend: got %v, want %v", err, privacypass.DoubleSpend)
+	}
+	fresh := issueTokens(t, ti, second, challenge, 1)
+	if err := ti.redeem(fresh[0].Marshal(), challenge); err != nil {
+		t.Errorf("token of the current period: %v", err)
+	}
+
+	now = now.Add(period)
+	for _, tok := range tokens[1:] {
+		if err := ti.redeem(tok.Marshal(), challenge); err != privacypass.UnknownKey {
+			t.Errorf("expired token: got %v, want %v", err, privacypass.UnknownKey)
+		}
+	}
+	if m := ti.metrics(); m["issued"] != 5 || m["redeemed"] != 2 || m["rejected"] != 4 {
+		t.Errorf("metrics = %v", m)
+	}
+	if _, err := newTokenIssuance("issuer.example", bytes.Repeat([]byte{5}, 32), time.Hour, "", 3600, 100); err == nil {
+		t.Error("accepted a period shorter than a day")
+	}
+}
+
+func TestPrivacyPassSharedSpentDir(t *testing.T) {
+	dir := t.TempDir()
+	seed := bytes.Repeat([]byte{5}, 32)
+	var servers [2]*tokenIssuance
+	for i := range servers {
+		var err error
+		if servers[i], err = newTokenIssuance("issuer.example", seed, 30*24*time.Hour, dir, 3600, 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	challenge, err := (&privacypass.Challenge{TokenType: privacypass.TokenType, IssuerName: "issuer.example"}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer, err := servers[0].issuer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok := issueTokens(t, servers[0], issuer, challenge, 1)[0]
+	if err := servers[0].redeem(tok.Marshal(), challenge); err != nil {
+		t.Fatal(err)
+	}
+	if err := servers[1].redeem(tok.Marshal(), challenge); err != privacypass.DoubleSpend {
+		t.Errorf("other server: got %v, want %v", err, privacypass.DoubleSpend)
+	}
+}
+
+func TestPrivacyPassBusyRefund(t *testing.T) {
+	ti, err := newTokenIssuance("issuer.example", bytes.Repeat([]byte{5}, 32), 30*24*time.Hour, "", 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer, err := ti.issuer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, req, err := privacypass.NewTokenRequest(issuer.PublicKey(), []byte("challenge"), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := pool
+	pool = newCryptoPool(1, 1)
+	defer func() {
+		pool.close()
+		pool = old
+	}()
+	release := blockPool(t, pool, 1)
+	if _, err := ti.issue("busy", req); err != errBusy {
+		t.Fatalf("got %v, want %v", err, errBusy)
+	}
+	close(release)
+	for pool.queueDepth() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := ti.issue("busy", req); err != nil {
+		t.Errorf("after the busy request: %v", err)
+	}
+}
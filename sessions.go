@@ -0,0 +1,561 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"GoTcpServerWithOpaque/opaque"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// handshakeState is the state of an in-progress run of the password
+// registration or authentication protocol. The legal transitions are
+//
+//	pwreg: stateNew --PwRegMsg1--> stateAwaitPwRegMsg3 --PwRegMsg3--> stateDone
+//	auth:  stateNew --AuthMsg1-->  stateAwaitAuthMsg3  --AuthMsg3-->  stateDone
+//
+// Any other message moves the handshake to stateFailed.
+type handshakeState int
+
+const (
+	stateNew handshakeState = iota
+	stateAwaitPwRegMsg3
+	stateAwaitAuthMsg3
+	stateDone
+	stateFailed
+)
+
+func (s handshakeState) String() string {
+	switch s {
+	case stateNew:
+		return "new"
+	case stateAwaitPwRegMsg3:
+		return "awaiting PwRegMsg3"
+	case stateAwaitAuthMsg3:
+		return "awaiting AuthMsg3"
+	case stateDone:
+		return "done"
+	case stateFailed:
+		return "failed"
+	}
+	return fmt.Sprintf("handshakeState(%d)", int(s))
+}
+
+// handshakeEvent is the arrival of a protocol message.
+type handshakeEvent int
+
+const (
+	eventPwRegMsg1 handshakeEvent = iota
+	eventPwRegMsg3
+	eventAuthMsg1
+	eventAuthMsg3
+)
+
+func (e handshakeEvent) String() string {
+	switch e {
+	case eventPwRegMsg1:
+		return "PwRegMsg1"
+	case eventPwRegMsg3:
+		return "PwRegMsg3"
+	case eventAuthMsg1:
+		return "AuthMsg1"
+	case eventAuthMsg3:
+		return "AuthMsg3"
+	}
+	return fmt.Sprintf("handshakeEvent(%d)", int(e))
+}
+
+var transitions = map[handshakeState]map[handshakeEvent]handshakeState{
+	stateNew: {
+		eventPwRegMsg1: stateAwaitPwRegMsg3,
+		eventAuthMsg1:  stateAwaitAuthMsg3,
+	},
+	stateAwaitPwRegMsg3: {
+		eventPwRegMsg3: stateDone,
+	},
+	stateAwaitAuthMsg3: {
+		eventAuthMsg3: stateDone,
+	},
+}
+
+var (
+	errUnknownSession  = errors.New("unknown session")
+	errSessionExpired  = errors.New("session expired")
+	errTooManySessions = errors.New("too many sessions in progress")
+	errOutOfOrder      = errors.New("message out of order")
+	errSessionReplayed = errors.New("session already finished")
+)
+
+// handshake is an in-progress run of one of the protocols. Exactly one of
+// pwReg and auth is set once the first message has been processed.
+type handshake struct {
+	id       string
+	state    handshakeState
+	username string
+	expires  time.Time
+
+	pwReg *opaque.PwRegServerSession
+	auth  *opaque.AuthServerSession
+	// cred is the credential being registered by a pwreg handshake. Its
+	// User is set when the handshake finishes.
+	cred *credential
+	// login is the login that adds cred to its account, or nil if the
+	// handshake creates a new account.
+	login *login
+}
+
+// advance moves h to the state that follows ev. If ev is not legal in the
+// current state h is marked as failed and an error is returned.
+func (h *handshake) advance(ev handshakeEvent) error {
+	next, ok := transitions[h.state][ev]
+	if !ok {
+		prev := h.state
+		h.state = stateFailed
+		return fmt.Errorf("%w: unexpected %s in state %s", errOutOfOrder, ev, prev)
+	}
+	h.state = next
+	return nil
+}
+
+// sessionTable stores in-progress handshakes by ID so that the rounds of a
+// protocol run can arrive on different connections or transports. Handshakes
+// expire after ttl and at most max are kept.
+type sessionTable struct {
+	mu         sync.Mutex
+	handshakes map[string]*handshake
+	ttl        time.Duration
+	max        int
+	// reserved is the number of places reserved with reserve.
+	reserved  int
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func newSessionTable(ttl time.Duration, max int) *sessionTable {
+	return &sessionTable{
+		handshakes: map[string]*handshake{},
+		ttl:        ttl,
+		max:        max,
+		now:        time.Now,
+	}
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// sweep removes expired handshakes. t.mu must be held.
+func (t *sessionTable) sweep(now time.Time) {
+	for id, h := range t.handshakes {
+		if now.After(h.expires) {
+			delete(t.handshakes, id)
+		}
+	}
+	t.lastSweep = now
+}
+
+// full reports whether the table has no room for another handshake, after
+// sweeping expired ones if needed. t.mu must be held.
+func (t *sessionTable) full(now time.Time) bool {
+	if len(t.handshakes)+t.reserved >= t.max || now.Sub(t.lastSweep) > t.ttl {
+		t.sweep(now)
+	}
+	return len(t.handshakes)+t.reserved >= t.max
+}
+
+// reserve reserves room for a handshake, so that the crypto for it is not
+// run only to find the table full. The caller must then call addReserved or
+// release.
+func (t *sessionTable) reserve() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.full(t.now()) {
+		return errTooManySessions
+	}
+	t.reserved++
+	return nil
+}
+
+// release gives back a place reserved with reserve.
+func (t *sessionTable) release() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.reserved--
+}
+
+// add stores h under a new ID and returns the ID.
+func (t *sessionTable) add(h *handshake) (string, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return "", err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	if t.full(now) {
+		return "", errTooManySessions
+	}
+	t.insert(id, h, now)
+	return id, nil
+}
+
+// addReserved is like add but stores h in a place reserved with reserve. It
+// releases the place if it fails.
+func (t *sessionTable) addReserved(h *handshake) (string, error) {
+	id, err := newSessionID()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.reserved--
+	if err != nil {
+		return "", err
+	}
+	t.insert(id, h, t.now())
+	return id, nil
+}
+
+// insert stores h under id. t.mu must be held.
+func (t *sessionTable) insert(id string, h *handshake, now time.Time) {
+	h.id = id
+	h.expires = now.Add(t.ttl)
+	t.handshakes[id] = h
+}
+
+// take removes the handshake with the given ID from the table and advances it
+// with ev. A handshake can only be taken once, so a message cannot be
+// replayed against the same session.
+func (t *sessionTable) take(id string, ev handshakeEvent) (*handshake, error) {
+	t.mu.Lock()
+	h, ok := t.handshakes[id]
+	delete(t.handshakes, id)
+	now := t.now()
+	t.mu.Unlock()
+	if !ok {
+		return nil, errUnknownSession
+	}
+	if now.After(h.expires) {
+		return nil, errSessionExpired
+	}
+	if err := h.advance(ev); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// len returns the number of handshakes in the table, including expired ones
+// that have not been swept yet.
+func (t *sessionTable) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.handshakes)
+}
+
+// pwRegStart processes a PwRegMsg1 and stores the new handshake in sessions.
+// When the handshake finishes, cred is stored in the account of l, or in a
+// new account if l is nil. errAccountExists is returned if l is nil and the
+// account exists.
+//
+// Registration therefore reveals whether a username is taken. This is
+// accepted: a client that picks a username has to learn that it is in use,
+// so the fake users that hide unknown usernames at login cannot be used here.
+// Deployments that must not reveal usernames should rate-limit or otherwise
+// gate registration.
+func pwRegStart(msg1 opaque.PwRegMsg1, cred *credential, l *login) (string, opaque.PwRegMsg2, error) {
+	if l == nil && len(accounts.List(msg1.Username)) > 0 {
+		return "", opaque.PwRegMsg2{}, errAccountExists
+	}
+	h := &handshake{username: msg1.Username, cred: cred, login: l}
+	if err := h.advance(eventPwRegMsg1); err != nil {
+		return "", opaque.PwRegMsg2{}, err
+	}
+	if err := sessions.reserve(); err != nil {
+		return "", opaque.PwRegMsg2{}, err
+	}
+	msg2, err := pwRegEvaluate(h, msg1, cred)
+	if err != nil {
+		sessions.release()
+		return "", opaque.PwRegMsg2{}, err
+	}
+	id, err := sessions.addReserved(h)
+	if err != nil {
+		return "", opaque.PwRegMsg2{}, err
+	}
+	return id, msg2, nil
+}
+
+// pwRegEvaluate runs the server's part of the first round of pwRegStart and
+// stores the session in h.
+func pwRegEvaluate(h *handshake, msg1 opaque.PwRegMsg1, cred *credential) (opaque.PwRegMsg2, error) {
+	var msg2 opaque.PwRegMsg2
+	var err error
+	if thresholdKey != nil {
+		// The share holders are asked outside the pool, which is for
+		// computations.
+		e, proof, err := thresholdKey.evaluate(msg1.A, credentialIdentifier(msg1.Username, cred.ID), nil, msg1.Verifiable)
+		if err != nil {
+			return opaque.PwRegMsg2{}, err
+		}
+		h.pwReg, msg2, err = opaque.PwRegEvaluated(&pubS, msg1, e.B, e.PubK, proof)
+		return msg2, err
+	}
+	if poolErr := pool.do(func() {
+		if oprfSeed != nil {
+			h.pwReg, msg2, err = opaque.PwRegDerived(&pubS, oprfSeed, credentialIdentifier(msg1.Username, cred.ID), msg1)
+		} else {
+			h.pwReg, msg2, err = opaque.PwReg(&pubS, msg1)
+		}
+	}); poolErr != nil {
+		return opaque.PwRegMsg2{}, poolErr
+	}
+	return msg2, err
+}
+
+// pwRegFinish processes the PwRegMsg3 for the handshake id and stores the new
+// credential.
+func pwRegFinish(id string, msg3 opaque.PwRegMsg3) (*opaque.User, error) {
+	h, err := sessions.take(id, eventPwRegMsg3)
+	if err != nil {
+		return nil, err
+	}
+	user, err := opaque.PwReg3(h.pwReg, msg3)
+	if err != nil {
+		return nil, err
+	}
+	c := *h.cred
+	c.User = user
+	c.Created = time.Now()
+	if h.login == nil {
+		// The account may have been created since pwRegStart.
+		if err := accounts.Create(user.Username, &c); err != nil {
+			return nil, err
+		}
+	} else if accounts.Put(user.Username, &c) {
+		// Logins with the replaced credential must not outlive it.
+		logins.revokeOthers(user.Username, h.login.sessionID)
+	}
+	return user, nil
+}
+
+// newFakeUserSeed returns the seed for fakeUserSeed: oprfSeed if it is set,
+// and otherwise a random seed. A random seed changes the fake answers for a
+// username when the server restarts, which the answers for a registered user
+// do not, so servers that must hide usernames across restarts should use
+// -user-oprf-seed-file.
+func newFakeUserSeed(oprfSeed []byte) ([]byte, error) {
+	if oprfSeed != nil {
+		return oprfSeed, nil
+	}
+	seed := make([]byte, opaque.MinOprfSeedLength)
+	if _, err := rand.Read(seed); err != nil {
+		return nil, err
+	}
+	return seed, nil
+}
+
+// authStart processes an AuthMsg1 and stores the new handshake in sessions.
+// Unknown users and credentials get a fake AuthMsg2 and the handshake fails
+// in authFinish, as for a wrong password, so logins do not tell which
+// usernames exist.
+func authStart(msg1 opaque.AuthMsg1) (string, opaque.AuthMsg2, error) {
+	credID := credentialID(msg1.CredentialID)
+	cred, ok := accounts.Get(msg1.Username, credID)
+	h := &handshake{username: msg1.Username}
+	if err := h.advance(eventAuthMsg1); err != nil {
+		return "", opaque.AuthMsg2{}, err
+	}
+	// Without a sealer the handshake is stored in sessions. Reserve its
+	// place before the crypto runs.
+	if sealer == nil {
+		if err := sessions.reserve(); err != nil {
+			return "", opaque.AuthMsg2{}, err
+		}
+	}
+	msg2, err := auth1Start(h, msg1, cred, ok)
+	if err != nil {
+		if sealer == nil {
+			sessions.release()
+		}
+		return "", opaque.AuthMsg2{}, err
+	}
+	var id string
+	if sealer != nil {
+		id, err = sealer.Seal(h.auth)
+	} else {
+		id, err = sessions.addReserved(h)
+	}
+	if err != nil {
+		return "", opaque.AuthMsg2{}, err
+	}
+	return id, msg2, nil
+}
+
+// auth1Start runs the server's part of the first round of authStart and
+// stores the session in h. ok reports whether cred exists; if not, a fake
+// AuthMsg2 is computed.
+//
+// In threshold mode the OPRF evaluation for a fake user is also done by the
+// share holders, so that an unknown user costs the same round trip as a
+// registered one and the response time does not reveal whether the account
+// exists.
+func auth1Start(h *handshake, msg1 opaque.AuthMsg1, cred *credential, ok bool) (opaque.AuthMsg2, error) {
+	ident := credentialIdentifier(msg1.Username, credentialID(msg1.CredentialID))
+	var msg2 opaque.AuthMsg2
+	var err error
+	// e is the OPRF evaluation for users whose key is shared.
+	var e *opaque.ThresholdEvaluation
+	var proof string
+	shared := ok && cred.User.PubK != nil
+	if shared && thresholdKey == nil {
+		return opaque.AuthMsg2{}, errors.New("The user's OPRF key is shared but -threshold-config is not set")
+	}
+	if shared || (!ok && thresholdKey != nil) {
+		var pubK *opaque.ECPoint
+		if ok {
+			pubK = cred.User.PubK
+		}
+		if e, proof, err = thresholdKey.evaluate(msg1.A, ident, pubK, msg1.Verifiable); err != nil {
+			return opaque.AuthMsg2{}, err
+		}
+	}
+	if poolErr := pool.do(func() {
+		var user *opaque.User
+		switch {
+		case ok && e != nil:
+			user = cred.User
+		case ok:
+			user, err = cred.User.WithDerivedKey(oprfSeed, ident)
+		default:
+			user, err = opaque.FakeUser(fakeUserSeed, ident, msg1.Username, &pubS)
+		}
+		if err != nil {
+			return
+		}
+		user = user.WithIdentities(loginIdentities(msg1.Username))
+		if e != nil {
+			h.auth, msg2, err = auth1Evaluated(user, msg1, e.B, proof)
+		} else {
+			h.auth, msg2, err = auth1(user, msg1)
+		}
+	}); poolErr != nil {
+		return opaque.AuthMsg2{}, poolErr
+	}
+	return msg2, err
+}
+
+// authFinish processes the AuthMsg3 for the handshake id, sent from
+// remoteAddr, and issues a token for the login. The login is recorded in
+// logins.
+func authFinish(id string, msg3 opaque.AuthMsg3, remoteAddr string) (*login, error) {
+	var h *handshake
+	var err error
+	if sealer != nil {
+		h, err = openSealed(id)
+	} else {
+		h, err = sessions.take(id, eventAuthMsg3)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sharedSecret, err := opaque.Auth3(h.auth, msg3)
+	if err != nil {
+		return nil, err
+	}
+	credID := credentialID(h.auth.CredentialID())
+	cred, err := useCredential(h.username, credID)
+	if err != nil {
+		return nil, err
+	}
+	sessionID, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+	tok, claims, err := signer.Issue(h.username, sessionID, sharedSecret)
+	if err != nil {
+		return nil, err
+	}
+	l := &login{
+		username:  h.username,
+		sessionID: sessionID,
+		sk:        sharedSecret,
+		token:     tok,
+		tokenID:   claims.ID,
+		credID:    credID,
+		vaultKey:  cred.VaultKey,
+	}
+	logins.add(l, remoteAddr)
+	return l, nil
+}
+
+// useCredential is called when a login with the credential id of username
+// has succeeded and returns the credential. It fails if the credential was
+// removed during the login. Recovery credentials are removed, so each can be
+// used once.
+func useCredential(username, id string) (*credential, error) {
+	c, ok := accounts.Get(username, id)
+	if !ok {
+		return nil, errNoSuchCredential
+	}
+	if c.Kind == kindRecovery {
+		if err := accounts.Remove(username, id); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// newReplayCache returns a cache that keeps its IDs in dir, or in memory if
+// dir is empty. Only servers that share dir see each other's IDs.
+func newReplayCache(dir string) (opaque.ReplayCache, error) {
+	if dir == "" {
+		return opaque.NewMemoryReplayCache(), nil
+	}
+	return opaque.NewDirReplayCache(dir)
+}
+
+// newSealer reads a hex-encoded master key from keyFile and returns a sealer
+// for stateless logins. Opened sessions are remembered in replayDir, see
+// newReplayCache, so with more than one server a replay is only detected if
+// they share replayDir.
+func newSealer(keyFile, replayDir string, period, ttl time.Duration) (*opaque.SessionSealer, error) {
+	key, err := readKeyFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	replay, err := newReplayCache(replayDir)
+	if err != nil {
+		return nil, err
+	}
+	return opaque.NewSessionSealer(key, period, ttl, replay)
+}
+
+// openSealed is the stateless counterpart of sessions.take for auth
+// handshakes. The sealer's errors are mapped to the session table's.
+func openSealed(id string) (*handshake, error) {
+	sess, err := sealer.Open(id)
+	switch err {
+	case nil:
+	case opaque.InvalidSession:
+		return nil, errUnknownSession
+	case opaque.SessionExpired:
+		return nil, errSessionExpired
+	case opaque.SessionReplayed:
+		return nil, errSessionReplayed
+	default:
+		return nil, err
+	}
+	h := &handshake{id: id, state: stateAwaitAuthMsg3, username: sess.Username(), auth: sess}
+	if err := h.advance(eventAuthMsg3); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
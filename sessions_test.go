@@ -0,0 +1,338 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"GoTcpServerWithOpaque/opaque"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandshakeTransitions(t *testing.T) {
+	for _, tc := range []struct {
+		events []handshakeEvent
+		ok     bool
+	}{
+		{[]handshakeEvent{eventPwRegMsg1, eventPwRegMsg3}, true},
+		{[]handshakeEvent{eventAuthMsg1, eventAuthMsg3}, true},
+		{[]handshakeEvent{eventPwRegMsg3}, false},
+		{[]handshakeEvent{eventAuthMsg3}, false},
+		{[]handshakeEvent{eventPwRegMsg1, eventAuthMsg3}, false},
+		{[]handshakeEvent{eventAuthMsg1, eventPwRegMsg3}, false},
+		{[]handshakeEvent{eventAuthMsg1, eventAuthMsg1}, false},
+		{[]handshakeEvent{eventAuthMsg1, eventAuthMsg3, eventAuthMsg3}, false},
+	} {
+		h := &handshake{}
+		var err error
+		for _, ev := range tc.events {
+			if err = h.advance(ev); err != nil {
+				break
+			}
+		}
+		if (err == nil) != tc.ok {
+			t.Errorf("%v: err = %v", tc.events, err)
+		}
+		if !tc.ok && h.state != stateFailed {
+			t.Errorf("%v: state = %s, want %s", tc.events, h.state, stateFailed)
+		}
+	}
+}
+
+func TestSessionTable(t *testing.T) {
+	now := time.Unix(1000, 0)
+	table := newSessionTable(time.Minute, 2)
+	table.now = func() time.Time { return now }
+
+	newAuth := func() *handshake {
+		h := &handshake{}
+		h.advance(eventAuthMsg1)
+		return h
+	}
+	id1, err := table.add(newAuth())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := table.add(newAuth()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := table.add(newAuth()); err != errTooManySessions {
+		t.Errorf("add to a full table: got %v, want %v", err, errTooManySessions)
+	}
+
+	// Messages out of order are rejected and the handshake is dropped.
+	if _, err := table.take(id1, eventPwRegMsg3); err == nil {
+		t.Error("take accepted PwRegMsg3 for an auth handshake")
+	}
+	if _, err := table.take(id1, eventAuthMsg3); err != errUnknownSession {
+		t.Errorf("take after failure: got %v, want %v", err, errUnknownSession)
+	}
+
+	// Expired handshakes are swept to make room and cannot be finished.
+	id3, err := table.add(newAuth())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(2 * time.Minute)
+	if _, err := table.add(newAuth()); err != nil {
+		t.Errorf("add after expiry: %v", err)
+	}
+	if n := table.len(); n != 1 {
+		t.Errorf("len = %d after sweep, want 1", n)
+	}
+	if _, err := table.take(id3, eventAuthMsg3); err != errUnknownSession {
+		t.Errorf("take of swept handshake: got %v, want %v", err, errUnknownSession)
+	}
+
+	id5, err := table.add(newAuth())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(2 * time.Minute)
+	if _, err := table.take(id5, eventAuthMsg3); err != errSessionExpired {
+		t.Errorf("take of expired handshake: got %v, want %v", err, errSessionExpired)
+	}
+}
+
+func TestSessionTableReserve(t *testing.T) {
+	table := newSessionTable(time.Minute, 2)
+	table.now = func() time.Time { return time.Unix(1000, 0) }
+	if err := table.reserve(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := table.add(&handshake{}); err != nil {
+		t.Fatal(err)
+	}
+	// The reserved place counts against the limit.
+	if err := table.reserve(); err != errTooManySessions {
+		t.Errorf("reserve in a full table: got %v, want %v", err, errTooManySessions)
+	}
+	if _, err := table.addReserved(&handshake{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := table.len(); n != 2 {
+		t.Errorf("len = %d, want 2", n)
+	}
+
+	table = newSessionTable(time.Minute, 1)
+	if err := table.reserve(); err != nil {
+		t.Fatal(err)
+	}
+	table.release()
+	if err := table.reserve(); err != nil {
+		t.Errorf("reserve after release: %v", err)
+	}
+}
+
+func TestFullSessionTableSkipsCrypto(t *testing.T) {
+	register(t, "full-table", "secret")
+	defer func(s *sessionTable, p *cryptoPool) {
+		sessions = s
+		pool.close()
+		pool = p
+	}(sessions, pool)
+	sessions = newSessionTable(time.Minute, 0)
+	pool = newCryptoPool(1, 1)
+
+	c := dial(t)
+	if _, err := c.Login("full-table", "secret"); err == nil {
+		t.Fatal("login succeeded with a full session table")
+	}
+	if n := pool.metrics()["completed"].(int64); n != 0 {
+		t.Errorf("pool ran %d jobs for a full session table", n)
+	}
+}
+
+// startAuth runs the first round of the auth command on c and returns the
+// client session and the server's reply.
+func startAuth(t *testing.T, c *testConn, username, password string) (*opaque.AuthClientSession, authMsg2) {
+	t.Helper()
+	return startAuthCredential(t, c, username, "", password)
+}
+
+// startAuthCredential is like startAuth but uses the credential credentialID.
+func startAuthCredential(t *testing.T, c *testConn, username, credentialID, password string) (*opaque.AuthClientSession, authMsg2) {
+	t.Helper()
+	if err := opaque.Write(c.w, []byte("auth")); err != nil {
+		t.Fatal(err)
+	}
+	sess, msg1, err := opaque.AuthInit(username, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg1.CredentialID = credentialID
+	sess.SetCredentialID(credentialID)
+	if err := c.write(msg1); err != nil {
+		t.Fatal(err)
+	}
+	var msg2 authMsg2
+	if err := c.read(&msg2); err != nil {
+		t.Fatal(err)
+	}
+	return sess, msg2
+}
+
+func TestAuthAcrossConnections(t *testing.T) {
+	register(t, "across", "secret")
+
+	c1 := dial(t)
+	sess, msg2 := startAuth(t, c1, "across", "secret")
+	if msg2.SessionID == "" {
+		t.Fatal("AuthMsg2 has no SessionID")
+	}
+	// The first connection goes away before AuthMsg3 is sent.
+	c1.serverErr()
+
+	secret, msg3, err := opaque.Auth2(sess, msg2.AuthMsg2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	finish := struct {
+		SessionID string
+		opaque.AuthMsg3
+	}{msg2.SessionID, msg3}
+
+	c2 := dial(t)
+	if err := opaque.Write(c2.w, []byte("auth-finish-token")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c2.write(finish); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := opaque.Read(c2.r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "ok" {
+		t.Errorf("reply = %q, want ok", reply)
+	}
+	if _, err := opaque.ReadAndDecrypt(c2.r, opaque.ChannelKey(secret)); err != nil {
+		t.Errorf("token: %v", err)
+	}
+	if err := c2.serverErr(); err != nil {
+		t.Errorf("server: %v", err)
+	}
+
+	// The session cannot be finished twice.
+	c3 := dial(t)
+	go func() {
+		opaque.Write(c3.w, []byte("auth-finish"))
+		c3.write(finish)
+	}()
+	if err := <-c3.done; err == nil {
+		t.Error("auth-finish succeeded twice for the same session")
+	}
+}
+
+func TestFinishWrongKind(t *testing.T) {
+	register(t, "wrong-kind", "secret")
+
+	c1 := dial(t)
+	_, msg2 := startAuth(t, c1, "wrong-kind", "secret")
+	c1.serverErr()
+
+	data, err := json.Marshal(map[string]interface{}{
+		"SessionID": msg2.SessionID,
+		"EnvU":      "00",
+		"PubU":      &pubS,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2 := dial(t)
+	go func() {
+		opaque.Write(c2.w, []byte("pwreg-finish"))
+		opaque.Write(c2.w, data)
+	}()
+	if err := <-c2.done; err == nil || !strings.Contains(err.Error(), "unexpected PwRegMsg3") {
+		t.Errorf("pwreg-finish of an auth session: got %v", err)
+	}
+}
+
+func TestStatelessAuthSharedReplayDir(t *testing.T) {
+	register(t, "stateless-shared", "secret")
+	keyFile := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(keyFile, []byte(strings.Repeat("cd", 32)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Two servers with the same key and replay directory.
+	replayDir := t.TempDir()
+	s1, err := newSealer(keyFile, replayDir, time.Hour, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := newSealer(keyFile, replayDir, time.Hour, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { sealer = nil }()
+
+	sealer = s1
+	c := dial(t)
+	sess, msg2 := startAuth(t, c, "stateless-shared", "secret")
+	c.serverErr()
+	_, msg3, err := opaque.Auth2(sess, msg2.AuthMsg2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authFinish(msg2.SessionID, msg3, "pipe"); err != nil {
+		t.Fatalf("authFinish: %v", err)
+	}
+	sealer = s2
+	if _, err := authFinish(msg2.SessionID, msg3, "pipe"); err != errSessionReplayed {
+		t.Errorf("replay on the other server: got %v, want %v", err, errSessionReplayed)
+	}
+}
+
+func TestStatelessAuth(t *testing.T) {
+	register(t, "stateless", "secret")
+	keyFile := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(keyFile, []byte(strings.Repeat("ab", 32)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newSealer(keyFile, "", time.Hour, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealer = s
+	defer func() { sealer = nil }()
+
+	c := dial(t)
+	if _, err := c.Login("stateless", "secret"); err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if err := c.serverErr(); err != nil {
+		t.Errorf("server: %v", err)
+	}
+
+	before := sessions.len()
+	c1 := dial(t)
+	sess, msg2 := startAuth(t, c1, "stateless", "secret")
+	c1.serverErr()
+	if n := sessions.len(); n != before {
+		t.Errorf("session table grew from %d to %d", before, n)
+	}
+	_, msg3, err := opaque.Auth2(sess, msg2.AuthMsg2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := authFinish(msg2.SessionID, msg3, "pipe")
+	if err != nil {
+		t.Fatalf("authFinish: %v", err)
+	}
+	if l.username != "stateless" {
+		t.Errorf("username = %q", l.username)
+	}
+	if _, err := authFinish(msg2.SessionID, msg3, "pipe"); err != errSessionReplayed {
+		t.Errorf("replay: got %v, want %v", err, errSessionReplayed)
+	}
+	if _, err := authFinish("not a blob", msg3, "pipe"); err != errUnknownSession {
+		t.Errorf("bad blob: got %v, want %v", err, errUnknownSession)
+	}
+}
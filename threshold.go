@@ -0,0 +1,447 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"GoTcpServerWithOpaque/opaque"
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// In threshold mode the OPRF keys of new registrations are shared among
+// several servers, see opaque/threshold.go. A share holder is started with
+// -oprf-share-file and answers partial evaluations on its own listener,
+// -oprf-share-addr, which should only be reachable by the coordinators:
+//
+//	coordinator: shareRequest
+//	holder:      opaque.PartialEvaluation
+//	coordinator: shareChallenge, if the client asked for a proof
+//	holder:      shareResponse
+//
+// A coordinator is started with -threshold-config. For each registration and
+// login it asks all share holders in parallel and combines the first t
+// answers whose proofs verify and, for logins, that are under the key the
+// user registered with. Users registered before keep their own K.
+//
+// The requests are authenticated with a key that each share holder shares
+// with the coordinators, and each holder limits the number of evaluations
+// for each credential to -oprf-share-rate per minute, so that a coordinator
+// that has been broken into still has to ask for every guess.
+
+var (
+	errShareAuth  = errors.New("Unauthenticated share request")
+	errShareStale = errors.New("Stale share request")
+)
+
+// shareRequestMaxAge is how far the time of a share request may be from the
+// share holder's clock.
+const shareRequestMaxAge = time.Minute
+
+// shareConnTimeout is how long a share holder keeps a connection open.
+const shareConnTimeout = 10 * time.Second
+
+// thresholdKey is nil unless enabled with -threshold-config.
+var thresholdKey *thresholdOprf
+
+// thresholdPeer is a share holder in the threshold configuration.
+type thresholdPeer struct {
+	Index int
+	Addr  string
+	// MacKey authenticates the requests to the share holder.
+	MacKey []byte
+}
+
+// thresholdConfig is the content of the -threshold-config file.
+type thresholdConfig struct {
+	T     int
+	Peers []thresholdPeer
+}
+
+// shareRequest asks a share holder to evaluate A under its share of the key
+// for CredentialIdentifier.
+type shareRequest struct {
+	CredentialIdentifier []byte
+	A                    *opaque.ECPoint
+	// Time is when the request was made, in seconds since the epoch.
+	Time int64
+	// Mac is the HMAC-SHA256 of the other fields under the holder's MacKey.
+	Mac []byte
+}
+
+func (r *shareRequest) mac(key []byte) []byte {
+	var b []byte
+	b = binary.BigEndian.AppendUint64(b, uint64(r.Time))
+	b = appendLengthPrefixed(b, r.CredentialIdentifier)
+	if r.A != nil && r.A.X != nil && r.A.Y != nil {
+		b = appendLengthPrefixed(b, r.A.X.Bytes())
+		b = appendLengthPrefixed(b, r.A.Y.Bytes())
+	}
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte("share request"))
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+// shareChallenge asks a share holder for its answer to the challenge of the
+// joint proof, see opaque.ThresholdEvaluation.Challenge.
+type shareChallenge struct {
+	Challenge string
+	// Mac is the HMAC-SHA256 of the request's Mac and Challenge under the
+	// holder's MacKey.
+	Mac []byte
+}
+
+func (c *shareChallenge) mac(key, requestMac []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte("share challenge"))
+	h.Write(appendLengthPrefixed(nil, requestMac))
+	h.Write([]byte(c.Challenge))
+	return h.Sum(nil)
+}
+
+// shareResponse is a share holder's answer to a shareChallenge.
+type shareResponse struct {
+	S string
+}
+
+func appendLengthPrefixed(b, data []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(data)))
+	return append(b, data...)
+}
+
+// thresholdOprf evaluates the OPRF under the shared keys.
+type thresholdOprf struct {
+	t       int
+	peers   []thresholdPeer
+	timeout time.Duration
+}
+
+func newThresholdOprf(cfg thresholdConfig, timeout time.Duration) (*thresholdOprf, error) {
+	if cfg.T < 1 || cfg.T > len(cfg.Peers) {
+		return nil, fmt.Errorf("threshold %d with %d peers", cfg.T, len(cfg.Peers))
+	}
+	seen := map[int]bool{}
+	for _, p := range cfg.Peers {
+		if seen[p.Index] || len(p.MacKey) < 32 || p.Addr == "" {
+			return nil, fmt.Errorf("peer %d: duplicate index, MacKey shorter than 32 bytes or missing Addr", p.Index)
+		}
+		seen[p.Index] = true
+	}
+	return &thresholdOprf{t: cfg.T, peers: cfg.Peers, timeout: timeout}, nil
+}
+
+// readThresholdConfig reads the JSON configuration in file.
+func readThresholdConfig(file string) (thresholdConfig, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return thresholdConfig{}, err
+	}
+	var cfg thresholdConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return thresholdConfig{}, fmt.Errorf("%s: %s", file, err)
+	}
+	return cfg, nil
+}
+
+// shareAnswer is a share holder's answer to a shareRequest. The connection
+// stays open for the shareChallenge.
+type shareAnswer struct {
+	peer thresholdPeer
+	err  error
+
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+	// mac is the Mac of the request.
+	mac  []byte
+	eval opaque.PartialEvaluation
+}
+
+// evaluate evaluates a under the key for credentialIdentifier and, if prove
+// is set, returns the proof of the evaluation. pubK is the user's public key
+// from registration, or nil when registering.
+func (o *thresholdOprf) evaluate(a *opaque.ECPoint, credentialIdentifier []byte, pubK *opaque.ECPoint, prove bool) (*opaque.ThresholdEvaluation, string, error) {
+	deadline := time.Now().Add(o.timeout)
+	answers := make(chan *shareAnswer, len(o.peers))
+	for _, p := range o.peers {
+		go func(p thresholdPeer) {
+			answers <- o.ask(p, credentialIdentifier, a, deadline)
+		}(p)
+	}
+	var received []*shareAnswer
+	defer func() {
+		for _, ans := range received {
+			if ans.conn != nil {
+				ans.conn.Close()
+			}
+		}
+		// The answers of the slower share holders are not needed.
+		go func(n int) {
+			for ; n > 0; n-- {
+				if ans := <-answers; ans.conn != nil {
+					ans.conn.Close()
+				}
+			}
+		}(len(o.peers) - len(received))
+	}()
+
+	var partials []opaque.PartialEvaluation
+	var e *opaque.ThresholdEvaluation
+	var err error
+	for range o.peers {
+		ans := <-answers
+		received = append(received, ans)
+		if ans.err != nil {
+			fmt.Printf("Share holder %d at %s: %s\n", ans.peer.Index, ans.peer.Addr, ans.err)
+			continue
+		}
+		partials = append(partials, ans.eval)
+		if len(partials) < o.t {
+			continue
+		}
+		if e, err = opaque.CombineOprf(a, partials, o.t, pubK); err == nil {
+			break
+		}
+	}
+	if e == nil {
+		if err == nil {
+			err = fmt.Errorf("%d share holders answered, need %d", len(partials), o.t)
+		}
+		return nil, "", err
+	}
+	if !prove {
+		return e, "", nil
+	}
+	proof, err := o.prove(e, received)
+	if err != nil {
+		return nil, "", err
+	}
+	return e, proof, nil
+}
+
+// prove asks the share holders combined into e for their answers to the
+// challenge of the proof of e.
+func (o *thresholdOprf) prove(e *opaque.ThresholdEvaluation, received []*shareAnswer) (string, error) {
+	c, err := e.Challenge()
+	if err != nil {
+		return "", err
+	}
+	byIndex := map[int]*shareAnswer{}
+	for _, ans := range received {
+		if ans.err == nil {
+			byIndex[ans.peer.Index] = ans
+		}
+	}
+	responses := map[int]string{}
+	for _, i := range e.Indices {
+		ans := byIndex[i]
+		ch := shareChallenge{Challenge: c}
+		ch.Mac = ch.mac(ans.peer.MacKey, ans.mac)
+		var res shareResponse
+		if err := writeShareMsg(ans.w, ch); err != nil {
+			return "", fmt.Errorf("share holder %d: %s", i, err)
+		}
+		if err := readShareMsg(ans.r, &res); err != nil {
+			return "", fmt.Errorf("share holder %d: %s", i, err)
+		}
+		responses[i] = res.S
+	}
+	return e.Proof(responses)
+}
+
+// ask sends a shareRequest to the share holder p and returns its answer.
+func (o *thresholdOprf) ask(p thresholdPeer, credentialIdentifier []byte, a *opaque.ECPoint, deadline time.Time) *shareAnswer {
+	ans := &shareAnswer{peer: p}
+	conn, err := net.DialTimeout("tcp", p.Addr, time.Until(deadline))
+	if err != nil {
+		ans.err = err
+		return ans
+	}
+	conn.SetDeadline(deadline)
+	req := shareRequest{CredentialIdentifier: credentialIdentifier, A: a, Time: time.Now().Unix()}
+	req.Mac = req.mac(p.MacKey)
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	var eval opaque.PartialEvaluation
+	err = writeShareMsg(w, req)
+	if err == nil {
+		err = readShareMsg(r, &eval)
+	}
+	if err == nil && eval.Index != p.Index {
+		err = fmt.Errorf("answered for share %d", eval.Index)
+	}
+	if err != nil {
+		conn.Close()
+		ans.err = err
+		return ans
+	}
+	ans.conn, ans.r, ans.w, ans.mac, ans.eval = conn, r, w, req.Mac, eval
+	return ans
+}
+
+func writeShareMsg(w *bufio.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return opaque.Write(w, data)
+}
+
+func readShareMsg(r *bufio.Reader, v interface{}) error {
+	data, err := opaque.Read(r)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("replied %q", data)
+	}
+	return nil
+}
+
+// shareFile is the content of the -oprf-share-file, as written by
+// cmd/oprf-split.
+type shareFile struct {
+	opaque.KeyShare
+	// MacKey authenticates the coordinators' requests.
+	MacKey []byte
+}
+
+// readKeyShare reads the share file file.
+func readKeyShare(file string) (shareFile, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return shareFile{}, err
+	}
+	var share shareFile
+	if err := json.Unmarshal(data, &share); err != nil {
+		return shareFile{}, fmt.Errorf("%s: %s", file, err)
+	}
+	if share.Index < 1 || len(share.Seeds) == 0 || len(share.MacKey) < 32 {
+		return shareFile{}, fmt.Errorf("%s: missing Index or Seeds, or MacKey shorter than 32 bytes", file)
+	}
+	return share, nil
+}
+
+// shareHolder answers partial evaluations under a key share.
+type shareHolder struct {
+	share  opaque.KeyShare
+	macKey []byte
+	now    func() time.Time
+
+	mu      sync.Mutex
+	limits  *bucketMap
+	limited int64
+}
+
+// newShareHolder returns a share holder that evaluates up to perMinute
+// elements per minute, and burst at once, for each credential.
+func newShareHolder(f shareFile, perMinute float64, burst int) (*shareHolder, error) {
+	if perMinute <= 0 || burst < 1 {
+		return nil, errors.New("share holder: rate must be positive and burst at least 1")
+	}
+	return &shareHolder{share: f.KeyShare, macKey: f.MacKey, now: time.Now, limits: newBucketMap(perMinute/60, float64(burst))}, nil
+}
+
+// take takes a token from the bucket of credentialIdentifier.
+func (s *shareHolder) take(credentialIdentifier []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.limits.take(string(credentialIdentifier), 1, s.now()) {
+		s.limited++
+		return false
+	}
+	return true
+}
+
+// give returns a token taken for credentialIdentifier.
+func (s *shareHolder) give(credentialIdentifier []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limits.give(string(credentialIdentifier), 1)
+}
+
+// serveKeyShare answers partial evaluations on ln until ln is closed.
+func serveKeyShare(ln net.Listener, holder *shareHolder) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			if err := holder.handle(conn); err != nil {
+				fmt.Printf("Partial evaluation for %s: %s\n", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+func (s *shareHolder) handle(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(shareConnTimeout))
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	var req shareRequest
+	if err := readShareMsg(r, &req); err != nil {
+		return err
+	}
+	if !hmac.Equal(req.Mac, req.mac(s.macKey)) {
+		return errShareAuth
+	}
+	if age := s.now().Sub(time.Unix(req.Time, 0)); age > shareRequestMaxAge || age < -shareRequestMaxAge {
+		return errShareStale
+	}
+	if !s.take(req.CredentialIdentifier) {
+		if err := opaque.Write(w, []byte(errRateLimited.Error())); err != nil {
+			return err
+		}
+		return errRateLimited
+	}
+	var prover *opaque.PartialProver
+	var eval opaque.PartialEvaluation
+	var err error
+	if poolErr := pool.do(func() {
+		prover, eval, err = opaque.PartialEvaluate(s.share, req.CredentialIdentifier, req.A)
+	}); poolErr != nil {
+		s.give(req.CredentialIdentifier)
+		return writeBusy(w, poolErr)
+	}
+	if err != nil {
+		return err
+	}
+	if err := writeShareMsg(w, eval); err != nil {
+		return err
+	}
+
+	// The coordinator closes the connection unless it wants a proof.
+	var ch shareChallenge
+	if err := readShareMsg(r, &ch); err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	if !hmac.Equal(ch.Mac, ch.mac(s.macKey, req.Mac)) {
+		return errShareAuth
+	}
+	resp, err := prover.Respond(ch.Challenge)
+	if err != nil {
+		return err
+	}
+	return writeShareMsg(w, shareResponse{S: resp})
+}
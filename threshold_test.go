@@ -0,0 +1,198 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"GoTcpServerWithOpaque/opaque"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+// startShareHolders splits new seeds into n shares and serves each on a
+// loopback port. It returns the configuration for a coordinator, the
+// listeners and the share holders.
+func startShareHolders(t *testing.T, threshold, n int) (thresholdConfig, []net.Listener, []*shareHolder) {
+	t.Helper()
+	shares, err := opaque.SplitOprfKey(threshold, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := thresholdConfig{T: threshold}
+	var lns []net.Listener
+	var holders []*shareHolder
+	for _, share := range shares {
+		f := shareFile{KeyShare: share, MacKey: make([]byte, 32)}
+		if _, err := rand.Read(f.MacKey); err != nil {
+			t.Fatal(err)
+		}
+		holder, err := newShareHolder(f, 60, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		go serveKeyShare(ln, holder)
+		cfg.Peers = append(cfg.Peers, thresholdPeer{Index: share.Index, Addr: ln.Addr().String(), MacKey: f.MacKey})
+		lns = append(lns, ln)
+		holders = append(holders, holder)
+	}
+	return cfg, lns, holders
+}
+
+func TestThresholdLogin(t *testing.T) {
+	// Registered before threshold mode, with a random K.
+	register(t, "threshold-random-k", "secret")
+
+	cfg, lns, _ := startShareHolders(t, 2, 3)
+	var err error
+	thresholdKey, err = newThresholdOprf(cfg, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { thresholdKey = nil }()
+
+	c := dial(t)
+	if err := c.Register("threshold", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	c.serverErr()
+	oprfKey := c.OPRFKey
+	if cred, _ := accounts.Get("threshold", defaultCredential); cred.User.K != nil || cred.User.PubK == nil {
+		t.Fatal("stored the OPRF key of a threshold user or not its public key")
+	}
+	login := func(username, password string) error {
+		c := dial(t)
+		_, err := c.Login(username, password)
+		c.serverErr()
+		return err
+	}
+	for _, username := range []string{"threshold", "threshold-random-k"} {
+		if err := login(username, "secret"); err != nil {
+			t.Errorf("login %s: %v", username, err)
+		}
+	}
+	for _, username := range []string{"threshold", "no-such-threshold-user"} {
+		if err := login(username, "guess"); err != opaque.AuthtagMismatch {
+			t.Errorf("login %s with a wrong password: got %v, want %v", username, err, opaque.AuthtagMismatch)
+		}
+	}
+	// The share holders prove the combined evaluation to a client that
+	// pinned the key from registration.
+	c = dial(t)
+	c.OPRFKey = oprfKey
+	if _, err := c.Login("threshold", "secret"); err != nil {
+		t.Errorf("verifiable login: %v", err)
+	}
+	c.serverErr()
+
+	// A share holder that evaluates under another share is left out.
+	other, err := opaque.SplitOprfKey(2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad, err := newShareHolder(shareFile{KeyShare: other[1], MacKey: cfg.Peers[1].MacKey}, 60, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveKeyShare(ln, bad)
+	badCfg := thresholdConfig{T: cfg.T, Peers: append([]thresholdPeer(nil), cfg.Peers...)}
+	badCfg.Peers[1].Addr = ln.Addr().String()
+	good := thresholdKey
+	if thresholdKey, err = newThresholdOprf(badCfg, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	c = dial(t)
+	c.OPRFKey = oprfKey
+	if _, err := c.Login("threshold", "secret"); err != nil {
+		t.Errorf("with a bad share holder: %v", err)
+	}
+	c.serverErr()
+	thresholdKey = good
+
+	// One share holder down still leaves two.
+	lns[0].Close()
+	if err := login("threshold", "secret"); err != nil {
+		t.Errorf("with a share holder down: %v", err)
+	}
+	lns[2].Close()
+	if err := login("threshold", "secret"); err == nil {
+		t.Error("login succeeded with one share holder")
+	}
+	// Unknown users are evaluated by the share holders as well, so they
+	// fail in the same way instead of answering from the local fake user.
+	if err := login("no-such-threshold-user", "secret"); err == nil || err == opaque.AuthtagMismatch {
+		t.Errorf("unknown user with one share holder: got %v, want the share holder error", err)
+	}
+}
+
+func TestShareRequests(t *testing.T) {
+	cfg, _, holders := startShareHolders(t, 1, 1)
+	holders[0].limits = newBucketMap(1.0/60, 2)
+	evaluate := func(cfg thresholdConfig, username string) error {
+		o, err := newThresholdOprf(cfg, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, msg1, err := opaque.AuthInit(username, "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = o.evaluate(msg1.A, credentialIdentifier(username, defaultCredential), nil, true)
+		return err
+	}
+	if err := evaluate(cfg, "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Requests under another key are refused.
+	wrong := thresholdConfig{T: 1, Peers: []thresholdPeer{cfg.Peers[0]}}
+	wrong.Peers[0].MacKey = make([]byte, 32)
+	if err := evaluate(wrong, "alice"); err == nil {
+		t.Error("share holder answered a request with a wrong MAC")
+	}
+
+	// So are old requests.
+	holders[0].now = func() time.Time { return time.Now().Add(2 * shareRequestMaxAge) }
+	if err := evaluate(cfg, "alice"); err == nil {
+		t.Error("share holder answered a stale request")
+	}
+	holders[0].now = time.Now
+
+	// Each credential has its own limit.
+	if err := evaluate(cfg, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := evaluate(cfg, "alice"); err == nil {
+		t.Error("share holder answered over the limit")
+	}
+	if err := evaluate(cfg, "bob"); err != nil {
+		t.Errorf("another credential: %v", err)
+	}
+}
+
+func TestThresholdConfig(t *testing.T) {
+	cfg, _, _ := startShareHolders(t, 2, 2)
+	for _, bad := range []thresholdConfig{
+		{T: 3, Peers: cfg.Peers},
+		{T: 0, Peers: cfg.Peers},
+		{T: 1, Peers: []thresholdPeer{cfg.Peers[0], cfg.Peers[0]}},
+		{T: 1, Peers: []thresholdPeer{{Index: 1, Addr: "x:1"}}},
+	} {
+		if _, err := newThresholdOprf(bad, time.Second); err == nil {
+			t.Errorf("accepted %+v", bad)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+// Package token issues and verifies the bearer tokens the server hands out
+// after a successful login. Tokens are JWS compact serializations (RFC 7515)
+// signed with ES256, the ECDSA P-256 SHA-256 algorithm from RFC 7518.
+//
+// The server creates a Signer and publishes Signer.KeySet as a JSON Web Key
+// Set. Relying services build a Verifier from the key set and call Verify on
+// the tokens presented to them.
+package token
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Claims is the payload of a token.
+type Claims struct {
+	// ID uniquely identifies the token.
+	ID string `json:"jti"`
+	// Subject is the username.
+	Subject string `json:"sub"`
+	// IssuedAt and Expiry are Unix times in seconds.
+	IssuedAt int64 `json:"iat"`
+	Expiry   int64 `json:"exp"`
+	// SessionID identifies the login the token was issued for.
+	SessionID string `json:"sid"`
+	// Binding is Binding(SK) for the session key SK of the login. A service
+	// that shares SK with the client can use it to check that the token
+	// belongs to the channel it was presented on.
+	Binding string `json:"skh"`
+}
+
+var (
+	// Malformed is returned by Verify for strings that are not tokens.
+	Malformed = errors.New("token: malformed")
+	// UnknownKey is returned by Verify for tokens signed by a key that is not
+	// in the verifier's key set.
+	UnknownKey = errors.New("token: unknown key")
+	// BadSignature is returned by Verify for tokens whose signature does not
+	// verify.
+	BadSignature = errors.New("token: bad signature")
+	// Expired is returned by Verify for tokens that have expired or are not
+	// yet valid.
+	Expired = errors.New("token: expired")
+)
+
+const alg = "ES256"
+
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+	Kid string `json:"kid"`
+}
+
+var b64 = base64.RawURLEncoding
+
+// Binding returns the channel-binding hash of the session key sk.
+func Binding(sk []byte) string {
+	h := sha256.New()
+	h.Write([]byte("opaque token binding"))
+	h.Write(sk)
+	return b64.EncodeToString(h.Sum(nil))
+}
+
+// Signer issues tokens.
+type Signer struct {
+	key *ecdsa.PrivateKey
+	kid string
+	ttl time.Duration
+	now func() time.Time
+}
+
+// NewSigner returns a Signer that signs with key, which must be a P-256 key,
+// and issues tokens that are valid for ttl.
+func NewSigner(key *ecdsa.PrivateKey, ttl time.Duration) (*Signer, error) {
+	if key.Curve != elliptic.P256() {
+		return nil, errors.New("token: key is not a P-256 key")
+	}
+	return &Signer{key: key, kid: thumbprint(&key.PublicKey), ttl: ttl, now: time.Now}, nil
+}
+
+// Issue returns a signed token for subject and the login sessionID with
+// session key sk, together with its claims.
+func (s *Signer) Issue(subject, sessionID string, sk []byte) (string, *Claims, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, err
+	}
+	now := s.now()
+	claims := &Claims{
+		ID:        b64.EncodeToString(id),
+		Subject:   subject,
+		IssuedAt:  now.Unix(),
+		Expiry:    now.Add(s.ttl).Unix(),
+		SessionID: sessionID,
+		Binding:   Binding(sk),
+	}
+	h, err := json.Marshal(header{Alg: alg, Typ: "JWT", Kid: s.kid})
+	if err != nil {
+		return "", nil, err
+	}
+	p, err := json.Marshal(claims)
+	if err != nil {
+		return "", nil, err
+	}
+	signingInput := b64.EncodeToString(h) + "." + b64.EncodeToString(p)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, ss, err := ecdsa.Sign(rand.Reader, s.key, digest[:])
+	if err != nil {
+		return "", nil, err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	ss.FillBytes(sig[32:])
+	return signingInput + "." + b64.EncodeToString(sig), claims, nil
+}
+
+// KeySet returns the key set containing the signer's public key.
+func (s *Signer) KeySet() KeySet {
+	return KeySet{Keys: []JWK{newJWK(&s.key.PublicKey, s.kid)}}
+}
+
+// KeySet is a JSON Web Key Set (RFC 7517).
+type KeySet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWK is a P-256 public key in JSON Web Key format.
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+}
+
+func newJWK(pub *ecdsa.PublicKey, kid string) JWK {
+	x, y := make([]byte, 32), make([]byte, 32)
+	pub.X.FillBytes(x)
+	pub.Y.FillBytes(y)
+	return JWK{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   b64.EncodeToString(x),
+		Y:   b64.EncodeToString(y),
+		Kid: kid,
+		Alg: alg,
+		Use: "sig",
+	}
+}
+
+// publicKey returns the key in k. A non-nil error is returned if k is not a
+// valid P-256 key.
+func (k JWK) publicKey() (*ecdsa.PublicKey, error) {
+	if k.Kty != "EC" || k.Crv != "P-256" {
+		return nil, fmt.Errorf("token: unsupported key type %s %s", k.Kty, k.Crv)
+	}
+	x, err := b64.DecodeString(k.X)
+	if err != nil || len(x) != 32 {
+		return nil, fmt.Errorf("token: key %s: bad x", k.Kid)
+	}
+	y, err := b64.DecodeString(k.Y)
+	if err != nil || len(y) != 32 {
+		return nil, fmt.Errorf("token: key %s: bad y", k.Kid)
+	}
+	pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+		return nil, fmt.Errorf("token: key %s is not on P-256", k.Kid)
+	}
+	return pub, nil
+}
+
+// thumbprint returns the RFC 7638 thumbprint of pub, which is used as the key
+// ID.
+func thumbprint(pub *ecdsa.PublicKey) string {
+	k := newJWK(pub, "")
+	// The members must be in lexicographic order with no whitespace.
+	s := fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`, k.X, k.Y)
+	sum := sha256.Sum256([]byte(s))
+	return b64.EncodeToString(sum[:])
+}
+
+// KeySetHandler returns a handler that serves ks as JSON. It is meant to be
+// mounted at a well-known path such as /.well-known/jwks.json.
+func KeySetHandler(ks KeySet) http.Handler {
+	data, err := json.Marshal(ks)
+	if err != nil {
+		panic(err)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/jwk-set+json")
+		w.Header().Set("Cache-Control", "max-age=300")
+		w.Write(data)
+	})
+}
+
+// Verifier verifies tokens.
+type Verifier struct {
+	keys map[string]*ecdsa.PublicKey
+
+	// Leeway is the clock skew allowed when checking IssuedAt and Expiry.
+	Leeway time.Duration
+
+	// Check, if non-nil, is called by Verify with the claims of every token
+	// that is otherwise valid. If Check returns an error Verify returns it.
+	// The server that issued the token uses this to reject tokens of revoked
+	// logins.
+	Check func(*Claims) error
+
+	now func() time.Time
+}
+
+// NewVerifier returns a Verifier that accepts tokens signed by any of the
+// keys in ks.
+func NewVerifier(ks KeySet) (*Verifier, error) {
+	v := &Verifier{keys: map[string]*ecdsa.PublicKey{}, Leeway: 30 * time.Second, now: time.Now}
+	for _, k := range ks.Keys {
+		if k.Alg != "" && k.Alg != alg {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			return nil, err
+		}
+		v.keys[k.Kid] = pub
+	}
+	if len(v.keys) == 0 {
+		return nil, errors.New("token: no ES256 keys in key set")
+	}
+	return v, nil
+}
+
+// Verify checks the signature and the validity period of tok and returns its
+// claims.
+func (v *Verifier) Verify(tok string) (*Claims, error) {
+	parts := strings.Split(tok, ".")
+	if len(parts) != 3 {
+		return nil, Malformed
+	}
+	var h header
+	if err := decodeJSON(parts[0], &h); err != nil {
+		return nil, err
+	}
+	if h.Alg != alg {
+		return nil, Malformed
+	}
+	pub, ok := v.keys[h.Kid]
+	if !ok {
+		return nil, UnknownKey
+	}
+	sig, err := b64.DecodeString(parts[2])
+	if err != nil || len(sig) != 64 {
+		return nil, Malformed
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(pub, digest[:], r, s) {
+		return nil, BadSignature
+	}
+	var c Claims
+	if err := decodeJSON(parts[1], &c); err != nil {
+		return nil, err
+	}
+	now := v.now()
+	if now.Add(-v.Leeway).Unix() >= c.Expiry || now.Add(v.Leeway).Unix() < c.IssuedAt {
+		return nil, Expired
+	}
+	if v.Check != nil {
+		if err := v.Check(&c); err != nil {
+			return nil, err
+		}
+	}
+	return &c, nil
+}
+
+func decodeJSON(part string, v interface{}) error {
+	data, err := b64.DecodeString(part)
+	if err != nil {
+		return Malformed
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return Malformed
+	}
+	return nil
+}
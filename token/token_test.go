@@ -0,0 +1,153 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package token
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newSigner(t *testing.T) *Signer {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSigner(key, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestIssueAndVerify(t *testing.T) {
+	s := newSigner(t)
+	sk := []byte("session key")
+	tok, claims, err := s.Issue("alice", "sid-1", sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Relying services get the key set from the well-known endpoint.
+	srv := httptest.NewServer(KeySetHandler(s.KeySet()))
+	defer srv.Close()
+	resp, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var ks KeySet
+	if err := json.NewDecoder(resp.Body).Decode(&ks); err != nil {
+		t.Fatal(err)
+	}
+	v, err := NewVerifier(ks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := v.Verify(tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != *claims {
+		t.Errorf("Verify = %+v, want %+v", got, claims)
+	}
+	if got.Subject != "alice" || got.SessionID != "sid-1" || got.Binding != Binding(sk) {
+		t.Errorf("unexpected claims %+v", got)
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	s := newSigner(t)
+	tok, _, err := s.Issue("alice", "sid-1", []byte("sk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := NewVerifier(s.KeySet())
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewVerifier(newSigner(t).KeySet())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Verify(tok); err != UnknownKey {
+		t.Errorf("other key: got %v, want %v", err, UnknownKey)
+	}
+
+	parts := strings.Split(tok, ".")
+	forged, _, err := s.Issue("mallory", "sid-1", []byte("sk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// alice's signature on mallory's claims.
+	swapped := strings.Join([]string{parts[0], strings.Split(forged, ".")[1], parts[2]}, ".")
+	if _, err := v.Verify(swapped); err != BadSignature {
+		t.Errorf("swapped claims: got %v, want %v", err, BadSignature)
+	}
+	none := b64.EncodeToString([]byte(`{"alg":"none","kid":"x"}`))
+	for _, bad := range []string{"", "a.b", none + "." + parts[1] + ".", parts[0] + "." + parts[1] + ".!!"} {
+		if _, err := v.Verify(bad); err != Malformed {
+			t.Errorf("Verify(%q): got %v, want %v", bad, err, Malformed)
+		}
+	}
+
+	revoked := errors.New("revoked")
+	v.Check = func(c *Claims) error {
+		if c.SessionID == "sid-1" {
+			return revoked
+		}
+		return nil
+	}
+	if _, err := v.Verify(tok); err != revoked {
+		t.Errorf("Check: got %v, want %v", err, revoked)
+	}
+	v.Check = nil
+
+	v.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	if _, err := v.Verify(tok); err != Expired {
+		t.Errorf("expired: got %v, want %v", err, Expired)
+	}
+	v.now = func() time.Time { return time.Now().Add(-time.Hour) }
+	if _, err := v.Verify(tok); err != Expired {
+		t.Errorf("not yet valid: got %v, want %v", err, Expired)
+	}
+}
+
+func TestNewSignerRejectsOtherCurves(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewSigner(key, time.Minute); err == nil {
+		t.Error("P-384 key accepted")
+	}
+}
+
+func TestThumbprint(t *testing.T) {
+	// Example key from RFC 7515, appendix A.3.
+	k := JWK{
+		Kty: "EC", Crv: "P-256",
+		X: "f83OJ3D2xF1Bg8vub9tLe1gHMzV76e8Tus9uPHvRVEU",
+		Y: "x_FEzRu9m36HLN_tue659LNpXW6pCyStikYjKIWI5a0",
+	}
+	pub, err := k.publicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The thumbprint is stable and URL-safe.
+	tp := thumbprint(pub)
+	if tp != thumbprint(pub) || len(tp) != 43 || strings.ContainsAny(tp, "+/=") {
+		t.Errorf("thumbprint %q", tp)
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// The vault stores blobs for logged-in users with their account, see
+// accountStore. Clients encrypt the blobs under keys derived from a vault key
+// of the account, see client/vault.go, so the server only ever sees
+// ciphertext. The server keeps the vault key wrapped under the export key of
+// each credential that the client shared it with, so every credential can
+// read the vault, and a credential's copy goes away with the credential. The
+// channel commands are:
+//
+//	vault-list     nothing               -> []blobInfo
+//	vault-get      blobRef               -> blob
+//	vault-put      blob                  -> blobInfo
+//	vault-delete   blobRef with Version  -> nothing
+//	vault-key      nothing               -> vaultKey
+//	vault-key-put  vaultKey              -> nothing
+//
+// vault-key returns the vault key wrapped for the credential of the login.
+// vault-key-put stores it wrapped for CredentialID, or for the credential of
+// the login if it is empty. With Create set it only succeeds if no credential
+// of the account has a vault key yet, so that two clients cannot create
+// different ones.
+//
+// Every blob has a version, which is 1 when it is created and increases by
+// one on every put. Puts and deletes are compare-and-swap: they name the
+// version the client last saw, 0 for a blob that does not exist yet, and
+// fail with errVersionMismatch if the blob has changed since.
+
+var (
+	errNoSuchBlob      = errors.New("no such blob")
+	errVersionMismatch = errors.New("version mismatch")
+	errVaultQuota      = errors.New("vault quota exceeded")
+	errBlobName        = errors.New("invalid blob name")
+	errNoVaultKey      = errors.New("no vault key")
+	// errVaultKeyExists is returned when the account has a vault key but
+	// the credential has none.
+	errVaultKeyExists = errors.New("vault key exists")
+)
+
+// maxBlobName is the maximum length of a blob name.
+const maxBlobName = 256
+
+// blobInfo describes a blob.
+type blobInfo struct {
+	Name     string
+	Version  uint64
+	Size     int
+	Modified time.Time
+}
+
+// blob is a blob with its content.
+type blob struct {
+	blobInfo
+	Data []byte
+}
+
+// blobRef is the argument of vault-get and vault-delete.
+type blobRef struct {
+	Name    string
+	Version uint64 `json:",omitempty"`
+}
+
+// vaultKey is the argument of vault-key-put and the result of vault-key.
+type vaultKey struct {
+	CredentialID string `json:",omitempty"`
+	// Key is the vault key wrapped under the export key of the credential.
+	Key    []byte
+	Create bool `json:",omitempty"`
+}
+
+// blobQuota limits the blobs of each user.
+type blobQuota struct {
+	// Blobs is the number of blobs and Bytes their total size.
+	Blobs int
+	Bytes int
+}
+
+// vaultQuota is the quota of every user, set with -vault-max-blobs and
+// -vault-max-bytes.
+var vaultQuota = blobQuota{Blobs: 100, Bytes: 1 << 20}
+
+func (s *memoryAccountStore) GetBlob(username, name string) (*blob, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	b, ok := s.blobs[username][name]
+	return b, ok
+}
+
+func (s *memoryAccountStore) PutBlob(username string, b *blob, quota blobQuota) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	blobs := s.blobs[username]
+	old, ok := blobs[b.Name]
+	var version uint64
+	if ok {
+		version = old.Version
+	}
+	if b.Version != version {
+		return errVersionMismatch
+	}
+	n, size := len(blobs), len(b.Data)
+	for _, other := range blobs {
+		size += len(other.Data)
+	}
+	if ok {
+		size -= len(old.Data)
+	} else {
+		n++
+	}
+	if n > quota.Blobs || size > quota.Bytes {
+		return errVaultQuota
+	}
+	if blobs == nil {
+		blobs = map[string]*blob{}
+		s.blobs[username] = blobs
+	}
+	b.Version = version + 1
+	b.Size = len(b.Data)
+	b.Modified = time.Now()
+	stored := *b
+	blobs[b.Name] = &stored
+	return nil
+}
+
+func (s *memoryAccountStore) DeleteBlob(username, name string, version uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.blobs[username][name]
+	if !ok {
+		return errNoSuchBlob
+	}
+	if b.Version != version {
+		return errVersionMismatch
+	}
+	delete(s.blobs[username], name)
+	return nil
+}
+
+func (s *memoryAccountStore) ListBlobs(username string) []blobInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	res := []blobInfo{}
+	for _, b := range s.blobs[username] {
+		res = append(res, b.blobInfo)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// checkBlobName returns errBlobName unless name is a valid blob name.
+func checkBlobName(name string) error {
+	if name == "" || len(name) > maxBlobName {
+		return fmt.Errorf("%w: length %d, need 1 to %d", errBlobName, len(name), maxBlobName)
+	}
+	return nil
+}
+
+func cmdVaultList(l *login, _ json.RawMessage) (interface{}, error) {
+	return accounts.ListBlobs(l.username), nil
+}
+
+func cmdVaultGet(l *login, args json.RawMessage) (interface{}, error) {
+	var ref blobRef
+	if err := json.Unmarshal(args, &ref); err != nil {
+		return nil, err
+	}
+	b, ok := accounts.GetBlob(l.username, ref.Name)
+	if !ok {
+		return nil, errNoSuchBlob
+	}
+	return b, nil
+}
+
+func cmdVaultPut(l *login, args json.RawMessage) (interface{}, error) {
+	var b blob
+	if err := json.Unmarshal(args, &b); err != nil {
+		return nil, err
+	}
+	if err := checkBlobName(b.Name); err != nil {
+		return nil, err
+	}
+	if err := accounts.PutBlob(l.username, &b, vaultQuota); err != nil {
+		return nil, err
+	}
+	return b.blobInfo, nil
+}
+
+func cmdVaultDelete(l *login, args json.RawMessage) (interface{}, error) {
+	var ref blobRef
+	if err := json.Unmarshal(args, &ref); err != nil {
+		return nil, err
+	}
+	return nil, accounts.DeleteBlob(l.username, ref.Name, ref.Version)
+}
+
+func cmdVaultKey(l *login, _ json.RawMessage) (interface{}, error) {
+	// A recovery credential is removed by the login, which keeps its key.
+	key := l.vaultKey
+	if c, ok := accounts.Get(l.username, l.credID); ok && c.VaultKey != nil {
+		key = c.VaultKey
+	}
+	if key != nil {
+		return vaultKey{Key: key}, nil
+	}
+	for _, c := range accounts.List(l.username) {
+		if c.VaultKey != nil {
+			return nil, errVaultKeyExists
+		}
+	}
+	return nil, errNoVaultKey
+}
+
+func cmdVaultKeyPut(l *login, args json.RawMessage) (interface{}, error) {
+	var k vaultKey
+	if err := json.Unmarshal(args, &k); err != nil {
+		return nil, err
+	}
+	if k.CredentialID == "" {
+		k.CredentialID = l.credID
+	}
+	if len(k.Key) == 0 {
+		return nil, errNoVaultKey
+	}
+	return nil, accounts.PutVaultKey(l.username, k.CredentialID, k.Key, k.Create)
+}
@@ -0,0 +1,200 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"GoTcpServerWithOpaque/client"
+	"GoTcpServerWithOpaque/opaque"
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestMemoryAccountStoreBlobs(t *testing.T) {
+	s := newMemoryAccountStore()
+	quota := blobQuota{Blobs: 2, Bytes: 10}
+
+	b := &blob{blobInfo: blobInfo{Name: "a"}, Data: []byte("12345")}
+	if err := s.PutBlob("u", b, quota); err != nil || b.Version != 1 {
+		t.Fatalf("create: version %d, %v", b.Version, err)
+	}
+	if err := s.PutBlob("u", &blob{blobInfo: blobInfo{Name: "a"}, Data: []byte("x")}, quota); err != errVersionMismatch {
+		t.Errorf("create existing: got %v, want %v", err, errVersionMismatch)
+	}
+	b = &blob{blobInfo: blobInfo{Name: "a", Version: 1}, Data: []byte("1234567890")}
+	if err := s.PutBlob("u", b, quota); err != nil || b.Version != 2 {
+		t.Fatalf("update: version %d, %v", b.Version, err)
+	}
+	if err := s.PutBlob("u", &blob{blobInfo: blobInfo{Name: "b"}, Data: []byte("x")}, quota); err != errVaultQuota {
+		t.Errorf("over byte quota: got %v, want %v", err, errVaultQuota)
+	}
+	// Another user has a quota of their own.
+	if err := s.PutBlob("v", &blob{blobInfo: blobInfo{Name: "b"}, Data: []byte("x")}, quota); err != nil {
+		t.Errorf("other user: %v", err)
+	}
+
+	if err := s.DeleteBlob("u", "a", 1); err != errVersionMismatch {
+		t.Errorf("delete old version: got %v, want %v", err, errVersionMismatch)
+	}
+	if err := s.DeleteBlob("u", "a", 2); err != nil {
+		t.Errorf("delete: %v", err)
+	}
+	if err := s.DeleteBlob("u", "a", 2); err != errNoSuchBlob {
+		t.Errorf("second delete: got %v, want %v", err, errNoSuchBlob)
+	}
+
+	for _, name := range []string{"c", "b"} {
+		if err := s.PutBlob("u", &blob{blobInfo: blobInfo{Name: name}}, quota); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.PutBlob("u", &blob{blobInfo: blobInfo{Name: "d"}}, quota); err != errVaultQuota {
+		t.Errorf("over blob quota: got %v, want %v", err, errVaultQuota)
+	}
+	if got := s.ListBlobs("u"); len(got) != 2 || got[0].Name != "b" || got[1].Name != "c" {
+		t.Errorf("List = %+v", got)
+	}
+}
+
+func TestVault(t *testing.T) {
+	register(t, "vault", "password")
+	c, _ := loginChannel(t, "vault", "password")
+
+	secret := []byte("my diary")
+	v, err := c.VaultPut("diary", secret, 0)
+	if err != nil || v != 1 {
+		t.Fatalf("put: version %d, %v", v, err)
+	}
+	if b, _ := accounts.GetBlob("vault", "diary"); bytes.Contains(b.Data, secret) {
+		t.Error("server stores the plaintext")
+	}
+	if _, err := c.VaultPut("diary", []byte("other"), 0); err != client.VersionMismatch {
+		t.Errorf("concurrent create: got %v, want %v", err, client.VersionMismatch)
+	}
+	if v, err = c.VaultPut("diary", []byte("my new diary"), v); err != nil || v != 2 {
+		t.Fatalf("update: version %d, %v", v, err)
+	}
+	c.serverErr()
+
+	// Another login with the same credential reads the blob.
+	c, _ = loginChannel(t, "vault", "password")
+	got, v, err := c.VaultGet("diary")
+	if err != nil || v != 2 || string(got) != "my new diary" {
+		t.Errorf("get: %q, version %d, %v", got, v, err)
+	}
+	entries, err := c.VaultList()
+	if err != nil || len(entries) != 1 || entries[0].Name != "diary" || entries[0].Version != 2 {
+		t.Errorf("list: %+v, %v", entries, err)
+	}
+
+	// A ciphertext that the server stores again as another version does not
+	// decrypt.
+	b, _ := accounts.GetBlob("vault", "diary")
+	if err := accounts.PutBlob("vault", &blob{blobInfo: blobInfo{Name: "diary", Version: 2}, Data: b.Data}, vaultQuota); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.VaultGet("diary"); err != opaque.AuthtagMismatch {
+		t.Errorf("get of a replayed blob: got %v, want %v", err, opaque.AuthtagMismatch)
+	}
+
+	if err := c.VaultDelete("diary", 2); err != client.VersionMismatch {
+		t.Errorf("delete of old version: got %v, want %v", err, client.VersionMismatch)
+	}
+	if err := c.VaultDelete("diary", 3); err != nil {
+		t.Errorf("delete: %v", err)
+	}
+	if _, _, err := c.VaultGet("diary"); err == nil {
+		t.Error("deleted blob still there")
+	}
+	if _, err := c.VaultPut("", nil, 0); err == nil {
+		t.Error("blob without a name stored")
+	}
+	c.serverErr()
+}
+
+func TestVaultCredentials(t *testing.T) {
+	register(t, "vault-creds", "password")
+	c, _ := loginChannel(t, "vault-creds", "password")
+	if _, err := c.VaultPut("diary", []byte("my diary"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddCredential("phone", client.KindDevice, "device secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddCredential("recovery", client.KindRecovery, "recovery code"); err != nil {
+		t.Fatal(err)
+	}
+	c.serverErr()
+
+	// Every credential reads the vault, also after a password change and
+	// after the recovery credential is used up by its login.
+	changePassword(t, "vault-creds", "password", "new password")
+	read := func(credentialID, password string) {
+		t.Helper()
+		c := dial(t)
+		if _, err := c.LoginCredential("vault-creds", credentialID, password); err != nil {
+			t.Fatalf("login %s: %v", credentialID, err)
+		}
+		if got, _, err := c.VaultGet("diary"); err != nil || string(got) != "my diary" {
+			t.Errorf("get with %s: %q, %v", credentialID, got, err)
+		}
+		c.conn.Close()
+		c.serverErr()
+	}
+	read("", "new password")
+	read("phone", "device secret")
+	read("recovery", "recovery code")
+
+	// The wrapped vault key goes away with the credential, and one that
+	// is added again gets a new one.
+	c, _ = loginChannel(t, "vault-creds", "new password")
+	if err := c.RemoveCredential("phone"); err != nil {
+		t.Fatal(err)
+	}
+	if err := accounts.PutVaultKey("vault-creds", "phone", []byte("x"), false); err != errNoSuchCredential {
+		t.Errorf("vault key of a removed credential: got %v, want %v", err, errNoSuchCredential)
+	}
+	if err := c.AddCredential("phone", client.KindDevice, "device secret"); err != nil {
+		t.Fatal(err)
+	}
+	c.serverErr()
+	read("phone", "device secret")
+
+	// A credential that the key was not shared with cannot read the vault
+	// or make another key.
+	if err := accounts.PutVaultKey("vault-creds", "phone", nil, false); err != nil {
+		t.Fatal(err)
+	}
+	c = dial(t)
+	if _, err := c.LoginCredential("vault-creds", "phone", "device secret"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.VaultGet("diary"); err != client.NoVaultKey {
+		t.Errorf("credential without the key: got %v, want %v", err, client.NoVaultKey)
+	}
+	c.conn.Close()
+	c.serverErr()
+	if err := accounts.PutVaultKey("vault-creds", "phone", []byte("x"), true); err != errVaultKeyExists {
+		t.Errorf("second vault key: got %v, want %v", err, errVaultKeyExists)
+	}
+}
+
+func TestVaultQuota(t *testing.T) {
+	defer func(q blobQuota) { vaultQuota = q }(vaultQuota)
+	vaultQuota = blobQuota{Blobs: 10, Bytes: 100}
+	register(t, "vault-quota", "password")
+	c, _ := loginChannel(t, "vault-quota", "password")
+	if _, err := c.VaultPut("small", make([]byte, 10), 0); err != nil {
+		t.Fatal(err)
+	}
+	var se *client.ServerError
+	if _, err := c.VaultPut("big", make([]byte, 100), 0); err == nil {
+		t.Error("blob over the quota stored")
+	} else if !errors.As(err, &se) || se.Msg != errVaultQuota.Error() {
+		t.Errorf("got %v, want %v", err, errVaultQuota)
+	}
+	c.serverErr()
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/net/websocket"
+	"net"
+	"net/http"
+)
+
+// newWSHandler returns the WebSocket transport. Each WebSocket message
+// carries one frame of the TCP protocol, without the trailing newline, so a
+// browser client sends "auth", then the AuthMsg1 and so on, exactly as a TCP
+// client would. The connection is handled by doHandleConn.
+//
+// Any origin is accepted. The protocol does not rely on cookies or other
+// credentials the browser attaches on its own, so a page from another origin
+// gains nothing by connecting.
+func newWSHandler() http.Handler {
+	return websocket.Server{
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+			fmt.Printf("Got WebSocket connection from %s\n", ws.Request().RemoteAddr)
+			if err := doHandleConn(&wsFrameConn{Conn: ws, addr: wsAddr(ws.Request().RemoteAddr)}); err != nil {
+				fmt.Printf("Error happened in WebSocket handler: %s\n", err)
+			}
+		},
+	}
+}
+
+// errNewlineInMessage is returned when a WebSocket message contains a
+// newline, which would split it into several frames.
+var errNewlineInMessage = errors.New("newline in WebSocket message")
+
+// wsFrameConn turns a WebSocket connection into the newline-delimited stream
+// read by opaque.Read and written by opaque.Write.
+type wsFrameConn struct {
+	*websocket.Conn
+	addr wsAddr
+	rbuf []byte
+	wbuf []byte
+}
+
+// wsAddr is the address of the HTTP client that opened a WebSocket.
+type wsAddr string
+
+func (a wsAddr) Network() string { return "websocket" }
+func (a wsAddr) String() string  { return string(a) }
+
+// RemoteAddr returns the address of the client. The embedded
+// websocket.Conn returns the Origin header instead.
+func (c *wsFrameConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// Read returns the next message followed by a newline.
+func (c *wsFrameConn) Read(p []byte) (int, error) {
+	if len(c.rbuf) == 0 {
+		var msg []byte
+		if err := websocket.Message.Receive(c.Conn, &msg); err != nil {
+			return 0, err
+		}
+		if bytes.IndexByte(msg, '\n') >= 0 {
+			return 0, errNewlineInMessage
+		}
+		c.rbuf = append(msg, '\n')
+	}
+	n := copy(p, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+// Write sends each complete line in p as a text message. An incomplete line
+// is kept until the rest of it is written.
+func (c *wsFrameConn) Write(p []byte) (int, error) {
+	c.wbuf = append(c.wbuf, p...)
+	for {
+		i := bytes.IndexByte(c.wbuf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		if err := websocket.Message.Send(c.Conn, string(c.wbuf[:i])); err != nil {
+			return 0, err
+		}
+		c.wbuf = c.wbuf[i+1:]
+	}
+}
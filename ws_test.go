@@ -0,0 +1,66 @@
+// Copyright (c) 2018 Fredrik Kuivinen, frekui@gmail.com
+//
+// Use of this source code is governed by the BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"GoTcpServerWithOpaque/client"
+	"golang.org/x/net/websocket"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func dialWS(t *testing.T, srv *httptest.Server) *websocket.Conn {
+	t.Helper()
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), "", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+func TestWebSocketRegisterAndLogin(t *testing.T) {
+	srv := httptest.NewServer(newWSHandler())
+	defer srv.Close()
+
+	c := client.NewConn(&wsFrameConn{Conn: dialWS(t, srv)})
+	if err := c.Register("ws-user", "secret"); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	c = client.NewConn(&wsFrameConn{Conn: dialWS(t, srv)})
+	if _, err := c.Login("ws-user", "secret"); err != nil {
+		t.Fatalf("login: %v", err)
+	}
+}
+
+func TestWebSocketOneFramePerMessage(t *testing.T) {
+	srv := httptest.NewServer(newWSHandler())
+	defer srv.Close()
+
+	// A message with an embedded newline is not split into two frames; the
+	// server drops the connection instead.
+	ws := dialWS(t, srv)
+	if err := websocket.Message.Send(ws, "auth\n{}"); err != nil {
+		t.Fatal(err)
+	}
+	var reply string
+	if err := websocket.Message.Receive(ws, &reply); err == nil {
+		t.Errorf("server replied %q", reply)
+	}
+
+	// Frames arrive as separate text messages.
+	ws = dialWS(t, srv)
+	if err := websocket.Message.Send(ws, "auth"); err != nil {
+		t.Fatal(err)
+	}
+	if err := websocket.Message.Send(ws, `{"Username":"ws-nobody","A":{"X":1,"Y":2}}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := websocket.Message.Receive(ws, &reply); err == nil {
+		t.Errorf("server replied %q to an invalid point", reply)
+	}
+}